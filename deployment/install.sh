@@ -44,6 +44,15 @@ ensure_wg() {
     WIREGUARD_QUICK_PATH="$(which wg-quick)"
 }
 
+ensure_ip() {
+    if ! command -v ip >/dev/null 2>&1; then
+        log "iproute2 not found"
+        log "Please install iproute2 for your distro"
+        abort "ip must be installed"
+    fi
+    IP_PATH="$(which ip)"
+}
+
 ensure_systemd() {
     if ! systemctl --version >/dev/null 2>&1; then
         abort "systemd is required but not available"
@@ -124,13 +133,30 @@ create_etc_directory() {
 
 configure_access_control() {
     log "Configure ACL for /etc/wireguard"
-    setfacl -R -m g:wg-portal:r /etc/wireguard
+    # Read access to list the connections, the configs of the host stay read-only
+    setfacl -R -m g:wg-portal:rX /etc/wireguard
+    # Write access only to the configs managed by the portal (config_dir: /etc/wireguard/wg-portal)
+    mkdir -p /etc/wireguard/wg-portal
+    chmod 750 /etc/wireguard/wg-portal
+    setfacl -R -m g:wg-portal:rwX /etc/wireguard/wg-portal
+    setfacl -R -d -m g:wg-portal:rwX /etc/wireguard/wg-portal
 
     log "Setting up wg-portal user/group sudo permissions"
     cat > "$TMP_DIR/wg-portal-sudoers" << EOF
 %wg-portal ALL=(ALL) NOPASSWD: ${WIREGUARD_QUICK_PATH} up *, ${WIREGUARD_QUICK_PATH} down *
-%wg-portal ALL=(ALL) NOPASSWD: ${WIREGUARD_PATH} show
+%wg-portal ALL=(ALL) NOPASSWD: ${WIREGUARD_PATH} show all dump, ${WIREGUARD_PATH} syncconf *
+%wg-portal ALL=(ALL) NOPASSWD: ${WIREGUARD_PATH} set * peer * remove, ${WIREGUARD_PATH} set * peer * persistent-keepalive *
+%wg-portal ALL=(ALL) NOPASSWD: ${IP_PATH} link set dev * mtu *
 EOF
+    # Listing the firewall rules (GET /api/diagnostics/firewall) of the installed firewalls
+    for command in iptables-save ip6tables-save; do
+        if command -v "$command" >/dev/null 2>&1; then
+            echo "%wg-portal ALL=(ALL) NOPASSWD: $(command -v "$command")" >> "$TMP_DIR/wg-portal-sudoers"
+        fi
+    done
+    if command -v nft >/dev/null 2>&1; then
+        echo "%wg-portal ALL=(ALL) NOPASSWD: $(command -v nft) list ruleset" >> "$TMP_DIR/wg-portal-sudoers"
+    fi
     # Validate before installing
     if visudo -c -f "$TMP_DIR/wg-portal-sudoers"; then
         mv "$TMP_DIR/wg-portal-sudoers" /etc/sudoers.d/wg-portal
@@ -185,6 +211,7 @@ ensure_visudo
 ensure_curl
 ensure_acl
 ensure_wg
+ensure_ip
 ensure_systemd
 ensure_sudo
 get_arch
@@ -12,10 +12,14 @@ export default [
         fetch: "readonly",
         setInterval: "readonly",
         clearInterval: "readonly",
+        WebSocket: "readonly",
         App: "readonly",
         Utils: "readonly",
         ConnectionManager: "readonly",
-        StatusManager: "readonly"
+        StatusManager: "readonly",
+        FeedManager: "readonly",
+        SessionManager: "readonly",
+        Settings: "readonly"
       }
     },
     rules: {
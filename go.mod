@@ -1,10 +1,23 @@
 module wg-portal
 
-go 1.25
+go 1.25.0
 
 require (
+	github.com/go-ldap/ldap/v3 v3.4.14
+	github.com/gorilla/websocket v1.5.3
+	github.com/redis/go-redis/v9 v9.22.0
 	github.com/samber/lo v1.51.0
+	golang.org/x/crypto v0.54.0
+	golang.org/x/sync v0.22.0
+	golang.org/x/sys v0.47.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require golang.org/x/text v0.22.0 // indirect
+require (
+	github.com/Azure/go-ntlmssp v0.1.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.8 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	go.uber.org/atomic v1.11.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+)
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// transferSample is the total bytes received and sent by an interface
+type transferSample struct {
+	received uint64
+	sent     uint64
+}
+
+// activityTracker derives the last time traffic flowed on each interface
+// from the transfer counters increasing between samples
+type activityTracker struct {
+	previous     map[string]transferSample
+	lastActivity map[string]time.Time
+	mutex        sync.Mutex
+}
+
+func newActivityTracker() *activityTracker {
+	return &activityTracker{
+		previous:     make(map[string]transferSample),
+		lastActivity: make(map[string]time.Time),
+	}
+}
+
+// record compares the samples to the previous ones, interfaces seen for the first time
+// have no activity until their counters advance
+func (t *activityTracker) record(samples map[string]transferSample, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for name, sample := range samples {
+		previous, seen := t.previous[name]
+		if seen && (sample.received > previous.received || sample.sent > previous.sent) {
+			t.lastActivity[name] = now
+		}
+	}
+	t.previous = samples
+}
+
+func (t *activityTracker) get(name string) *time.Time {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if lastActivity, ok := t.lastActivity[name]; ok {
+		return &lastActivity
+	}
+	return nil
+}
+
+// rename moves the samples and the last activity of the interface to its new name
+func (t *activityTracker) rename(name, newName string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if lastActivity, ok := t.lastActivity[name]; ok {
+		t.lastActivity[newName] = lastActivity
+		delete(t.lastActivity, name)
+	}
+	delete(t.previous, name)
+}
+
+// StartActivitySampler samples the transfer counters every interval
+func (m *WireGuardManager) StartActivitySampler(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			m.sampleActivity()
+		}
+	}()
+}
+
+func (m *WireGuardManager) sampleActivity() {
+	devices, err := m.readDevices()
+	if err != nil {
+		log.Printf("Failed to sample transfer: %v", err)
+		return
+	}
+	samples := make(map[string]transferSample, len(devices))
+	for _, device := range devices {
+		samples[device.Name] = device.transfer()
+	}
+	m.activity.record(samples, time.Now())
+}
+
+// GetLastActivity returns when traffic last flowed on each active connection,
+// nil when no traffic was observed since sampling started
+func (m *WireGuardManager) GetLastActivity() (map[string]*time.Time, error) {
+	connections, err := m.GetConnections()
+	if err != nil {
+		return nil, err
+	}
+	activity := make(map[string]*time.Time)
+	for _, connection := range connections {
+		if connection.Active {
+			activity[connection.Name] = m.activity.get(connection.Name)
+		}
+	}
+	return activity, nil
+}
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// alertTimeout bounds the delivery of an alert to a notifier
+	alertTimeout = 10 * time.Second
+	// maxAlertFailures bounds the failed logins kept for the alerts during an attack
+	maxAlertFailures = 10000
+)
+
+// LoginAlertConfig raises an alert when the failed logins within the window reach the threshold
+type LoginAlertConfig struct {
+	// Threshold is the number of failed logins raising an alert (0 disables the alerts)
+	Threshold     int `yaml:"threshold"`
+	WindowSeconds int `yaml:"window_seconds"`
+	// WebhookURL receives the alerts as JSON POST requests, next to the log
+	WebhookURL string `yaml:"webhook_url"`
+}
+
+func (c LoginAlertConfig) validate() error {
+	if c.Threshold < 0 {
+		return errors.New("threshold must not be negative")
+	}
+	if c.Threshold > 0 && c.WindowSeconds <= 0 {
+		return errors.New("window_seconds must be positive")
+	}
+	if c.WebhookURL != "" {
+		parsed, err := url.Parse(c.WebhookURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("invalid webhook_url %q", c.WebhookURL)
+		}
+	}
+	return nil
+}
+
+// LoginAlert reports the failed logins of a window
+type LoginAlert struct {
+	Time     time.Time `json:"time"`
+	Failures int       `json:"failures"`
+	Window   string    `json:"window"`
+	// Addresses and Usernames are the distinct client addresses and usernames of the failures
+	Addresses []string `json:"addresses"`
+	Usernames []string `json:"usernames"`
+}
+
+// AlertNotifier delivers the login alerts
+type AlertNotifier interface {
+	Notify(alert *LoginAlert) error
+}
+
+// loginFailure is a failed login of the alert window
+type loginFailure struct {
+	time     time.Time
+	addr     string
+	username string
+}
+
+// LoginAlerter counts the failed logins of all clients and accounts, raising an alert
+// when they reach the threshold within the window. After an alert, the next one is raised
+// once the window is over, so a running attack raises an alert per window.
+type LoginAlerter struct {
+	config    LoginAlertConfig
+	notifiers []AlertNotifier
+	failures  []loginFailure
+	lastAlert time.Time
+	mutex     sync.Mutex
+}
+
+// NewLoginAlerter creates the alerter of the configuration, logging the alerts and
+// posting them to the webhook when set, and to the other notifiers
+func NewLoginAlerter(config LoginAlertConfig, notifiers ...AlertNotifier) *LoginAlerter {
+	notifiers = append([]AlertNotifier{logNotifier{}}, notifiers...)
+	if config.WebhookURL != "" {
+		webhook := &webhookNotifier{url: config.WebhookURL, client: &http.Client{Timeout: alertTimeout}}
+		notifiers = append(notifiers, webhook)
+	}
+	return &LoginAlerter{config: config, notifiers: notifiers}
+}
+
+// Fail records a failed login of the client address and the username
+func (a *LoginAlerter) Fail(addr, username string) {
+	if a.config.Threshold == 0 {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	window := time.Duration(a.config.WindowSeconds) * time.Second
+	a.failures = slices.DeleteFunc(a.failures, func(failure loginFailure) bool {
+		return now.Sub(failure.time) > window
+	})
+	a.failures = append(a.failures, loginFailure{time: now, addr: addr, username: username})
+	if len(a.failures) > maxAlertFailures {
+		a.failures = a.failures[len(a.failures)-maxAlertFailures:]
+	}
+	if len(a.failures) < a.config.Threshold || now.Sub(a.lastAlert) < window {
+		return
+	}
+
+	a.lastAlert = now
+	alert := a.alert(now, window)
+	go a.notify(alert)
+}
+
+// alert returns the alert of the failures of the window, it must be called holding the mutex
+func (a *LoginAlerter) alert(now time.Time, window time.Duration) *LoginAlert {
+	alert := &LoginAlert{Time: now, Failures: len(a.failures), Window: window.String()}
+	for _, failure := range a.failures {
+		if !slices.Contains(alert.Addresses, failure.addr) {
+			alert.Addresses = append(alert.Addresses, failure.addr)
+		}
+		if !slices.Contains(alert.Usernames, failure.username) {
+			alert.Usernames = append(alert.Usernames, failure.username)
+		}
+	}
+	return alert
+}
+
+func (a *LoginAlerter) notify(alert *LoginAlert) {
+	for _, notifier := range a.notifiers {
+		if err := notifier.Notify(alert); err != nil {
+			log.Printf("Failed to send the failed logins alert: %v", err)
+		}
+	}
+}
+
+// logNotifier writes the alerts to the log
+type logNotifier struct{}
+
+func (logNotifier) Notify(alert *LoginAlert) error {
+	log.Printf("ALERT: %d failed logins within %s from %v for users %v",
+		alert.Failures, alert.Window, alert.Addresses, alert.Usernames)
+	return nil
+}
+
+// webhookNotifier posts the alerts as JSON to a URL
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *webhookNotifier) Notify(alert *LoginAlert) error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := n.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to post alert: %w", err)
+	}
+	response.Body.Close()
+	if response.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("failed to post alert: webhook returned %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+)
+
+// ErrInvalidAllowedIPs is returned for unknown presets, invalid CIDRs and empty allowed IPs
+var ErrInvalidAllowedIPs = errors.New("invalid allowed IPs")
+
+// AllowedIPsPreset is a named set of allowed IPs, from a full tunnel to split tunnels
+type AllowedIPsPreset struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	AllowedIPs  []string `json:"allowed_ips"`
+}
+
+// privateNetworks are the private IPv4 networks and the IPv6 unique local addresses
+var privateNetworks = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+
+// allowedIPsPresets are the presets of the allowed IPs editor
+var allowedIPsPresets = []*AllowedIPsPreset{
+	{Name: "full", Description: "Full tunnel, all the traffic", AllowedIPs: []string{"0.0.0.0/0", "::/0"}},
+	{Name: "ipv4", Description: "Full tunnel for IPv4 only", AllowedIPs: []string{"0.0.0.0/0"}},
+	{Name: "lan", Description: "LAN only, the private networks", AllowedIPs: privateNetworks},
+	{
+		Name:        "exclude_lan",
+		Description: "All the traffic except the private networks",
+		AllowedIPs:  mustExcludePrefixes([]string{"0.0.0.0/0", "::/0"}, privateNetworks),
+	},
+}
+
+// AllowedIPsPresets returns the presets of the allowed IPs editor
+func AllowedIPsPresets() []*AllowedIPsPreset {
+	return allowedIPsPresets
+}
+
+// AllowedIPsSpec sets the allowed IPs of the peers of a connection: the allowed IPs of the
+// preset and the custom ones, without the excluded networks
+type AllowedIPsSpec struct {
+	Preset     string   `json:"preset"`
+	AllowedIPs []string `json:"allowed_ips"`
+	Exclude    []string `json:"exclude"`
+	// Peer is the public key of the changed peer, every peer is changed without one
+	Peer string `json:"peer"`
+}
+
+// resolve returns the allowed IPs of the spec, masked and without duplicates
+func (s AllowedIPsSpec) resolve() ([]string, error) {
+	allowedIPs := slices.Clone(s.AllowedIPs)
+	if s.Preset != "" {
+		index := slices.IndexFunc(allowedIPsPresets, func(p *AllowedIPsPreset) bool { return p.Name == s.Preset })
+		if index < 0 {
+			return nil, fmt.Errorf("%w: unknown preset %q", ErrInvalidAllowedIPs, s.Preset)
+		}
+		allowedIPs = append(slices.Clone(allowedIPsPresets[index].AllowedIPs), allowedIPs...)
+	}
+	resolved, err := excludePrefixes(allowedIPs, s.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	if len(resolved) == 0 {
+		return nil, fmt.Errorf("%w: no allowed IPs left, a preset or allowed_ips outside of the exclusions is required",
+			ErrInvalidAllowedIPs)
+	}
+	return resolved, nil
+}
+
+// SetAllowedIPs rewrites the allowed IPs of the peers of the connection config,
+// an active connection is restarted to install the routes of the new allowed IPs
+func (m *WireGuardManager) SetAllowedIPs(name string, spec AllowedIPsSpec) ([]string, *ApplyResult, error) {
+	allowedIPs, err := spec.resolve()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := m.writeAllowedIPs(name, spec.Peer, allowedIPs); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Changed the allowed IPs of %s", name)
+	result, err := m.restartActiveConnection(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return allowedIPs, result, nil
+}
+
+// writeAllowedIPs sets the allowed IPs of the peer with the public key, or of every peer
+func (m *WireGuardManager) writeAllowedIPs(name, publicKey string, allowedIPs []string) error {
+	m.peersMutex.Lock()
+	defer m.peersMutex.Unlock()
+	config, err := m.connectionConfig(name)
+	if err != nil {
+		return err
+	}
+	peers := config.Peers
+	if publicKey != "" {
+		index, err := findPeer(config, publicKey)
+		if err != nil {
+			return err
+		}
+		peers = peers[index : index+1]
+	}
+	for _, peer := range peers {
+		peer.AllowedIPs = slices.Clone(allowedIPs)
+	}
+	return m.writeConfig(name, config)
+}
+
+// excludePrefixes returns the prefixes without the excluded networks, splitting the prefixes
+// containing an excluded network into the smallest set of prefixes around it
+func excludePrefixes(allowedIPs, excluded []string) ([]string, error) {
+	prefixes, err := parsePrefixes(allowedIPs)
+	if err != nil {
+		return nil, err
+	}
+	exclusions, err := parsePrefixes(excluded)
+	if err != nil {
+		return nil, err
+	}
+	for _, exclusion := range exclusions {
+		var remaining []netip.Prefix
+		for _, prefix := range prefixes {
+			remaining = append(remaining, subtractPrefix(prefix, exclusion)...)
+		}
+		prefixes = remaining
+	}
+	result := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if !slices.Contains(result, prefix.String()) {
+			result = append(result, prefix.String())
+		}
+	}
+	return result, nil
+}
+
+// mustExcludePrefixes is excludePrefixes for the valid networks of the presets
+func mustExcludePrefixes(allowedIPs, excluded []string) []string {
+	result, err := excludePrefixes(allowedIPs, excluded)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// parsePrefixes parses the CIDRs, masking their host bits
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid CIDR %q", ErrInvalidAllowedIPs, cidr)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// subtractPrefix returns the prefix without the excluded network
+func subtractPrefix(prefix, excluded netip.Prefix) []netip.Prefix {
+	switch {
+	case !prefix.Overlaps(excluded):
+		return []netip.Prefix{prefix}
+	case excluded.Bits() <= prefix.Bits():
+		return nil
+	}
+	lower, upper := splitPrefix(prefix)
+	if lower.Contains(excluded.Addr()) {
+		return append(subtractPrefix(lower, excluded), upper)
+	}
+	return append([]netip.Prefix{lower}, subtractPrefix(upper, excluded)...)
+}
+
+// splitPrefix returns the two halves of the prefix
+func splitPrefix(prefix netip.Prefix) (netip.Prefix, netip.Prefix) {
+	bits := prefix.Bits()
+	address := prefix.Addr().AsSlice()
+	address[bits/8] |= 0x80 >> (bits % 8)
+	upper, _ := netip.AddrFromSlice(address)
+	return netip.PrefixFrom(prefix.Addr(), bits+1), netip.PrefixFrom(upper, bits+1)
+}
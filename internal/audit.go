@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Audited actions
+const (
+	AuditLogin       = "login"
+	AuditLogout      = "logout"
+	AuditAuth        = "auth"
+	AuditToggle      = "toggle"
+	AuditStart       = "start"
+	AuditStop        = "stop"
+	AuditDelete      = "delete"
+	AuditRename      = "rename"
+	AuditFailover    = "failover"
+	AuditReconnect   = "reconnect"
+	AuditSchedule    = "schedule"
+	AuditExpire      = "expire"
+	AuditRotate      = "rotate"
+	AuditBackup      = "backup"
+	AuditRestore     = "restore"
+	AuditKillSwitch  = "kill_switch"
+	AuditMaintenance = "maintenance"
+)
+
+// Audit results
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// Limits of the entries returned by an audit log query
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// AuditEntry records who did an action, when, from which address and its result
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Username string    `json:"username"`
+	IP       string    `json:"ip"`
+	// Target is the object of the action, like the toggled connection or the login method
+	Target string `json:"target,omitempty"`
+	Result string `json:"result"`
+	// Reason explains the failures
+	Reason string `json:"reason,omitempty"`
+}
+
+// AuditQuery filters the audit log entries, the empty fields match all entries
+type AuditQuery struct {
+	Username string
+	Action   string
+	Since    time.Time
+	// Limit is the number of returned entries, defaults to 100 and at most 1000
+	Limit int
+}
+
+// matches reports whether the entry matches the query
+func (q AuditQuery) matches(entry *AuditEntry) bool {
+	return (q.Username == "" || entry.Username == q.Username) &&
+		(q.Action == "" || entry.Action == q.Action) &&
+		!entry.Time.Before(q.Since)
+}
+
+// AuditLog appends the audited actions to a file of the state directory, one JSON entry per line.
+// The entries are never rewritten, the file is only appended to.
+type AuditLog struct {
+	path  string
+	file  *os.File
+	mutex sync.Mutex
+}
+
+// NewAuditLog opens the audit log of the profile, the actions aren't recorded unless enabled
+func NewAuditLog(profile string, config *Config) (*AuditLog, error) {
+	if !config.AuditLog {
+		return &AuditLog{}, nil
+	}
+	path := filepath.Join(config.StateDir, profileStateFile("audit", ".log", profile))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &AuditLog{path: path, file: file}, nil
+}
+
+// Record appends the entry, its failure only logs since the action is done anyway
+func (l *AuditLog) Record(entry AuditEntry) {
+	if l.file == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to record audit entry: %v", err)
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		log.Printf("Failed to record audit entry: %v", err)
+	}
+}
+
+// Query returns the entries matching the query, newest first
+func (l *AuditLog) Query(query AuditQuery) ([]*AuditEntry, error) {
+	entries := []*AuditEntry{}
+	if l.file == nil {
+		return entries, nil
+	}
+	file, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		// Skip the lines cut short by a crash, the other entries stay readable
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil && query.matches(&entry) {
+			entries = append(entries, &entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	slices.Reverse(entries)
+	return entries[:min(len(entries), query.limit())], nil
+}
+
+func (q AuditQuery) limit() int {
+	if q.Limit <= 0 {
+		return defaultAuditLimit
+	}
+	return min(q.Limit, maxAuditLimit)
+}
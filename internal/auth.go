@@ -2,68 +2,296 @@ package internal
 
 import (
 	"crypto/rand"
-	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// slideInterval is the minimum extension of a sliding session, so the sessions
+// aren't saved again on every request
+const slideInterval = 1 * time.Minute
+
+// challengeTTL is the time to enter the second factor after the password
+const challengeTTL = 5 * time.Minute
+
+var (
+	// ErrInvalidSession is returned for unknown or expired sessions
+	ErrInvalidSession = errors.New("invalid session")
+	// ErrRefreshTooSoon is returned when a session is refreshed again within the refresh interval
+	ErrRefreshTooSoon = errors.New("session was refreshed too recently")
 )
 
 type Session struct {
-	Expires time.Time
+	// Username is the account the session was created for
+	Username  string    `json:"username"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	Refreshed time.Time `json:"refreshed"`
+	// IP and UserAgent are the client of the login, listed to the user
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// ActiveSession is a session listed to its user, identified by its store key
+// since the session IDs are the session cookies
+type ActiveSession struct {
+	ID string `json:"id"`
+	Session
+	// Current is the session of the listing request
+	Current bool `json:"current"`
+}
+
+// maxUserAgentLength truncates the stored user agents
+const maxUserAgentLength = 256
+
+// ErrSessionNotFound is returned when revoking an unknown session
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionLifetime configures how long the sessions last
+type SessionLifetime struct {
+	// TTL is the lifetime of a session, refreshing extends it by the same duration
+	TTL time.Duration
+	// Sliding extends the sessions by the TTL on every request
+	Sliding bool
+	// MaxLifetime caps the sessions from their creation whatever the extensions, 0 doesn't cap them
+	MaxLifetime time.Duration
+}
+
+// expiry returns the expiry of the session extended at now, capped by the max lifetime
+func (l SessionLifetime) expiry(session *Session, now time.Time) time.Time {
+	expires := now.Add(l.TTL)
+	if l.MaxLifetime == 0 || session.Created.IsZero() {
+		// Sessions stored before the max lifetime have no creation time
+		return expires
+	}
+	if limit := session.Created.Add(l.MaxLifetime); limit.Before(expires) {
+		return limit
+	}
+	return expires
+}
+
+// SessionBindingConfig binds the sessions to the client of their login, a session used
+// from another client is logged out, so a stolen session cookie is useless elsewhere
+type SessionBindingConfig struct {
+	// IP binds the sessions to the client address, which mobile clients change often
+	IP bool `yaml:"ip"`
+	// UserAgent binds the sessions to the client user agent
+	UserAgent bool `yaml:"user_agent"`
+}
+
+// matches reports whether the session is used from the client of its login
+func (c SessionBindingConfig) matches(session *Session, ip, userAgent string) bool {
+	return (!c.IP || session.IP == ip) &&
+		(!c.UserAgent || session.UserAgent == userAgent[:min(len(userAgent), maxUserAgentLength)])
 }
 
+// SessionManager keeps the sessions and the login challenges in the session store,
+// so they are shared by the portal instances of a shared store
 type SessionManager struct {
-	sessions map[string]*Session
-	mutex    sync.RWMutex
+	store    SessionStore
+	lifetime SessionLifetime
+	// maxSessions limits the simultaneous sessions of a user (0 is unlimited)
+	maxSessions int
+	binding     SessionBindingConfig
+	// mutex guards the session refreshes and the challenge uses
+	mutex sync.Mutex
+	// deleted is called after sessions are deleted before their expiry, set by onDelete
+	deleted func()
 }
 
-func NewSessionManager() *SessionManager {
+func NewSessionManager(
+	store SessionStore, lifetime SessionLifetime, maxSessions int, binding SessionBindingConfig,
+) *SessionManager {
 	sm := &SessionManager{
-		sessions: make(map[string]*Session),
+		store:       store,
+		lifetime:    lifetime,
+		maxSessions: maxSessions,
+		binding:     binding,
 	}
 	// Start cleanup goroutine
 	go sm.cleanupExpiredSessions()
 	return sm
 }
 
-// Using the same logic that powers the pi-hole authentication
-// GeneratePasswordHash creates a double SHA256 hash from the password param to
-// validate against config.PasswordHash
-func GeneratePasswordHash(password string) string {
-	first := sha256.Sum256([]byte(password))
-	firstHex := hex.EncodeToString(first[:])
-	second := sha256.Sum256([]byte(firstHex))
-	return hex.EncodeToString(second[:])
+// ldapTimeout bounds the connection to and each request against the LDAP server
+const ldapTimeout = 10 * time.Second
+
+// LDAPConfig authenticates users by binding against an LDAP (or Active Directory) server
+// with the submitted credentials. {username} is replaced in the bind DN and search filter.
+type LDAPConfig struct {
+	URL string `yaml:"url"`
+	// BindDN is the DN (or the userPrincipalName for Active Directory) the user binds as
+	BindDN string `yaml:"bind_dn"`
+	// SearchBase and SearchFilter optionally restrict the users, e.g. to group members,
+	// the bound user must find at least one entry
+	SearchBase   string `yaml:"search_base"`
+	SearchFilter string `yaml:"search_filter"`
+	StartTLS     bool   `yaml:"start_tls"`
+	// Role of the users logging in for the first time, defaults to viewer
+	Role Role `yaml:"role"`
 }
 
-func ValidatePassword(password, hash string) bool {
-	return GeneratePasswordHash(password) == hash
+var (
+	// ErrInvalidCredentials is returned when the LDAP server rejects the credentials
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrLDAPDenied is returned for LDAP users not matching the search filter
+	ErrLDAPDenied = errors.New("user doesn't match the LDAP search filter")
+)
+
+// Configured reports whether the LDAP authentication is enabled
+func (c LDAPConfig) Configured() bool {
+	return c.URL != "" && c.BindDN != ""
 }
 
-func (sm *SessionManager) CreateSession() (string, time.Time, error) {
-	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
+func (c LDAPConfig) validate() error {
+	if !c.Configured() {
+		return nil
+	}
+	if !strings.HasPrefix(c.URL, "ldap://") && !strings.HasPrefix(c.URL, "ldaps://") {
+		return fmt.Errorf("url must start with ldap:// or ldaps://, got %q", c.URL)
+	}
+	if c.StartTLS && strings.HasPrefix(c.URL, "ldaps://") {
+		return errors.New("start_tls can't be used with ldaps://")
+	}
+	_, err := ParseRole(string(c.Role))
+	return err
+}
+
+// AuthenticateLDAP binds with the credentials and checks the search filter when set
+func AuthenticateLDAP(config LDAPConfig, username, password string) error {
+	// An empty password is an unauthenticated bind, which servers accept for any DN
+	if !usernameRegex.MatchString(username) || password == "" {
+		return ErrInvalidCredentials
+	}
+	conn, err := dialLDAP(config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = conn.Bind(strings.ReplaceAll(config.BindDN, "{username}", ldap.EscapeDN(username)), password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return ErrInvalidCredentials
+	}
+	if err != nil {
+		return fmt.Errorf("failed to bind: %w", err)
+	}
+	if config.SearchFilter == "" {
+		return nil
+	}
+
+	filter := strings.ReplaceAll(config.SearchFilter, "{username}", ldap.EscapeFilter(username))
+	request := ldap.NewSearchRequest(config.SearchBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		1, int(ldapTimeout.Seconds()), false, filter, []string{"dn"}, nil)
+	result, err := conn.Search(request)
+	if err != nil {
+		return fmt.Errorf("failed to search LDAP: %w", err)
+	}
+	if len(result.Entries) == 0 {
+		return ErrLDAPDenied
+	}
+	return nil
+}
+
+func dialLDAP(config LDAPConfig) (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(config.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %w", err)
+	}
+	conn.SetTimeout(ldapTimeout)
+	if !config.StartTLS {
+		return conn, nil
+	}
 
+	serverURL, err := url.Parse(config.URL)
+	if err == nil {
+		err = conn.StartTLS(&tls.Config{ServerName: serverURL.Hostname(), MinVersion: tls.VersionTLS12})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start TLS: %w", err)
+	}
+	return conn, nil
+}
+
+// CreateSession creates a session of the user logging in from the client IP and user agent
+func (sm *SessionManager) CreateSession(username, ip, userAgent string) (string, time.Time, error) {
 	sessionID, err := generateSecureToken()
 	if err != nil {
 		return "", time.Time{}, fmt.Errorf("failed to generate session ID: %w", err)
 	}
 
-	expires := time.Now().Add(1 * time.Hour)
-	sm.sessions[sessionID] = &Session{
-		Expires: expires,
+	now := time.Now()
+	session := &Session{
+		Username:  username,
+		Created:   now,
+		IP:        ip,
+		UserAgent: userAgent[:min(len(userAgent), maxUserAgentLength)],
 	}
+	expires := sm.lifetime.expiry(session, now)
+	session.Expires = expires
+	if err := sm.store.Save(sessionKey(sessionID), session); err != nil {
+		return "", time.Time{}, err
+	}
+	sm.evictSessions(username)
 
 	return sessionID, expires, nil
 }
 
-func (sm *SessionManager) ValidateSession(sessionID string) (*Session, bool) {
-	sm.mutex.RLock()
-	defer sm.mutex.RUnlock()
+// evictSessions deletes the oldest sessions of the user past the max sessions,
+// its failure only logs since the new session is valid anyway
+func (sm *SessionManager) evictSessions(username string) {
+	if sm.maxSessions == 0 {
+		return
+	}
+	sessions, err := sm.ListUserSessions(username, "")
+	if err != nil {
+		log.Printf("Failed to list the sessions of %s: %v", username, err)
+		return
+	}
+	evicted := sessions[:max(len(sessions)-sm.maxSessions, 0)]
+	for _, session := range evicted {
+		if err := sm.store.Delete(session.ID); err != nil {
+			log.Printf("Failed to evict a session of %s: %v", username, err)
+			continue
+		}
+		log.Printf("Evicted the oldest session of %s past %d sessions", username, sm.maxSessions)
+	}
+	if len(evicted) > 0 {
+		sm.notifyDeleted()
+	}
+}
+
+// onDelete registers the function called after sessions are deleted before their expiry,
+// like the feed closing the connections of the logged out sessions
+func (sm *SessionManager) onDelete(deleted func()) {
+	sm.deleted = deleted
+}
 
-	session, exists := sm.sessions[sessionID]
-	if !exists {
+// notifyDeleted calls the function registered with onDelete
+func (sm *SessionManager) notifyDeleted() {
+	if sm.deleted != nil {
+		sm.deleted()
+	}
+}
+
+func (sm *SessionManager) ValidateSession(sessionID string) (*Session, bool) {
+	session, err := sm.store.Get(sessionKey(sessionID))
+	if err != nil {
+		if !errors.Is(err, ErrInvalidSession) {
+			log.Printf("Failed to read session: %v", err)
+		}
 		return nil, false
 	}
 
@@ -74,10 +302,238 @@ func (sm *SessionManager) ValidateSession(sessionID string) (*Session, bool) {
 	return session, true
 }
 
+// UseSession validates the session of a user request from the client IP and user agent,
+// extending sliding sessions by the TTL
+func (sm *SessionManager) UseSession(sessionID, ip, userAgent string) (*Session, bool) {
+	session, valid := sm.ValidateSession(sessionID)
+	if valid {
+		valid = sm.checkBinding(sessionID, session, ip, userAgent)
+	}
+	if !valid || !sm.lifetime.Sliding {
+		return session, valid
+	}
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	expires := sm.lifetime.expiry(session, time.Now())
+	if expires.Sub(session.Expires) < slideInterval {
+		return session, true
+	}
+	session.Expires = expires
+	if err := sm.store.Save(sessionKey(sessionID), session); err != nil {
+		log.Printf("Failed to extend session: %v", err)
+	}
+	return session, true
+}
+
+// RefreshSession extends a valid session expiry by the session TTL, for the client IP and user agent.
+// A session can be refreshed at most once per minInterval.
+func (sm *SessionManager) RefreshSession(
+	sessionID, ip, userAgent string, minInterval time.Duration,
+) (time.Time, error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	key := sessionKey(sessionID)
+	session, err := sm.store.Get(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	now := time.Now()
+	if now.After(session.Expires) || !sm.checkBinding(sessionID, session, ip, userAgent) {
+		return time.Time{}, ErrInvalidSession
+	}
+	if now.Before(session.Refreshed.Add(minInterval)) {
+		return time.Time{}, ErrRefreshTooSoon
+	}
+
+	session.Expires = sm.lifetime.expiry(session, now)
+	session.Refreshed = now
+	if err := sm.store.Save(key, session); err != nil {
+		return time.Time{}, err
+	}
+	return session.Expires, nil
+}
+
+// checkBinding reports whether the session is used from the client of its login,
+// deleting the session otherwise
+func (sm *SessionManager) checkBinding(sessionID string, session *Session, ip, userAgent string) bool {
+	if sm.binding.matches(session, ip, userAgent) {
+		return true
+	}
+	log.Printf("Session of %s used from another client (%s), logging it out", session.Username, ip)
+	sm.DeleteSession(sessionID)
+	return false
+}
+
 func (sm *SessionManager) DeleteSession(sessionID string) {
+	if err := sm.store.Delete(sessionKey(sessionID)); err != nil {
+		log.Printf("Failed to delete session: %v", err)
+	}
+	sm.notifyDeleted()
+}
+
+// DeleteUserSessions deletes all sessions of the user, with the remember-me tokens
+func (sm *SessionManager) DeleteUserSessions(username string) {
+	if err := sm.store.DeleteUser(username); err != nil {
+		log.Printf("Failed to delete the sessions of %s: %v", username, err)
+	}
+	sm.notifyDeleted()
+}
+
+// ListUserSessions returns the valid sessions of the user, oldest first,
+// marking the current session of the listing request
+func (sm *SessionManager) ListUserSessions(username, currentSessionID string) ([]ActiveSession, error) {
+	sessions, err := sm.store.ListUser(username)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	current := sessionKey(currentSessionID)
+	active := []ActiveSession{}
+	for key, session := range sessions {
+		if isSessionKey(key) && now.Before(session.Expires) {
+			active = append(active, ActiveSession{ID: key, Session: *session, Current: key == current})
+		}
+	}
+	slices.SortFunc(active, func(a, b ActiveSession) int {
+		return a.Created.Compare(b.Created)
+	})
+	return active, nil
+}
+
+// RevokeSession deletes a session of the user by its listed ID
+func (sm *SessionManager) RevokeSession(username, id string) error {
+	if !isSessionKey(id) {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	session, err := sm.store.Get(id)
+	if errors.Is(err, ErrInvalidSession) || (err == nil && session.Username != username) {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	if err != nil {
+		return err
+	}
+	if err := sm.store.Delete(id); err != nil {
+		return err
+	}
+	sm.notifyDeleted()
+	return nil
+}
+
+// CreateChallenge starts the second factor step of the user login
+func (sm *SessionManager) CreateChallenge(username string) (string, error) {
+	challengeID, _, err := sm.issue(challengeKey, username, challengeTTL)
+	if err != nil {
+		return "", fmt.Errorf("failed to create challenge: %w", err)
+	}
+	return challengeID, nil
+}
+
+// ConsumeChallenge returns the username of a valid challenge, a challenge can only be used once
+// so a wrong code restarts the login with the password
+func (sm *SessionManager) ConsumeChallenge(challengeID string) (string, bool) {
+	return sm.consume(challengeKey(challengeID))
+}
+
+// CreateRememberToken issues a remember-me token of the user, logging the user in again
+// for the duration once the session expired
+func (sm *SessionManager) CreateRememberToken(username string, duration time.Duration) (string, time.Time, error) {
+	token, expires, err := sm.issue(rememberKey, username, duration)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to create remember-me token: %w", err)
+	}
+	return token, expires, nil
+}
+
+// ConsumeRememberToken returns the username of a valid remember-me token, a token can only
+// be used once so it's replaced by a new token on each use
+func (sm *SessionManager) ConsumeRememberToken(token string) (string, bool) {
+	return sm.consume(rememberKey(token))
+}
+
+// DeleteRememberToken deletes the remember-me token, on logout
+func (sm *SessionManager) DeleteRememberToken(token string) {
+	if err := sm.store.Delete(rememberKey(token)); err != nil {
+		log.Printf("Failed to delete remember-me token: %v", err)
+	}
+}
+
+// issue creates a single-use token of the user, kept in the store as a session
+// of the TTL under the key of the token
+func (sm *SessionManager) issue(
+	key func(string) string, username string, ttl time.Duration,
+) (string, time.Time, error) {
+	token, err := generateSecureToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now()
+	session := &Session{
+		Username: username,
+		Created:  now,
+		Expires:  now.Add(ttl),
+	}
+	if err := sm.store.Save(key(token), session); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, session.Expires, nil
+}
+
+// consume returns the username of the valid single-use token of the key, deleting it
+func (sm *SessionManager) consume(key string) (string, bool) {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
-	delete(sm.sessions, sessionID)
+
+	session, err := sm.store.Get(key)
+	if err != nil {
+		return "", false
+	}
+	if err := sm.store.Delete(key); err != nil {
+		log.Printf("Failed to delete single-use token: %v", err)
+		return "", false
+	}
+	if time.Now().After(session.Expires) {
+		return "", false
+	}
+	return session.Username, true
+}
+
+// sessionKey returns the session store key of the session ID
+func sessionKey(sessionID string) string {
+	return hashToken(sessionID)
+}
+
+// CSRFToken returns the CSRF token the state-changing requests of the session must send.
+// It is derived from the session ID, so it can't be forged without the session cookie.
+func (*SessionManager) CSRFToken(sessionID string) string {
+	if sessionID == "" {
+		return ""
+	}
+	return hashToken("csrf:" + sessionID)
+}
+
+// ValidCSRFToken reports whether the token is the CSRF token of the session
+func (sm *SessionManager) ValidCSRFToken(sessionID, token string) bool {
+	expected := sm.CSRFToken(sessionID)
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+// isSessionKey reports whether the store key is a session key, rather than a key
+// of a challenge or remember-me token
+func isSessionKey(key string) bool {
+	return !strings.Contains(key, ":")
+}
+
+// challengeKey returns the session store key of the login challenge ID
+func challengeKey(challengeID string) string {
+	return "challenge:" + hashToken(challengeID)
+}
+
+// rememberKey returns the session store key of the remember-me token
+func rememberKey(token string) string {
+	return "remember:" + hashToken(token)
 }
 
 func generateSecureToken() (string, error) {
@@ -89,19 +545,14 @@ func generateSecureToken() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-// cleanupExpiredSessions periodically removes expired sessions every 1 hour
+// cleanupExpiredSessions periodically removes expired sessions and challenges every 1 hour
 func (sm *SessionManager) cleanupExpiredSessions() {
 	ticker := time.NewTicker(1 * time.Hour)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		sm.mutex.Lock()
-		now := time.Now()
-		for sessionID, session := range sm.sessions {
-			if now.After(session.Expires) {
-				delete(sm.sessions, sessionID)
-			}
+		if err := sm.store.DeleteExpired(time.Now()); err != nil {
+			log.Printf("Failed to delete expired sessions: %v", err)
 		}
-		sm.mutex.Unlock()
 	}
 }
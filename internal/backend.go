@@ -0,0 +1,385 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Connection backends
+const (
+	BackendWGQuick = "wg-quick"
+	BackendNative  = "native"
+)
+
+// nativeRouteTable is the routing table and firewall mark of the default routes of the native
+// backend, the same as wg-quick uses by default
+const (
+	nativeRouteTable   = "51820"
+	nativeRouteTableID = 51820
+)
+
+// mainRouteTableID is the main routing table, of the routes of the allowed IPs
+const mainRouteTableID = 254
+
+// nativeDefaultMTU is the MTU of the interfaces without an MTU in their config
+const nativeDefaultMTU = 1420
+
+// ErrUnsupportedConfig is returned by the native backend for the configs requiring wg-quick
+var ErrUnsupportedConfig = errors.New("unsupported by the native backend")
+
+// ConnectionBackend brings the connections up and down
+type ConnectionBackend interface {
+	Up(name string) ([]byte, error)
+	Down(name string) ([]byte, error)
+}
+
+// NewConnectionBackend returns the backend of the config
+func NewConnectionBackend(config *Config, runner CommandRunner) ConnectionBackend {
+	if config.Backend == BackendNative {
+		return &nativeBackend{config: config, runner: runner, netlink: config.kernelNetlink()}
+	}
+	return &wgQuickBackend{config: config, runner: runner}
+}
+
+// wgQuickBackend runs wg-quick, which supports all the config options and hooks
+type wgQuickBackend struct {
+	config *Config
+	runner CommandRunner
+}
+
+// Up runs wg-quick in the network namespace of the connection, with the userspace implementation
+// wg-quick falls back to without the kernel module
+func (b *wgQuickBackend) Up(name string) ([]byte, error) {
+	target, cleanup, err := b.upTarget(name)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	args := namespacedCommand(b.config.namespaceOf(name), []string{"sudo", "wg-quick", "up", target})
+	if userspace := b.config.UserspaceImplementation; userspace != "" {
+		// sudo sets the variable for wg-quick, which needs the SETENV tag in the sudoers rule
+		args = slices.Insert(args, 1, "WG_QUICK_USERSPACE_IMPLEMENTATION="+userspace)
+	}
+	output, err := b.runner.CombinedOutput(args[0], args[1:]...)
+	if err != nil {
+		return nil, commandError(err, output)
+	}
+	return output, nil
+}
+
+func (b *wgQuickBackend) Down(name string) ([]byte, error) {
+	args := namespacedCommand(b.config.namespaceOf(name), []string{"sudo", "wg-quick", "down", b.target(name)})
+	output, err := b.runner.CombinedOutput(args[0], args[1:]...)
+	if err != nil {
+		return nil, commandError(err, output)
+	}
+	return output, nil
+}
+
+// target returns the config file of the connection, which wg-quick accepts in place
+// of the name, or the name for connections without a config file in the config directories
+func (b *wgQuickBackend) target(name string) string {
+	path := findConfigFile(b.config.SearchDirs(), name)
+	if _, err := os.Stat(path); err != nil {
+		return name
+	}
+	return path
+}
+
+// upTarget returns the target of wg-quick up. A config with an encrypted private key is decrypted
+// to a temporary directory only the portal user can read, removed by cleanup once wg-quick ran.
+func (b *wgQuickBackend) upTarget(name string) (target string, cleanup func(), err error) {
+	target, cleanup = b.target(name), func() {}
+	if target == name || b.config.keys == nil {
+		return target, cleanup, nil
+	}
+	content, err := os.ReadFile(target)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	if !bytes.Contains(content, []byte(encryptedKeyPrefix)) {
+		return target, cleanup, nil
+	}
+	decrypted, err := b.config.keys.openConfig(content)
+	if err != nil {
+		return "", nil, err
+	}
+	dir, err := os.MkdirTemp("", "wg-portal-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to write config: %w", err)
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	// wg-quick names the interface after the file
+	target = configFilePath(dir, name)
+	if err := os.WriteFile(target, decrypted, 0o600); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to write config: %w", err)
+	}
+	return target, cleanup, nil
+}
+
+// nativeBackend creates the interfaces and configures them with wg setconf, without the bash
+// of wg-quick. The configs can't have DNS servers, hooks or other wg-quick options, and each
+// failed step is reported by name.
+type nativeBackend struct {
+	config *Config
+	runner CommandRunner
+	// netlink configures the links, addresses, routes and rules over rtnetlink instead of running
+	// ip, when the portal has the privileges
+	netlink bool
+}
+
+// nativeStep is a command bringing a connection up or down
+type nativeStep struct {
+	description string
+	args        []string
+	// netlink does the step over rtnetlink, nil for the steps only a command does
+	netlink func() error
+}
+
+// netlinkRule is a routing rule looking up a table, like the rules of the full tunnels
+type netlinkRule struct {
+	ipv6  bool
+	table uint32
+	// notFwMark matches the packets without the firewall mark, when it's set
+	notFwMark uint32
+	// suppressPrefixLength ignores the routes of the table with a prefix up to the length, when it's set
+	suppressPrefixLength *uint32
+}
+
+// nativeDefaultRouteRules are the rules of the default routes of a full tunnel, like wg-quick's
+func nativeDefaultRouteRules(ipv6 bool) []netlinkRule {
+	var noPrefix uint32
+	return []netlinkRule{
+		{ipv6: ipv6, table: nativeRouteTableID, notFwMark: nativeRouteTableID},
+		{ipv6: ipv6, table: mainRouteTableID, suppressPrefixLength: &noPrefix},
+	}
+}
+
+func (b *nativeBackend) Up(name string) ([]byte, error) {
+	config, err := ParseConfig(findConfigFile(b.config.SearchDirs(), name))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNativeConfig(config); err != nil {
+		return nil, err
+	}
+	wgConfig, err := writeWGConfig(config, b.config.keys)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(wgConfig)
+
+	steps := nativeUpSteps(name, config, wgConfig, b.config.UserspaceImplementation)
+	output, err := b.run(namespaceSteps(name, b.config.namespaceOf(name), steps))
+	if err != nil {
+		// Deleting the interface removes its addresses and routes, the rules are removed with it
+		if _, downErr := b.Down(name); downErr != nil {
+			log.Printf("Failed to clean up connection %s: %v", name, downErr)
+		}
+		return nil, err
+	}
+	return output, nil
+}
+
+func (b *nativeBackend) Down(name string) ([]byte, error) {
+	namespace := b.config.namespaceOf(name)
+	// The rules of the default routes only exist for full tunnels, their removal may fail
+	for _, family := range []string{"-4", "-6"} {
+		for _, rule := range nativeDefaultRouteRules(family == "-6") {
+			if b.netlink && namespace == "" {
+				_ = netlinkDeleteRule(rule)
+				continue
+			}
+			args := []string{"sudo", "ip", family, "rule", "del", "table", nativeRouteTable}
+			if rule.suppressPrefixLength != nil {
+				args = []string{"sudo", "ip", family, "rule", "del", "table", "main", "suppress_prefixlength", "0"}
+			}
+			args = namespacedCommand(namespace, args)
+			_, _ = b.runner.CombinedOutput(args[0], args[1:]...)
+		}
+	}
+	step := nativeStep{"delete interface", []string{"ip", "link", "del", "dev", name},
+		func() error { return netlinkDeleteLink(name) }}
+	if namespace != "" {
+		step = nativeStep{description: step.description, args: namespacedCommand(namespace, step.args)}
+	}
+	return b.run([]nativeStep{step})
+}
+
+// run runs the steps in order as root, over rtnetlink when the backend and the step support it,
+// stopping at the first failure
+func (b *nativeBackend) run(steps []nativeStep) ([]byte, error) {
+	var output []byte
+	for _, step := range steps {
+		if b.netlink && step.netlink != nil {
+			if err := step.netlink(); err != nil {
+				return nil, fmt.Errorf("failed to %s: %w", step.description, err)
+			}
+			continue
+		}
+		args := step.args
+		if args[0] != "sudo" {
+			args = append([]string{"sudo"}, args...)
+		}
+		out, err := b.runner.CombinedOutput(args[0], args[1:]...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to %s: %w", step.description, commandError(err, out))
+		}
+		output = append(output, out...)
+	}
+	return output, nil
+}
+
+// checkNativeConfig rejects the configs relying on wg-quick
+func checkNativeConfig(config *WireGuardConfig) error {
+	if len(config.Interface.DNS) > 0 {
+		return fmt.Errorf("DNS is %w", ErrUnsupportedConfig)
+	}
+	if len(config.Interface.Options) > 0 {
+		return fmt.Errorf("%s is %w", config.Interface.Options[0].Key, ErrUnsupportedConfig)
+	}
+	for _, peer := range config.Peers {
+		for _, allowedIP := range peer.AllowedIPs {
+			if _, err := netip.ParsePrefix(allowedIP); err != nil {
+				return fmt.Errorf("invalid AllowedIPs %q", allowedIP)
+			}
+		}
+	}
+	return nil
+}
+
+// writeWGConfig writes the config stripped of the wg-quick settings, like wg-quick strip,
+// for wg setconf and syncconf, returning the path of the file only the portal user can read.
+// An encrypted private key is decrypted in the file.
+func writeWGConfig(config *WireGuardConfig, keys *KeyCipher) (string, error) {
+	wgConfig := config.clone()
+	privateKey, err := keys.decrypt(wgConfig.Interface.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	wgConfig.Interface.PrivateKey = privateKey
+	wgConfig.Interface.Address = nil
+	wgConfig.Interface.DNS = nil
+	wgConfig.Interface.MTU = 0
+	// FwMark is the only interface option of wg, the others are wg-quick settings
+	wgConfig.Interface.Options = slices.DeleteFunc(wgConfig.Interface.Options, func(option ConfigOption) bool {
+		return !strings.EqualFold(option.Key, "FwMark")
+	})
+	file, err := os.CreateTemp("", "wg-portal-*.conf")
+	if err != nil {
+		return "", fmt.Errorf("failed to write config: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(wgConfig.Render()); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write config: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// nativeUpSteps returns the steps bringing the connection up, like wg-quick does. The userspace
+// implementation creates the interface instead of the kernel module when it's set.
+func nativeUpSteps(name string, config *WireGuardConfig, wgConfig, userspace string) []nativeStep {
+	mtu := config.Interface.MTU
+	if mtu == 0 {
+		mtu = nativeDefaultMTU
+	}
+	create := nativeStep{"create interface", []string{"ip", "link", "add", "dev", name, "type", "wireguard"},
+		func() error { return netlinkAddLink(name) }}
+	if userspace != "" {
+		create = nativeStep{description: "create interface", args: []string{userspace, name}}
+	}
+	steps := []nativeStep{create, {description: "configure interface", args: []string{"wg", "setconf", name, wgConfig}}}
+	for _, address := range config.Interface.Address {
+		steps = append(steps, nativeStep{"add address " + address,
+			[]string{"ip", "address", "add", address, "dev", name},
+			func() error { return netlinkAddAddress(name, address) }})
+	}
+	steps = append(steps, nativeStep{"set interface up",
+		[]string{"ip", "link", "set", "dev", name, "mtu", strconv.Itoa(mtu), "up"},
+		func() error { return netlinkSetLinkUp(name, mtu) }})
+	return append(steps, nativeRouteSteps(name, config)...)
+}
+
+// namespaceSteps moves the interface created by the first step to the network namespace and runs
+// the other steps in it with ip netns exec, the netlink socket of the portal being in its own
+// namespace. The socket of the interface stays in the namespace of the portal, where the endpoints
+// are reachable, like the namespace setups of the WireGuard documentation.
+func namespaceSteps(name, namespace string, steps []nativeStep) []nativeStep {
+	if namespace == "" {
+		return steps
+	}
+	namespaced := []nativeStep{
+		steps[0],
+		{description: "move interface to namespace " + namespace,
+			args: []string{"ip", "link", "set", "dev", name, "netns", namespace}},
+	}
+	for _, step := range steps[1:] {
+		namespaced = append(namespaced, nativeStep{description: step.description,
+			args: namespacedCommand(namespace, step.args)})
+	}
+	return namespaced
+}
+
+// nativeRouteSteps routes the allowed IPs of the peers through the interface. The default
+// routes go to a dedicated table, except for the packets of the tunnel itself marked by wg.
+func nativeRouteSteps(name string, config *WireGuardConfig) []nativeStep {
+	var steps []nativeStep
+	for _, peer := range config.Peers {
+		for _, allowedIP := range peer.AllowedIPs {
+			prefix := netip.MustParsePrefix(allowedIP).Masked()
+			family := "-4"
+			if prefix.Addr().Is6() {
+				family = "-6"
+			}
+			if prefix.Bits() > 0 {
+				steps = append(steps, nativeStep{"add route " + prefix.String(),
+					[]string{"ip", family, "route", "add", prefix.String(), "dev", name},
+					func() error { return netlinkAddRoute(name, prefix, mainRouteTableID) }})
+				continue
+			}
+			steps = append(steps, nativeDefaultRouteSteps(name, family, prefix)...)
+		}
+	}
+	return steps
+}
+
+func nativeDefaultRouteSteps(name, family string, prefix netip.Prefix) []nativeStep {
+	description := "add default route " + prefix.String()
+	rules := nativeDefaultRouteRules(family == "-6")
+	return []nativeStep{
+		{description: description, args: []string{"wg", "set", name, "fwmark", nativeRouteTable}},
+		{description, []string{"ip", family, "route", "add", prefix.String(), "dev", name, "table", nativeRouteTable},
+			func() error { return netlinkAddRoute(name, prefix, nativeRouteTableID) }},
+		{description, []string{"ip", family, "rule", "add", "not", "fwmark", nativeRouteTable, "table", nativeRouteTable},
+			func() error { return netlinkAddRule(rules[0]) }},
+		{description, []string{"ip", family, "rule", "add", "table", "main", "suppress_prefixlength", "0"},
+			func() error { return netlinkAddRule(rules[1]) }},
+	}
+}
+
+// configFilePath returns the config file of the connection in the config directory
+func configFilePath(configDir, name string) string {
+	return filepath.Join(configDir, name+".conf")
+}
+
+// findConfigFile returns the config file of the connection in the first of the config directories
+// having one, the config file in the first directory when none has one
+func findConfigFile(configDirs []string, name string) string {
+	for _, configDir := range configDirs {
+		path := configFilePath(configDir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return configFilePath(configDirs[0], name)
+}
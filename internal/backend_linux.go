@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+)
+
+// The native backend configures the links, the addresses, the routes and the rules over rtnetlink
+// when the portal has the privileges, like ip does, without running it
+
+// netlinkAddLink creates the WireGuard interface
+func netlinkAddLink(name string) error {
+	info := netlinkAttributeBytes(unix.IFLA_INFO_KIND, []byte(unix.WG_GENL_NAME))
+	return routeRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, make([]byte, unix.SizeofIfInfomsg),
+		netlinkAttributeBytes(unix.IFLA_IFNAME, append([]byte(name), 0)),
+		netlinkAttributeBytes(unix.IFLA_LINKINFO|unix.NLA_F_NESTED, info))
+}
+
+// netlinkDeleteLink deletes the interface, with its addresses and routes
+func netlinkDeleteLink(name string) error {
+	header, err := linkHeader(name, 0, 0)
+	if err != nil {
+		return err
+	}
+	return routeRequest(unix.RTM_DELLINK, 0, header)
+}
+
+// netlinkSetLinkUp sets the MTU of the interface and brings it up
+func netlinkSetLinkUp(name string, mtu int) error {
+	header, err := linkHeader(name, unix.IFF_UP, unix.IFF_UP)
+	if err != nil {
+		return err
+	}
+	return routeRequest(unix.RTM_NEWLINK, 0, header,
+		netlinkAttributeBytes(unix.IFLA_MTU, binary.NativeEndian.AppendUint32(nil, uint32(mtu))))
+}
+
+// netlinkAddAddress assigns the address with its prefix length to the interface
+func netlinkAddAddress(name, address string) error {
+	prefix, err := netip.ParsePrefix(address)
+	if err != nil {
+		return fmt.Errorf("invalid Address %q", address)
+	}
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	// struct ifaddrmsg: family, prefix length, flags, scope and interface index
+	header := []byte{addressFamily(prefix.Addr()), uint8(prefix.Bits()), 0, unix.RT_SCOPE_UNIVERSE, 0, 0, 0, 0}
+	binary.NativeEndian.PutUint32(header[4:], index)
+	value := prefix.Addr().AsSlice()
+	return routeRequest(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, header,
+		netlinkAttributeBytes(unix.IFA_LOCAL, value), netlinkAttributeBytes(unix.IFA_ADDRESS, value))
+}
+
+// netlinkAddRoute routes the prefix through the interface in the routing table
+func netlinkAddRoute(name string, prefix netip.Prefix, table uint32) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	// struct rtmsg: family, destination and source lengths, tos, table, protocol, scope, type and flags,
+	// the table is set by its attribute since the header only holds 8 bits
+	header := []byte{addressFamily(prefix.Addr()), uint8(prefix.Bits()), 0, 0, unix.RT_TABLE_UNSPEC,
+		unix.RTPROT_BOOT, unix.RT_SCOPE_LINK, unix.RTN_UNICAST, 0, 0, 0, 0}
+	attributes := [][]byte{
+		netlinkAttributeBytes(unix.RTA_OIF, binary.NativeEndian.AppendUint32(nil, index)),
+		netlinkAttributeBytes(unix.RTA_TABLE, binary.NativeEndian.AppendUint32(nil, table)),
+	}
+	if prefix.Bits() > 0 {
+		attributes = append(attributes, netlinkAttributeBytes(unix.RTA_DST, prefix.Addr().AsSlice()))
+	}
+	return routeRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, header, attributes...)
+}
+
+// netlinkAddRule adds the routing rule
+func netlinkAddRule(rule netlinkRule) error {
+	header, attributes := rule.message()
+	return routeRequest(unix.RTM_NEWRULE, unix.NLM_F_CREATE, header, attributes...)
+}
+
+// netlinkDeleteRule deletes the routing rule
+func netlinkDeleteRule(rule netlinkRule) error {
+	header, attributes := rule.message()
+	return routeRequest(unix.RTM_DELRULE, 0, header, attributes...)
+}
+
+// message returns the fib_rule_hdr and the attributes of the rule
+func (r netlinkRule) message() ([]byte, [][]byte) {
+	family := uint8(unix.AF_INET)
+	if r.ipv6 {
+		family = unix.AF_INET6
+	}
+	// struct fib_rule_hdr: family, destination and source lengths, tos, table, 2 reserved bytes,
+	// action and flags
+	header := []byte{family, 0, 0, 0, unix.RT_TABLE_UNSPEC, 0, 0, unix.FR_ACT_TO_TBL, 0, 0, 0, 0}
+	attributes := [][]byte{netlinkAttributeBytes(unix.FRA_TABLE, binary.NativeEndian.AppendUint32(nil, r.table))}
+	if r.notFwMark != 0 {
+		binary.NativeEndian.PutUint32(header[8:], unix.FIB_RULE_INVERT)
+		attributes = append(attributes,
+			netlinkAttributeBytes(unix.FRA_FWMARK, binary.NativeEndian.AppendUint32(nil, r.notFwMark)))
+	}
+	if r.suppressPrefixLength != nil {
+		attributes = append(attributes, netlinkAttributeBytes(unix.FRA_SUPPRESS_PREFIXLEN,
+			binary.NativeEndian.AppendUint32(nil, *r.suppressPrefixLength)))
+	}
+	return header, attributes
+}
+
+// routeRequest sends the rtnetlink request and waits for its acknowledgement
+func routeRequest(messageType, flags uint16, header []byte, attributes ...[]byte) error {
+	conn, err := dialNetlink(unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+	payload := header
+	for _, attribute := range attributes {
+		payload = append(payload, attribute...)
+	}
+	_, err = conn.request(messageType, unix.NLM_F_ACK|flags, payload)
+	return err
+}
+
+// linkHeader returns the ifinfomsg of the interface, changing the flags of the mask to the flags
+func linkHeader(name string, flags, mask uint32) ([]byte, error) {
+	index, err := linkIndex(name)
+	if err != nil {
+		return nil, err
+	}
+	// struct ifinfomsg: family, padding, type, index, flags and change mask
+	header := make([]byte, unix.SizeofIfInfomsg)
+	binary.NativeEndian.PutUint32(header[4:], index)
+	binary.NativeEndian.PutUint32(header[8:], flags)
+	binary.NativeEndian.PutUint32(header[12:], mask)
+	return header, nil
+}
+
+func linkIndex(name string) (uint32, error) {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(link.Index), nil
+}
+
+func addressFamily(address netip.Addr) uint8 {
+	if address.Is4() {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
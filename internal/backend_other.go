@@ -0,0 +1,38 @@
+//go:build !linux
+
+package internal
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// The native backend only configures the interfaces over rtnetlink on Linux, it runs ip otherwise
+
+func netlinkAddLink(string) error {
+	return errors.ErrUnsupported
+}
+
+func netlinkDeleteLink(string) error {
+	return errors.ErrUnsupported
+}
+
+func netlinkSetLinkUp(string, int) error {
+	return errors.ErrUnsupported
+}
+
+func netlinkAddAddress(string, string) error {
+	return errors.ErrUnsupported
+}
+
+func netlinkAddRoute(string, netip.Prefix, uint32) error {
+	return errors.ErrUnsupported
+}
+
+func netlinkAddRule(netlinkRule) error {
+	return errors.ErrUnsupported
+}
+
+func netlinkDeleteRule(netlinkRule) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,30 @@
+package internal
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNamespaceStepsRunInTheNamespace(t *testing.T) {
+	config := &WireGuardConfig{
+		Interface: InterfaceConfig{Address: []string{"10.8.0.2/24"}},
+		Peers:     []*PeerConfig{{AllowedIPs: []string{"10.8.0.0/24", "0.0.0.0/0"}}},
+	}
+	steps := nativeUpSteps("wg0", config, "/tmp/wg0.conf", "")
+	for _, step := range steps {
+		if step.netlink == nil && slices.Contains(step.args, "ip") {
+			t.Fatalf("step %q runs ip without a netlink equivalent", step.description)
+		}
+	}
+
+	namespaced := namespaceSteps("wg0", "vpn", steps)
+	// The interface is created in the namespace of the portal, then moved
+	if namespaced[0].netlink == nil {
+		t.Fatal("interface not created over netlink in the namespace of the portal")
+	}
+	for _, step := range namespaced[1:] {
+		if step.netlink != nil {
+			t.Fatalf("step %q of the namespace runs over the netlink socket of the portal", step.description)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Entries of the backup archives
+const (
+	backupManifestFile = "manifest.json"
+	backupMetadataFile = "metadata.json"
+	backupConfigsDir   = "configs/"
+)
+
+const (
+	// backupVersion is the version of the backup archives written by the portal
+	backupVersion = 1
+	// MaxBackupSize bounds the backup archives, and their content once decompressed
+	MaxBackupSize = 16 << 20
+	// MinBackupPassphraseLength is the length of the shortest passphrase encrypting a backup
+	MinBackupPassphraseLength = 8
+)
+
+// Bounds of the Argon2id parameters of the encrypted backups, so a crafted backup can't
+// make the portal allocate gigabytes to derive its key
+const (
+	maxBackupArgon2Memory = 256 * 1024
+	maxBackupArgon2Time   = 16
+)
+
+// backupMagic starts the encrypted backups, followed by the Argon2id parameters and salt
+// deriving the key from the passphrase, the AES-GCM nonce and the encrypted archive
+var backupMagic = []byte("wg-portal backup\n")
+
+var (
+	// ErrInvalidBackup is returned for a backup which isn't an archive of the portal, or whose
+	// configs or metadata are invalid
+	ErrInvalidBackup = errors.New("invalid backup")
+	// ErrBackupPassphrase is returned for a passphrase too short to encrypt a backup, a missing one
+	// while the private keys are encrypted, or when restoring an encrypted backup without its passphrase
+	ErrBackupPassphrase = errors.New("invalid backup passphrase")
+)
+
+// BackupManifest describes the content of a backup archive
+type BackupManifest struct {
+	Version     int       `json:"version"`
+	Created     time.Time `json:"created"`
+	Connections []string  `json:"connections"`
+}
+
+// RestoreResult is the outcome of a restore, by connection name
+type RestoreResult struct {
+	Restored  []string `json:"restored"`
+	Unchanged []string `json:"unchanged"`
+	// RestartRequired are the restored active connections, still running their previous config
+	RestartRequired []string                   `json:"restart_required"`
+	Warnings        map[string][]ConfigProblem `json:"warnings,omitempty"`
+}
+
+// backupContents are the validated entries of a backup archive
+type backupContents struct {
+	manifest BackupManifest
+	configs  map[string][]byte
+	metadata map[string]ConnectionMetadata
+}
+
+// ExportBackup returns a gzipped tar archive of the configs of the granted connections and
+// of their metadata, encrypted with the passphrase unless it's empty. The encrypted private keys
+// are decrypted, so the backup restores without the master key: the passphrase is then required,
+// the keys never leave the portal in plaintext.
+func (m *WireGuardManager) ExportBackup(grants ConnectionGrants, passphrase string) ([]byte, error) {
+	if passphrase == "" && m.config.keys != nil {
+		return nil, fmt.Errorf("%w: the private keys are encrypted, a passphrase is required to export them",
+			ErrBackupPassphrase)
+	}
+	if passphrase != "" && len(passphrase) < MinBackupPassphraseLength {
+		return nil, fmt.Errorf("%w: the passphrase must have at least %d characters",
+			ErrBackupPassphrase, MinBackupPassphraseLength)
+	}
+	allConnections, err := m.getAllConnections()
+	if err != nil {
+		return nil, err
+	}
+	names := grants.Filter(allConnections)
+	slices.Sort(names)
+	contents := &backupContents{
+		manifest: BackupManifest{Version: backupVersion, Created: time.Now().UTC(), Connections: names},
+		configs:  make(map[string][]byte, len(names)),
+		metadata: m.metadata.export(names),
+	}
+	for _, name := range names {
+		config, err := os.ReadFile(m.configPath(name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the config of %s: %w", name, err)
+		}
+		if contents.configs[name], err = m.config.keys.openConfig(config); err != nil {
+			return nil, fmt.Errorf("failed to decrypt the private key of %s: %w", name, err)
+		}
+	}
+	archive, err := contents.archive()
+	if err != nil {
+		return nil, fmt.Errorf("failed to write backup: %w", err)
+	}
+	if passphrase == "" {
+		return archive, nil
+	}
+	return encryptBackup(archive, passphrase)
+}
+
+// RestoreBackup validates the configs and the metadata of the backup before writing any of them,
+// the previous configs are kept in <name>.conf.bak. The active connections aren't restarted.
+func (m *WireGuardManager) RestoreBackup(data []byte, passphrase string,
+	grants ConnectionGrants) (*RestoreResult, error) {
+	contents, err := readBackup(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	result := &RestoreResult{Restored: []string{}, Unchanged: []string{}, RestartRequired: []string{}}
+	if err := m.checkBackup(contents, grants, result); err != nil {
+		return nil, err
+	}
+	m.peersMutex.Lock()
+	defer m.peersMutex.Unlock()
+
+	activeConnections, err := m.getActiveConnections()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range contents.manifest.Connections {
+		restored, err := m.restoreConfig(name, contents.configs[name])
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !restored:
+			result.Unchanged = append(result.Unchanged, name)
+		case slices.Contains(activeConnections, name):
+			result.RestartRequired = append(result.RestartRequired, name)
+			fallthrough
+		default:
+			result.Restored = append(result.Restored, name)
+		}
+	}
+	if err := m.metadata.restore(contents.manifest.Connections, contents.metadata); err != nil {
+		return nil, err
+	}
+	log.Printf("Restored the backup of %s, %d configs changed", contents.manifest.Created.Format(time.RFC3339),
+		len(result.Restored))
+	return result, nil
+}
+
+// checkBackup checks the connections of the backup are granted and their configs valid,
+// adding the warnings of the configs to the result. The private keys are encrypted with
+// key encryption.
+func (m *WireGuardManager) checkBackup(contents *backupContents, grants ConnectionGrants,
+	result *RestoreResult) error {
+	for _, name := range contents.manifest.Connections {
+		if err := m.checkNewName(name); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+		}
+		if !grants.Allows(name) {
+			return fmt.Errorf("%w: %s", ErrConnectionNotGranted, name)
+		}
+		report := ValidateConfig(contents.configs[name], m.config.AllowConfigHooks)
+		if err := report.Err(); err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrInvalidBackup, name, err)
+		}
+		sealed, err := m.config.keys.sealConfig(contents.configs[name])
+		if err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrInvalidBackup, name, err)
+		}
+		contents.configs[name] = sealed
+		if len(report.Warnings) > 0 {
+			if result.Warnings == nil {
+				result.Warnings = make(map[string][]ConfigProblem)
+			}
+			result.Warnings[name] = report.Warnings
+		}
+	}
+	return nil
+}
+
+// restoreConfig writes the config of the connection unless it's unchanged, keeping the previous one.
+// The configs are compared with their private keys decrypted, each encryption being different.
+func (m *WireGuardManager) restoreConfig(name string, config []byte) (bool, error) {
+	configPath := m.configPath(name)
+	previous, err := os.ReadFile(configPath)
+	switch {
+	case err == nil && m.config.keys.sameConfig(previous, config):
+		return false, nil
+	case err == nil:
+		if err := writeFileAtomic(configPath+".bak", previous); err != nil {
+			return false, fmt.Errorf("failed to back up the config of %s: %w", name, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return false, fmt.Errorf("failed to read the config of %s: %w", name, err)
+	}
+	if err := writeFileAtomic(configPath, config); err != nil {
+		return false, fmt.Errorf("failed to write the config of %s: %w", name, err)
+	}
+	return true, nil
+}
+
+// archive writes the manifest, the metadata and the configs to a gzipped tar archive
+func (c *backupContents) archive() ([]byte, error) {
+	manifest, err := json.MarshalIndent(c.manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := json.MarshalIndent(c.metadata, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	files := map[string][]byte{backupManifestFile: manifest, backupMetadataFile: metadata}
+	for name, config := range c.configs {
+		files[backupConfigsDir+name+".conf"] = config
+	}
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		header := &tar.Header{Name: name, Mode: 0o600, Size: int64(len(files[name])), ModTime: c.manifest.Created}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := tarWriter.Write(files[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return nil, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// readBackup decrypts the backup when it's encrypted and reads its archive,
+// checking it holds a config for each connection of its manifest and nothing else
+func readBackup(data []byte, passphrase string) (*backupContents, error) {
+	if bytes.HasPrefix(data, backupMagic) {
+		var err error
+		if data, err = decryptBackup(data, passphrase); err != nil {
+			return nil, err
+		}
+	}
+	files, err := readBackupArchive(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+	}
+	contents := &backupContents{configs: make(map[string][]byte)}
+	if err := json.Unmarshal(files[backupManifestFile], &contents.manifest); err != nil {
+		return nil, fmt.Errorf("%w: invalid %s: %w", ErrInvalidBackup, backupManifestFile, err)
+	}
+	if contents.manifest.Version != backupVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidBackup, contents.manifest.Version)
+	}
+	if err := json.Unmarshal(files[backupMetadataFile], &contents.metadata); err != nil {
+		return nil, fmt.Errorf("%w: invalid %s: %w", ErrInvalidBackup, backupMetadataFile, err)
+	}
+	delete(files, backupManifestFile)
+	delete(files, backupMetadataFile)
+	for _, name := range contents.manifest.Connections {
+		config, ok := files[backupConfigsDir+name+".conf"]
+		if !ok {
+			return nil, fmt.Errorf("%w: the config of %s is missing", ErrInvalidBackup, name)
+		}
+		contents.configs[name] = config
+		delete(files, backupConfigsDir+name+".conf")
+	}
+	for file := range files {
+		return nil, fmt.Errorf("%w: unexpected file %s", ErrInvalidBackup, file)
+	}
+	return contents, contents.checkMetadata()
+}
+
+// checkMetadata normalizes the metadata of the backup, which must be of its connections
+func (c *backupContents) checkMetadata() error {
+	for name, metadata := range c.metadata {
+		if !slices.Contains(c.manifest.Connections, name) {
+			return fmt.Errorf("%w: metadata of the unknown connection %s", ErrInvalidBackup, name)
+		}
+		normalized, err := metadata.normalize()
+		if err != nil {
+			return fmt.Errorf("%w: metadata of %s: %w", ErrInvalidBackup, name, err)
+		}
+		c.metadata[name] = normalized
+	}
+	return nil
+}
+
+// readBackupArchive returns the regular files of the gzipped tar archive by name,
+// its decompressed size is bounded by MaxBackupSize
+func readBackupArchive(data []byte) (map[string][]byte, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(io.LimitReader(gzipReader, MaxBackupSize))
+	files := make(map[string][]byte)
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(header.Name)
+		switch {
+		case header.Typeflag == tar.TypeDir:
+			continue
+		case header.Typeflag != tar.TypeReg || strings.HasPrefix(name, "../") || path.IsAbs(name):
+			return nil, fmt.Errorf("unexpected entry %s", header.Name)
+		}
+		if _, ok := files[name]; ok {
+			return nil, fmt.Errorf("duplicate file %s", name)
+		}
+		if files[name], err = io.ReadAll(tarReader); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// encryptBackup encrypts the archive with AES-256-GCM, its key derived from the passphrase with Argon2id
+func encryptBackup(archive []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate backup salt: %w", err)
+	}
+	params := currentArgon2Params
+	aead, err := passphraseCipher(passphrase, salt, params)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate backup nonce: %w", err)
+	}
+	header := slices.Clone(backupMagic)
+	header = binary.BigEndian.AppendUint32(header, params.memory)
+	header = binary.BigEndian.AppendUint32(header, params.time)
+	header = append(header, params.threads)
+	header = append(header, salt...)
+	header = append(header, nonce...)
+	// The header is authenticated with the archive
+	return append(header, aead.Seal(nil, nonce, archive, header)...), nil
+}
+
+// decryptBackup decrypts an archive encrypted by encryptBackup
+func decryptBackup(data []byte, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("%w: the backup is encrypted, its passphrase is required", ErrBackupPassphrase)
+	}
+	const paramsSize = 4 + 4 + 1
+	const nonceSize = 12
+	headerSize := len(backupMagic) + paramsSize + argon2SaltLen + nonceSize
+	if len(data) < headerSize {
+		return nil, fmt.Errorf("%w: truncated encrypted backup", ErrInvalidBackup)
+	}
+	fields := data[len(backupMagic):headerSize]
+	params := argon2Params{
+		memory:  binary.BigEndian.Uint32(fields),
+		time:    binary.BigEndian.Uint32(fields[4:]),
+		threads: fields[8],
+	}
+	// argon2 panics with a zero time
+	if params.memory > maxBackupArgon2Memory || params.time == 0 || params.time > maxBackupArgon2Time || params.threads == 0 {
+		return nil, fmt.Errorf("%w: unsupported key derivation parameters", ErrInvalidBackup)
+	}
+	salt := fields[paramsSize : paramsSize+argon2SaltLen]
+	aead, err := passphraseCipher(passphrase, salt, params)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := aead.Open(nil, fields[paramsSize+argon2SaltLen:], data[headerSize:], data[:headerSize])
+	if err != nil {
+		return nil, fmt.Errorf("%w: it doesn't decrypt the backup", ErrBackupPassphrase)
+	}
+	return archive, nil
+}
+
+// passphraseCipher returns the AES-256-GCM cipher of the key derived from the passphrase
+func passphraseCipher(passphrase string, salt []byte, params argon2Params) (cipher.AEAD, error) {
+	key := argon2.IDKey([]byte(passphrase), salt, params.time, params.memory, params.threads, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
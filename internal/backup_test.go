@@ -0,0 +1,23 @@
+package internal
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportBackupRequiresPassphraseWithKeyEncryption(t *testing.T) {
+	manager := newTestManager(t, nil, "home")
+	keys, err := createKeyCipher(filepath.Join(t.TempDir(), "key-encryption.json"), "a master key of the test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.config.keys = keys
+
+	if _, err := manager.ExportBackup(nil, ""); !errors.Is(err, ErrBackupPassphrase) {
+		t.Fatalf("ExportBackup without passphrase = %v, want ErrBackupPassphrase", err)
+	}
+	if _, err := manager.ExportBackup(nil, "a backup passphrase"); err != nil {
+		t.Fatal(err)
+	}
+}
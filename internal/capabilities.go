@@ -0,0 +1,60 @@
+package internal
+
+import "runtime"
+
+// Capabilities returns the optional features enabled by the configuration,
+// so clients can adapt to them instead of probing the endpoints
+func (c *Config) Capabilities() map[string]bool {
+	return map[string]bool{
+		"websocket":                true,
+		"session_refresh":          true,
+		"session_warning":          c.SessionWarningSeconds > 0,
+		"kill_switch":              c.KillSwitch.Configured(),
+		"last_activity":            c.ActivitySampleSeconds > 0,
+		"status_events":            c.StatusPollSeconds > 0,
+		"traffic_history":          c.Traffic.SampleSeconds > 0,
+		"latency_monitor":          c.Latency.IntervalSeconds > 0,
+		"health_checks":            c.HealthChecks.IntervalSeconds > 0,
+		"failover":                 c.Failover.Enabled(),
+		"watchdog":                 c.Watchdog.IntervalSeconds > 0,
+		"schedules":                true,
+		"connection_tags":          true,
+		"dns_leak_test":            true,
+		"exit_ip":                  c.ExitIP.URL != "",
+		"speed_test":               c.SpeedTest.DownloadURL != "",
+		"allowed_ips_editor":       true,
+		"mtu":                      true,
+		"peer_expiry":              true,
+		"key_rotation":             true,
+		"tunnel_routes":            runtime.GOOS == "linux",
+		"tunnel_firewall":          true,
+		"toggle_hooks":             len(c.Hooks.PreStop) > 0 || len(c.Hooks.PostStart) > 0,
+		"events_feed":              c.EventLogSize > 0,
+		"audit_log":                c.AuditLog,
+		"list_connections_command": c.ListConnectionsCommand != "",
+		"maintenance_window":       true,
+		"multi_active":             c.MultiActive,
+		"read_only_mode":           true,
+		"route_conflicts":          true,
+		"compare_connections":      true,
+		"connection_profiles":      len(c.ConnectionProfiles) > 0,
+		"peer_management":          true,
+		"key_generation":           true,
+		"client_configs":           true,
+		"config_editor":            true,
+		"config_import":            c.ListConnectionsCommand == "",
+		"interface_creation":       c.ListConnectionsCommand == "",
+		"connection_deletion":      c.ListConnectionsCommand == "",
+		"connection_rename":        c.ListConnectionsCommand == "",
+		"config_backup":            c.ListConnectionsCommand == "",
+		"config_git":               c.ConfigGit.Enabled,
+		"config_history":           c.ConfigHistorySize > 0,
+		"key_encryption":           c.KeyEncryption.Enabled,
+		"totp":                     true,
+		"ldap":                     c.LDAP.Configured(),
+		"oauth":                    c.OAuth.Configured(),
+		"proxy_auth":               c.ProxyAuth.Configured(),
+		"client_certificates":      c.TLS.ClientAuth(),
+		"api_tokens":               true,
+	}
+}
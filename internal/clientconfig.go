@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// peerKeysFile is the file of the state directory keeping the private keys of the peers
+// generated by the portal, by public key
+const peerKeysFile = "peer_keys.json"
+
+// ErrPeerKeyUnknown is returned for the client configs of peers added with their own keys
+var ErrPeerKeyUnknown = errors.New("private key of the peer is unknown, only peers added without a public key have one")
+
+// peerKeysMutex serializes the changes of the peer keys file, shared by the profiles
+var peerKeysMutex sync.Mutex
+
+// defaultClientAllowedIPs route all the traffic of the peers through the tunnel
+var defaultClientAllowedIPs = []string{"0.0.0.0/0", "::/0"}
+
+func (s ConnectionSettings) validate() error {
+	if s.ClientEndpoint != "" {
+		if _, _, err := net.SplitHostPort(s.ClientEndpoint); err != nil {
+			return fmt.Errorf("client_endpoint must be host:port, got %q", s.ClientEndpoint)
+		}
+	}
+	for _, dns := range s.ClientDNS {
+		if _, err := netip.ParseAddr(dns); err != nil && !dnsSearchDomainRegex.MatchString(dns) {
+			return fmt.Errorf("invalid client_dns %q", dns)
+		}
+	}
+	for _, allowedIP := range s.ClientAllowedIPs {
+		if _, err := netip.ParsePrefix(allowedIP); err != nil {
+			return fmt.Errorf("invalid client_allowed_ips %q", allowedIP)
+		}
+	}
+	if s.Namespace != "" && !namespaceRegex.MatchString(s.Namespace) {
+		return fmt.Errorf("invalid namespace %q", s.Namespace)
+	}
+	return nil
+}
+
+// ClientConfig assembles the config of the peer's side of the connection: its addresses
+// are the allowed IPs of the peer, or of the old peer while its key rotation is pending,
+// and the connection is its only peer. The endpoint defaults to the host the portal is
+// reached at and the listen port of the connection.
+func (m *WireGuardManager) ClientConfig(name, publicKey, host string) (*WireGuardConfig, error) {
+	config, err := m.connectionConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	index, err := findPeer(config, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	peer := config.Peers[index]
+	addresses := peer.AllowedIPs
+	if old := m.rotatingPeer(config, name, publicKey); old != nil {
+		addresses = old.AllowedIPs
+	}
+	privateKey, err := m.peerKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	serverPrivateKey, err := m.config.keys.decrypt(config.Interface.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	serverKey, err := publicKeyOf(serverPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := m.config.Connections[name]
+	client := &WireGuardConfig{Interface: InterfaceConfig{
+		PrivateKey: privateKey,
+		Address:    addresses,
+		DNS:        settings.ClientDNS,
+	}}
+	client.Peers = []*PeerConfig{{
+		PublicKey:           serverKey,
+		PresharedKey:        peer.PresharedKey,
+		Endpoint:            settings.ClientEndpoint,
+		AllowedIPs:          settings.ClientAllowedIPs,
+		PersistentKeepalive: peer.PersistentKeepalive,
+	}}
+	if client.Peers[0].Endpoint == "" {
+		client.Peers[0].Endpoint = net.JoinHostPort(host, strconv.Itoa(config.Interface.ListenPort))
+	}
+	if len(client.Peers[0].AllowedIPs) == 0 {
+		client.Peers[0].AllowedIPs = defaultClientAllowedIPs
+	}
+	return client, nil
+}
+
+// publicKeyOf derives the public key of a private key, like wg pubkey
+func publicKeyOf(privateKey string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return "", errors.New("invalid private key of the connection")
+	}
+	key, err := ecdh.X25519().NewPrivateKey(decoded)
+	if err != nil {
+		return "", errors.New("invalid private key of the connection")
+	}
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+func (m *WireGuardManager) peerKeysPath() string {
+	return filepath.Join(m.config.StateDir, peerKeysFile)
+}
+
+// peerKey returns the private key the portal generated for the peer, decrypted
+func (m *WireGuardManager) peerKey(publicKey string) (string, error) {
+	peerKeysMutex.Lock()
+	defer peerKeysMutex.Unlock()
+	keys, err := m.loadPeerKeys()
+	if err != nil {
+		return "", err
+	}
+	privateKey, ok := keys[publicKey]
+	if !ok {
+		return "", ErrPeerKeyUnknown
+	}
+	return m.config.keys.decrypt(privateKey)
+}
+
+// setPeerKey keeps the private key of the peer, encrypted with key encryption, an empty key forgets it
+func (m *WireGuardManager) setPeerKey(publicKey, privateKey string) error {
+	peerKeysMutex.Lock()
+	defer peerKeysMutex.Unlock()
+	keys, err := m.loadPeerKeys()
+	if err != nil {
+		return err
+	}
+	if _, ok := keys[publicKey]; !ok && privateKey == "" {
+		return nil
+	}
+	if privateKey == "" {
+		delete(keys, publicKey)
+		return m.savePeerKeys(keys)
+	}
+	encrypted, err := m.config.keys.encrypt(privateKey)
+	if err != nil {
+		return err
+	}
+	keys[publicKey] = encrypted
+	return m.savePeerKeys(keys)
+}
+
+// encryptPeerKeys encrypts the plaintext keys of the peer keys file
+func (m *WireGuardManager) encryptPeerKeys() error {
+	peerKeysMutex.Lock()
+	defer peerKeysMutex.Unlock()
+	keys, err := m.loadPeerKeys()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for publicKey, privateKey := range keys {
+		if strings.HasPrefix(privateKey, encryptedKeyPrefix) {
+			continue
+		}
+		encrypted, err := m.config.keys.encrypt(privateKey)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt the private key of peer %s: %w", publicKey, err)
+		}
+		keys[publicKey], changed = encrypted, true
+	}
+	if !changed {
+		return nil
+	}
+	log.Printf("Encrypted the private keys of %s", m.peerKeysPath())
+	return m.savePeerKeys(keys)
+}
+
+// savePeerKeys writes the peer keys file, it must be called holding peerKeysMutex
+func (m *WireGuardManager) savePeerKeys(keys map[string]string) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to save peer keys: %w", err)
+	}
+	if err := writeFileAtomic(m.peerKeysPath(), data); err != nil {
+		return fmt.Errorf("failed to save peer keys: %w", err)
+	}
+	return nil
+}
+
+func (m *WireGuardManager) loadPeerKeys() (map[string]string, error) {
+	keys := make(map[string]string)
+	data, err := os.ReadFile(m.peerKeysPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer keys: %w", err)
+	}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse peer keys: %w", err)
+	}
+	return keys, nil
+}
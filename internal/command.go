@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// CommandRunner executes the external commands used to manage the host
+type CommandRunner interface {
+	// CombinedOutput runs the command and returns its combined stdout and stderr
+	CombinedOutput(name string, args ...string) ([]byte, error)
+	// Output runs the command and returns its stdout
+	Output(name string, args ...string) ([]byte, error)
+}
+
+// Privilege modes of the commands requiring root
+const (
+	// PrivilegeSudo runs them with sudo
+	PrivilegeSudo = "sudo"
+	// PrivilegeDirect runs them with the privileges of the portal, root or CAP_NET_ADMIN
+	PrivilegeDirect = "direct"
+	// PrivilegeAuto runs them directly when the portal is root or has CAP_NET_ADMIN, else with sudo
+	PrivilegeAuto = "auto"
+)
+
+// userspaceEnv is the variable of wg-quick running the interfaces with a userspace implementation
+const userspaceEnv = "WG_QUICK_USERSPACE_IMPLEMENTATION"
+
+// DirectPrivileges reports whether the commands requiring root run without sudo
+func (c *Config) DirectPrivileges() bool {
+	switch c.PrivilegeMode {
+	case PrivilegeDirect:
+		return true
+	case PrivilegeAuto:
+		return hasNetAdmin()
+	default:
+		return false
+	}
+}
+
+// kernelNetlink reports whether the portal reads and configures the kernel interfaces over netlink
+// itself, which needs the privileges of the commands run without sudo. The privileged helper takes
+// precedence, and netlink is only supported on Linux.
+func (c *Config) kernelNetlink() bool {
+	return runtime.GOOS == "linux" && c.PrivilegedHelper.Socket == "" && c.DirectPrivileges()
+}
+
+// execRunner runs the commands on the host, killing them once they exceed the timeout
+type execRunner struct {
+	timeout time.Duration
+	// direct runs the commands prefixed with sudo without it
+	direct bool
+}
+
+// NewCommandRunner returns the runner of the commands on the host, direct drops the sudo
+// of the commands requiring root
+func NewCommandRunner(timeout time.Duration, direct bool) CommandRunner {
+	return execRunner{timeout: timeout, direct: direct}
+}
+
+func (r execRunner) CombinedOutput(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	return r.command(ctx, name, args).CombinedOutput()
+}
+
+func (r execRunner) Output(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	return r.command(ctx, name, args).Output()
+}
+
+// command returns the command to run, a command prefixed with sudo runs without it in the direct
+// mode, passing the capabilities of the portal on to it
+func (r execRunner) command(ctx context.Context, name string, args []string) *exec.Cmd {
+	if !r.direct || name != "sudo" {
+		return exec.CommandContext(ctx, name, args...)
+	}
+	command := privilegedCommand(ctx, args)
+	command.SysProcAttr = directProcAttr()
+	return command
+}
+
+// privilegedCommand returns the command of the args of sudo, the userspace implementation
+// of wg-quick being set in its environment
+func privilegedCommand(ctx context.Context, args []string) *exec.Cmd {
+	if strings.HasPrefix(args[0], userspaceEnv+"=") {
+		command := exec.CommandContext(ctx, args[1], args[2:]...)
+		command.Env = append(os.Environ(), args[0])
+		return command
+	}
+	return exec.CommandContext(ctx, args[0], args[1:]...)
+}
+
+// commandError adds the command output to its error, the exit status alone says little
+func commandError(err error, output []byte) error {
+	if message := strings.TrimSpace(string(output)); message != "" {
+		return fmt.Errorf("%w: %s", err, message)
+	}
+	return err
+}
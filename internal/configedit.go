@@ -0,0 +1,292 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ReadConfigFile returns the config file of the connection as written, comments included
+func (m *WireGuardManager) ReadConfigFile(name string) (string, error) {
+	if err := m.requireConnection(name); err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(m.configPath(name))
+	if err != nil {
+		return "", fmt.Errorf("failed to read config: %w", err)
+	}
+	return string(data), nil
+}
+
+// WriteConfigFile validates and saves the config file of the connection, the previous
+// version is kept in <name>.conf.bak. An active connection is restarted with the new config.
+// The private key is encrypted with key encryption.
+func (m *WireGuardManager) WriteConfigFile(name, content string) (*ApplyResult, error) {
+	if err := ValidateConfig([]byte(content), m.config.AllowConfigHooks).Err(); err != nil {
+		return nil, err
+	}
+	sealed, err := m.config.keys.sealConfig([]byte(content))
+	if err != nil {
+		return nil, err
+	}
+	m.peersMutex.Lock()
+	defer m.peersMutex.Unlock()
+
+	if err := m.requireConnection(name); err != nil {
+		return nil, err
+	}
+	previous, err := os.ReadFile(m.configPath(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := writeFileAtomic(m.configPath(name)+".bak", previous); err != nil {
+		return nil, fmt.Errorf("failed to back up config: %w", err)
+	}
+	if err := writeFileAtomic(m.configPath(name), sealed); err != nil {
+		return nil, fmt.Errorf("failed to write config: %w", err)
+	}
+	log.Printf("Saved the config of %s", name)
+	return m.restartActiveConnection(name)
+}
+
+// requireConnection checks the connection is known
+func (m *WireGuardManager) requireConnection(name string) error {
+	allConnections, err := m.getAllConnections()
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(allConnections, name) {
+		return fmt.Errorf("%w: %s", ErrConnectionNotFound, name)
+	}
+	return nil
+}
+
+// ErrConnectionExists is returned when importing a config over an existing connection
+var ErrConnectionExists = errors.New("connection already exists")
+
+// invalidNameChars matches the characters wg-quick doesn't accept in interface names
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_=+.-]+`)
+
+// SanitizeConnectionName turns an uploaded file name into a connection name: the
+// directories and the .conf extension are dropped, the characters wg-quick doesn't
+// accept are replaced and the name is truncated to the 15 characters of interface names
+func SanitizeConnectionName(filename string) string {
+	name := strings.TrimSuffix(filepath.Base(strings.ReplaceAll(filename, `\`, "/")), ".conf")
+	name = strings.Trim(invalidNameChars.ReplaceAllString(name, "-"), "-.")
+	if len(name) > 15 {
+		name = strings.TrimRight(name[:15], "-.")
+	}
+	return name
+}
+
+// ImportConfig validates the config and installs it as a new connection of the config
+// directory, its private key encrypted with key encryption, returning the validation report
+// with its warnings
+func (m *WireGuardManager) ImportConfig(name, content string) (*ConfigReport, error) {
+	if err := m.checkNewName(name); err != nil {
+		return nil, err
+	}
+	report := ValidateConfig([]byte(content), m.config.AllowConfigHooks)
+	if err := report.Err(); err != nil {
+		return report, err
+	}
+	sealed, err := m.config.keys.sealConfig([]byte(content))
+	if err != nil {
+		return report, err
+	}
+	m.peersMutex.Lock()
+	defer m.peersMutex.Unlock()
+
+	if _, err := os.Stat(m.configPath(name)); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrConnectionExists, name)
+	}
+	if err := writeFileAtomic(m.configPath(name), sealed); err != nil {
+		return nil, fmt.Errorf("failed to write config: %w", err)
+	}
+	log.Printf("Imported connection %s", name)
+	return report, nil
+}
+
+// archiveDir is the directory of the state directory keeping the configs of deleted connections
+const archiveDir = "archive"
+
+var (
+	// ErrConfirmationRequired is returned when deleting a connection without its confirmation token
+	ErrConfirmationRequired = errors.New("confirmation required")
+	// ErrConfirmationMismatch is returned for a confirmation token of another config version
+	ErrConfirmationMismatch = errors.New("confirmation token doesn't match the config, it changed since")
+)
+
+// DeleteResult is the outcome of a connection deletion
+type DeleteResult struct {
+	// Archive is the copy of the deleted config in the state directory
+	Archive string
+	Output  []byte
+	Stopped bool
+}
+
+// DeletionToken returns the token confirming the deletion of the connection, derived
+// from its config so that a config changed after it was reviewed isn't deleted
+func (m *WireGuardManager) DeletionToken(name string) (string, error) {
+	content, err := m.ReadConfigFile(name)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(name + "\n" + content))
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// DeleteConnection stops the connection when it's active, archives its config in the state
+// directory and removes it. The token must be the deletion token of the current config.
+func (m *WireGuardManager) DeleteConnection(name, token string, grants ConnectionGrants) (*DeleteResult, error) {
+	m.peersMutex.Lock()
+	defer m.peersMutex.Unlock()
+
+	expected, err := m.DeletionToken(name)
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case "":
+		return nil, fmt.Errorf("%w: repeat the request with confirm=%s", ErrConfirmationRequired, expected)
+	case expected:
+	default:
+		return nil, ErrConfirmationMismatch
+	}
+	archive, err := m.archiveConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	// A toggle mustn't start the connection between its stop and the removal of its config
+	m.operationMutex.Lock()
+	defer m.operationMutex.Unlock()
+	stop, err := m.changeConnection(name, changeStop, grants)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(m.configPath(name)); err != nil {
+		return nil, fmt.Errorf("failed to remove config: %w", err)
+	}
+	if err := os.Remove(m.configPath(name) + ".bak"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Failed to remove the config backup of %s: %v", name, err)
+	}
+	m.clearLastErrors(name)
+	if err := m.metadata.DeleteConnection(name); err != nil {
+		log.Printf("Failed to delete the metadata of %s: %v", name, err)
+	}
+	if err := m.expiries.DeleteConnection(name); err != nil {
+		log.Printf("Failed to delete the peer expiry of %s: %v", name, err)
+	}
+	if err := m.rotations.DeleteConnection(name); err != nil {
+		log.Printf("Failed to delete the key rotations of %s: %v", name, err)
+	}
+	log.Printf("Deleted connection %s, its config is archived in %s", name, archive)
+	return &DeleteResult{Archive: archive, Output: stop.Output, Stopped: len(stop.Stopped) > 0}, nil
+}
+
+// archiveConfig copies the config of the connection to the archive directory,
+// named by the connection and the time of the deletion
+func (m *WireGuardManager) archiveConfig(name string) (string, error) {
+	content, err := os.ReadFile(m.configPath(name))
+	if err != nil {
+		return "", fmt.Errorf("failed to read config: %w", err)
+	}
+	dir := filepath.Join(m.config.StateDir, archiveDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create the archive directory: %w", err)
+	}
+	archive := filepath.Join(dir, fmt.Sprintf("%s-%s.conf", name, time.Now().UTC().Format("20060102T150405Z")))
+	if err := writeFileAtomic(archive, content); err != nil {
+		return "", fmt.Errorf("failed to archive config: %w", err)
+	}
+	return archive, nil
+}
+
+// RenameConnection renames the config file of the connection and the state kept under its
+// name, an active connection is stopped and started under the new name. When the renamed
+// connection fails to start, the result is returned with the error.
+func (m *WireGuardManager) RenameConnection(name, newName string) (*ApplyResult, error) {
+	if err := m.checkNewName(newName); err != nil {
+		return nil, err
+	}
+	m.peersMutex.Lock()
+	defer m.peersMutex.Unlock()
+	// The active state is read under operationMutex for a concurrent toggle not to be reverted
+	m.operationMutex.Lock()
+	defer m.operationMutex.Unlock()
+
+	connection, err := m.getConnection(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(m.configPath(newName)); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrConnectionExists, newName)
+	}
+	var output []byte
+	if connection.Active {
+		if output, err = m.stopActiveConnections([]*WireGuardConnection{connection}); err != nil {
+			m.setLastError(name, "down", err)
+			return nil, err
+		}
+	}
+	if err := m.renameConfigFiles(name, newName); err != nil {
+		return nil, err
+	}
+	m.moveConnectionState(name, newName)
+	log.Printf("Renamed connection %s to %s", name, newName)
+
+	result := &ApplyResult{Output: output, Restarted: connection.Active}
+	if !connection.Active {
+		return result, nil
+	}
+	startOutput, err := m.startConnection(&WireGuardConnection{Name: newName})
+	if err != nil {
+		m.setLastError(newName, "up", err)
+		return result, err
+	}
+	result.Output = append(result.Output, startOutput...)
+	return result, nil
+}
+
+// renameConfigFiles renames the config file of the connection and its backup, in their config directory
+func (m *WireGuardManager) renameConfigFiles(name, newName string) error {
+	path := m.configPath(name)
+	newPath := configFilePath(filepath.Dir(path), newName)
+	if err := os.Rename(path, newPath); err != nil {
+		return fmt.Errorf("failed to rename config: %w", err)
+	}
+	err := os.Rename(path+".bak", newPath+".bak")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Failed to rename the config backup of %s: %v", name, err)
+	}
+	return nil
+}
+
+// moveConnectionState moves the last error, the last activity, the metadata, the peer expiry
+// and the key rotations of the connection to its new name
+func (m *WireGuardManager) moveConnectionState(name, newName string) {
+	m.lastErrorsMutex.Lock()
+	if lastError, ok := m.lastErrors[name]; ok {
+		m.lastErrors[newName] = lastError
+		delete(m.lastErrors, name)
+	}
+	m.lastErrorsMutex.Unlock()
+	m.activity.rename(name, newName)
+	if err := m.metadata.RenameConnection(name, newName); err != nil {
+		log.Printf("Failed to rename the metadata of %s: %v", name, err)
+	}
+	if err := m.expiries.RenameConnection(name, newName); err != nil {
+		log.Printf("Failed to rename the peer expiry of %s: %v", name, err)
+	}
+	if err := m.rotations.RenameConnection(name, newName); err != nil {
+		log.Printf("Failed to rename the key rotations of %s: %v", name, err)
+	}
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// configGitIgnore is written to the config directories the portal creates a repository in,
+// only the configs are versioned, not their backups nor the temporary files of their writes
+const configGitIgnore = `# Written by wg-portal, only the configs are versioned
+*
+!.gitignore
+!*.conf
+`
+
+// configGitCommitter is the committer of the commits, and the author of the automatic changes
+const configGitCommitter = "wg-portal"
+
+// ConfigGitConfig commits the changes the portal makes to the config files to a git repository
+// in each config directory
+type ConfigGitConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// EmailDomain is the domain of the emails of the commit authors, <username>@<email_domain>
+	EmailDomain string `yaml:"email_domain"`
+}
+
+func (c ConfigGitConfig) validate() error {
+	if c.EmailDomain == "" || strings.ContainsAny(c.EmailDomain, "@<> \t\n") {
+		return fmt.Errorf("invalid email_domain %q", c.EmailDomain)
+	}
+	return nil
+}
+
+// ConfigRepository commits the changes of the config files to the git repositories of the
+// config directories, with the user making them as the author
+type ConfigRepository struct {
+	config ConfigGitConfig
+	dirs   []string
+	runner CommandRunner
+	// mutex serializes the commits, so a change is committed with its own author and message
+	mutex sync.Mutex
+}
+
+func NewConfigRepository(config *Config, runner CommandRunner) *ConfigRepository {
+	return &ConfigRepository{config: config.ConfigGit, dirs: config.SearchDirs(), runner: runner}
+}
+
+// Init creates a repository in the config directories without one, committing their configs.
+// It does nothing unless the versioning is enabled.
+func (r *ConfigRepository) Init() error {
+	if !r.config.Enabled {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, dir := range r.dirs {
+		if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			continue
+		}
+		if output, err := r.git(dir, "init", "-q"); err != nil {
+			return fmt.Errorf("failed to create the repository of %s: %w", dir, commandError(err, output))
+		}
+		if err := writeFileAtomic(filepath.Join(dir, ".gitignore"), []byte(configGitIgnore)); err != nil {
+			return fmt.Errorf("failed to write the .gitignore of %s: %w", dir, err)
+		}
+		if err := r.commit(dir, configGitCommitter, "Version the configs"); err != nil {
+			return err
+		}
+		log.Printf("Created the config repository of %s", dir)
+	}
+	return nil
+}
+
+// Commit commits the changes of the configs of each config directory, nothing when they're
+// unchanged. The author is the user making the change, empty for the automatic changes.
+// A failing commit is logged, the change being already made.
+func (r *ConfigRepository) Commit(author, message string) {
+	if !r.config.Enabled {
+		return
+	}
+	if author == "" {
+		author = configGitCommitter
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, dir := range r.dirs {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+			continue
+		}
+		if err := r.commit(dir, author, message); err != nil {
+			log.Printf("Failed to commit the configs of %s: %v", dir, err)
+		}
+	}
+}
+
+// commit stages the added, changed and removed files of the directory besides those its .gitignore
+// ignores, and commits them
+func (r *ConfigRepository) commit(dir, author, message string) error {
+	if output, err := r.git(dir, "add", "-A", "--", "."); err != nil {
+		return fmt.Errorf("failed to stage the configs: %w", commandError(err, output))
+	}
+	staged, err := r.git(dir, "diff", "--cached", "--name-only")
+	if err != nil {
+		return fmt.Errorf("failed to list the staged configs: %w", commandError(err, staged))
+	}
+	if len(strings.TrimSpace(string(staged))) == 0 {
+		return nil
+	}
+	if output, err := r.git(dir, "commit", "-q", "--author", r.authorIdentity(author), "-m", message); err != nil {
+		return fmt.Errorf("failed to commit: %w", commandError(err, output))
+	}
+	return nil
+}
+
+// authorIdentity returns the name and email of the author, the usernames which are emails,
+// like those of the OAuth accounts, are kept as they are
+func (r *ConfigRepository) authorIdentity(author string) string {
+	email := author
+	if !strings.Contains(author, "@") {
+		email = author + "@" + r.config.EmailDomain
+	}
+	return fmt.Sprintf("%s <%s>", author, email)
+}
+
+// git runs git in the directory as the committer, trusting the directory even when
+// it's owned by another user like root
+func (r *ConfigRepository) git(dir string, args ...string) ([]byte, error) {
+	args = append([]string{
+		"-C", dir, "-c", "safe.directory=" + dir,
+		"-c", "user.name=" + configGitCommitter, "-c", "user.email=" + configGitCommitter + "@" + r.config.EmailDomain,
+	}, args...)
+	return r.runner.CombinedOutput("git", args...)
+}
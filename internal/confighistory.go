@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrVersionNotFound is returned for a version of a config the history doesn't have
+var ErrVersionNotFound = errors.New("config version not found")
+
+// ConfigVersion is the config of a connection after a change
+type ConfigVersion struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	// Author is the user who made the change, empty for the automatic changes
+	// and those made outside of the portal
+	Author  string `json:"author,omitempty"`
+	Message string `json:"message"`
+	Size    int    `json:"size"`
+	// Content is left out of the version lists
+	Content string `json:"content,omitempty"`
+}
+
+// ConfigHistory keeps the last versions of the configs of the connections, persisted in the state directory
+type ConfigHistory struct {
+	size     int
+	path     string
+	versions map[string][]*ConfigVersion
+	mutex    sync.RWMutex
+}
+
+func NewConfigHistory(profile string, config *Config) (*ConfigHistory, error) {
+	history := &ConfigHistory{
+		size:     config.ConfigHistorySize,
+		path:     filepath.Join(config.StateDir, profileStateFile("config-history", ".json", profile)),
+		versions: make(map[string][]*ConfigVersion),
+	}
+	if err := history.load(); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// Enabled reports whether versions are kept
+func (h *ConfigHistory) Enabled() bool {
+	return h.size > 0
+}
+
+// Sync records the configs changed since their last version, like those edited outside of
+// the portal while it wasn't running, and the first version of the configs without history
+func (h *ConfigHistory) Sync(m *WireGuardManager) {
+	if !h.Enabled() {
+		return
+	}
+	allConnections, err := m.getAllConnections()
+	if err != nil {
+		log.Printf("Failed to list the connections of the config history: %v", err)
+		return
+	}
+	for _, name := range allConnections {
+		message := "Changed outside of the portal"
+		if len(h.Versions(name)) == 0 {
+			message = "First version"
+		}
+		h.Record(m, "", message, name)
+	}
+}
+
+// Record records the configs of the connections as a new version unless they're unchanged,
+// the connections without a config file are skipped. A failing record is logged.
+func (h *ConfigHistory) Record(m *WireGuardManager, author, message string, names ...string) {
+	if !h.Enabled() {
+		return
+	}
+	for _, name := range names {
+		content, err := os.ReadFile(m.configPath(name))
+		if err != nil {
+			continue
+		}
+		if err := h.add(name, &ConfigVersion{
+			Time: time.Now(), Author: author, Message: message, Size: len(content), Content: string(content),
+		}); err != nil {
+			log.Printf("Failed to record the config version of %s: %v", name, err)
+		}
+	}
+}
+
+// add appends the version unless its content is the last one, dropping the oldest versions
+// beyond the history size
+func (h *ConfigHistory) add(name string, version *ConfigVersion) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	versions := h.versions[name]
+	if len(versions) > 0 {
+		last := versions[len(versions)-1]
+		if last.Content == version.Content {
+			return nil
+		}
+		version.Version = last.Version + 1
+	} else {
+		version.Version = 1
+	}
+	h.versions[name] = append(slices.Clone(versions[max(len(versions)+1-h.size, 0):]), version)
+	return h.save(func() { h.versions[name] = versions })
+}
+
+// Versions returns the versions of the config of the connection without their content, newest first
+func (h *ConfigHistory) Versions(name string) []*ConfigVersion {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	versions := make([]*ConfigVersion, 0, len(h.versions[name]))
+	for _, version := range slices.Backward(h.versions[name]) {
+		listed := *version
+		listed.Content = ""
+		versions = append(versions, &listed)
+	}
+	return versions
+}
+
+// Version returns a version of the config of the connection, the last one for version 0
+func (h *ConfigHistory) Version(name string, version int) (*ConfigVersion, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	versions := h.versions[name]
+	if version == 0 && len(versions) > 0 {
+		found := *versions[len(versions)-1]
+		return &found, nil
+	}
+	for _, kept := range versions {
+		if kept.Version == version {
+			found := *kept
+			return &found, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: version %d of %s", ErrVersionNotFound, version, name)
+}
+
+// Diff returns the unified diff between two versions of the config of the connection,
+// to the last version when to is 0
+func (h *ConfigHistory) Diff(name string, from, to int) (string, error) {
+	fromVersion, err := h.Version(name, from)
+	if err != nil {
+		return "", err
+	}
+	toVersion, err := h.Version(name, to)
+	if err != nil {
+		return "", err
+	}
+	return UnifiedDiff(fmt.Sprintf("%s.conf (version %d)", name, fromVersion.Version),
+		fmt.Sprintf("%s.conf (version %d)", name, toVersion.Version), fromVersion.Content, toVersion.Content), nil
+}
+
+// RenameConnection moves the versions of the renamed connection to its new name
+func (h *ConfigHistory) RenameConnection(name, newName string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	versions, ok := h.versions[name]
+	if !ok {
+		return nil
+	}
+	previous, existed := h.versions[newName]
+	h.versions[newName] = versions
+	delete(h.versions, name)
+	return h.save(func() {
+		h.versions[name] = versions
+		delete(h.versions, newName)
+		if existed {
+			h.versions[newName] = previous
+		}
+	})
+}
+
+// DeleteConnection removes the versions of the deleted connection, its last config is archived
+func (h *ConfigHistory) DeleteConnection(name string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	versions, ok := h.versions[name]
+	if !ok {
+		return nil
+	}
+	delete(h.versions, name)
+	return h.save(func() { h.versions[name] = versions })
+}
+
+func (h *ConfigHistory) load() error {
+	data, err := os.ReadFile(h.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config history: %w", err)
+	}
+	var versions map[string][]*ConfigVersion
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", h.path, err)
+	}
+	maps.Copy(h.versions, versions)
+	return nil
+}
+
+// save persists the versions, it must be called holding the mutex.
+// The change is reverted with undo when it can't be persisted.
+func (h *ConfigHistory) save(undo func()) error {
+	data, err := json.MarshalIndent(h.versions, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(h.path, data)
+	}
+	if err != nil {
+		undo()
+		return fmt.Errorf("failed to save config history: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"regexp"
+	"slices"
+)
+
+// ConnectionProfile bundles connection settings applied together to a connection config,
+// only the settings set in the profile are changed
+type ConnectionProfile struct {
+	MTU        int      `yaml:"mtu"`
+	DNS        []string `yaml:"dns"`
+	AllowedIPs []string `yaml:"allowed_ips"`
+	// PersistentKeepalive is a pointer, so a profile can turn the keepalive off with 0
+	PersistentKeepalive *int `yaml:"persistent_keepalive"`
+}
+
+// ApplyResult is the outcome of applying a connection profile
+type ApplyResult struct {
+	Output []byte
+	// Restarted reports whether the connection was active and restarted with the new config
+	Restarted bool
+}
+
+// ErrProfileNotFound is returned for connection profiles missing from the configuration
+var ErrProfileNotFound = errors.New("connection profile not found")
+
+// dnsSearchDomainRegex matches the search domains wg-quick accepts next to DNS servers
+var dnsSearchDomainRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+// Validate checks every setting of the profile
+func (p *ConnectionProfile) Validate() error {
+	if p.MTU != 0 && (p.MTU < 576 || p.MTU > 65535) {
+		return fmt.Errorf("mtu must be between 576 and 65535, got %d", p.MTU)
+	}
+	for _, dns := range p.DNS {
+		if _, err := netip.ParseAddr(dns); err != nil && !dnsSearchDomainRegex.MatchString(dns) {
+			return fmt.Errorf("invalid dns %q", dns)
+		}
+	}
+	for _, allowedIP := range p.AllowedIPs {
+		if _, err := netip.ParsePrefix(allowedIP); err != nil {
+			return fmt.Errorf("invalid allowed_ips %q", allowedIP)
+		}
+	}
+	if p.PersistentKeepalive != nil && (*p.PersistentKeepalive < 0 || *p.PersistentKeepalive > 65535) {
+		return fmt.Errorf("persistent_keepalive must be between 0 and 65535, got %d", *p.PersistentKeepalive)
+	}
+	return nil
+}
+
+// apply sets the profile settings on the config, the peer settings are set on every peer
+func (p *ConnectionProfile) apply(config *WireGuardConfig) {
+	if p.MTU != 0 {
+		config.Interface.MTU = p.MTU
+	}
+	if len(p.DNS) > 0 {
+		config.Interface.DNS = slices.Clone(p.DNS)
+	}
+	for _, peer := range config.Peers {
+		if len(p.AllowedIPs) > 0 {
+			peer.AllowedIPs = slices.Clone(p.AllowedIPs)
+		}
+		if p.PersistentKeepalive != nil {
+			peer.PersistentKeepalive = *p.PersistentKeepalive
+		}
+	}
+}
+
+// ApplyProfile rewrites the config of the connection with the settings of the named profile,
+// an active connection is restarted to apply the new config.
+// The profiles are validated with the configuration, before any is applied.
+func (m *WireGuardManager) ApplyProfile(name, profileName string) (*ApplyResult, error) {
+	profile, ok := m.config.ConnectionProfiles[profileName]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrProfileNotFound, profileName)
+	}
+	if err := m.writeProfile(name, profile); err != nil {
+		return nil, err
+	}
+	log.Printf("Applied connection profile %s to %s", profileName, name)
+	return m.restartActiveConnection(name)
+}
+
+// writeProfile rewrites the config under peersMutex, so a concurrent peer change isn't lost
+func (m *WireGuardManager) writeProfile(name string, profile ConnectionProfile) error {
+	m.peersMutex.Lock()
+	defer m.peersMutex.Unlock()
+	config, err := m.connectionConfig(name)
+	if err != nil {
+		return err
+	}
+	profile.apply(config)
+	return m.writeConfig(name, config)
+}
+
+// restartActiveConnection restarts the connection to apply its new config when it's active.
+// The state is read under operationMutex, so a connection stopped by a concurrent toggle stays stopped.
+func (m *WireGuardManager) restartActiveConnection(name string) (*ApplyResult, error) {
+	m.operationMutex.Lock()
+	defer m.operationMutex.Unlock()
+	connection, err := m.getConnection(name)
+	if err != nil {
+		return nil, err
+	}
+	if !connection.Active {
+		return &ApplyResult{}, nil
+	}
+	output, err := m.restartConnection(name)
+	if err != nil {
+		return nil, err
+	}
+	return &ApplyResult{Output: output, Restarted: true}, nil
+}
+
+// restartConnection stops and starts the connection, recording the error of the failed step.
+// The caller holds operationMutex.
+func (m *WireGuardManager) restartConnection(name string) ([]byte, error) {
+	output, err := m.stopActiveConnections([]*WireGuardConnection{{Name: name}})
+	if err == nil {
+		var startOutput []byte
+		startOutput, err = m.startConnection(&WireGuardConnection{Name: name})
+		output = append(output, startOutput...)
+	}
+	var opErr *operationError
+	if errors.As(err, &opErr) {
+		m.setLastError(opErr.connection, opErr.action, opErr.err)
+		return nil, err
+	}
+	m.clearLastErrors(name)
+	return output, nil
+}
+
+// writeConfig replaces the config file of the connection
+func (m *WireGuardManager) writeConfig(name string, config *WireGuardConfig) error {
+	if err := writeFileAtomic(m.configPath(name), config.Render()); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CookieConfig sets the attributes of the authentication cookies, for portals served
+// behind a TLS-terminating proxy or under a sub-path of another site
+type CookieConfig struct {
+	// Name of the session cookie, RememberName of the remember-me cookie.
+	// The cookies of the other profiles than the default one are suffixed with the profile name.
+	Name         string `yaml:"name"`
+	RememberName string `yaml:"remember_name"`
+	// Secure only sends the cookies over HTTPS, set it when a proxy terminates TLS
+	Secure bool `yaml:"secure"`
+	// SameSite is "strict" (default), "lax" or "none" (which requires secure)
+	SameSite string `yaml:"same_site"`
+	Domain   string `yaml:"domain"`
+	Path     string `yaml:"path"`
+}
+
+var sameSiteModes = map[string]http.SameSite{
+	"strict": http.SameSiteStrictMode,
+	"lax":    http.SameSiteLaxMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+func (c CookieConfig) validate() error {
+	for _, name := range []string{c.Name, c.RememberName} {
+		if !headerNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid cookie name %q", name)
+		}
+	}
+	if c.Name == c.RememberName {
+		return fmt.Errorf("name and remember_name must differ, got %q", c.Name)
+	}
+	sameSite, ok := sameSiteModes[c.SameSite]
+	if !ok {
+		return fmt.Errorf("same_site must be strict, lax or none, got %q", c.SameSite)
+	}
+	if sameSite == http.SameSiteNoneMode && !c.Secure {
+		return errors.New("same_site none requires secure")
+	}
+	return c.validateScope()
+}
+
+// validateScope checks the path and the domain the cookies are sent to
+func (c CookieConfig) validateScope() error {
+	if !strings.HasPrefix(c.Path, "/") || strings.ContainsAny(c.Path, "; \t") {
+		return fmt.Errorf("path must start with /, got %q", c.Path)
+	}
+	if strings.ContainsAny(c.Domain, "; \t") {
+		return fmt.Errorf("invalid domain %q", c.Domain)
+	}
+	return nil
+}
+
+// Cookie returns an authentication cookie of the configured attributes,
+// an empty value clears the cookie
+func (c CookieConfig) Cookie(name, value string, expires time.Time) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     c.Path,
+		Domain:   c.Domain,
+		Expires:  expires,
+		Secure:   c.Secure,
+		HttpOnly: true,
+		SameSite: sameSiteModes[c.SameSite],
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Device is the state of an up WireGuard interface
+type Device struct {
+	Name       string
+	PublicKey  string
+	ListenPort int
+	// FwMark is the firewall mark of the packets of the interface, 0 when it's off
+	FwMark uint32
+	// Namespace is the network namespace of the interface, empty for the namespace of the portal
+	Namespace string
+	Peers     []*Peer
+}
+
+// Peer is the state of a peer of a WireGuard interface
+type Peer struct {
+	PublicKey  string
+	Endpoint   string
+	AllowedIPs []string
+	// LatestHandshake is zero until the first handshake
+	LatestHandshake time.Time
+	ReceiveBytes    uint64
+	TransmitBytes   uint64
+	// PersistentKeepalive is the keepalive interval in seconds, 0 when it's off
+	PersistentKeepalive int
+}
+
+// DeviceReader reads the state of the up WireGuard interfaces
+type DeviceReader interface {
+	Devices() ([]*Device, error)
+}
+
+// newDeviceReader returns the reader of the UAPI sockets when their directory is set, the netlink
+// reader of the kernel interfaces when the privileged commands run without sudo on Linux, wg otherwise
+func newDeviceReader(config *Config, runner CommandRunner) DeviceReader {
+	if config.UAPISocketDir != "" {
+		return uapiReader{socketDir: config.UAPISocketDir}
+	}
+	dump := wgDumpReader{runner: runner, namespaces: config.namespaces()}
+	// The userspace implementations aren't kernel interfaces, only wg reads their sockets
+	if config.UserspaceImplementation == "" && config.kernelNetlink() {
+		return netlinkReader{dump: dump}
+	}
+	return dump
+}
+
+// netlinkReader reads the kernel interfaces of the namespace of the portal over generic netlink,
+// without running wg, and the interfaces of the network namespaces of the connections with wg
+type netlinkReader struct {
+	dump wgDumpReader
+}
+
+func (r netlinkReader) Devices() ([]*Device, error) {
+	devices, err := readNetlinkDevices()
+	if err != nil {
+		log.Printf("Failed to read the interfaces over netlink, running wg: %v", err)
+		return r.dump.Devices()
+	}
+	return r.dump.appendNamespaces(devices), nil
+}
+
+// wgDumpReader reads the interfaces from `wg show all dump`, the tab separated output
+// of wg meant for scripts, instead of the text meant for humans.
+// It runs wg with sudo unless privilege_mode drops it.
+type wgDumpReader struct {
+	runner CommandRunner
+	// namespaces are the network namespaces of the connections, read after the namespace of the portal
+	namespaces []string
+}
+
+func (r wgDumpReader) Devices() ([]*Device, error) {
+	devices, err := r.namespaceDevices("")
+	if err != nil {
+		return nil, err
+	}
+	return r.appendNamespaces(devices), nil
+}
+
+// appendNamespaces appends the interfaces of the network namespaces of the connections
+func (r wgDumpReader) appendNamespaces(devices []*Device) []*Device {
+	for _, namespace := range r.namespaces {
+		// A missing namespace only hides its connections
+		namespaceDevices, err := r.namespaceDevices(namespace)
+		if err != nil {
+			log.Printf("Failed to read the interfaces of network namespace %s: %v", namespace, err)
+			continue
+		}
+		devices = append(devices, namespaceDevices...)
+	}
+	return devices
+}
+
+// namespaceDevices reads the interfaces of the network namespace
+func (r wgDumpReader) namespaceDevices(namespace string) ([]*Device, error) {
+	args := namespacedCommand(namespace, []string{"sudo", "wg", "show", "all", "dump"})
+	output, err := r.runner.Output(args[0], args[1:]...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute wg show: %w", err)
+	}
+	devices, err := parseDump(string(output))
+	for _, device := range devices {
+		device.Namespace = namespace
+	}
+	return devices, err
+}
+
+// parseDump parses the output of `wg show all dump`, a line per interface
+// "<interface> <private-key> <public-key> <listen-port> <fwmark>" followed by a line per peer
+// "<interface> <public-key> <preshared-key> <endpoint> <allowed-ips> <latest-handshake> <rx> <tx> <keepalive>"
+func parseDump(output string) ([]*Device, error) {
+	var devices []*Device
+	for line := range strings.SplitSeq(strings.TrimSpace(output), "\n") {
+		fields := strings.Split(line, "\t")
+		switch {
+		case line == "":
+		case len(fields) == 5:
+			listenPort, _ := strconv.Atoi(fields[3])
+			fwMark, _ := strconv.ParseUint(fields[4], 0, 32)
+			devices = append(devices, &Device{
+				Name: fields[0], PublicKey: fields[2], ListenPort: listenPort, FwMark: uint32(fwMark),
+			})
+		case len(fields) == 9 && len(devices) > 0 && devices[len(devices)-1].Name == fields[0]:
+			peer, err := parseDumpPeer(fields)
+			if err != nil {
+				return nil, err
+			}
+			device := devices[len(devices)-1]
+			device.Peers = append(device.Peers, peer)
+		default:
+			return nil, fmt.Errorf("unexpected wg dump line with %d fields", len(fields))
+		}
+	}
+	return devices, nil
+}
+
+func parseDumpPeer(fields []string) (*Peer, error) {
+	handshake, errHandshake := strconv.ParseInt(fields[5], 10, 64)
+	received, errReceived := strconv.ParseUint(fields[6], 10, 64)
+	sent, errSent := strconv.ParseUint(fields[7], 10, 64)
+	if errHandshake != nil || errReceived != nil || errSent != nil {
+		return nil, fmt.Errorf("invalid wg dump peer of %s", fields[0])
+	}
+	peer := &Peer{PublicKey: fields[1], ReceiveBytes: received, TransmitBytes: sent}
+	if fields[3] != "(none)" {
+		peer.Endpoint = fields[3]
+	}
+	if fields[4] != "(none)" {
+		peer.AllowedIPs = strings.Split(fields[4], ",")
+	}
+	if handshake > 0 {
+		peer.LatestHandshake = time.Unix(handshake, 0)
+	}
+	if fields[8] != "off" {
+		peer.PersistentKeepalive, _ = strconv.Atoi(fields[8])
+	}
+	return peer, nil
+}
+
+// transfer returns the bytes received and sent by all the peers of the device
+func (d *Device) transfer() transferSample {
+	var sample transferSample
+	for _, peer := range d.Peers {
+		sample.received += peer.ReceiveBytes
+		sample.sent += peer.TransmitBytes
+	}
+	return sample
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"log"
+	"net/netip"
+
+	"github.com/samber/lo"
+)
+
+// RouteConflict is a pair of connections routing overlapping AllowedIPs,
+// active together their routes would contend for the same traffic
+type RouteConflict struct {
+	Connection      string `json:"connection"`
+	CIDR            string `json:"cidr"`
+	OtherConnection string `json:"other_connection"`
+	OtherCIDR       string `json:"other_cidr"`
+}
+
+// connectionRoutes are the AllowedIPs routed by a connection
+type connectionRoutes struct {
+	name     string
+	prefixes []netip.Prefix
+}
+
+// FindRouteConflicts reports overlapping AllowedIPs across connections,
+// only considering the active connections when activeOnly is set
+func (m *WireGuardManager) FindRouteConflicts(activeOnly bool) ([]*RouteConflict, error) {
+	connections, err := m.GetConnections()
+	if err != nil {
+		return nil, err
+	}
+	if activeOnly {
+		connections = lo.Filter(connections, func(c *WireGuardConnection, _ int) bool {
+			return c.Active
+		})
+	}
+
+	routes := make([]*connectionRoutes, 0, len(connections))
+	for _, connection := range connections {
+		config, err := ParseConfig(m.configPath(connection.Name))
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, &connectionRoutes{name: connection.Name, prefixes: config.allowedPrefixes()})
+	}
+
+	conflicts := []*RouteConflict{}
+	for i, route := range routes {
+		for _, other := range routes[i+1:] {
+			conflicts = append(conflicts, route.conflictsWith(other)...)
+		}
+	}
+	return conflicts, nil
+}
+
+// allowedPrefixes returns the AllowedIPs of all peers, skipping invalid entries
+func (c *WireGuardConfig) allowedPrefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, peer := range c.Peers {
+		for _, allowedIP := range peer.AllowedIPs {
+			prefix, err := netip.ParsePrefix(allowedIP)
+			if err != nil {
+				log.Printf("Skipping invalid AllowedIPs %s: %v", allowedIP, err)
+				continue
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+	return prefixes
+}
+
+func (r *connectionRoutes) conflictsWith(other *connectionRoutes) []*RouteConflict {
+	var conflicts []*RouteConflict
+	for _, prefix := range r.prefixes {
+		for _, otherPrefix := range other.prefixes {
+			if prefix.Overlaps(otherPrefix) {
+				conflicts = append(conflicts, &RouteConflict{
+					Connection:      r.name,
+					CIDR:            prefix.String(),
+					OtherConnection: other.name,
+					OtherCIDR:       otherPrefix.String(),
+				})
+			}
+		}
+	}
+	return conflicts
+}
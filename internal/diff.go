@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines around the changes of the unified diffs
+const diffContext = 3
+
+// diffOp is a line of an edit script, kept, removed or added
+type diffOp struct {
+	// kind is ' ' for a kept line, '-' for a removed line and '+' for an added line
+	kind byte
+	line string
+}
+
+// UnifiedDiff returns the unified diff of the texts, empty when they're the same
+func UnifiedDiff(fromName, toName, from, to string) string {
+	ops := diffLines(splitLines(from), splitLines(to))
+	if !slices.ContainsFunc(ops, func(op diffOp) bool { return op.kind != ' ' }) {
+		return ""
+	}
+	// The line numbers of the texts before each line of the edit script
+	fromLines, toLines := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		fromLines[i+1], toLines[i+1] = fromLines[i], toLines[i]
+		if op.kind != '+' {
+			fromLines[i+1]++
+		}
+		if op.kind != '-' {
+			toLines[i+1]++
+		}
+	}
+	var diff strings.Builder
+	fmt.Fprintf(&diff, "--- %s\n+++ %s\n", fromName, toName)
+	for start := 0; start < len(ops); {
+		if ops[start].kind == ' ' {
+			start++
+			continue
+		}
+		end := hunkEnd(ops, start)
+		first := max(start-diffContext, 0)
+		fmt.Fprintf(&diff, "@@ -%s +%s @@\n", hunkRange(fromLines[first], fromLines[end]),
+			hunkRange(toLines[first], toLines[end]))
+		for _, op := range ops[first:end] {
+			diff.WriteByte(op.kind)
+			diff.WriteString(op.line)
+			diff.WriteByte('\n')
+		}
+		start = end
+	}
+	return diff.String()
+}
+
+// hunkEnd returns the end of the hunk of the change at start, merging the following changes
+// closer than twice the context, followed by the context of its last change
+func hunkEnd(ops []diffOp, start int) int {
+	last := start
+	for i := start; i < len(ops) && i-last <= 2*diffContext; i++ {
+		if ops[i].kind != ' ' {
+			last = i
+		}
+	}
+	return min(last+diffContext+1, len(ops))
+}
+
+// hunkRange returns the range of a hunk header from the lines before the hunk and before its end,
+// a range without lines starts at the line before it
+func hunkRange(before, end int) string {
+	if end == before {
+		return fmt.Sprintf("%d,0", before)
+	}
+	return fmt.Sprintf("%d,%d", before+1, end-before)
+}
+
+// splitLines returns the lines of the text, without their line ends
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffLines returns the shortest edit script turning the lines a into the lines b,
+// with the Myers algorithm
+func diffLines(a, b []string) []diffOp {
+	offset := len(a) + len(b) + 1
+	// furthest holds the furthest line of a reached on each diagonal k = x - y
+	furthest := make([]int, 2*offset+1)
+	var trace [][]int
+	for d := 0; d < offset; d++ {
+		trace = append(trace, slices.Clone(furthest))
+		for k := -d; k <= d; k += 2 {
+			x := furthest[offset+k-1] + 1
+			if k == -d || (k != d && furthest[offset+k-1] < furthest[offset+k+1]) {
+				x = furthest[offset+k+1]
+			}
+			y := x - k
+			for x < len(a) && y < len(b) && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			furthest[offset+k] = x
+			if x >= len(a) && y >= len(b) {
+				return backtrackDiff(trace, a, b, offset)
+			}
+		}
+	}
+	return nil
+}
+
+// backtrackDiff follows the furthest lines of each step of diffLines back from the ends of the lines
+func backtrackDiff(trace [][]int, a, b []string, offset int) []diffOp {
+	var ops []diffOp
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		furthest := trace[d]
+		k := x - y
+		previousK := k - 1
+		if k == -d || (k != d && furthest[offset+k-1] < furthest[offset+k+1]) {
+			previousK = k + 1
+		}
+		previousX := furthest[offset+previousK]
+		previousY := previousX - previousK
+		for x > previousX && y > previousY {
+			ops = append(ops, diffOp{kind: ' ', line: a[x-1]})
+			x, y = x-1, y-1
+		}
+		switch {
+		case d == 0:
+		case x == previousX:
+			ops = append(ops, diffOp{kind: '+', line: b[y-1]})
+		default:
+			ops = append(ops, diffOp{kind: '-', line: a[x-1]})
+		}
+		x, y = previousX, previousY
+	}
+	slices.Reverse(ops)
+	return ops
+}
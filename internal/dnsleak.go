@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// dnsLeakTestName resolves to the address the querying resolver reached the authoritative servers from
+	dnsLeakTestName = "whoami.akamai.net"
+	dnsLeakTimeout  = 5 * time.Second
+	resolvConfPath  = "/etc/resolv.conf"
+)
+
+// Sources of the checked resolvers, besides the connections
+const (
+	ResolverSourceHost   = "resolv.conf"
+	ResolverSourceSystem = "system"
+)
+
+// ErrNoActiveConnection is returned by the checks requiring an active connection
+var ErrNoActiveConnection = errors.New("no active connection")
+
+// routeDeviceRegex matches the interface of the route of ip route get
+var routeDeviceRegex = regexp.MustCompile(`\bdev (\S+)`)
+
+// DNSLeakResult is the outcome of a DNS leak test
+type DNSLeakResult struct {
+	// Connections are the active connections
+	Connections []string         `json:"connections"`
+	Resolvers   []*ResolverCheck `json:"resolvers"`
+	// System is the resolution by the resolver of the host, as the applications resolve
+	System *ResolverCheck `json:"system"`
+	// Leaking reports whether a resolver routed outside of the tunnels answered. The local stub
+	// resolvers, like systemd-resolved, forward to other resolvers and aren't taken into account.
+	Leaking bool      `json:"leaking"`
+	Time    time.Time `json:"time"`
+}
+
+// ResolverCheck is the resolution of the test name by a resolver
+type ResolverCheck struct {
+	Address string `json:"address,omitempty"`
+	// Source is resolv.conf for the resolvers of the host, the connection for its DNS servers
+	// and system for the resolver of the host
+	Source string `json:"source"`
+	// Interface routes the queries to the resolver
+	Interface     string `json:"interface,omitempty"`
+	ThroughTunnel bool   `json:"through_tunnel"`
+	Local         bool   `json:"local"`
+	Answered      bool   `json:"answered"`
+	// EgressAddresses are the addresses the resolver reached the authoritative servers from
+	EgressAddresses []string `json:"egress_addresses,omitempty"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// TestDNSLeak resolves the test name through the resolvers of the host and the DNS servers of
+// the active connections, reporting the interface routing each resolver and which answered.
+// The DNS servers of the connections which aren't granted are checked without their source.
+func (m *WireGuardManager) TestDNSLeak(grants ConnectionGrants) (*DNSLeakResult, error) {
+	status, err := m.GetStatus(nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(status) == 0 {
+		return nil, ErrNoActiveConnection
+	}
+	result := &DNSLeakResult{Connections: []string{}, Time: time.Now()}
+	tunnels := make([]string, 0, len(status))
+	for _, connection := range status {
+		tunnels = append(tunnels, connection.Name)
+		if grants.Allows(connection.Name) {
+			result.Connections = append(result.Connections, connection.Name)
+		}
+	}
+	result.Resolvers = m.dnsResolvers(tunnels, grants)
+
+	var wg sync.WaitGroup
+	for _, resolver := range result.Resolvers {
+		wg.Go(func() { m.checkResolver(resolver, tunnels) })
+	}
+	result.System = &ResolverCheck{Source: ResolverSourceSystem}
+	wg.Go(func() { resolveEgress(result.System, net.DefaultResolver) })
+	wg.Wait()
+
+	result.Leaking = slices.ContainsFunc(result.Resolvers, func(resolver *ResolverCheck) bool {
+		return resolver.Answered && !resolver.Local && !resolver.ThroughTunnel
+	})
+	return result, nil
+}
+
+// dnsResolvers returns the resolvers of the host and the DNS servers of the active connections
+func (m *WireGuardManager) dnsResolvers(tunnels []string, grants ConnectionGrants) []*ResolverCheck {
+	var resolvers []*ResolverCheck
+	add := func(address, source string) {
+		if !slices.ContainsFunc(resolvers, func(r *ResolverCheck) bool { return r.Address == address }) {
+			resolvers = append(resolvers, &ResolverCheck{Address: address, Source: source})
+		}
+	}
+	for _, address := range hostResolvers() {
+		add(address, ResolverSourceHost)
+	}
+	for _, name := range tunnels {
+		config, err := ParseConfig(m.configPath(name))
+		if err != nil {
+			continue
+		}
+		source := ""
+		if grants.Allows(name) {
+			source = name
+		}
+		for _, dns := range config.Interface.DNS {
+			if _, err := netip.ParseAddr(dns); err == nil {
+				add(dns, source)
+			}
+		}
+	}
+	return resolvers
+}
+
+// hostResolvers returns the nameservers of resolv.conf
+func hostResolvers() []string {
+	file, err := os.Open(resolvConfPath)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	var resolvers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if _, err := netip.ParseAddr(fields[1]); err == nil {
+			resolvers = append(resolvers, fields[1])
+		}
+	}
+	return resolvers
+}
+
+// checkResolver finds the interface routing the resolver and resolves the test name through it
+func (m *WireGuardManager) checkResolver(resolver *ResolverCheck, tunnels []string) {
+	address, _ := netip.ParseAddr(resolver.Address)
+	resolver.Local = address.IsLoopback()
+	if !resolver.Local {
+		output, err := m.runner.Output("ip", "route", "get", resolver.Address)
+		if match := routeDeviceRegex.FindSubmatch(output); err == nil && match != nil {
+			resolver.Interface = string(match[1])
+			resolver.ThroughTunnel = slices.Contains(tunnels, resolver.Interface)
+		}
+	}
+	resolveEgress(resolver, &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, net.JoinHostPort(resolver.Address, "53"))
+		},
+	})
+}
+
+// resolveEgress resolves the test name, its addresses are those of the resolver's egress
+func resolveEgress(check *ResolverCheck, resolver *net.Resolver) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLeakTimeout)
+	defer cancel()
+	addresses, err := resolver.LookupHost(ctx, dnsLeakTestName)
+	// The errors of the lookups name the first resolver of the host, whichever resolver was dialed
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		check.Error = dnsErr.Err
+		return
+	}
+	if err != nil {
+		check.Error = err.Error()
+		return
+	}
+	check.Answered, check.EgressAddresses = true, addresses
+}
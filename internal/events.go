@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"crypto/rand"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Connection event types
+const (
+	EventConnectionUp   = "up"
+	EventConnectionDown = "down"
+)
+
+// Event is a connection state change
+type Event struct {
+	ID         uint64    `json:"id"`
+	Type       string    `json:"type"`
+	Connection string    `json:"connection"`
+	Time       time.Time `json:"time"`
+}
+
+// EventLog keeps the most recent connection events, up to its size
+type EventLog struct {
+	events []*Event
+	size   int
+	lastID uint64
+	// epoch is random per process, the IDs restarting at 1 after a restart
+	// don't repeat the ETags and the JSON Feed item IDs of the previous run
+	epoch string
+	mutex sync.Mutex
+}
+
+func NewEventLog(size int) *EventLog {
+	return &EventLog{size: size, epoch: rand.Text()}
+}
+
+// Record appends an event, dropping the oldest one when the log is full
+func (l *EventLog) Record(eventType, connection string) {
+	if l.size <= 0 {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.record(eventType, connection)
+}
+
+// RecordChange records an event unless it's the last recorded event of the connection,
+// like a change already recorded by the portal observed again by the status poller
+func (l *EventLog) RecordChange(eventType, connection string) {
+	if l.size <= 0 {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, event := range slices.Backward(l.events) {
+		if event.Connection == connection {
+			if event.Type == eventType {
+				return
+			}
+			break
+		}
+	}
+	l.record(eventType, connection)
+}
+
+// record appends an event, it must be called holding the mutex
+func (l *EventLog) record(eventType, connection string) {
+	l.lastID++
+	l.events = append(l.events, &Event{
+		ID:         l.lastID,
+		Type:       eventType,
+		Connection: connection,
+		Time:       time.Now(),
+	})
+	if len(l.events) > l.size {
+		l.events = l.events[len(l.events)-l.size:]
+	}
+}
+
+// Events returns the recorded events newest first, and the ETag identifying them
+// which changes with every recorded event
+func (l *EventLog) Events() ([]*Event, string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	events := slices.Clone(l.events)
+	slices.Reverse(events)
+	return events, strconv.Quote(l.itemID(l.lastID))
+}
+
+// JSONFeed is the event log as a JSON Feed (https://jsonfeed.org/version/1.1)
+type JSONFeed struct {
+	Version string          `json:"version"`
+	Title   string          `json:"title"`
+	Items   []*JSONFeedItem `json:"items"`
+}
+
+// JSONFeedItem is an event of the JSON Feed, the _event extension holds the structured event
+type JSONFeedItem struct {
+	ID            string    `json:"id"`
+	Title         string    `json:"title"`
+	ContentText   string    `json:"content_text"`
+	DatePublished time.Time `json:"date_published"`
+	Event         *Event    `json:"_event"`
+}
+
+// JSONFeed returns the recorded events as a JSON Feed newest first, and its ETag
+func (l *EventLog) JSONFeed() (*JSONFeed, string) {
+	events, etag := l.Events()
+	feed := &JSONFeed{
+		Version: "https://jsonfeed.org/version/1.1",
+		Title:   "WireGuard Gateway Portal events",
+		Items:   []*JSONFeedItem{},
+	}
+	for _, event := range events {
+		feed.Items = append(feed.Items, &JSONFeedItem{
+			ID:            l.itemID(event.ID),
+			Title:         fmt.Sprintf("%s %s", event.Connection, event.Type),
+			ContentText:   fmt.Sprintf("Connection %s went %s", event.Connection, event.Type),
+			DatePublished: event.Time,
+			Event:         event,
+		})
+	}
+	return feed, etag
+}
+
+// itemID returns the ID of the event unique across the restarts
+func (l *EventLog) itemID(id uint64) string {
+	return l.epoch + "-" + strconv.FormatUint(id, 10)
+}
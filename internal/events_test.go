@@ -0,0 +1,18 @@
+package internal
+
+import "testing"
+
+func TestEventLogIDsDontRepeatAcrossRestarts(t *testing.T) {
+	before, after := NewEventLog(10), NewEventLog(10)
+	before.Record(EventConnectionUp, "wg0")
+	after.Record(EventConnectionUp, "wg0")
+
+	beforeFeed, beforeETag := before.JSONFeed()
+	afterFeed, afterETag := after.JSONFeed()
+	if beforeETag == afterETag {
+		t.Fatalf("ETag %s repeated after the restart", afterETag)
+	}
+	if beforeFeed.Items[0].ID == afterFeed.Items[0].ID {
+		t.Fatalf("item ID %s repeated after the restart", afterFeed.Items[0].ID)
+	}
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exitIPResponseLimit is the size read from the responses of the exit IP and GeoIP services
+const exitIPResponseLimit = 256
+
+// ExitIPConfig checks the public address of the host after a connection is started
+type ExitIPConfig struct {
+	// URL answers the address of the requests as plain text, like https://api.ipify.org
+	// (empty disables the check)
+	URL string `yaml:"url"`
+	// GeoIPURL answers the country code of the address as plain text, {ip} is replaced by
+	// the address, like https://ipinfo.io/{ip}/country (optional)
+	GeoIPURL       string `yaml:"geoip_url"`
+	TimeoutSeconds int    `yaml:"timeout_seconds"`
+}
+
+func (c ExitIPConfig) validate() error {
+	if c.URL == "" {
+		return nil
+	}
+	for _, serviceURL := range []string{c.URL, c.GeoIPURL} {
+		if serviceURL == "" {
+			continue
+		}
+		parsed, err := url.Parse(strings.ReplaceAll(serviceURL, "{ip}", "0.0.0.0"))
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("invalid service URL %q", serviceURL)
+		}
+	}
+	if c.TimeoutSeconds <= 0 {
+		return errors.New("timeout_seconds must be positive")
+	}
+	return nil
+}
+
+// ExitIP is the public address of the host after a connection was started
+type ExitIP struct {
+	// Connection is the started connection, empty for the checks after the connections were stopped
+	Connection string `json:"connection,omitempty"`
+	Address    string `json:"address,omitempty"`
+	Country    string `json:"country,omitempty"`
+	// Previous is the address of the previous check, Changed is unset without a previous address
+	Previous string    `json:"previous,omitempty"`
+	Changed  *bool     `json:"changed,omitempty"`
+	Checked  time.Time `json:"checked"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// exitIPTracker keeps the latest exit IP check
+type exitIPTracker struct {
+	latest *ExitIP
+	mutex  sync.Mutex
+}
+
+func newExitIPTracker() *exitIPTracker {
+	return &exitIPTracker{}
+}
+
+// get returns the latest check when it was through the connection
+func (t *exitIPTracker) get(name string) *ExitIP {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.latest == nil || t.latest.Connection != name {
+		return nil
+	}
+	exitIP := *t.latest
+	return &exitIP
+}
+
+// record keeps the check, comparing its address to the address of the previous check
+func (t *exitIPTracker) record(exitIP *ExitIP) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.latest != nil && t.latest.Address != "" && exitIP.Address != "" {
+		changed := exitIP.Address != t.latest.Address
+		exitIP.Previous, exitIP.Changed = t.latest.Address, &changed
+	}
+	if exitIP.Address != "" || t.latest == nil {
+		t.latest = exitIP
+	}
+}
+
+// CheckExitIP fetches the public address of the host, with the routes of the host so through
+// the tunnel routing all the traffic, and the country of the address when a GeoIP service is
+// set. It returns nil when the check is disabled.
+func (m *WireGuardManager) CheckExitIP(connection string) *ExitIP {
+	config := m.config.ExitIP
+	if config.URL == "" {
+		return nil
+	}
+	timeout := time.Duration(config.TimeoutSeconds) * time.Second
+	// New connections, the kept alive ones may have been routed outside of the tunnel
+	client := &http.Client{Timeout: timeout, Transport: &http.Transport{DisableKeepAlives: true}}
+	exitIP := &ExitIP{Connection: connection, Checked: time.Now()}
+	address, err := fetchText(client, config.URL)
+	if _, parseErr := netip.ParseAddr(address); err == nil && parseErr != nil {
+		err = fmt.Errorf("invalid address %q", address)
+	}
+	if err != nil {
+		exitIP.Error = fmt.Sprintf("failed to get the exit IP: %v", err)
+	} else {
+		exitIP.Address = address
+		exitIP.Country, exitIP.Error = lookupCountry(client, config.GeoIPURL, address)
+	}
+	m.exitIP.record(exitIP)
+	return exitIP
+}
+
+// lookupCountry returns the country code of the address, or the error of the lookup
+func lookupCountry(client *http.Client, geoIPURL, address string) (string, string) {
+	if geoIPURL == "" {
+		return "", ""
+	}
+	country, err := fetchText(client, strings.ReplaceAll(geoIPURL, "{ip}", address))
+	country = strings.ToUpper(country)
+	if err == nil && !countryRegex.MatchString(country) {
+		err = fmt.Errorf("invalid country code %q", country)
+	}
+	if err != nil {
+		return "", fmt.Sprintf("failed to get the country: %v", err)
+	}
+	return country, ""
+}
+
+// fetchText returns the trimmed plain text response of the service
+func fetchText(client *http.Client, serviceURL string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), client.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, serviceURL, nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", request.URL.Host, response.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, exitIPResponseLimit))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
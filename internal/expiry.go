@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// peerExpiryInterval is the interval between the removals of the expired peers from the interfaces
+const peerExpiryInterval = 30 * time.Second
+
+// PeerExpiration is the removal of an expired peer from the interface of its connection
+type PeerExpiration struct {
+	Connection string    `json:"connection"`
+	PublicKey  string    `json:"public_key"`
+	ID         string    `json:"id"`
+	Expires    time.Time `json:"expires"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// PeerExpiryStore holds the expiry times of the peers of the connections of the profile,
+// persisted in the state directory
+type PeerExpiryStore struct {
+	path string
+	// expiries are the expiry times by connection and public key
+	expiries map[string]map[string]time.Time
+	mutex    sync.RWMutex
+}
+
+func NewPeerExpiryStore(profile string, config *Config) (*PeerExpiryStore, error) {
+	store := &PeerExpiryStore{
+		path:     filepath.Join(config.StateDir, profileStateFile("peer-expiry", ".json", profile)),
+		expiries: make(map[string]map[string]time.Time),
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Get returns the expiry time of the peer of the connection, nil when it doesn't expire
+func (s *PeerExpiryStore) Get(connection, publicKey string) *time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	expires, ok := s.expiries[connection][publicKey]
+	if !ok {
+		return nil
+	}
+	return &expires
+}
+
+// Expired reports whether the peer of the connection expired at the time
+func (s *PeerExpiryStore) Expired(connection, publicKey string, now time.Time) bool {
+	expires := s.Get(connection, publicKey)
+	return expires != nil && !now.Before(*expires)
+}
+
+// Set sets the expiry time of the peer of the connection, nil removes it
+func (s *PeerExpiryStore) Set(connection, publicKey string, expires *time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous := maps.Clone(s.expiries[connection])
+	peers := maps.Clone(previous)
+	if peers == nil {
+		peers = make(map[string]time.Time)
+	}
+	if expires == nil {
+		if _, ok := peers[publicKey]; !ok {
+			return nil
+		}
+		delete(peers, publicKey)
+	} else {
+		peers[publicKey] = expires.UTC()
+	}
+	s.setPeers(connection, peers)
+	return s.save(func() { s.setPeers(connection, previous) })
+}
+
+// setPeers replaces the expiry times of the connection, the connections without any aren't kept
+func (s *PeerExpiryStore) setPeers(connection string, peers map[string]time.Time) {
+	if len(peers) == 0 {
+		delete(s.expiries, connection)
+	} else {
+		s.expiries[connection] = peers
+	}
+}
+
+// RenameConnection moves the expiry times of the renamed connection to its new name
+func (s *PeerExpiryStore) RenameConnection(name, newName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	peers, ok := s.expiries[name]
+	if !ok {
+		return nil
+	}
+	previous := s.expiries[newName]
+	s.expiries[newName] = peers
+	delete(s.expiries, name)
+	return s.save(func() {
+		s.expiries[name] = peers
+		s.setPeers(newName, previous)
+	})
+}
+
+// DeleteConnection removes the expiry times of the deleted connection
+func (s *PeerExpiryStore) DeleteConnection(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	peers, ok := s.expiries[name]
+	if !ok {
+		return nil
+	}
+	delete(s.expiries, name)
+	return s.save(func() { s.expiries[name] = peers })
+}
+
+func (s *PeerExpiryStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read peer expiry: %w", err)
+	}
+	var expiries map[string]map[string]time.Time
+	if err := json.Unmarshal(data, &expiries); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", s.path, err)
+	}
+	maps.Copy(s.expiries, expiries)
+	return nil
+}
+
+// save persists the expiry times, it must be called holding the mutex.
+// The change is reverted with undo when it can't be persisted.
+func (s *PeerExpiryStore) save(undo func()) error {
+	data, err := json.MarshalIndent(s.expiries, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		undo()
+		return fmt.Errorf("failed to save peer expiry: %w", err)
+	}
+	return nil
+}
+
+// SetPeerExpiry sets the expiry time of the peer, nil removes it. The peer stays in the
+// connection config, the expired peers are removed from the interface of the active connection
+// and the peers which don't expire anymore are synced back.
+func (m *WireGuardManager) SetPeerExpiry(name, publicKey string, expires *time.Time) (*PeerResult, error) {
+	m.peersMutex.Lock()
+	defer m.peersMutex.Unlock()
+	connection, err := m.getConnection(name)
+	if err != nil {
+		return nil, err
+	}
+	config, err := m.connectionConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := findPeer(config, publicKey); err != nil {
+		return nil, err
+	}
+	if err := m.expiries.Set(name, publicKey, expires); err != nil {
+		return nil, err
+	}
+	log.Printf("Changed the expiry of a peer of %s", name)
+	if !connection.Active {
+		return &PeerResult{PublicKey: publicKey}, nil
+	}
+	output, err := m.syncPeers(name, config)
+	if err != nil {
+		m.setLastError(name, "sync", err)
+		return nil, err
+	}
+	return &PeerResult{PublicKey: publicKey, Output: output, Applied: true}, nil
+}
+
+// StartExpiryReaper periodically removes the expired peers from the interfaces of the active
+// connections, which wg-quick adds back when it starts them
+func (m *WireGuardManager) StartExpiryReaper(onExpire func(expiration *PeerExpiration)) {
+	go func() {
+		ticker := time.NewTicker(peerExpiryInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			for _, expiration := range m.reapExpiredPeers(now) {
+				onExpire(expiration)
+			}
+		}
+	}()
+}
+
+// reapExpiredPeers removes the expired peers from the interfaces
+func (m *WireGuardManager) reapExpiredPeers(now time.Time) []*PeerExpiration {
+	devices, err := m.readDevices()
+	if err != nil {
+		log.Printf("Failed to read the interfaces for the expired peers: %v", err)
+		return nil
+	}
+	var expirations []*PeerExpiration
+	for _, device := range devices {
+		for _, peer := range device.Peers {
+			expires := m.expiries.Get(device.Name, peer.PublicKey)
+			if expires == nil || now.Before(*expires) {
+				continue
+			}
+			expiration := &PeerExpiration{
+				Connection: device.Name, PublicKey: peer.PublicKey, ID: PeerID(peer.PublicKey), Expires: *expires,
+			}
+			output, err := m.combinedOutputIn(device.Name, "sudo", "wg", "set", device.Name, "peer", peer.PublicKey, "remove")
+			if err != nil {
+				expiration.Error = commandError(err, output).Error()
+				log.Printf("Failed to remove the expired peer %s from %s: %s", expiration.ID, device.Name, expiration.Error)
+			} else {
+				log.Printf("Removed the expired peer %s from %s", expiration.ID, device.Name)
+			}
+			expirations = append(expirations, expiration)
+		}
+	}
+	return expirations
+}
+
+// moveExpiry moves the expiry time of the peer whose public key changed
+func (m *WireGuardManager) moveExpiry(name, publicKey, newPublicKey string) error {
+	expires := m.expiries.Get(name, publicKey)
+	if expires == nil {
+		return nil
+	}
+	if err := m.expiries.Set(name, newPublicKey, expires); err != nil {
+		return err
+	}
+	return m.expiries.Set(name, publicKey, nil)
+}
+
+// activePeers returns the config with the peers which haven't expired, for the interface
+func (m *WireGuardManager) activePeers(name string, config *WireGuardConfig) *WireGuardConfig {
+	now := time.Now()
+	active := *config
+	active.Peers = slices.DeleteFunc(slices.Clone(config.Peers), func(peer *PeerConfig) bool {
+		return m.expiries.Expired(name, peer.PublicKey, now)
+	})
+	return &active
+}
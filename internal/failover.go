@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// FailoverConfig switches to the next connection of the list when the active one is unhealthy
+type FailoverConfig struct {
+	// Connections are the connections in failover order, failover is disabled with less than 2
+	Connections []string `yaml:"connections"`
+	// CheckIntervalSeconds is the interval between the checks of the active connection
+	CheckIntervalSeconds int `yaml:"check_interval_seconds"`
+	// HandshakeTimeoutSeconds is the age of the latest handshake making the connection unhealthy
+	HandshakeTimeoutSeconds int `yaml:"handshake_timeout_seconds"`
+	// UnhealthySeconds is how long the active connection is unhealthy before the switch
+	UnhealthySeconds int `yaml:"unhealthy_seconds"`
+}
+
+// Enabled reports whether there are connections to fail over between
+func (c FailoverConfig) Enabled() bool {
+	return len(c.Connections) >= 2
+}
+
+func (c FailoverConfig) validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	for i, name := range c.Connections {
+		if !connectionNameRegex.MatchString(name) {
+			return fmt.Errorf("%q is not a connection name", name)
+		}
+		if slices.Contains(c.Connections[:i], name) {
+			return fmt.Errorf("connection %s is listed twice", name)
+		}
+	}
+	if c.CheckIntervalSeconds <= 0 || c.HandshakeTimeoutSeconds <= 0 {
+		return errors.New("check_interval_seconds and handshake_timeout_seconds must be positive")
+	}
+	if c.UnhealthySeconds < 0 {
+		return errors.New("unhealthy_seconds must not be negative")
+	}
+	return nil
+}
+
+// FailoverEvent is a switch from an unhealthy connection to the next one
+type FailoverEvent struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// FailoverState is the failover controller as reported by the API
+type FailoverState struct {
+	Enabled     bool     `json:"enabled"`
+	Connections []string `json:"connections"`
+	// Unhealthy is the active connection currently unhealthy, if any
+	Unhealthy *UnhealthyConnection `json:"unhealthy,omitempty"`
+	LastEvent *FailoverEvent       `json:"last_event,omitempty"`
+}
+
+// UnhealthyConnection is an active connection unhealthy since Since
+type UnhealthyConnection struct {
+	Connection string    `json:"connection"`
+	Reason     string    `json:"reason"`
+	Since      time.Time `json:"since"`
+}
+
+// FailoverController watches the active connection of the failover list, and switches to
+// the next one with a reachable endpoint once it lost its handshakes or its endpoint is
+// unreachable for the unhealthy duration. Like all the automated connection management,
+// it pauses during the maintenance windows and in read-only mode.
+type FailoverController struct {
+	config      FailoverConfig
+	manager     *WireGuardManager
+	maintenance *MaintenanceWindow
+	readOnly    *ReadOnlyMode
+
+	unhealthy *UnhealthyConnection
+	lastEvent *FailoverEvent
+	mutex     sync.Mutex
+}
+
+func NewFailoverController(
+	config FailoverConfig, manager *WireGuardManager, maintenance *MaintenanceWindow, readOnly *ReadOnlyMode,
+) *FailoverController {
+	return &FailoverController{config: config, manager: manager, maintenance: maintenance, readOnly: readOnly}
+}
+
+// Start checks the active connection every check interval, onFailover is called after each switch
+func (c *FailoverController) Start(onFailover func(event *FailoverEvent, result *ToggleResult)) {
+	if !c.config.Enabled() {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(c.config.CheckIntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if event, result := c.check(now); event != nil {
+				onFailover(event, result)
+			}
+		}
+	}()
+}
+
+// State returns the failover list, the unhealthy connection and the last switch
+func (c *FailoverController) State() FailoverState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	state := FailoverState{
+		Enabled:     c.config.Enabled(),
+		Connections: slices.Clone(c.config.Connections),
+		LastEvent:   c.lastEvent,
+	}
+	if c.unhealthy != nil {
+		unhealthy := *c.unhealthy
+		state.Unhealthy = &unhealthy
+	}
+	return state
+}
+
+// check switches to the next connection when the active one is unhealthy for long enough
+func (c *FailoverController) check(now time.Time) (*FailoverEvent, *ToggleResult) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.maintenance.Active() || c.readOnly.Enabled() {
+		c.unhealthy = nil
+		return nil, nil
+	}
+	status, err := c.manager.GetStatus(nil)
+	if err != nil {
+		log.Printf("Failover failed to get the status: %v", err)
+		return nil, nil
+	}
+	index := slices.IndexFunc(status, func(s *ConnectionStatus) bool {
+		return slices.Contains(c.config.Connections, s.Name)
+	})
+	if index < 0 {
+		c.unhealthy = nil
+		return nil, nil
+	}
+	active := status[index]
+	reason := c.unhealthyReason(active, now)
+	switch {
+	case reason == "":
+		c.unhealthy = nil
+		return nil, nil
+	case c.unhealthy == nil || c.unhealthy.Connection != active.Name:
+		c.unhealthy = &UnhealthyConnection{Connection: active.Name, Reason: reason, Since: now}
+	}
+	c.unhealthy.Reason = reason
+	if now.Sub(c.unhealthy.Since) < time.Duration(c.config.UnhealthySeconds)*time.Second {
+		return nil, nil
+	}
+	return c.failover(active.Name, reason, now)
+}
+
+// unhealthyReason describes why the active connection is unhealthy, empty when it's healthy
+func (c *FailoverController) unhealthyReason(status *ConnectionStatus, now time.Time) string {
+	if health := c.manager.health.get(status.Name); health != nil && !health.Reachable {
+		return "endpoint unreachable"
+	}
+	if status.LatestHandshake == nil {
+		return "no handshake"
+	}
+	timeout := time.Duration(c.config.HandshakeTimeoutSeconds) * time.Second
+	if age := now.Sub(*status.LatestHandshake); age > timeout {
+		return fmt.Sprintf("no handshake for %s", age.Round(time.Second))
+	}
+	return ""
+}
+
+// failover starts the next connection of the list after the unhealthy one, skipping the
+// connections with unreachable endpoints and those failing to start
+func (c *FailoverController) failover(from, reason string, now time.Time) (*FailoverEvent, *ToggleResult) {
+	start := slices.Index(c.config.Connections, from)
+	for i := 1; i < len(c.config.Connections); i++ {
+		to := c.config.Connections[(start+i)%len(c.config.Connections)]
+		if health := c.manager.health.get(to); health != nil && !health.Reachable {
+			continue
+		}
+		result, err := c.switchConnection(from, to)
+		if err != nil {
+			log.Printf("Failover from %s to %s failed: %v", from, to, err)
+			continue
+		}
+		log.Printf("Failed over from %s to %s: %s", from, to, reason)
+		c.unhealthy = nil
+		c.lastEvent = &FailoverEvent{From: from, To: to, Reason: reason, Time: now}
+		return c.lastEvent, result
+	}
+	log.Printf("Failover found no connection to replace %s: %s", from, reason)
+	return nil, nil
+}
+
+// switchConnection starts the connection, stopping the unhealthy one first
+// when multiple connections may be active. Both steps run under a single operationMutex
+// hold, so a toggle can't slip in between them.
+func (c *FailoverController) switchConnection(from, to string) (*ToggleResult, error) {
+	c.manager.operationMutex.Lock()
+	defer c.manager.operationMutex.Unlock()
+	if !c.manager.config.MultiActive {
+		return c.manager.changeConnection(to, changeStart, nil)
+	}
+	stopped, err := c.manager.changeConnection(from, changeStop, nil)
+	if err != nil {
+		return nil, err
+	}
+	result, err := c.manager.changeConnection(to, changeStart, nil)
+	if err != nil {
+		return nil, err
+	}
+	result.Output = append(stopped.Output, result.Output...)
+	result.Stopped = append(stopped.Stopped, result.Stopped...)
+	return result, nil
+}
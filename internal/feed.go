@@ -0,0 +1,325 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// FeedMessage is a single message pushed to the websocket feed clients
+type FeedMessage struct {
+	Type string `json:"type"`
+	Data any    `json:"data,omitempty"`
+}
+
+// Feed pushes live updates to the dashboard over websocket connections.
+// Each connection is associated with the session that opened it.
+type Feed struct {
+	sessionManager *SessionManager
+	warning        time.Duration
+	interval       time.Duration
+	upgrader       websocket.Upgrader
+
+	clients map[*feedClient]struct{}
+	mutex   sync.Mutex
+
+	// Status broadcasts are coalesced to at most one per interval
+	statusMutex   sync.Mutex
+	statusTimer   *time.Timer
+	pendingStatus []byte
+	lastStatus    []byte
+	lastStatusAt  time.Time
+}
+
+// feedClient is a websocket connection, writes are serialized as the
+// session watcher and the broadcasts write from different goroutines
+type feedClient struct {
+	conn  *websocket.Conn
+	mutex sync.Mutex
+	// send queues the broadcasts, written by the sender of the client so a slow
+	// client never blocks the broadcasts to the others
+	send chan []byte
+	// statusUpdates is set for the clients receiving the status broadcasts
+	statusUpdates bool
+	// recheck wakes the session watcher up to validate the session again after a deletion
+	recheck chan struct{}
+}
+
+const feedWriteTimeout = 10 * time.Second
+
+// feedSendQueue is the number of broadcasts queued for a client, a client
+// falling further behind is disconnected
+const feedSendQueue = 16
+
+// NewFeed creates a feed warning clients the warning duration before their session expires,
+// and broadcasting status updates at most once per interval.
+// A zero warning duration disables the warning.
+func NewFeed(sessionManager *SessionManager, warning, interval time.Duration) *Feed {
+	f := &Feed{
+		sessionManager: sessionManager,
+		warning:        warning,
+		interval:       interval,
+		clients:        make(map[*feedClient]struct{}),
+	}
+	// The connections of the sessions logged out or revoked are closed right away,
+	// instead of receiving the broadcasts until the former session expiry
+	sessionManager.onDelete(f.recheckSessions)
+	return f
+}
+
+// Serve upgrades the request to a websocket connection and keeps it open
+// until the client disconnects or its session is no longer valid.
+// Without a session ID the connection is kept open until the client disconnects.
+// The status broadcasts are only sent with statusUpdates.
+func (f *Feed) Serve(w http.ResponseWriter, r *http.Request, sessionID string, statusUpdates bool) error {
+	// Upgrade replies to the client with an HTTP error on failure
+	conn, err := f.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	client := &feedClient{
+		conn:          conn,
+		send:          make(chan []byte, feedSendQueue),
+		statusUpdates: statusUpdates,
+		recheck:       make(chan struct{}, 1),
+	}
+	f.addClient(client)
+	defer f.removeClient(client)
+
+	done := make(chan struct{})
+	go discardIncoming(conn, done)
+	go client.sendQueued(done)
+	if sessionID == "" {
+		<-done
+		return nil
+	}
+	f.watchSession(client, sessionID, done)
+	return nil
+}
+
+// Broadcast sends the message to all connected clients
+func (f *Feed) Broadcast(message FeedMessage) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Failed to encode feed message: %v", err)
+		return
+	}
+	f.broadcast(data)
+}
+
+// BroadcastStatusEvent sends the message to the clients receiving the status broadcasts,
+// its connections may not be granted to the other clients
+func (f *Feed) BroadcastStatusEvent(message FeedMessage) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Failed to encode feed message: %v", err)
+		return
+	}
+	f.broadcastTo(data, func(client *feedClient) bool { return client.statusUpdates })
+}
+
+// PublishStatus broadcasts a status update, coalescing frequent updates to at most
+// one per interval. The latest status is always sent once the interval passes.
+func (f *Feed) PublishStatus(status any) {
+	data, err := json.Marshal(FeedMessage{Type: "status", Data: status})
+	if err != nil {
+		log.Printf("Failed to encode status update: %v", err)
+		return
+	}
+
+	f.statusMutex.Lock()
+	defer f.statusMutex.Unlock()
+	f.pendingStatus = data
+	if f.statusTimer != nil {
+		// The pending timer sends the latest status
+		return
+	}
+	wait := time.Until(f.lastStatusAt.Add(f.interval))
+	if wait <= 0 {
+		f.sendPendingStatus()
+		return
+	}
+	f.statusTimer = time.AfterFunc(wait, f.flushPendingStatus)
+}
+
+// FlushStatus broadcasts a status update immediately, dropping any coalesced update
+func (f *Feed) FlushStatus(status any) {
+	data, err := json.Marshal(FeedMessage{Type: "status", Data: status})
+	if err != nil {
+		log.Printf("Failed to encode status update: %v", err)
+		return
+	}
+
+	f.statusMutex.Lock()
+	defer f.statusMutex.Unlock()
+	if f.statusTimer != nil {
+		f.statusTimer.Stop()
+		f.statusTimer = nil
+	}
+	f.pendingStatus = data
+	f.sendPendingStatus()
+}
+
+func (f *Feed) flushPendingStatus() {
+	f.statusMutex.Lock()
+	defer f.statusMutex.Unlock()
+	f.statusTimer = nil
+	f.sendPendingStatus()
+}
+
+// sendPendingStatus broadcasts the pending status unless it didn't change,
+// it must be called holding the status mutex
+func (f *Feed) sendPendingStatus() {
+	data := f.pendingStatus
+	f.pendingStatus = nil
+	if data == nil || bytes.Equal(data, f.lastStatus) {
+		return
+	}
+	f.lastStatus = data
+	f.lastStatusAt = time.Now()
+	f.broadcastTo(data, func(client *feedClient) bool { return client.statusUpdates })
+}
+
+func (f *Feed) broadcast(data []byte) {
+	f.broadcastTo(data, func(*feedClient) bool { return true })
+}
+
+// broadcastTo queues the data to the connected clients matching the filter, without waiting
+// for the writes. A client whose queue is full is disconnected.
+func (f *Feed) broadcastTo(data []byte, filter func(*feedClient) bool) {
+	f.mutex.Lock()
+	clients := make([]*feedClient, 0, len(f.clients))
+	for client := range f.clients {
+		if filter(client) {
+			clients = append(clients, client)
+		}
+	}
+	f.mutex.Unlock()
+
+	for _, client := range clients {
+		select {
+		case client.send <- data:
+		default:
+			log.Printf("Feed client too slow, disconnecting it")
+			f.removeClient(client)
+			client.conn.Close()
+		}
+	}
+}
+
+// recheckSessions makes the session watchers validate their sessions again
+func (f *Feed) recheckSessions() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for client := range f.clients {
+		select {
+		case client.recheck <- struct{}{}:
+		default:
+			// A check is already pending
+		}
+	}
+}
+
+func (f *Feed) addClient(client *feedClient) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.clients[client] = struct{}{}
+}
+
+func (f *Feed) removeClient(client *feedClient) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.clients, client)
+}
+
+// sendQueued writes the queued broadcasts until the connection is gone,
+// a failed write closes the connection, which removes the client
+func (c *feedClient) sendQueued(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case data := <-c.send:
+			if err := c.write(data); err != nil {
+				log.Printf("Failed to send feed message: %v", err)
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *feedClient) write(data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(feedWriteTimeout))
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *feedClient) writeJSON(message FeedMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return c.write(data)
+}
+
+// discardIncoming reads (and drops) client messages, which is required to process
+// control frames, and closes done once the connection is gone
+func discardIncoming(conn *websocket.Conn, done chan<- struct{}) {
+	defer close(done)
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// watchSession sends a session_expiring message ahead of the session expiry
+// and a session_expired message once the session isn't valid anymore.
+// The expiry is re-read on every check, so renewed sessions aren't warned again.
+func (f *Feed) watchSession(client *feedClient, sessionID string, done <-chan struct{}) {
+	var warnedFor time.Time
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		case <-client.recheck:
+		}
+
+		session, valid := f.sessionManager.ValidateSession(sessionID)
+		if !valid {
+			_ = client.writeJSON(FeedMessage{Type: "session_expired"})
+			return
+		}
+
+		warnAt := session.Expires.Add(-f.warning)
+		if f.warning > 0 && !warnedFor.Equal(session.Expires) && !time.Now().Before(warnAt) {
+			message := FeedMessage{Type: "session_expiring", Data: map[string]any{"expires": session.Expires}}
+			if err := client.writeJSON(message); err != nil {
+				return
+			}
+			warnedFor = session.Expires
+		}
+		timer.Reset(time.Until(nextSessionCheck(session.Expires, warnAt, warnedFor)))
+	}
+}
+
+// nextSessionCheck returns when the session has to be checked again
+func nextSessionCheck(expires, warnAt, warnedFor time.Time) time.Time {
+	if warnedFor.Equal(expires) || warnAt.Before(time.Now()) {
+		return expires
+	}
+	return warnAt
+}
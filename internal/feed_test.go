@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestFeedClosesConnectionsOfDeletedSessions(t *testing.T) {
+	store := &localSessionStore{sessions: make(map[string]Session)}
+	sessionManager := NewSessionManager(store, SessionLifetime{TTL: time.Hour}, 0, SessionBindingConfig{})
+	feed := NewFeed(sessionManager, 0, time.Second)
+	sessionID, _, err := sessionManager.CreateSession("alice", "127.0.0.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = feed.Serve(w, r, sessionID, true)
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Wait for the watcher to validate the session before logging out everywhere
+	deadline := time.Now().Add(5 * time.Second)
+	for !feedHasClients(feed) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	sessionManager.DeleteUserSessions("alice")
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("no message after the logout: %v", err)
+	}
+	var message FeedMessage
+	if err := json.Unmarshal(data, &message); err != nil || message.Type != "session_expired" {
+		t.Fatalf("message = %s, want session_expired", data)
+	}
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("connection of the deleted session still open")
+	}
+}
+
+func TestFeedBroadcastDisconnectsSlowClients(t *testing.T) {
+	feed := NewFeed(NewSessionManager(&localSessionStore{sessions: make(map[string]Session)},
+		SessionLifetime{TTL: time.Hour}, 0, SessionBindingConfig{}), 0, time.Second)
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := feed.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- conn
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Nothing sends the queue of the client, as if its writes were stuck
+	client := &feedClient{conn: <-conns, send: make(chan []byte, 1)}
+	feed.addClient(client)
+	feed.Broadcast(FeedMessage{Type: "first"})
+	feed.Broadcast(FeedMessage{Type: "second"})
+
+	if feedHasClients(feed) {
+		t.Fatal("client with a full queue still connected")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("connection of the slow client still open")
+	}
+}
+
+func feedHasClients(feed *Feed) bool {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	return len(feed.clients) > 0
+}
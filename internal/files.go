@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces the file with the data, the data is written to a temporary
+// file next to it and renamed so readers never see a partially written file.
+// The file is created readable by its owner only.
+func writeFileAtomic(path string, data []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// profileStateFile returns the name of a state directory file of the profile,
+// suffixed with the profile name for the other profiles than the default one
+func profileStateFile(name, ext, profile string) string {
+	if profile == DefaultProfile {
+		return name + ext
+	}
+	return name + "-" + profile + ext
+}
@@ -0,0 +1,268 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Firewall backends of the inspected rules
+const (
+	FirewallIPTables  = "iptables"
+	FirewallIP6Tables = "ip6tables"
+	FirewallNFTables  = "nftables"
+)
+
+// Reasons of the inspected rules matching a tunnel
+const (
+	// FirewallMatchWGQuick is a rule installed by wg-quick for the interface
+	FirewallMatchWGQuick = "wg-quick"
+	// FirewallMatchInterface is a rule matching the packets received or sent through the interface
+	FirewallMatchInterface = "interface"
+	// FirewallMatchFwMark is a rule matching or setting the firewall mark of the interface
+	FirewallMatchFwMark = "fwmark"
+	// FirewallMatchMasquerade is a masquerade rule, which rewrites the source of the tunnel traffic
+	FirewallMatchMasquerade = "masquerade"
+)
+
+// firewallHookKeys are the wg-quick options running commands, which usually install firewall rules
+var firewallHookKeys = []string{"PreUp", "PostUp", "PreDown", "PostDown"}
+
+// FirewallRule is a firewall rule affecting the traffic of a tunnel
+type FirewallRule struct {
+	Backend string `json:"backend"`
+	// Table is the iptables table, like nat, or the nftables family and table, like inet filter
+	Table string `json:"table"`
+	Chain string `json:"chain"`
+	Rule  string `json:"rule"`
+	// Matches are the reasons the rule affects the tunnel
+	Matches []string `json:"matches"`
+}
+
+// TunnelFirewall are the firewall rules affecting the traffic of an active connection
+type TunnelFirewall struct {
+	Connection string `json:"connection"`
+	Namespace  string `json:"namespace,omitempty"`
+	// FwMark is the firewall mark of the interface, set by wg-quick for the full tunnels
+	FwMark string          `json:"fwmark,omitempty"`
+	Rules  []*FirewallRule `json:"rules"`
+	// Hooks are the PreUp, PostUp, PreDown and PostDown commands of the connection config
+	Hooks []ConfigOption `json:"hooks"`
+}
+
+// TunnelFirewallResult are the firewall rules of the active connections
+type TunnelFirewallResult struct {
+	Tunnels []*TunnelFirewall `json:"tunnels"`
+	// Errors are the backends which couldn't be listed, like nft when it isn't installed,
+	// followed by the network namespace they were listed in
+	Errors map[string]string `json:"errors,omitempty"`
+	Time   time.Time         `json:"time"`
+}
+
+// firewallListing is a firewall backend listing its rules
+type firewallListing struct {
+	backend string
+	command []string
+	parse   func(output string) []*FirewallRule
+}
+
+var firewallListings = []firewallListing{
+	{FirewallIPTables, []string{"sudo", "iptables-save"}, parseIPTablesRules},
+	{FirewallIP6Tables, []string{"sudo", "ip6tables-save"}, parseIPTablesRules},
+	{FirewallNFTables, []string{"sudo", "nft", "list", "ruleset"}, parseNFTablesRules},
+}
+
+// TunnelFirewall lists the iptables and nftables rules affecting the traffic of the interfaces
+// of the granted active connections: the rules wg-quick installed, those matching the interfaces
+// or their firewall marks and the masquerade rules
+func (m *WireGuardManager) TunnelFirewall(grants ConnectionGrants) (*TunnelFirewallResult, error) {
+	devices, err := m.readDevices()
+	if err != nil {
+		return nil, err
+	}
+	allConnections, err := m.getAllConnections()
+	if err != nil {
+		return nil, err
+	}
+	granted := grants.Filter(allConnections)
+	devices = slices.DeleteFunc(devices, func(device *Device) bool { return !slices.Contains(granted, device.Name) })
+	if len(devices) == 0 {
+		return nil, ErrNoActiveConnection
+	}
+	result := &TunnelFirewallResult{Tunnels: []*TunnelFirewall{}, Time: time.Now()}
+	// The rules are listed once per network namespace of the interfaces
+	rules := make(map[string][]*FirewallRule)
+	for _, device := range devices {
+		if _, ok := rules[device.Namespace]; !ok {
+			rules[device.Namespace] = m.listFirewallRules(device.Namespace, result)
+		}
+		result.Tunnels = append(result.Tunnels, m.tunnelFirewall(device, rules[device.Namespace]))
+	}
+	return result, nil
+}
+
+// listFirewallRules lists the rules of the firewall backends in the network namespace, adding
+// the errors of the backends which couldn't be listed to the result
+func (m *WireGuardManager) listFirewallRules(namespace string, result *TunnelFirewallResult) []*FirewallRule {
+	var rules []*FirewallRule
+	for _, listing := range firewallListings {
+		command := namespacedCommand(namespace, listing.command)
+		output, err := m.runner.CombinedOutput(command[0], command[1:]...)
+		if err != nil {
+			if result.Errors == nil {
+				result.Errors = make(map[string]string)
+			}
+			source := listing.backend
+			if namespace != "" {
+				source += " (" + namespace + ")"
+			}
+			result.Errors[source] = commandError(err, output).Error()
+			continue
+		}
+		for _, rule := range listing.parse(string(output)) {
+			rule.Backend = listing.backend
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// tunnelFirewall returns the rules affecting the traffic of the interface and the hooks of its config
+func (m *WireGuardManager) tunnelFirewall(device *Device, rules []*FirewallRule) *TunnelFirewall {
+	tunnel := &TunnelFirewall{
+		Connection: device.Name, Namespace: device.Namespace, Rules: []*FirewallRule{}, Hooks: []ConfigOption{},
+	}
+	if device.FwMark != 0 {
+		tunnel.FwMark = fmt.Sprintf("%#x", device.FwMark)
+	}
+	for _, rule := range rules {
+		if matches := firewallMatches(rule, device); len(matches) > 0 {
+			matched := *rule
+			matched.Matches = matches
+			tunnel.Rules = append(tunnel.Rules, &matched)
+		}
+	}
+	if config, err := m.connectionConfig(device.Name); err == nil {
+		for _, option := range config.Interface.Options {
+			if isFirewallHook(option.Key) {
+				tunnel.Hooks = append(tunnel.Hooks, option)
+			}
+		}
+	}
+	return tunnel
+}
+
+// firewallMatches returns the reasons the rule affects the traffic of the interface
+func firewallMatches(rule *FirewallRule, device *Device) []string {
+	fields := strings.Fields(rule.Rule)
+	var matches []string
+	if strings.Contains(rule.Rule, "wg-quick(8) rule for "+device.Name) ||
+		slices.Contains([]string{"ip wg-quick-" + device.Name, "ip6 wg-quick-" + device.Name}, rule.Table) {
+		matches = append(matches, FirewallMatchWGQuick)
+	}
+	if mentionsInterface(fields, device.Name) {
+		matches = append(matches, FirewallMatchInterface)
+	}
+	if device.FwMark != 0 && mentionsMark(fields, device.FwMark) {
+		matches = append(matches, FirewallMatchFwMark)
+	}
+	if slices.ContainsFunc(fields, func(field string) bool { return strings.EqualFold(field, "masquerade") }) {
+		matches = append(matches, FirewallMatchMasquerade)
+	}
+	return matches
+}
+
+// isFirewallHook reports whether the interface option is a command run by wg-quick
+func isFirewallHook(key string) bool {
+	return slices.ContainsFunc(firewallHookKeys, func(hook string) bool { return strings.EqualFold(hook, key) })
+}
+
+// mentionsInterface reports whether the rule matches the input or output interface,
+// as in -o wg0 or oifname "wg0", negated or not
+func mentionsInterface(fields []string, name string) bool {
+	fields = slices.DeleteFunc(slices.Clone(fields), func(field string) bool { return field == "!=" })
+	for i := 1; i < len(fields); i++ {
+		switch fields[i-1] {
+		case "-i", "-o", "iifname", "oifname":
+			if interfaceMatches(strings.Trim(fields[i], `"`), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// interfaceMatches reports whether the interface pattern of a rule, like wg+ or wg*, matches the interface
+func interfaceMatches(pattern, name string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "+"); ok {
+		return strings.HasPrefix(name, prefix)
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(name, prefix)
+	}
+	return pattern == name
+}
+
+// mentionsMark reports whether the rule matches or sets the firewall mark, as in --mark 0xca6c
+// or meta mark 51820, ignoring the other numbers like the ports
+func mentionsMark(fields []string, mark uint32) bool {
+	for i := 1; i < len(fields); i++ {
+		if !strings.Contains(fields[i-1], "mark") {
+			continue
+		}
+		value, _, _ := strings.Cut(fields[i], "/")
+		if parsed, err := strconv.ParseUint(value, 0, 32); err == nil && uint32(parsed) == mark {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIPTablesRules parses the output of iptables-save, the tables starting with *table
+// followed by the rules like -A CHAIN ...
+func parseIPTablesRules(output string) []*FirewallRule {
+	var rules []*FirewallRule
+	table := ""
+	for line := range strings.SplitSeq(output, "\n") {
+		line = strings.TrimSpace(line)
+		if name, ok := strings.CutPrefix(line, "*"); ok {
+			table = name
+		}
+		rule, ok := strings.CutPrefix(line, "-A ")
+		if !ok {
+			continue
+		}
+		chain, _, _ := strings.Cut(rule, " ")
+		rules = append(rules, &FirewallRule{Table: table, Chain: chain, Rule: line})
+	}
+	return rules
+}
+
+// parseNFTablesRules parses the output of nft list ruleset, the blocks of the tables and of
+// their chains, whose lines are the rules besides the type and policy declarations
+func parseNFTablesRules(output string) []*FirewallRule {
+	var rules []*FirewallRule
+	table, chain := "", ""
+	depth := 0
+	for line := range strings.SplitSeq(output, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case fields[0] == "}":
+			depth--
+		case strings.HasSuffix(line, "{"):
+			depth++
+			if depth == 1 && fields[0] == "table" && len(fields) >= 3 {
+				table = strings.Join(fields[1:3], " ")
+			}
+			if chain = ""; depth == 2 && fields[0] == "chain" {
+				chain = fields[1]
+			}
+		case depth == 2 && chain != "" && fields[0] != "type" && fields[0] != "policy":
+			rules = append(rules, &FirewallRule{Table: table, Chain: chain, Rule: strings.Join(fields, " ")})
+		}
+	}
+	return rules
+}
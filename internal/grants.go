@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var (
+	// ErrConnectionNotGranted is returned for the connections the caller isn't granted
+	ErrConnectionNotGranted = errors.New("connection not granted")
+	// ErrInvalidGrants is returned for grants of invalid connection names
+	ErrInvalidGrants = errors.New("invalid connections")
+)
+
+// ConnectionGrants are the connections a user or an API token can see and toggle.
+// Nil grants all the connections, while an empty list grants none.
+type ConnectionGrants []string
+
+// Restricted reports whether some connections aren't granted
+func (g ConnectionGrants) Restricted() bool {
+	return g != nil
+}
+
+// Allows reports whether the connection is granted
+func (g ConnectionGrants) Allows(name string) bool {
+	return !g.Restricted() || slices.Contains(g, name)
+}
+
+// Intersect returns the connections granted by both grants
+func (g ConnectionGrants) Intersect(other ConnectionGrants) ConnectionGrants {
+	if !g.Restricted() {
+		return other
+	}
+	if !other.Restricted() {
+		return g
+	}
+	return slices.DeleteFunc(slices.Clone(g), func(name string) bool { return !other.Allows(name) })
+}
+
+// Filter returns the granted connection names
+func (g ConnectionGrants) Filter(names []string) []string {
+	if !g.Restricted() {
+		return names
+	}
+	return slices.DeleteFunc(slices.Clone(names), func(name string) bool { return !g.Allows(name) })
+}
+
+// allowToggle checks the connection and the active connections its toggle stops are granted
+func (g ConnectionGrants) allowToggle(name string, activeConnections []*WireGuardConnection) error {
+	if !g.Allows(name) {
+		return fmt.Errorf("%w: %s", ErrConnectionNotGranted, name)
+	}
+	for _, connection := range activeConnections {
+		if !g.Allows(connection.Name) {
+			return fmt.Errorf("%w: %s is active", ErrConnectionNotGranted, connection.Name)
+		}
+	}
+	return nil
+}
+
+// rename returns the grants with the renamed connection, and whether it was granted by name
+func (g ConnectionGrants) rename(name, newName string) (ConnectionGrants, bool) {
+	index := slices.Index(g, name)
+	if index < 0 {
+		return g, false
+	}
+	if slices.Contains(g, newName) {
+		return slices.Delete(slices.Clone(g), index, index+1), true
+	}
+	renamed := slices.Clone(g)
+	renamed[index] = newName
+	return renamed, true
+}
+
+// remove returns the grants without the deleted connection, and whether it was granted by name.
+// Grants left empty grant no connection, not all of them.
+func (g ConnectionGrants) remove(name string) (ConnectionGrants, bool) {
+	index := slices.Index(g, name)
+	if index < 0 {
+		return g, false
+	}
+	return slices.Delete(slices.Clone(g), index, index+1), true
+}
+
+func (g ConnectionGrants) equal(other ConnectionGrants) bool {
+	return g.Restricted() == other.Restricted() && slices.Equal(g, other)
+}
+
+func (g ConnectionGrants) validate() error {
+	for _, name := range g {
+		if !connectionNameRegex.MatchString(name) {
+			return fmt.Errorf("%w: %q is not a connection name", ErrInvalidGrants, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestConnectionGrantsFilter(t *testing.T) {
+	names := []string{"home", "work", "travel"}
+	tests := []struct {
+		name   string
+		grants ConnectionGrants
+		want   []string
+	}{
+		{"unrestricted", nil, names},
+		{"none", ConnectionGrants{}, []string{}},
+		{"restricted", ConnectionGrants{"travel", "home", "gone"}, []string{"home", "travel"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.grants.Filter(names); !slices.Equal(got, test.want) {
+				t.Fatalf("Filter = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestConnectionGrantsAllowToggle(t *testing.T) {
+	active := []*WireGuardConnection{{Name: "work", Active: true}}
+	tests := []struct {
+		name       string
+		connection string
+		grants     ConnectionGrants
+		wantErr    error
+	}{
+		{"unrestricted", "home", nil, nil},
+		{"granted", "home", ConnectionGrants{"home", "work"}, nil},
+		{"ungranted connection", "work", ConnectionGrants{"home"}, ErrConnectionNotGranted},
+		// Starting home stops the active work connection, which isn't granted
+		{"ungranted active connection", "home", ConnectionGrants{"home"}, ErrConnectionNotGranted},
+		{"no grants", "home", ConnectionGrants{}, ErrConnectionNotGranted},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.grants.allowToggle(test.connection, active); !errors.Is(err, test.wantErr) {
+				t.Fatalf("allowToggle(%s) = %v, want %v", test.connection, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetStatusFiltersGrantedConnections(t *testing.T) {
+	runner := newCountingRunner("home\tprivate\tpublic\t51820\toff\nwork\tprivate\tpublic\t51821\toff\n")
+	close(runner.release)
+	manager := newTestManager(t, runner, "home", "work")
+
+	status, err := manager.GetStatus(ConnectionGrants{"work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 1 || status[0].Name != "work" {
+		t.Fatalf("status = %+v, want only work", status)
+	}
+}
+
+func TestToggleConnectionRejectsUngrantedConnections(t *testing.T) {
+	runner := newCountingRunner("work\tprivate\tpublic\t51820\toff\n")
+	close(runner.release)
+	manager := newTestManager(t, runner, "home", "work")
+
+	// Starting home stops the active work connection, which isn't granted
+	for _, name := range []string{"work", "home"} {
+		if _, err := manager.ToggleConnection(name, ConnectionGrants{"home"}); !errors.Is(err, ErrConnectionNotGranted) {
+			t.Fatalf("ToggleConnection(%s) = %v, want ErrConnectionNotGranted", name, err)
+		}
+	}
+}
+
+func TestConnectionGrantsRemove(t *testing.T) {
+	remaining, ok := ConnectionGrants{"home"}.remove("home")
+	if !ok || !remaining.Restricted() || len(remaining) != 0 {
+		t.Fatalf("remove = %#v, %v, want empty restricted grants", remaining, ok)
+	}
+	if remaining.Allows("home") {
+		t.Fatal("a connection recreated under the deleted name is still granted")
+	}
+	if _, ok := ConnectionGrants(nil).remove("home"); ok {
+		t.Fatal("unrestricted grants changed by the deletion")
+	}
+}
@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Methods of the endpoint health checks
+const (
+	HealthCheckICMP = "icmp"
+	HealthCheckUDP  = "udp"
+)
+
+// HealthCheckConfig checks periodically that the peer endpoints of the connections are reachable
+type HealthCheckConfig struct {
+	// IntervalSeconds is the interval between the checks (0 disables them)
+	IntervalSeconds int `yaml:"interval_seconds"`
+	// Method is icmp, pinging the endpoint hosts, or udp, probing the endpoint ports
+	Method string `yaml:"method"`
+	// TimeoutSeconds is how long a reply is awaited
+	TimeoutSeconds int `yaml:"timeout_seconds"`
+}
+
+func (c HealthCheckConfig) validate() error {
+	if c.IntervalSeconds < 0 {
+		return errors.New("interval_seconds must not be negative")
+	}
+	if c.IntervalSeconds == 0 {
+		return nil
+	}
+	if c.Method != HealthCheckICMP && c.Method != HealthCheckUDP {
+		return fmt.Errorf("method must be %s or %s, got %q", HealthCheckICMP, HealthCheckUDP, c.Method)
+	}
+	if c.TimeoutSeconds <= 0 {
+		return errors.New("timeout_seconds must be positive")
+	}
+	return nil
+}
+
+// ConnectionHealth is the outcome of the latest check of the peer endpoints of a connection
+type ConnectionHealth struct {
+	// Reachable reports whether a peer endpoint of the connection is reachable
+	Reachable bool              `json:"reachable"`
+	Endpoints []*EndpointHealth `json:"endpoints"`
+	Checked   time.Time         `json:"checked"`
+}
+
+// EndpointHealth is the outcome of the check of a peer endpoint
+type EndpointHealth struct {
+	Endpoint  string `json:"endpoint"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+// healthTracker keeps the latest check of each connection
+type healthTracker struct {
+	results map[string]*ConnectionHealth
+	mutex   sync.Mutex
+}
+
+func newHealthTracker() *healthTracker {
+	return &healthTracker{results: make(map[string]*ConnectionHealth)}
+}
+
+func (t *healthTracker) get(name string) *ConnectionHealth {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.results[name]
+}
+
+// StartHealthChecks checks the peer endpoints of all the connections every interval,
+// the inactive connections included
+func (m *WireGuardManager) StartHealthChecks(config HealthCheckConfig) {
+	if config.IntervalSeconds <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.IntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			m.checkHealth(config)
+			<-ticker.C
+		}
+	}()
+}
+
+// checkHealth checks the connections concurrently, replacing their previous results.
+// The connections without peer endpoints, like servers, aren't checked.
+func (m *WireGuardManager) checkHealth(config HealthCheckConfig) {
+	allConnections, err := m.getAllConnections()
+	if err != nil {
+		log.Printf("Failed to check endpoints: %v", err)
+		return
+	}
+	results := make(map[string]*ConnectionHealth, len(allConnections))
+	var resultsMutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range allConnections {
+		wg.Go(func() {
+			health := m.connectionHealth(name, config)
+			if health == nil {
+				return
+			}
+			resultsMutex.Lock()
+			defer resultsMutex.Unlock()
+			results[name] = health
+		})
+	}
+	wg.Wait()
+
+	m.health.mutex.Lock()
+	defer m.health.mutex.Unlock()
+	m.health.results = results
+}
+
+func (m *WireGuardManager) connectionHealth(name string, config HealthCheckConfig) *ConnectionHealth {
+	wgConfig, err := ParseConfig(m.configPath(name))
+	if err != nil {
+		return nil
+	}
+	health := &ConnectionHealth{Endpoints: []*EndpointHealth{}, Checked: time.Now()}
+	for _, peer := range wgConfig.Peers {
+		if peer.Endpoint == "" {
+			continue
+		}
+		endpoint := &EndpointHealth{Endpoint: peer.Endpoint, Reachable: true}
+		if err := m.checkEndpoint(peer.Endpoint, config); err != nil {
+			endpoint.Reachable, endpoint.Error = false, err.Error()
+		}
+		health.Reachable = health.Reachable || endpoint.Reachable
+		health.Endpoints = append(health.Endpoints, endpoint)
+	}
+	if len(health.Endpoints) == 0 {
+		return nil
+	}
+	return health
+}
+
+func (m *WireGuardManager) checkEndpoint(endpoint string, config HealthCheckConfig) error {
+	timeout := time.Duration(config.TimeoutSeconds) * time.Second
+	if config.Method == HealthCheckUDP {
+		return probeUDP(endpoint, timeout)
+	}
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return err
+	}
+	output, _ := m.runner.Output("ping", "-n", "-q", "-c", "1", "-W", strconv.Itoa(config.TimeoutSeconds), host)
+	var result LatencyResult
+	if !result.parse(string(output)) || result.Received == 0 {
+		return fmt.Errorf("no reply from %s", host)
+	}
+	return nil
+}
+
+// probeUDP sends a datagram to the endpoint. WireGuard doesn't answer unauthenticated
+// packets, so the endpoint is unreachable only when it can't be resolved or when the
+// host rejects the port; no answer within the timeout counts as reachable.
+func probeUDP(endpoint string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("udp", endpoint, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err = conn.Read(make([]byte, 1))
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errors.New("port unreachable")
+	case err == nil, errors.Is(err, os.ErrDeadlineExceeded):
+		return nil
+	default:
+		return err
+	}
+}
@@ -0,0 +1,436 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxHelperRequestSize bounds the requests of the helper, a command and a config file
+const maxHelperRequestSize = 1 << 20
+
+// helperTimeoutMargin is added to the command timeout for the round trip to the helper
+const helperTimeoutMargin = 5 * time.Second
+
+// ErrHelperCommand is returned by the helper for the commands it doesn't run
+var ErrHelperCommand = errors.New("command not allowed by the privileged helper")
+
+// PrivilegedHelperConfig runs the privileged commands through a helper running as root, instead of sudo
+type PrivilegedHelperConfig struct {
+	// Socket is the unix socket of the helper, empty runs the privileged commands with sudo
+	Socket string `yaml:"socket"`
+	// User is the user running the portal, the only one the helper accepts commands from
+	User string `yaml:"user"`
+	// AllowConfigHooks lets wg-quick run the PreUp, PostUp, PreDown and PostDown commands
+	// of the configs, as root
+	AllowConfigHooks bool `yaml:"allow_config_hooks"`
+}
+
+func (c PrivilegedHelperConfig) validate() error {
+	if c.Socket == "" {
+		return nil
+	}
+	if !filepath.IsAbs(c.Socket) {
+		return fmt.Errorf("socket must be an absolute path, got %q", c.Socket)
+	}
+	if c.User == "" {
+		return errors.New("user is required")
+	}
+	return nil
+}
+
+// helperRequest is a command sent to the helper, without its sudo
+type helperRequest struct {
+	Args []string `json:"args"`
+	// Combined returns the standard error with the standard output
+	Combined bool `json:"combined"`
+	// File is the content of the file argument of the command, written by the helper
+	// to a directory of its own
+	File []byte `json:"file,omitempty"`
+}
+
+// helperResponse is the output of a command run by the helper
+type helperResponse struct {
+	Output []byte `json:"output"`
+	Error  string `json:"error,omitempty"`
+}
+
+// helperRunner sends the commands run with sudo to the privileged helper, the other
+// commands are run as the portal user
+type helperRunner struct {
+	config *Config
+	local  CommandRunner
+}
+
+// NewHelperRunner returns the runner of the commands through the privileged helper,
+// the commands without sudo are run by the local runner
+func NewHelperRunner(config *Config, local CommandRunner) CommandRunner {
+	return &helperRunner{config: config, local: local}
+}
+
+func (r *helperRunner) CombinedOutput(name string, args ...string) ([]byte, error) {
+	if name != "sudo" {
+		return r.local.CombinedOutput(name, args...)
+	}
+	return r.run(args, true)
+}
+
+func (r *helperRunner) Output(name string, args ...string) ([]byte, error) {
+	if name != "sudo" {
+		return r.local.Output(name, args...)
+	}
+	return r.run(args, false)
+}
+
+// run sends the command to the helper with the content of its file argument, which the portal
+// user can read and root may not, like the temporary files
+func (r *helperRunner) run(args []string, combined bool) ([]byte, error) {
+	request := &helperRequest{Args: args, Combined: combined}
+	index, _, err := matchHelperCommand(args, r.config.UserspaceImplementation)
+	if err != nil {
+		return nil, err
+	}
+	if index >= 0 {
+		if request.File, err = os.ReadFile(args[index]); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", args[index], err)
+		}
+	}
+	timeout := r.config.GetCommandTimeout()
+	conn, err := net.DialTimeout("unix", r.config.PrivilegedHelper.Socket, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the privileged helper: %w", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout + helperTimeoutMargin)); err != nil {
+		return nil, err
+	}
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return nil, fmt.Errorf("failed to send the command to the privileged helper: %w", err)
+	}
+	var response helperResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to read the output of the privileged helper: %w", err)
+	}
+	if response.Error != "" {
+		return response.Output, errors.New(response.Error)
+	}
+	return response.Output, nil
+}
+
+// Argument classes of the helper commands
+const (
+	argInterface = "<interface>"
+	argKey       = "<key>"
+	argNumber    = "<number>"
+	argKeepalive = "<keepalive>"
+	argFamily    = "<family>"
+	argPrefix    = "<prefix>"
+	argAddress   = "<address>"
+	argNamespace = "<namespace>"
+	argHost      = "<host>"
+	// argFile is a file of wg, argConfig the config file of wg-quick named after its interface
+	argFile   = "<file>"
+	argConfig = "<config>"
+)
+
+// helperCommands are the commands the helper runs, the arguments in angle brackets match
+// a class of values and the others only themselves
+var helperCommands = [][]string{
+	{"wg", "show", "all", "dump"},
+	{"wg", "set", argInterface, "peer", argKey, "remove"},
+	{"wg", "set", argInterface, "peer", argKey, "persistent-keepalive", argKeepalive},
+	{"wg", "set", argInterface, "fwmark", nativeRouteTable},
+	{"wg", "setconf", argInterface, argFile},
+	{"wg", "syncconf", argInterface, argFile},
+	{"wg-quick", "up", argConfig},
+	{"wg-quick", "down", argConfig},
+	{"ip", "link", "add", "dev", argInterface, "type", "wireguard"},
+	{"ip", "link", "del", "dev", argInterface},
+	{"ip", "link", "show", "dev", argInterface},
+	{"ip", "link", "set", "dev", argInterface, "mtu", argNumber},
+	{"ip", "link", "set", "dev", argInterface, "mtu", argNumber, "up"},
+	{"ip", "link", "set", "dev", argInterface, "netns", argNamespace},
+	{"ip", "address", "add", argAddress, "dev", argInterface},
+	{"ip", argFamily, "route", "add", argPrefix, "dev", argInterface},
+	{"ip", argFamily, "route", "add", argPrefix, "dev", argInterface, "table", nativeRouteTable},
+	{"ip", argFamily, "rule", "add", "not", "fwmark", nativeRouteTable, "table", nativeRouteTable},
+	{"ip", argFamily, "rule", "add", "table", "main", "suppress_prefixlength", "0"},
+	{"ip", argFamily, "rule", "del", "table", nativeRouteTable},
+	{"ip", argFamily, "rule", "del", "table", "main", "suppress_prefixlength", "0"},
+	{"ping", "-n", "-q", "-c", argNumber, "-W", "1", "-I", argInterface, argHost},
+	{"iptables-save"},
+	{"ip6tables-save"},
+	{"nft", "list", "ruleset"},
+}
+
+// matchHelperCommand checks the helper runs the command, run in a network namespace with
+// ip netns exec or not, returning the index of its file argument and the name the helper
+// writes the file as, -1 without one. The userspace implementation may create the interfaces
+// and be set for wg-quick.
+func matchHelperCommand(args []string, userspace string) (int, string, error) {
+	offset := 0
+	if value, found := strings.CutPrefix(firstArg(args), userspaceEnv+"="); found {
+		if userspace == "" || value != userspace {
+			return -1, "", fmt.Errorf("%w: userspace implementation %q", ErrHelperCommand, value)
+		}
+		offset++
+	}
+	if rest := args[offset:]; len(rest) > 4 && slices.Equal(rest[:3], []string{"ip", "netns", "exec"}) {
+		if !namespaceRegex.MatchString(rest[3]) {
+			return -1, "", fmt.Errorf("%w: namespace %q", ErrHelperCommand, rest[3])
+		}
+		offset += 4
+	}
+	rest := args[offset:]
+	if userspace != "" && len(rest) == 2 && rest[0] == userspace && connectionNameRegex.MatchString(rest[1]) {
+		return -1, "", nil
+	}
+	for _, pattern := range helperCommands {
+		if index, ok := matchHelperPattern(pattern, rest); ok {
+			return helperFileArg(pattern, rest, index, offset)
+		}
+	}
+	return -1, "", fmt.Errorf("%w: %s", ErrHelperCommand, strings.Join(args, " "))
+}
+
+func firstArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+// helperFileArg returns the index of the file argument in the whole command and the name it's
+// written as, a config of wg-quick keeping its name
+func helperFileArg(pattern, args []string, index, offset int) (int, string, error) {
+	switch {
+	case index < 0:
+		return -1, "", nil
+	case pattern[index] == argConfig:
+		return index + offset, filepath.Base(args[index]), nil
+	default:
+		return index + offset, "wg.conf", nil
+	}
+}
+
+// matchHelperPattern reports whether the args match the pattern, with the index of the file argument
+func matchHelperPattern(pattern, args []string) (int, bool) {
+	if len(pattern) != len(args) {
+		return -1, false
+	}
+	file := -1
+	for i, arg := range args {
+		if !matchHelperArg(pattern[i], arg) {
+			return -1, false
+		}
+		if pattern[i] == argFile || pattern[i] == argConfig {
+			file = i
+		}
+	}
+	return file, true
+}
+
+func matchHelperArg(class, arg string) bool {
+	switch class {
+	case argInterface:
+		return connectionNameRegex.MatchString(arg)
+	case argNamespace:
+		return namespaceRegex.MatchString(arg)
+	case argKey:
+		return validKey(arg)
+	case argNumber:
+		number, err := strconv.Atoi(arg)
+		return err == nil && number >= 0
+	case argKeepalive:
+		return arg == "off" || matchHelperArg(argNumber, arg)
+	case argFamily:
+		return arg == "-4" || arg == "-6"
+	default:
+		return matchHelperAddressArg(class, arg)
+	}
+}
+
+func matchHelperAddressArg(class, arg string) bool {
+	switch class {
+	case argPrefix:
+		_, err := netip.ParsePrefix(arg)
+		return err == nil
+	case argAddress:
+		_, err := parseAddress(arg)
+		return err == nil
+	case argHost:
+		_, err := netip.ParseAddr(arg)
+		return err == nil || dnsSearchDomainRegex.MatchString(arg)
+	default:
+		return matchHelperFileArg(class, arg)
+	}
+}
+
+func matchHelperFileArg(class, arg string) bool {
+	switch class {
+	case argFile:
+		return filepath.IsAbs(arg)
+	case argConfig:
+		name, found := strings.CutSuffix(filepath.Base(arg), ".conf")
+		return filepath.IsAbs(arg) && found && connectionNameRegex.MatchString(name)
+	default:
+		return class == arg
+	}
+}
+
+// privilegedHelper runs the allowed commands as root for the portal user
+type privilegedHelper struct {
+	config *Config
+	uid    uint32
+}
+
+// RunHelper runs the privileged helper, which listens on the socket of the privileged_helper settings
+// and runs the allowed commands for their user. The helper reads the top-level settings.
+func RunHelper(config *Config) error {
+	settings := config.PrivilegedHelper
+	if settings.Socket == "" {
+		return errors.New("privileged_helper socket isn't set")
+	}
+	account, err := user.Lookup(settings.User)
+	if err != nil {
+		return fmt.Errorf("failed to look up user %s: %w", settings.User, err)
+	}
+	uid, err := strconv.ParseUint(account.Uid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid uid of user %s: %w", settings.User, err)
+	}
+	listener, err := listenHelperSocket(settings.Socket, int(uid))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	helper := &privilegedHelper{config: config, uid: uint32(uid)}
+	log.Printf("Privileged helper listening on %s for %s", settings.Socket, settings.User)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go helper.handle(conn)
+	}
+}
+
+// listenHelperSocket listens on the socket, replacing the one of a previous run, which only
+// the user can connect to
+func listenHelperSocket(socket string, uid int) (net.Listener, error) {
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove the previous socket: %w", err)
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Chown(socket, uid, -1); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// handle runs the command of the connection when it comes from the user of the portal
+func (h *privilegedHelper) handle(conn net.Conn) {
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(h.config.GetCommandTimeout() + helperTimeoutMargin)); err != nil {
+		return
+	}
+	uid, err := peerUID(conn)
+	if err != nil {
+		log.Printf("Failed to read the user of a connection: %v", err)
+		return
+	}
+	if uid != h.uid {
+		log.Printf("Refused a connection from uid %d", uid)
+		return
+	}
+	var request helperRequest
+	if err := json.NewDecoder(io.LimitReader(conn, maxHelperRequestSize)).Decode(&request); err != nil {
+		log.Printf("Failed to read a command: %v", err)
+		return
+	}
+	output, err := h.run(&request)
+	response := &helperResponse{Output: output}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	if err := json.NewEncoder(conn).Encode(response); err != nil {
+		log.Printf("Failed to send the output of %s: %v", strings.Join(request.Args, " "), err)
+	}
+}
+
+// run runs the command once it's allowed, its file argument replaced by a copy of the file content
+// in a directory only root can read
+func (h *privilegedHelper) run(request *helperRequest) ([]byte, error) {
+	index, fileName, err := matchHelperCommand(request.Args, h.config.UserspaceImplementation)
+	if err != nil {
+		log.Print(err)
+		return nil, err
+	}
+	args := slices.Clone(request.Args)
+	if index >= 0 {
+		dir, err := h.writeFile(request.File, fileName)
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		args[index] = filepath.Join(dir, fileName)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.GetCommandTimeout())
+	defer cancel()
+	command := privilegedCommand(ctx, args)
+	var output []byte
+	if request.Combined {
+		output, err = command.CombinedOutput()
+	} else {
+		output, err = command.Output()
+	}
+	if err != nil {
+		log.Printf("Command %s failed: %v", strings.Join(request.Args, " "), err)
+	}
+	return output, err
+}
+
+// writeFile writes the file of a command to a new directory, the configs with wg-quick hooks
+// are refused unless they're allowed, the hooks running as root
+func (h *privilegedHelper) writeFile(content []byte, name string) (string, error) {
+	config, err := parseConfig(content)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid config: %w", ErrHelperCommand, err)
+	}
+	hooks := slices.ContainsFunc(config.Interface.Options, func(option ConfigOption) bool {
+		return isFirewallHook(option.Key)
+	})
+	if hooks && !h.config.PrivilegedHelper.AllowConfigHooks {
+		return "", fmt.Errorf("%w: the config has PreUp, PostUp, PreDown or PostDown commands, "+
+			"set allow_config_hooks to run them", ErrHelperCommand)
+	}
+	dir, err := os.MkdirTemp("", "wg-portal-helper-*")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), content, 0o600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package internal
+
+import (
+	"errors"
+	"net"
+)
+
+// peerUID returns the user of the process at the other end of the unix socket connection,
+// which is only supported on Linux
+func peerUID(net.Conn) (uint32, error) {
+	return 0, errors.ErrUnsupported
+}
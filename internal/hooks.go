@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// hookResponseLimit is the size of the responses of the HTTP hooks kept in the operation output
+const hookResponseLimit = 4096
+
+// Events of the toggle hooks
+const (
+	HookPreStop   = "pre_stop"
+	HookPostStart = "post_start"
+)
+
+// HooksConfig holds the hooks run around the toggles of the connections, like pausing the
+// downloads before a connection is stopped or updating a DDNS record after one is started
+type HooksConfig struct {
+	PreStop   []Hook `yaml:"pre_stop"`
+	PostStart []Hook `yaml:"post_start"`
+	// TimeoutSeconds bounds the HTTP hooks, the commands are bounded by command_timeout_seconds
+	TimeoutSeconds int `yaml:"timeout_seconds"`
+}
+
+// Hook is a command or an HTTP call, {connection} is replaced by the name of the connection
+type Hook struct {
+	// Command is split on whitespace and run without a shell, include sudo when needed
+	Command string `yaml:"command"`
+	// URL is called with Method, POST by default, the POST and PUT requests sending
+	// the connection and the event as JSON
+	URL    string `yaml:"url"`
+	Method string `yaml:"method"`
+	// Connections restrict the hook to the connections, it runs for all of them by default
+	Connections []string `yaml:"connections"`
+}
+
+// HookEvent is the body of the POST and PUT requests of the HTTP hooks
+type HookEvent struct {
+	Event      string    `json:"event"`
+	Connection string    `json:"connection"`
+	Time       time.Time `json:"time"`
+}
+
+func (c HooksConfig) validate() error {
+	for event, hooks := range map[string][]Hook{HookPreStop: c.PreStop, HookPostStart: c.PostStart} {
+		for i, hook := range hooks {
+			if err := hook.validate(); err != nil {
+				return fmt.Errorf("invalid %s hook %d: %w", event, i+1, err)
+			}
+		}
+	}
+	if c.TimeoutSeconds <= 0 {
+		return errors.New("timeout_seconds must be positive")
+	}
+	return nil
+}
+
+func (h Hook) validate() error {
+	switch {
+	case (h.Command == "") == (h.URL == ""):
+		return errors.New("either command or url is required")
+	case h.Command != "" && len(strings.Fields(h.Command)) == 0:
+		return errors.New("command is blank")
+	case h.Command != "":
+		return nil
+	}
+	parsed, err := url.Parse(strings.ReplaceAll(h.URL, "{connection}", "wg0"))
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return fmt.Errorf("invalid url %q", h.URL)
+	}
+	if h.Method != "" && !slices.Contains([]string{http.MethodGet, http.MethodPost, http.MethodPut}, h.Method) {
+		return fmt.Errorf("method must be GET, POST or PUT, got %q", h.Method)
+	}
+	return nil
+}
+
+// describe returns the command or the method and URL of the hook for the connection
+func (h Hook) describe(name string) string {
+	if h.Command != "" {
+		return strings.ReplaceAll(h.Command, "{connection}", name)
+	}
+	return h.method() + " " + strings.ReplaceAll(h.URL, "{connection}", name)
+}
+
+func (h Hook) method() string {
+	if h.Method == "" {
+		return http.MethodPost
+	}
+	return h.Method
+}
+
+// runHooks runs the hooks of the event for the connection in order, returning their output
+// for the operation output. A failing hook is logged and doesn't fail the toggle.
+func (m *WireGuardManager) runHooks(event string, hooks []Hook, name string) []byte {
+	var output bytes.Buffer
+	for _, hook := range hooks {
+		if len(hook.Connections) > 0 && !slices.Contains(hook.Connections, name) {
+			continue
+		}
+		fmt.Fprintf(&output, "%s hook %s\n", event, hook.describe(name))
+		var out []byte
+		var err error
+		if hook.Command != "" {
+			fields := strings.Fields(strings.ReplaceAll(hook.Command, "{connection}", name))
+			out, err = m.runner.CombinedOutput(fields[0], fields[1:]...)
+		} else {
+			out, err = m.callHook(event, hook, name)
+		}
+		output.Write(out)
+		if len(out) > 0 && !bytes.HasSuffix(out, []byte("\n")) {
+			output.WriteByte('\n')
+		}
+		if err != nil {
+			log.Printf("Failed to run the %s hook %s of %s: %v", event, hook.describe(name), name, err)
+			fmt.Fprintf(&output, "%s hook failed: %v\n", event, err)
+		}
+	}
+	return output.Bytes()
+}
+
+// callHook calls the URL of the HTTP hook, returning the beginning of the response
+func (m *WireGuardManager) callHook(event string, hook Hook, name string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.config.Hooks.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	var body io.Reader
+	if hook.method() != http.MethodGet {
+		data, err := json.Marshal(HookEvent{Event: event, Connection: name, Time: time.Now()})
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	hookURL := strings.ReplaceAll(hook.URL, "{connection}", url.PathEscape(name))
+	request, err := http.NewRequestWithContext(ctx, hook.method(), hookURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(response.Body, hookResponseLimit))
+	if response.StatusCode >= http.StatusBadRequest {
+		return data, fmt.Errorf("hook returned %s", response.Status)
+	}
+	return data, nil
+}
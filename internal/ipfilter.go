@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+// IPFilterConfig restricts the client addresses reaching the portal, whatever the route.
+// The client address is taken from X-Forwarded-For behind the proxy_auth trusted proxies.
+type IPFilterConfig struct {
+	// Allow are the networks allowed to reach the portal, all of them when empty
+	Allow []string `yaml:"allow"`
+	// Deny are the networks denied even when allowed
+	Deny []string `yaml:"deny"`
+}
+
+func (c IPFilterConfig) validate() error {
+	for _, network := range slices.Concat(c.Allow, c.Deny) {
+		if _, err := netip.ParsePrefix(network); err != nil {
+			return fmt.Errorf("invalid network %q", network)
+		}
+	}
+	return nil
+}
+
+// Configured reports whether the client addresses are filtered
+func (c IPFilterConfig) Configured() bool {
+	return len(c.Allow) > 0 || len(c.Deny) > 0
+}
+
+// Allows reports whether the client address can reach the portal
+func (c IPFilterConfig) Allows(addr string) bool {
+	if !c.Configured() {
+		return true
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	if containsAddr(c.Deny, ip) {
+		return false
+	}
+	return len(c.Allow) == 0 || containsAddr(c.Allow, ip)
+}
+
+// containsAddr reports whether one of the networks contains the address
+func containsAddr(networks []string, ip netip.Addr) bool {
+	for _, network := range networks {
+		if prefix, err := netip.ParsePrefix(network); err == nil && prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+// IPv6 check modes of the connection settings
+const (
+	IPv6CheckWarn   = "warn"
+	IPv6CheckRefuse = "refuse"
+)
+
+// ipv6RoutesPath lists the IPv6 routing table of the host
+const ipv6RoutesPath = "/proc/net/ipv6_route"
+
+// ErrIPv6Unavailable is returned when starting an IPv6-only connection on a host without IPv6
+var ErrIPv6Unavailable = errors.New("host has no working IPv6")
+
+// checkIPv6 verifies the host can route an IPv6-only connection, returning a warning
+// or an error depending on the connection ipv6_check setting
+func (m *WireGuardManager) checkIPv6(name string, excluded []string) (string, error) {
+	mode := m.config.Connections[name].IPv6Check
+	if mode != IPv6CheckWarn && mode != IPv6CheckRefuse {
+		return "", nil
+	}
+	config, err := ParseConfig(m.configPath(name))
+	if err != nil {
+		return "", err
+	}
+	if !config.isIPv6Only() {
+		return "", nil
+	}
+
+	if err := hostHasIPv6(excluded); err != nil {
+		if mode == IPv6CheckRefuse {
+			return "", fmt.Errorf("%w: %w", ErrIPv6Unavailable, err)
+		}
+		return fmt.Sprintf("Connection %s is IPv6-only but %v", name, err), nil
+	}
+	return "", nil
+}
+
+// isIPv6Only reports whether all interface addresses and peer AllowedIPs are IPv6
+func (c *WireGuardConfig) isIPv6Only() bool {
+	addresses := slices.Clone(c.Interface.Address)
+	for _, peer := range c.Peers {
+		addresses = append(addresses, peer.AllowedIPs...)
+	}
+	if len(addresses) == 0 {
+		return false
+	}
+	for _, address := range addresses {
+		prefix, err := netip.ParsePrefix(address)
+		if err != nil || !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+			return false
+		}
+	}
+	return true
+}
+
+// hostHasIPv6 checks the host has a global IPv6 address and a default IPv6 route,
+// ignoring the excluded interfaces (the WireGuard connections themselves)
+func hostHasIPv6(excluded []string) error {
+	if !hasGlobalIPv6Address(excluded) {
+		return errors.New("host has no global IPv6 address")
+	}
+	hasRoute, err := hasDefaultIPv6Route(excluded)
+	if err != nil {
+		return err
+	}
+	if !hasRoute {
+		return errors.New("host has no default IPv6 route")
+	}
+	return nil
+}
+
+func hasGlobalIPv6Address(excluded []string) bool {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return false
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || slices.Contains(excluded, iface.Name) {
+			continue
+		}
+		addresses, _ := iface.Addrs()
+		for _, address := range addresses {
+			ip, _, _ := net.ParseCIDR(address.String())
+			if ip != nil && ip.To4() == nil && ip.IsGlobalUnicast() && !ip.IsPrivate() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasDefaultIPv6Route looks up a ::/0 route in the kernel routing table
+func hasDefaultIPv6Route(excluded []string) (bool, error) {
+	file, err := os.Open(ipv6RoutesPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read IPv6 routes: %w", err)
+	}
+	defer file.Close()
+
+	defaultDestination := strings.Repeat("0", 32)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// destination, prefix length, source, source prefix length, next hop, metric, refs, use, flags, device
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[0] != defaultDestination || fields[1] != "00" {
+			continue
+		}
+		if device := fields[9]; device != "lo" && !slices.Contains(excluded, device) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
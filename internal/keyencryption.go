@@ -0,0 +1,332 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// encryptedKeyPrefix starts the encrypted private keys of the configs and the peer keys file,
+// followed by the base64 AES-GCM nonce and encrypted key
+const encryptedKeyPrefix = "wgp-enc:"
+
+// keyEncryptionFile is the file of the state directory keeping the salt deriving the key
+// encryption key from the master key, shared by the profiles
+const keyEncryptionFile = "key-encryption.json"
+
+// keyEncryptionCheck is encrypted in the key encryption file, a master key failing to decrypt it is wrong
+const keyEncryptionCheck = "wg-portal key encryption"
+
+// minMasterKeyLength is the minimum length of the master key
+const minMasterKeyLength = 16
+
+var (
+	// ErrMasterKey is returned on startup for a missing, too short or wrong master key
+	ErrMasterKey = errors.New("invalid master key")
+	// ErrEncryptedKey is returned for the encrypted private keys the portal can't decrypt
+	ErrEncryptedKey = errors.New("private key can't be decrypted")
+)
+
+// KeyEncryptionConfig keeps the private keys of the configs and of the generated peers encrypted
+// at rest, they're only decrypted to bring the connections up and to derive the public keys
+type KeyEncryptionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MasterKeyEnv is the environment variable holding the master key, which is prompted for
+	// on the terminal when it's unset
+	MasterKeyEnv string `yaml:"master_key_env"`
+}
+
+func (c KeyEncryptionConfig) validate() error {
+	if c.Enabled && c.MasterKeyEnv == "" {
+		return errors.New("master_key_env is required")
+	}
+	return nil
+}
+
+// keyEncryptionState is the content of the key encryption file
+type keyEncryptionState struct {
+	Memory  uint32 `json:"memory"`
+	Time    uint32 `json:"time"`
+	Threads uint8  `json:"threads"`
+	Salt    []byte `json:"salt"`
+	// Check is keyEncryptionCheck encrypted with the key encryption key
+	Check string `json:"check"`
+}
+
+// KeyCipher encrypts and decrypts the private keys, a nil cipher keeps them in plaintext
+type KeyCipher struct {
+	aead cipher.AEAD
+}
+
+var (
+	// masterKeys caches the master keys by environment variable, so the profiles sharing
+	// one only prompt for it once
+	masterKeys      = make(map[string]string)
+	masterKeysMutex sync.Mutex
+)
+
+// LoadKeyCipher derives the cipher of the private keys from the master key when the key
+// encryption is enabled. The key encryption file of the state directory is created on first
+// use, a master key which doesn't match it afterwards fails.
+func (c *Config) LoadKeyCipher() error {
+	if !c.KeyEncryption.Enabled {
+		return nil
+	}
+	masterKey, err := readMasterKey(c.KeyEncryption.MasterKeyEnv)
+	if err != nil {
+		return err
+	}
+	keys, err := loadKeyCipher(filepath.Join(c.StateDir, keyEncryptionFile), masterKey)
+	if err != nil {
+		return err
+	}
+	c.keys = keys
+	return nil
+}
+
+// readMasterKey reads the master key from the environment variable, or prompts for it on the
+// terminal. The variable is unset, the commands run by the portal don't inherit it.
+func readMasterKey(env string) (string, error) {
+	masterKeysMutex.Lock()
+	defer masterKeysMutex.Unlock()
+	if masterKey, ok := masterKeys[env]; ok {
+		return masterKey, nil
+	}
+	masterKey := os.Getenv(env)
+	if err := os.Unsetenv(env); err != nil {
+		return "", err
+	}
+	if fd := int(os.Stdin.Fd()); masterKey == "" && IsTerminal(fd) {
+		fmt.Fprintf(os.Stderr, "Master key of the private keys (%s): ", env)
+		var err error
+		masterKey, err = ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the master key: %w", err)
+		}
+	}
+	if masterKey == "" {
+		return "", fmt.Errorf("%w: set %s or start the portal from a terminal", ErrMasterKey, env)
+	}
+	if len(masterKey) < minMasterKeyLength {
+		return "", fmt.Errorf("%w: it must be at least %d characters", ErrMasterKey, minMasterKeyLength)
+	}
+	masterKeys[env] = masterKey
+	return masterKey, nil
+}
+
+// loadKeyCipher derives the cipher from the master key and the salt of the key encryption file,
+// creating the file with a new salt when it doesn't exist
+func loadKeyCipher(path, masterKey string) (*KeyCipher, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return createKeyCipher(path, masterKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key encryption file: %w", err)
+	}
+	var state keyEncryptionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	// argon2 panics with a zero time
+	if state.Time == 0 || state.Threads == 0 || len(state.Salt) != argon2SaltLen {
+		return nil, fmt.Errorf("invalid key derivation parameters in %s", path)
+	}
+	params := argon2Params{memory: state.Memory, time: state.Time, threads: state.Threads}
+	aead, err := passphraseCipher(masterKey, state.Salt, params)
+	if err != nil {
+		return nil, err
+	}
+	keys := &KeyCipher{aead: aead}
+	if check, err := keys.open(state.Check); err != nil || string(check) != keyEncryptionCheck {
+		return nil, fmt.Errorf("%w: it doesn't decrypt the keys encrypted with %s", ErrMasterKey, path)
+	}
+	return keys, nil
+}
+
+func createKeyCipher(path, masterKey string) (*KeyCipher, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate key encryption salt: %w", err)
+	}
+	params := currentArgon2Params
+	aead, err := passphraseCipher(masterKey, salt, params)
+	if err != nil {
+		return nil, err
+	}
+	keys := &KeyCipher{aead: aead}
+	check, err := keys.seal([]byte(keyEncryptionCheck))
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(&keyEncryptionState{
+		Memory: params.memory, Time: params.time, Threads: params.threads, Salt: salt, Check: check,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return nil, fmt.Errorf("failed to write key encryption file: %w", err)
+	}
+	log.Printf("Created the key encryption file %s", path)
+	return keys, nil
+}
+
+// encrypt encrypts a base64 private key, the encrypted keys and the keys of a nil cipher
+// are returned as they are
+func (c *KeyCipher) encrypt(key string) (string, error) {
+	if c == nil || strings.HasPrefix(key, encryptedKeyPrefix) {
+		return key, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 32 {
+		return "", errors.New("invalid private key")
+	}
+	return c.seal(decoded)
+}
+
+// decrypt returns the base64 private key of an encrypted key, the plaintext keys are returned
+// as they are
+func (c *KeyCipher) decrypt(key string) (string, error) {
+	if !strings.HasPrefix(key, encryptedKeyPrefix) {
+		return key, nil
+	}
+	if c == nil {
+		return "", fmt.Errorf("%w: the key encryption is disabled", ErrEncryptedKey)
+	}
+	decoded, err := c.open(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(decoded), nil
+}
+
+func (c *KeyCipher) seal(plaintext []byte) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return encryptedKeyPrefix + base64.StdEncoding.EncodeToString(c.aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func (c *KeyCipher) open(value string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedKeyPrefix))
+	if err != nil || len(decoded) < c.aead.NonceSize() {
+		return nil, fmt.Errorf("%w: malformed encrypted key", ErrEncryptedKey)
+	}
+	size := c.aead.NonceSize()
+	plaintext, err := c.aead.Open(nil, decoded[:size], decoded[size:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: it was encrypted with another master key", ErrEncryptedKey)
+	}
+	return plaintext, nil
+}
+
+// isEncryptedKey reports whether the value has the format of an encrypted private key
+func isEncryptedKey(value string) bool {
+	encoded, found := strings.CutPrefix(value, encryptedKeyPrefix)
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	// The AES-GCM nonce, the 32 bytes of the key and the tag
+	return found && err == nil && len(decoded) == 12+32+16
+}
+
+// sealConfig encrypts the plaintext private key of the config file, checking an encrypted
+// one decrypts. Without key encryption, the configs with an encrypted key are rejected.
+func (c *KeyCipher) sealConfig(content []byte) ([]byte, error) {
+	return rewritePrivateKey(content, func(key string) (string, error) {
+		if _, err := c.decrypt(key); err != nil {
+			return "", fmt.Errorf("%w: PrivateKey: %w", ErrInvalidConfig, err)
+		}
+		return c.encrypt(key)
+	})
+}
+
+// openConfig decrypts the private key of the config file, for wg-quick
+func (c *KeyCipher) openConfig(content []byte) ([]byte, error) {
+	return rewritePrivateKey(content, c.decrypt)
+}
+
+// sameConfig reports whether the config files are the same once their private keys are decrypted
+func (c *KeyCipher) sameConfig(a, b []byte) bool {
+	openedA, errA := c.openConfig(a)
+	openedB, errB := c.openConfig(b)
+	return errA == nil && errB == nil && bytes.Equal(openedA, openedB)
+}
+
+// rewritePrivateKey rewrites the PrivateKey of the [Interface] section of the config file,
+// keeping the other lines as written
+func rewritePrivateKey(content []byte, rewrite func(key string) (string, error)) ([]byte, error) {
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	var section string
+	for i, line := range lines {
+		setting, _, _ := strings.Cut(string(line), "#")
+		setting = strings.TrimSpace(setting)
+		if strings.HasPrefix(setting, "[") && strings.HasSuffix(setting, "]") {
+			section = strings.ToLower(strings.TrimSpace(setting[1 : len(setting)-1]))
+			continue
+		}
+		key, value, found := strings.Cut(setting, "=")
+		if section != "interface" || !found || !strings.EqualFold(strings.TrimSpace(key), "PrivateKey") {
+			continue
+		}
+		rewritten, err := rewrite(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		lineEnd := line[len(bytes.TrimRight(line, "\r\n")):]
+		lines[i] = append([]byte(strings.TrimSpace(key)+" = "+rewritten), lineEnd...)
+	}
+	return bytes.Join(lines, nil), nil
+}
+
+// EncryptPrivateKeys encrypts the plaintext private keys of the config files and of the peer keys
+// file, like those written before the key encryption was enabled. A config failing to be encrypted
+// is logged and left as it is. It does nothing without key encryption.
+func (m *WireGuardManager) EncryptPrivateKeys() error {
+	if m.config.keys == nil {
+		return nil
+	}
+	m.peersMutex.Lock()
+	defer m.peersMutex.Unlock()
+	allConnections, err := m.getAllConnections()
+	if err != nil {
+		return err
+	}
+	for _, name := range allConnections {
+		if err := m.encryptConfigKey(name); err != nil {
+			log.Printf("Failed to encrypt the private key of %s: %v", name, err)
+		}
+	}
+	return m.encryptPeerKeys()
+}
+
+// encryptConfigKey encrypts the private key of the config file of the connection, the connections
+// without a config file are skipped
+func (m *WireGuardManager) encryptConfigKey(name string) error {
+	content, err := os.ReadFile(m.configPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	sealed, err := m.config.keys.sealConfig(content)
+	if err != nil || bytes.Equal(sealed, content) {
+		return err
+	}
+	if err := writeFileAtomic(m.configPath(name), sealed); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	log.Printf("Encrypted the private key of %s", name)
+	return nil
+}
@@ -0,0 +1,412 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// keyRotationInterval is the interval between the checks of the rotations
+const keyRotationInterval = time.Minute
+
+// ErrRotationPending is returned when rotating the key of a peer whose rotation isn't completed
+var ErrRotationPending = errors.New("key rotation of the peer is pending")
+
+// Actions of the key rotation events
+const (
+	RotationStarted   = "started"
+	RotationCompleted = "completed"
+)
+
+// KeyRotationConfig rotates the keys of the peers whose private key the portal generated.
+// The keys of the interfaces aren't rotated: their peers would all stop working at once.
+type KeyRotationConfig struct {
+	// IntervalDays is the age of the keys rotated (0 disables the scheduled rotations)
+	IntervalDays int `yaml:"interval_days"`
+	// GraceHours is how long the old key stays valid at most, until the new key completes a handshake
+	GraceHours int `yaml:"grace_hours"`
+}
+
+func (c KeyRotationConfig) validate() error {
+	if c.IntervalDays < 0 {
+		return errors.New("interval_days must not be negative")
+	}
+	if c.GraceHours <= 0 {
+		return errors.New("grace_hours must be positive")
+	}
+	return nil
+}
+
+// KeyRotation is a pending rotation of the key of a peer. During the grace window the new peer
+// is in the config without allowed IPs, the old peer keeps them until the new key completes
+// a handshake or the window ends, then the new peer gets them and the old peer is removed.
+type KeyRotation struct {
+	Connection   string `json:"connection"`
+	OldPublicKey string `json:"old_public_key"`
+	NewPublicKey string `json:"new_public_key"`
+	// NewID identifies the new peer in the URL of its client config
+	NewID   string    `json:"new_id"`
+	Started time.Time `json:"started"`
+	// Deadline is the end of the grace window
+	Deadline time.Time `json:"deadline"`
+}
+
+// KeyRotationEvent is the start or the completion of a rotation
+type KeyRotationEvent struct {
+	*KeyRotation
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+// keyRotationState is the persisted state of the rotations
+type keyRotationState struct {
+	Pending []*KeyRotation `json:"pending"`
+	// Rotated are the times of the last rotation of the keys, or when they were first seen,
+	// by connection and public key
+	Rotated map[string]map[string]time.Time `json:"rotated"`
+}
+
+// clone copies the state, the rotations are never modified
+func (s keyRotationState) clone() keyRotationState {
+	clone := keyRotationState{Pending: slices.Clone(s.Pending), Rotated: make(map[string]map[string]time.Time)}
+	for connection, keys := range s.Rotated {
+		clone.Rotated[connection] = maps.Clone(keys)
+	}
+	return clone
+}
+
+// KeyRotationStore holds the rotations of the peers of the connections of the profile,
+// persisted in the state directory
+type KeyRotationStore struct {
+	path  string
+	state keyRotationState
+	mutex sync.RWMutex
+}
+
+func NewKeyRotationStore(profile string, config *Config) (*KeyRotationStore, error) {
+	store := &KeyRotationStore{
+		path:  filepath.Join(config.StateDir, profileStateFile("key-rotation", ".json", profile)),
+		state: keyRotationState{Rotated: make(map[string]map[string]time.Time)},
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// List returns the pending rotations of the granted connections, oldest first
+func (s *KeyRotationStore) List(grants ConnectionGrants) []*KeyRotation {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	rotations := []*KeyRotation{}
+	for _, rotation := range s.state.Pending {
+		if grants.Allows(rotation.Connection) {
+			rotations = append(rotations, rotation)
+		}
+	}
+	return rotations
+}
+
+// pending returns the pending rotation of the peer, whether it's the old or the new peer
+func (s *KeyRotationStore) pending(connection, publicKey string) *KeyRotation {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, rotation := range s.state.Pending {
+		if rotation.Connection == connection &&
+			(rotation.OldPublicKey == publicKey || rotation.NewPublicKey == publicKey) {
+			return rotation
+		}
+	}
+	return nil
+}
+
+func (s *KeyRotationStore) add(rotation *KeyRotation) error {
+	return s.update(func(state *keyRotationState) {
+		state.Pending = append(state.Pending, rotation)
+	})
+}
+
+// finish removes the pending rotation, the new key being rotated at the time
+func (s *KeyRotationStore) finish(rotation *KeyRotation, now time.Time) error {
+	return s.update(func(state *keyRotationState) {
+		state.Pending = slices.DeleteFunc(state.Pending, func(r *KeyRotation) bool {
+			return r.Connection == rotation.Connection && r.NewPublicKey == rotation.NewPublicKey
+		})
+		if state.Rotated[rotation.Connection] == nil {
+			state.Rotated[rotation.Connection] = make(map[string]time.Time)
+		}
+		delete(state.Rotated[rotation.Connection], rotation.OldPublicKey)
+		state.Rotated[rotation.Connection][rotation.NewPublicKey] = now
+	})
+}
+
+// rotatedAt returns the time of the last rotation of the key, recording the time as the
+// rotation of the keys never seen before
+func (s *KeyRotationStore) rotatedAt(connection, publicKey string, now time.Time) (time.Time, error) {
+	s.mutex.RLock()
+	rotated, ok := s.state.Rotated[connection][publicKey]
+	s.mutex.RUnlock()
+	if ok {
+		return rotated, nil
+	}
+	return now, s.update(func(state *keyRotationState) {
+		if state.Rotated[connection] == nil {
+			state.Rotated[connection] = make(map[string]time.Time)
+		}
+		state.Rotated[connection][publicKey] = now
+	})
+}
+
+// RenameConnection moves the rotations of the renamed connection to its new name
+func (s *KeyRotationStore) RenameConnection(name, newName string) error {
+	if !s.hasConnection(name) {
+		return nil
+	}
+	return s.update(func(state *keyRotationState) {
+		for i, rotation := range state.Pending {
+			if rotation.Connection == name {
+				renamed := *rotation
+				renamed.Connection = newName
+				state.Pending[i] = &renamed
+			}
+		}
+		if keys, ok := state.Rotated[name]; ok {
+			state.Rotated[newName] = keys
+			delete(state.Rotated, name)
+		}
+	})
+}
+
+// DeleteConnection removes the rotations of the deleted connection
+func (s *KeyRotationStore) DeleteConnection(name string) error {
+	if !s.hasConnection(name) {
+		return nil
+	}
+	return s.update(func(state *keyRotationState) {
+		state.Pending = slices.DeleteFunc(state.Pending, func(r *KeyRotation) bool { return r.Connection == name })
+		delete(state.Rotated, name)
+	})
+}
+
+// hasConnection reports whether the connection has pending or completed rotations
+func (s *KeyRotationStore) hasConnection(name string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, rotated := s.state.Rotated[name]
+	return rotated || slices.ContainsFunc(s.state.Pending, func(r *KeyRotation) bool { return r.Connection == name })
+}
+
+// update changes a copy of the state and persists it
+func (s *KeyRotationStore) update(change func(state *keyRotationState)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state := s.state.clone()
+	change(&state)
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save key rotations: %w", err)
+	}
+	s.state = state
+	return nil
+}
+
+func (s *KeyRotationStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read key rotations: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", s.path, err)
+	}
+	if s.state.Rotated == nil {
+		s.state.Rotated = make(map[string]map[string]time.Time)
+	}
+	return nil
+}
+
+// RotatePeerKey starts the rotation of the key of the peer: the portal generates the new key pair
+// for the client config of the new peer, added to the connection config without allowed IPs
+func (m *WireGuardManager) RotatePeerKey(name, publicKey string) (*KeyRotation, error) {
+	if m.rotations.pending(name, publicKey) != nil {
+		return nil, fmt.Errorf("%w: %s", ErrRotationPending, publicKey)
+	}
+	keyPair, err := GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	rotation := &KeyRotation{
+		Connection:   name,
+		OldPublicKey: publicKey,
+		NewPublicKey: keyPair.PublicKey,
+		NewID:        PeerID(keyPair.PublicKey),
+		Started:      now,
+		Deadline:     now.Add(time.Duration(m.config.KeyRotation.GraceHours) * time.Hour),
+	}
+	_, err = m.changePeers(name, func(config *WireGuardConfig) error {
+		index, err := findPeer(config, publicKey)
+		if err != nil {
+			return err
+		}
+		old := config.Peers[index]
+		config.Peers = append(config.Peers, &PeerConfig{
+			PublicKey:           keyPair.PublicKey,
+			PresharedKey:        old.PresharedKey,
+			Endpoint:            old.Endpoint,
+			PersistentKeepalive: old.PersistentKeepalive,
+		})
+		return m.setPeerKey(keyPair.PublicKey, keyPair.PrivateKey)
+	})
+	if err == nil {
+		err = m.rotations.add(rotation)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Started the key rotation of the peer %s of %s", PeerID(publicKey), name)
+	return rotation, nil
+}
+
+// KeyRotations returns the pending key rotations of the granted connections
+func (m *WireGuardManager) KeyRotations(grants ConnectionGrants) []*KeyRotation {
+	return m.rotations.List(grants)
+}
+
+// completeRotation gives the allowed IPs of the old peer to the new peer and removes the old peer.
+// The rotations whose old or new peer was removed meanwhile are dropped.
+func (m *WireGuardManager) completeRotation(rotation *KeyRotation, now time.Time) error {
+	_, err := m.changePeers(rotation.Connection, func(config *WireGuardConfig) error {
+		oldIndex, oldErr := findPeer(config, rotation.OldPublicKey)
+		newIndex, newErr := findPeer(config, rotation.NewPublicKey)
+		if oldErr == nil && newErr == nil {
+			config.Peers[newIndex].AllowedIPs = config.Peers[oldIndex].AllowedIPs
+			config.Peers = slices.Delete(config.Peers, oldIndex, oldIndex+1)
+			if err := m.moveExpiry(rotation.Connection, rotation.OldPublicKey, rotation.NewPublicKey); err != nil {
+				return err
+			}
+			return m.setPeerKey(rotation.OldPublicKey, "")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Completed the key rotation of the peer %s of %s", PeerID(rotation.OldPublicKey), rotation.Connection)
+	return m.rotations.finish(rotation, now)
+}
+
+// rotatingPeer returns the old peer of the pending rotation to the new key, nil without one
+func (m *WireGuardManager) rotatingPeer(config *WireGuardConfig, name, publicKey string) *PeerConfig {
+	rotation := m.rotations.pending(name, publicKey)
+	if rotation == nil || rotation.NewPublicKey != publicKey {
+		return nil
+	}
+	index, err := findPeer(config, rotation.OldPublicKey)
+	if err != nil {
+		return nil
+	}
+	return config.Peers[index]
+}
+
+// StartKeyRotation periodically completes the pending rotations and, when the scheduled
+// rotations are enabled, starts the rotations of the keys past the rotation interval
+func (m *WireGuardManager) StartKeyRotation(onEvent func(event *KeyRotationEvent)) {
+	go func() {
+		ticker := time.NewTicker(keyRotationInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			for _, event := range m.checkRotations(now) {
+				onEvent(event)
+			}
+		}
+	}()
+}
+
+func (m *WireGuardManager) checkRotations(now time.Time) []*KeyRotationEvent {
+	devices, err := m.readDevices()
+	if err != nil {
+		log.Printf("Failed to read the interfaces for the key rotations: %v", err)
+		return nil
+	}
+	var events []*KeyRotationEvent
+	for _, rotation := range m.rotations.List(nil) {
+		reason := rotationCompletion(rotation, devices, now)
+		if reason == "" {
+			continue
+		}
+		event := &KeyRotationEvent{KeyRotation: rotation, Action: RotationCompleted, Reason: reason}
+		if err := m.completeRotation(rotation, now); err != nil {
+			log.Printf("Failed to complete the key rotation of %s: %v", rotation.Connection, err)
+			event.Error = err.Error()
+		}
+		events = append(events, event)
+	}
+	if m.config.KeyRotation.IntervalDays > 0 {
+		events = append(events, m.scheduleRotations(now)...)
+	}
+	return events
+}
+
+// rotationCompletion returns why the rotation completes, empty while it's pending
+func rotationCompletion(rotation *KeyRotation, devices []*Device, now time.Time) string {
+	for _, device := range devices {
+		for _, peer := range device.Peers {
+			if device.Name == rotation.Connection && peer.PublicKey == rotation.NewPublicKey &&
+				peer.LatestHandshake.After(rotation.Started) {
+				return "the new key completed a handshake"
+			}
+		}
+	}
+	if !now.Before(rotation.Deadline) {
+		return "the grace window ended"
+	}
+	return ""
+}
+
+// scheduleRotations starts the rotations of the keys the portal generated past the rotation interval
+func (m *WireGuardManager) scheduleRotations(now time.Time) []*KeyRotationEvent {
+	allConnections, err := m.getAllConnections()
+	if err != nil {
+		log.Printf("Failed to list the connections for the key rotations: %v", err)
+		return nil
+	}
+	interval := time.Duration(m.config.KeyRotation.IntervalDays) * 24 * time.Hour
+	var events []*KeyRotationEvent
+	for _, name := range allConnections {
+		config, err := ParseConfig(m.configPath(name))
+		if err != nil {
+			continue
+		}
+		for _, peer := range config.Peers {
+			if _, err := m.peerKey(peer.PublicKey); err != nil || m.rotations.pending(name, peer.PublicKey) != nil {
+				continue
+			}
+			rotated, err := m.rotations.rotatedAt(name, peer.PublicKey, now)
+			if err != nil || now.Sub(rotated) < interval {
+				continue
+			}
+			event := &KeyRotationEvent{Action: RotationStarted, Reason: "scheduled"}
+			event.KeyRotation, err = m.RotatePeerKey(name, peer.PublicKey)
+			if err != nil {
+				log.Printf("Failed to rotate the key of the peer %s of %s: %v", PeerID(peer.PublicKey), name, err)
+				event.KeyRotation, event.Error = &KeyRotation{Connection: name, OldPublicKey: peer.PublicKey}, err.Error()
+			}
+			events = append(events, event)
+		}
+	}
+	return events
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+// KeyPair is a WireGuard key pair, base64 encoded like the keys of wg genkey and wg pubkey
+type KeyPair struct {
+	PrivateKey string `json:"private_key"`
+	PublicKey  string `json:"public_key"`
+}
+
+// GeneratePresharedKey generates a random preshared key, like wg genpsk
+func GeneratePresharedKey() (string, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key[:]), nil
+}
+
+// validKey reports whether the key is a base64 encoded 32 bytes WireGuard key
+func validKey(key string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(decoded) == 32
+}
+
+// GenerateKeyPair generates a Curve25519 key pair, so peers and interfaces can be
+// created without running wg genkey on the host
+func GenerateKeyPair() (*KeyPair, error) {
+	var private [32]byte
+	if _, err := rand.Read(private[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	// Clamp the private key like wg genkey does
+	private[0] &= 248
+	private[31] = (private[31] & 127) | 64
+
+	key, err := ecdh.X25519().NewPrivateKey(private[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return &KeyPair{
+		PrivateKey: base64.StdEncoding.EncodeToString(key.Bytes()),
+		PublicKey:  base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()),
+	}, nil
+}
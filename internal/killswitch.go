@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// KillSwitchConfig holds the firewall commands blocking non-tunnel traffic.
+// Commands are split on whitespace and run without a shell, include sudo when needed.
+type KillSwitchConfig struct {
+	EnableOnStartup bool     `yaml:"enable_on_startup"`
+	EnableCommands  []string `yaml:"enable_commands"`
+	DisableCommands []string `yaml:"disable_commands"`
+}
+
+// KillSwitch installs and removes the firewall rules dropping all egress outside of the tunnels.
+// Its state is persisted in the state directory since the rules outlive the portal process.
+type KillSwitch struct {
+	config  KillSwitchConfig
+	runner  CommandRunner
+	path    string
+	enabled bool
+	mutex   sync.Mutex
+}
+
+// killSwitchState is the persisted state of the kill switch
+type killSwitchState struct {
+	Enabled bool `json:"enabled"`
+}
+
+// ErrKillSwitchNotConfigured is returned when changing a kill switch without commands
+var ErrKillSwitchNotConfigured = errors.New("kill switch is not configured")
+
+// NewKillSwitch creates the kill switch of the profile, enabled when it was enabled
+// before the restart of the portal
+func NewKillSwitch(profile string, config *Config, runner CommandRunner) (*KillSwitch, error) {
+	k := &KillSwitch{
+		config: config.KillSwitch,
+		runner: runner,
+		path:   filepath.Join(config.StateDir, profileStateFile("kill-switch", ".json", profile)),
+	}
+	data, err := os.ReadFile(k.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kill switch state: %w", err)
+	}
+	var state killSwitchState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", k.path, err)
+	}
+	k.enabled = state.Enabled
+	return k, nil
+}
+
+// Configured reports whether the kill switch commands are set
+func (c KillSwitchConfig) Configured() bool {
+	return len(c.EnableCommands) > 0 && len(c.DisableCommands) > 0
+}
+
+// Configured reports whether the kill switch commands are set
+func (k *KillSwitch) Configured() bool {
+	return k.config.Configured()
+}
+
+func (k *KillSwitch) Enabled() bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.enabled
+}
+
+// Enable installs the firewall rules, the disable commands are run to roll back
+// the rules already installed when one of the enable commands fails.
+// Enabling an enabled kill switch does nothing, so the rules are never installed twice.
+func (k *KillSwitch) Enable() ([]byte, error) {
+	if !k.Configured() {
+		return nil, ErrKillSwitchNotConfigured
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.enabled {
+		return nil, nil
+	}
+	return k.enable()
+}
+
+// Restore installs the rules again on startup, when the kill switch was enabled before the
+// restart or is enabled on startup. The disable commands first remove the rules left over by
+// the previous run, which are gone after a reboot, so the rules are installed exactly once.
+func (k *KillSwitch) Restore() ([]byte, error) {
+	if !k.Configured() {
+		return nil, ErrKillSwitchNotConfigured
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	output, err := k.runCommands(k.config.DisableCommands)
+	if err != nil {
+		log.Printf("No kill switch rules to remove before restoring them: %v", err)
+	}
+	enableOutput, err := k.enable()
+	return append(output, enableOutput...), err
+}
+
+// enable runs the enable commands, it must be called holding the mutex
+func (k *KillSwitch) enable() ([]byte, error) {
+	output, err := k.runCommands(k.config.EnableCommands)
+	if err != nil {
+		log.Printf("Failed to enable kill switch, rolling back: %v", err)
+		rollbackOutput, _ := k.runCommands(k.config.DisableCommands)
+		k.setEnabled(false)
+		return append(output, rollbackOutput...), err
+	}
+	k.setEnabled(true)
+	log.Printf("Kill switch enabled")
+	return output, nil
+}
+
+// Disable removes the firewall rules, the enable commands are run again when one
+// of the disable commands fails so the kill switch fails closed.
+// The disable commands always run, the rules may be installed while the switch is
+// known disabled, like after a lost state file. Their failure then only logs, since
+// there may be no rules to remove, and the kill switch isn't restored.
+func (k *KillSwitch) Disable() ([]byte, error) {
+	if !k.Configured() {
+		return nil, ErrKillSwitchNotConfigured
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	output, err := k.runCommands(k.config.DisableCommands)
+	if err != nil && !k.enabled {
+		log.Printf("No kill switch rules to remove: %v", err)
+		return output, nil
+	}
+	if err != nil {
+		log.Printf("Failed to disable kill switch, restoring it: %v", err)
+		restoreOutput, _ := k.runCommands(k.config.EnableCommands)
+		return append(output, restoreOutput...), err
+	}
+	k.setEnabled(false)
+	log.Printf("Kill switch disabled")
+	return output, nil
+}
+
+// setEnabled changes and persists the state, it must be called holding the mutex.
+// A failure to persist only logs since the rules are changed anyway.
+func (k *KillSwitch) setEnabled(enabled bool) {
+	k.enabled = enabled
+	data, err := json.Marshal(killSwitchState{Enabled: enabled})
+	if err == nil {
+		err = writeFileAtomic(k.path, data)
+	}
+	if err != nil {
+		log.Printf("Failed to save kill switch state: %v", err)
+	}
+}
+
+// runCommands runs the commands in order, stopping at the first failure
+func (k *KillSwitch) runCommands(commands []string) ([]byte, error) {
+	var output []byte
+	for _, command := range commands {
+		fields := strings.Fields(command)
+		if len(fields) == 0 {
+			continue
+		}
+		out, err := k.runner.CombinedOutput(fields[0], fields[1:]...)
+		output = append(output, out...)
+		if err != nil {
+			return output, fmt.Errorf("failed to run %q: %w", command, err)
+		}
+	}
+	return output, nil
+}
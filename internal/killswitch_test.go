@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// recordingRunner records the commands, failing the iptables -D commands while no rule is installed
+type recordingRunner struct {
+	commands []string
+	rules    int
+}
+
+func (r *recordingRunner) CombinedOutput(name string, args ...string) ([]byte, error) {
+	command := strings.Join(append([]string{name}, args...), " ")
+	r.commands = append(r.commands, command)
+	switch {
+	case strings.Contains(command, " -I "):
+		r.rules++
+	case strings.Contains(command, " -D ") && r.rules == 0:
+		return nil, errors.New("bad rule")
+	case strings.Contains(command, " -D "):
+		r.rules--
+	}
+	return nil, nil
+}
+
+func (r *recordingRunner) Output(name string, args ...string) ([]byte, error) {
+	return r.CombinedOutput(name, args...)
+}
+
+func newTestKillSwitch(t *testing.T, config *Config, runner CommandRunner) *KillSwitch {
+	t.Helper()
+	killSwitch, err := NewKillSwitch(DefaultProfile, config, runner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return killSwitch
+}
+
+func TestKillSwitchSurvivesRestart(t *testing.T) {
+	config := DefaultConfig()
+	config.StateDir = t.TempDir()
+	config.KillSwitch = KillSwitchConfig{
+		EnableCommands:  []string{"iptables -I OUTPUT -j REJECT"},
+		DisableCommands: []string{"iptables -D OUTPUT -j REJECT"},
+	}
+	runner := &recordingRunner{}
+
+	if _, err := newTestKillSwitch(t, config, runner).Enable(); err != nil {
+		t.Fatal(err)
+	}
+	// The portal restarts while the rule stays installed
+	restarted := newTestKillSwitch(t, config, runner)
+	if !restarted.Enabled() {
+		t.Fatal("kill switch reported disabled after a restart")
+	}
+	if _, err := restarted.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if runner.rules != 1 {
+		t.Fatalf("%d rules installed after the restore, want 1", runner.rules)
+	}
+	if _, err := restarted.Disable(); err != nil {
+		t.Fatal(err)
+	}
+	if runner.rules != 0 || restarted.Enabled() {
+		t.Fatalf("%d rules installed after the disable (enabled %v), want none", runner.rules, restarted.Enabled())
+	}
+}
+
+func TestKillSwitchDisableWhileDisabled(t *testing.T) {
+	config := DefaultConfig()
+	config.StateDir = t.TempDir()
+	config.KillSwitch = KillSwitchConfig{
+		EnableCommands:  []string{"iptables -I OUTPUT -j REJECT"},
+		DisableCommands: []string{"iptables -D OUTPUT -j REJECT"},
+	}
+	runner := &recordingRunner{}
+
+	// Removing a rule that isn't there must not fail closed
+	if _, err := newTestKillSwitch(t, config, runner).Disable(); err != nil {
+		t.Fatal(err)
+	}
+	if runner.rules != 0 {
+		t.Fatalf("%d rules installed by disabling a disabled kill switch, want none", runner.rules)
+	}
+}
@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// pingPacketsRegex matches the packet counts of the ping summary
+	pingPacketsRegex = regexp.MustCompile(`(\d+) packets transmitted, (\d+) (?:packets )?received`)
+	// pingRTTRegex matches the round-trip times of the ping summary, in milliseconds
+	pingRTTRegex = regexp.MustCompile(`= ([\d.]+)/([\d.]+)/([\d.]+)`)
+)
+
+// LatencyConfig pings the connections periodically, to compare their latency and packet loss
+type LatencyConfig struct {
+	// IntervalSeconds is the interval between the pings (0 disables the monitor)
+	IntervalSeconds int `yaml:"interval_seconds"`
+	// Count is the number of echo requests sent to each connection
+	Count int `yaml:"count"`
+}
+
+func (c LatencyConfig) validate() error {
+	if c.IntervalSeconds < 0 {
+		return errors.New("interval_seconds must not be negative")
+	}
+	if c.IntervalSeconds > 0 && (c.Count < 1 || c.Count > 20) {
+		return errors.New("count must be between 1 and 20")
+	}
+	return nil
+}
+
+// LatencyResult is the outcome of the latest ping of a connection
+type LatencyResult struct {
+	Connection string `json:"connection"`
+	Target     string `json:"target"`
+	// ThroughTunnel reports whether the target was pinged through the active connection,
+	// the endpoint of an inactive connection is pinged directly
+	ThroughTunnel bool `json:"through_tunnel"`
+	Sent          int  `json:"sent"`
+	Received      int  `json:"received"`
+	// PacketLoss is the percentage of the echo requests without a reply
+	PacketLoss float64 `json:"packet_loss"`
+	// The round-trip times in milliseconds are unset without replies
+	MinMs *float64  `json:"min_ms"`
+	AvgMs *float64  `json:"avg_ms"`
+	MaxMs *float64  `json:"max_ms"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+// latencyTracker keeps the latest ping of each connection
+type latencyTracker struct {
+	results map[string]*LatencyResult
+	mutex   sync.Mutex
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{results: make(map[string]*LatencyResult)}
+}
+
+// StartLatencyMonitor pings all the connections every interval
+func (m *WireGuardManager) StartLatencyMonitor(config LatencyConfig) {
+	if config.IntervalSeconds <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.IntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			m.measureLatency(config.Count)
+			<-ticker.C
+		}
+	}()
+}
+
+// measureLatency pings the connections concurrently, replacing their previous results
+func (m *WireGuardManager) measureLatency(count int) {
+	connections, err := m.GetConnections()
+	if err != nil {
+		log.Printf("Failed to measure latency: %v", err)
+		return
+	}
+	results := make(map[string]*LatencyResult, len(connections))
+	var resultsMutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, connection := range connections {
+		wg.Go(func() {
+			result := m.pingConnection(connection, count)
+			resultsMutex.Lock()
+			defer resultsMutex.Unlock()
+			results[connection.Name] = result
+		})
+	}
+	wg.Wait()
+
+	m.latency.mutex.Lock()
+	defer m.latency.mutex.Unlock()
+	m.latency.results = results
+}
+
+// pingConnection pings the target of an active connection through its interface,
+// or the endpoint of an inactive one
+func (m *WireGuardManager) pingConnection(connection *WireGuardConnection, count int) *LatencyResult {
+	result := &LatencyResult{Connection: connection.Name, ThroughTunnel: connection.Active, Time: time.Now()}
+	config, err := ParseConfig(m.configPath(connection.Name))
+	if err == nil {
+		result.Target, err = m.pingTarget(connection, config)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	args := []string{"ping", "-n", "-q", "-c", strconv.Itoa(count), "-W", "1", result.Target}
+	if connection.Active {
+		// The interface of the active connection is in its network namespace
+		args = namespacedCommand(m.config.namespaceOf(connection.Name), slices.Insert(args, 1, "-I", connection.Name))
+	}
+	// ping exits with an error when no reply arrived, its summary is parsed anyway
+	output, err := m.runner.Output(args[0], args[1:]...)
+	if !result.parse(string(output)) {
+		result.Error = fmt.Sprintf("ping failed: %v", commandError(err, output))
+	}
+	return result
+}
+
+// pingTarget returns the ping_target of an active connection, defaulting to the first
+// DNS server of its config or the first single address routed to a peer. The target of
+// an inactive connection is the endpoint host of its first peer.
+func (m *WireGuardManager) pingTarget(connection *WireGuardConnection, config *WireGuardConfig) (string, error) {
+	if !connection.Active {
+		for _, peer := range config.Peers {
+			if host, _, err := net.SplitHostPort(peer.Endpoint); err == nil {
+				return host, nil
+			}
+		}
+		return "", errors.New("no peer endpoint to ping")
+	}
+	if target := m.config.Connections[connection.Name].PingTarget; target != "" {
+		return target, nil
+	}
+	for _, dns := range config.Interface.DNS {
+		if _, err := netip.ParseAddr(dns); err == nil {
+			return dns, nil
+		}
+	}
+	for _, prefix := range config.allowedPrefixes() {
+		if prefix.IsSingleIP() {
+			return prefix.Addr().String(), nil
+		}
+	}
+	return "", errors.New("no ping target, set the ping_target of the connection")
+}
+
+// parse reads the packet counts and the round-trip times of the ping summary,
+// reporting whether the summary was found
+func (r *LatencyResult) parse(output string) bool {
+	packets := pingPacketsRegex.FindStringSubmatch(output)
+	if packets == nil {
+		return false
+	}
+	r.Sent, _ = strconv.Atoi(packets[1])
+	r.Received, _ = strconv.Atoi(packets[2])
+	if r.Sent > 0 {
+		r.PacketLoss = float64(r.Sent-r.Received) * 100 / float64(r.Sent)
+	}
+	if rtt := pingRTTRegex.FindStringSubmatch(output); rtt != nil {
+		times := make([]*float64, 3)
+		for i := range times {
+			if value, err := strconv.ParseFloat(rtt[i+1], 64); err == nil {
+				times[i] = &value
+			}
+		}
+		r.MinMs, r.AvgMs, r.MaxMs = times[0], times[1], times[2]
+	}
+	return true
+}
+
+// GetLatency returns the latest ping of each granted connection, sorted by name
+func (m *WireGuardManager) GetLatency(grants ConnectionGrants) []*LatencyResult {
+	m.latency.mutex.Lock()
+	defer m.latency.mutex.Unlock()
+	results := []*LatencyResult{}
+	for name, result := range m.latency.results {
+		if grants.Allows(name) {
+			results = append(results, result)
+		}
+	}
+	slices.SortFunc(results, func(a, b *LatencyResult) int {
+		return strings.Compare(a.Connection, b.Connection)
+	})
+	return results
+}
@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Locked out kinds
+const (
+	LockoutAddr = "addr"
+	LockoutUser = "user"
+)
+
+// ErrLockoutNotFound is returned when unlocking a client address or an account which isn't locked out
+var ErrLockoutNotFound = errors.New("lockout not found")
+
+// LoginLimitConfig locks out the client addresses and the accounts with repeated failed logins
+type LoginLimitConfig struct {
+	// MaxAttempts is the number of failed logins before the lockout (0 disables the limit)
+	MaxAttempts int `yaml:"max_attempts"`
+	// LockoutSeconds is the first lockout, doubled on each further failed login
+	LockoutSeconds int `yaml:"lockout_seconds"`
+	// MaxLockoutSeconds caps the lockout, the failures are forgotten after it without failed logins
+	MaxLockoutSeconds int `yaml:"max_lockout_seconds"`
+}
+
+func (c LoginLimitConfig) validate() error {
+	if c.MaxAttempts < 0 {
+		return errors.New("max_attempts must not be negative")
+	}
+	if c.MaxAttempts > 0 && (c.LockoutSeconds <= 0 || c.MaxLockoutSeconds < c.LockoutSeconds) {
+		return errors.New("lockout_seconds must be positive and at most max_lockout_seconds")
+	}
+	return nil
+}
+
+// loginFailures are the failed logins of a client address or an account
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// Lockout is a client address or an account locked out by its failed logins
+type Lockout struct {
+	// Kind is LockoutAddr or LockoutUser, Value the client address or the username
+	Kind        string    `json:"kind"`
+	Value       string    `json:"value"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// LoginLimiter tracks the failed logins per client address and per account
+type LoginLimiter struct {
+	config   LoginLimitConfig
+	failures map[string]*loginFailures
+	mutex    sync.Mutex
+}
+
+func NewLoginLimiter(config LoginLimitConfig) *LoginLimiter {
+	limiter := &LoginLimiter{
+		config:   config,
+		failures: make(map[string]*loginFailures),
+	}
+	if config.MaxAttempts > 0 {
+		go limiter.cleanup()
+	}
+	return limiter
+}
+
+// Locked returns how long the logins of the client address or the account are locked out
+func (l *LoginLimiter) Locked(addr, username string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range loginKeys(addr, username) {
+		if failures, exists := l.failures[key]; exists {
+			wait = max(wait, failures.lockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// Fail records a failed login of the client address and the account, locking them out
+// past the max attempts, returning the longest lockout
+func (l *LoginLimiter) Fail(addr, username string) time.Duration {
+	if l.config.MaxAttempts == 0 {
+		return 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	var lockout time.Duration
+	for _, key := range loginKeys(addr, username) {
+		failures, exists := l.failures[key]
+		if !exists {
+			failures = &loginFailures{}
+			l.failures[key] = failures
+		}
+		failures.count++
+		failures.last = now
+		if failures.count >= l.config.MaxAttempts {
+			failures.lockedUntil = now.Add(l.lockout(failures.count))
+			lockout = max(lockout, failures.lockedUntil.Sub(now))
+		}
+	}
+	return lockout
+}
+
+// Lockouts returns the locked out client addresses and accounts, the longest lockout first
+func (l *LoginLimiter) Lockouts() []*Lockout {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	lockouts := []*Lockout{}
+	for key, failures := range l.failures {
+		if !failures.lockedUntil.After(now) {
+			continue
+		}
+		kind, value, _ := strings.Cut(key, ":")
+		lockouts = append(lockouts, &Lockout{
+			Kind:        kind,
+			Value:       value,
+			Failures:    failures.count,
+			LockedUntil: failures.lockedUntil,
+		})
+	}
+	slices.SortFunc(lockouts, func(a, b *Lockout) int {
+		return cmp.Or(b.LockedUntil.Compare(a.LockedUntil), cmp.Compare(a.Kind+":"+a.Value, b.Kind+":"+b.Value))
+	})
+	return lockouts
+}
+
+// Unlock forgets the failed logins of a locked out client address or account
+func (l *LoginLimiter) Unlock(kind, value string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	key := kind + ":" + value
+	failures, exists := l.failures[key]
+	if !exists || !failures.lockedUntil.After(time.Now()) {
+		return fmt.Errorf("%w: %s %s", ErrLockoutNotFound, kind, value)
+	}
+	delete(l.failures, key)
+	return nil
+}
+
+// Reset forgets the failed logins of the account after a successful login.
+// The client address keeps its failures, so logging in to an own account doesn't
+// allow guessing the passwords of the others.
+func (l *LoginLimiter) Reset(username string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.failures, LockoutUser+":"+username)
+}
+
+// lockout returns the lockout after the failed logins, doubling from the first lockout
+func (l *LoginLimiter) lockout(count int) time.Duration {
+	lockout := time.Duration(l.config.LockoutSeconds) * time.Second
+	maxLockout := time.Duration(l.config.MaxLockoutSeconds) * time.Second
+	for range count - l.config.MaxAttempts {
+		if lockout >= maxLockout {
+			break
+		}
+		lockout *= 2
+	}
+	return min(lockout, maxLockout)
+}
+
+// cleanup periodically forgets the failures without failed logins for the max lockout
+func (l *LoginLimiter) cleanup() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		l.mutex.Lock()
+		expired := time.Now().Add(-time.Duration(l.config.MaxLockoutSeconds) * time.Second)
+		for key, failures := range l.failures {
+			if failures.last.Before(expired) {
+				delete(l.failures, key)
+			}
+		}
+		l.mutex.Unlock()
+	}
+}
+
+func loginKeys(addr, username string) []string {
+	return []string{LockoutAddr + ":" + addr, LockoutUser + ":" + username}
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// MaintenanceWindow pauses the automated connection management while operators
+// change the tunnels by hand, it ends by itself once its duration passes.
+// Automated actions must check Active before changing any connection.
+type MaintenanceWindow struct {
+	until time.Time
+	// timer calls the ended function of Start once the window passes
+	timer *time.Timer
+	mutex sync.Mutex
+}
+
+// MaintenanceState is the maintenance window as reported by the API
+type MaintenanceState struct {
+	Active bool       `json:"active"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+func NewMaintenanceWindow() *MaintenanceWindow {
+	return &MaintenanceWindow{}
+}
+
+// Start opens (or extends) the window for the given duration, ended is called once it
+// ends by itself, unless it's stopped or extended before
+func (w *MaintenanceWindow) Start(duration time.Duration, ended func()) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.stopTimer()
+	until := time.Now().Add(duration)
+	w.until = until
+	w.timer = time.AfterFunc(duration, func() {
+		w.mutex.Lock()
+		current := w.until.Equal(until)
+		if current {
+			w.timer = nil
+		}
+		w.mutex.Unlock()
+		if current {
+			ended()
+		}
+	})
+}
+
+// Stop ends the window immediately
+func (w *MaintenanceWindow) Stop() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.stopTimer()
+	w.until = time.Time{}
+}
+
+// stopTimer cancels the end of the current window, it must be called holding the mutex
+func (w *MaintenanceWindow) stopTimer() {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
+
+func (w *MaintenanceWindow) Active() bool {
+	return w.State().Active
+}
+
+func (w *MaintenanceWindow) State() MaintenanceState {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !time.Now().Before(w.until) {
+		return MaintenanceState{}
+	}
+	until := w.until
+	return MaintenanceState{Active: true, Until: &until}
+}
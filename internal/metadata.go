@@ -0,0 +1,311 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// maxConnectionTags is the number of tags of a connection
+const maxConnectionTags = 20
+
+// Lengths of the connection details
+const (
+	maxNotesLength    = 2000
+	maxProviderLength = 64
+)
+
+var (
+	// tagRegex matches the tags, lowercased before they're validated
+	tagRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,31}$`)
+	// countryRegex matches the ISO 3166-1 alpha-2 country codes, uppercased before they're validated
+	countryRegex = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+var (
+	// ErrInvalidTag is returned for tags with other characters than letters, digits, '_', '.' and '-'
+	ErrInvalidTag = errors.New("invalid tag")
+	// ErrInvalidMetadata is returned for connection details too long or with an invalid country
+	ErrInvalidMetadata = errors.New("invalid metadata")
+)
+
+// ConnectionMetadata is what the portal keeps about a connection besides its config
+type ConnectionMetadata struct {
+	// Tags group the connections, like by usage or country
+	Tags []string `json:"tags,omitempty"`
+	ConnectionDetails
+}
+
+// ConnectionDetails describe a connection, like the provider and the location of its server
+type ConnectionDetails struct {
+	Notes    string `json:"notes,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	// Country is the ISO 3166-1 alpha-2 code of the location of the server
+	Country string `json:"country,omitempty"`
+	// Priority orders the connections, higher first
+	Priority int `json:"priority,omitempty"`
+}
+
+// normalize validates the details, returning them trimmed with the country uppercased
+func (d ConnectionDetails) normalize() (ConnectionDetails, error) {
+	d.Notes = strings.TrimSpace(d.Notes)
+	d.Provider = strings.TrimSpace(d.Provider)
+	d.Country = strings.ToUpper(strings.TrimSpace(d.Country))
+	switch {
+	case utf8.RuneCountInString(d.Notes) > maxNotesLength:
+		return d, fmt.Errorf("%w: notes are at most %d characters", ErrInvalidMetadata, maxNotesLength)
+	case utf8.RuneCountInString(d.Provider) > maxProviderLength:
+		return d, fmt.Errorf("%w: provider is at most %d characters", ErrInvalidMetadata, maxProviderLength)
+	case d.Country != "" && !countryRegex.MatchString(d.Country):
+		return d, fmt.Errorf("%w: country must be a two letter code, got %q", ErrInvalidMetadata, d.Country)
+	}
+	return d, nil
+}
+
+// countryFlag returns the flag emoji of the country code, made of its regional indicator symbols
+func countryFlag(country string) string {
+	if !countryRegex.MatchString(country) {
+		return ""
+	}
+	var flag strings.Builder
+	for _, letter := range country {
+		flag.WriteRune('\U0001F1E6' + letter - 'A')
+	}
+	return flag.String()
+}
+
+// TagCount is a tag and the number of connections tagged with it
+type TagCount struct {
+	Tag         string `json:"tag"`
+	Connections int    `json:"connections"`
+}
+
+// MetadataStore holds the metadata of the connections of the profile, persisted in the state directory
+type MetadataStore struct {
+	path        string
+	connections map[string]*ConnectionMetadata
+	mutex       sync.RWMutex
+}
+
+func NewMetadataStore(profile string, config *Config) (*MetadataStore, error) {
+	store := &MetadataStore{
+		path:        filepath.Join(config.StateDir, profileStateFile("metadata", ".json", profile)),
+		connections: make(map[string]*ConnectionMetadata),
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Get returns the metadata of the connection, empty when it has none
+func (s *MetadataStore) Get(name string) ConnectionMetadata {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	metadata, ok := s.connections[name]
+	if !ok {
+		return ConnectionMetadata{}
+	}
+	return ConnectionMetadata{Tags: slices.Clone(metadata.Tags), ConnectionDetails: metadata.ConnectionDetails}
+}
+
+// normalizeTags validates the tags, returning them lowercased, sorted and deduplicated
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !tagRegex.MatchString(tag) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidTag, tag)
+		}
+		normalized = append(normalized, tag)
+	}
+	slices.Sort(normalized)
+	normalized = slices.Compact(normalized)
+	if len(normalized) > maxConnectionTags {
+		return nil, fmt.Errorf("%w: a connection has at most %d tags", ErrInvalidTag, maxConnectionTags)
+	}
+	return normalized, nil
+}
+
+// normalize validates the tags and the details of the metadata, returning them normalized
+func (c ConnectionMetadata) normalize() (ConnectionMetadata, error) {
+	tags, err := normalizeTags(c.Tags)
+	if err != nil {
+		return c, err
+	}
+	details, err := c.ConnectionDetails.normalize()
+	if err != nil {
+		return c, err
+	}
+	return ConnectionMetadata{Tags: tags, ConnectionDetails: details}, nil
+}
+
+// SetTags replaces the tags of the connection, returning them lowercased, sorted and deduplicated
+func (s *MetadataStore) SetTags(name string, tags []string) ([]string, error) {
+	normalized, err := normalizeTags(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.update(name, func(metadata *ConnectionMetadata) {
+		metadata.Tags = normalized
+	})
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(normalized), nil
+}
+
+// SetDetails replaces the details of the connection, returning them normalized
+func (s *MetadataStore) SetDetails(name string, details ConnectionDetails) (ConnectionDetails, error) {
+	details, err := details.normalize()
+	if err != nil {
+		return details, err
+	}
+	return details, s.update(name, func(metadata *ConnectionMetadata) {
+		metadata.ConnectionDetails = details
+	})
+}
+
+// update changes a copy of the metadata of the connection and persists it,
+// the connections without metadata left aren't kept
+func (s *MetadataStore) update(name string, change func(metadata *ConnectionMetadata)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous, existed := s.connections[name]
+	metadata := &ConnectionMetadata{}
+	if existed {
+		*metadata = *previous
+	}
+	change(metadata)
+	if len(metadata.Tags) == 0 && metadata.ConnectionDetails == (ConnectionDetails{}) {
+		delete(s.connections, name)
+	} else {
+		s.connections[name] = metadata
+	}
+	return s.save(func() {
+		delete(s.connections, name)
+		if existed {
+			s.connections[name] = previous
+		}
+	})
+}
+
+// CountTags returns the tags of the granted connections with their number of connections, sorted
+func (s *MetadataStore) CountTags(grants ConnectionGrants) []*TagCount {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	counts := make(map[string]int)
+	for name, metadata := range s.connections {
+		if !grants.Allows(name) {
+			continue
+		}
+		for _, tag := range metadata.Tags {
+			counts[tag]++
+		}
+	}
+	tags := []*TagCount{}
+	for _, tag := range slices.Sorted(maps.Keys(counts)) {
+		tags = append(tags, &TagCount{Tag: tag, Connections: counts[tag]})
+	}
+	return tags
+}
+
+// RenameConnection moves the metadata of the renamed connection to its new name
+func (s *MetadataStore) RenameConnection(name, newName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	metadata, ok := s.connections[name]
+	if !ok {
+		return nil
+	}
+	previous, existed := s.connections[newName]
+	s.connections[newName] = metadata
+	delete(s.connections, name)
+	return s.save(func() {
+		s.connections[name] = metadata
+		delete(s.connections, newName)
+		if existed {
+			s.connections[newName] = previous
+		}
+	})
+}
+
+// DeleteConnection removes the metadata of the deleted connection
+func (s *MetadataStore) DeleteConnection(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	metadata, ok := s.connections[name]
+	if !ok {
+		return nil
+	}
+	delete(s.connections, name)
+	return s.save(func() { s.connections[name] = metadata })
+}
+
+// export returns the metadata of the connections having some
+func (s *MetadataStore) export(names []string) map[string]ConnectionMetadata {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	exported := make(map[string]ConnectionMetadata)
+	for _, name := range names {
+		if metadata, ok := s.connections[name]; ok {
+			exported[name] = ConnectionMetadata{Tags: slices.Clone(metadata.Tags), ConnectionDetails: metadata.ConnectionDetails}
+		}
+	}
+	return exported
+}
+
+// restore replaces the metadata of the connections by the restored metadata,
+// the connections without restored metadata lose theirs
+func (s *MetadataStore) restore(names []string, restored map[string]ConnectionMetadata) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous := maps.Clone(s.connections)
+	for _, name := range names {
+		delete(s.connections, name)
+		metadata, ok := restored[name]
+		if ok && (len(metadata.Tags) > 0 || metadata.ConnectionDetails != (ConnectionDetails{})) {
+			s.connections[name] = &metadata
+		}
+	}
+	return s.save(func() { s.connections = previous })
+}
+
+func (s *MetadataStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+	var connections map[string]*ConnectionMetadata
+	if err := json.Unmarshal(data, &connections); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", s.path, err)
+	}
+	maps.Copy(s.connections, connections)
+	return nil
+}
+
+// save persists the metadata, it must be called holding the mutex.
+// The change is reverted with undo when it can't be persisted.
+func (s *MetadataStore) save(undo func()) error {
+	data, err := json.MarshalIndent(s.connections, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		undo()
+		return fmt.Errorf("failed to save metadata: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+)
+
+// Bounds of the MTU of the interfaces
+const (
+	minMTU = 576
+	maxMTU = 65535
+)
+
+// ErrInvalidMTU is returned for MTUs out of bounds
+var ErrInvalidMTU = errors.New("mtu must be 0 or between 576 and 65535")
+
+// linkMTURegex matches the MTU of ip link show
+var linkMTURegex = regexp.MustCompile(`\bmtu (\d+)`)
+
+// MTUInfo is the MTU of a connection
+type MTUInfo struct {
+	// MTU is the MTU of the connection config, 0 when wg-quick picks it
+	MTU int `json:"mtu"`
+	// Current is the MTU of the interface of the active connection
+	Current int `json:"current,omitempty"`
+}
+
+// GetMTU returns the MTU of the connection config and of its interface when it's active
+func (m *WireGuardManager) GetMTU(name string) (*MTUInfo, error) {
+	connection, err := m.getConnection(name)
+	if err != nil {
+		return nil, err
+	}
+	config, err := m.connectionConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	info := &MTUInfo{MTU: config.Interface.MTU}
+	if connection.Active {
+		output, err := m.outputIn(name, "ip", "link", "show", "dev", name)
+		if match := linkMTURegex.FindSubmatch(output); err == nil && match != nil {
+			info.Current, _ = strconv.Atoi(string(match[1]))
+		}
+	}
+	return info, nil
+}
+
+// SetMTU rewrites the MTU of the connection config and sets it on the interface of the active
+// connection. With 0, an active connection is restarted for wg-quick to pick the MTU.
+func (m *WireGuardManager) SetMTU(name string, mtu int) (*ApplyResult, error) {
+	if mtu != 0 && (mtu < minMTU || mtu > maxMTU) {
+		return nil, ErrInvalidMTU
+	}
+	if err := m.writeMTU(name, mtu); err != nil {
+		return nil, err
+	}
+	log.Printf("Changed the MTU of %s to %d", name, mtu)
+	if mtu == 0 {
+		return m.restartActiveConnection(name)
+	}
+	m.operationMutex.Lock()
+	defer m.operationMutex.Unlock()
+	connection, err := m.getConnection(name)
+	if err != nil {
+		return nil, err
+	}
+	if !connection.Active {
+		return &ApplyResult{}, nil
+	}
+	output, err := m.combinedOutputIn(name, "sudo", "ip", "link", "set", "dev", name, "mtu", strconv.Itoa(mtu))
+	if err != nil {
+		err = fmt.Errorf("failed to set the MTU: %w", commandError(err, output))
+		m.setLastError(name, "mtu", err)
+		return nil, err
+	}
+	return &ApplyResult{Output: output}, nil
+}
+
+func (m *WireGuardManager) writeMTU(name string, mtu int) error {
+	m.peersMutex.Lock()
+	defer m.peersMutex.Unlock()
+	config, err := m.connectionConfig(name)
+	if err != nil {
+		return err
+	}
+	config.Interface.MTU = mtu
+	return m.writeConfig(name, config)
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// netlinkTimeout bounds the replies of the kernel to the netlink requests
+const netlinkTimeout = 5 * time.Second
+
+// netlinkReceiveSize is the size of the receive buffer, the kernel splits the dumps into messages of a page
+const netlinkReceiveSize = 64 * 1024
+
+// netlinkConn is a netlink socket, sending a request at a time
+type netlinkConn struct {
+	fd       int
+	sequence uint32
+}
+
+// dialNetlink opens a netlink socket of the protocol, like NETLINK_ROUTE or NETLINK_GENERIC
+func dialNetlink(protocol int) (*netlinkConn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, protocol)
+	if err != nil {
+		return nil, err
+	}
+	timeout := unix.NsecToTimeval(netlinkTimeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &netlinkConn{fd: fd}, nil
+}
+
+func (c *netlinkConn) close() {
+	unix.Close(c.fd)
+}
+
+// family returns the ID of the generic netlink family, resolved by the controller
+func (c *netlinkConn) family(name string) (uint16, error) {
+	messages, err := c.genericRequest(unix.GENL_ID_CTRL, unix.CTRL_CMD_GETFAMILY, 1, 0,
+		netlinkAttributeBytes(unix.CTRL_ATTR_FAMILY_NAME, append([]byte(name), 0)))
+	if err != nil {
+		return 0, err
+	}
+	if len(messages) == 0 || len(messages[0].Data) < unix.GENL_HDRLEN {
+		return 0, errors.New("empty reply")
+	}
+	id, ok := netlinkUint16(parseNetlinkAttributes(messages[0].Data[unix.GENL_HDRLEN:])[unix.CTRL_ATTR_FAMILY_ID])
+	if !ok {
+		return 0, errors.New("reply without family ID")
+	}
+	return id, nil
+}
+
+// genericRequest sends the command of the generic netlink family with its attributes
+func (c *netlinkConn) genericRequest(family uint16, command, version uint8, flags uint16,
+	attributes []byte) ([]syscall.NetlinkMessage, error) {
+	return c.request(family, flags, append([]byte{command, version, 0, 0}, attributes...))
+}
+
+// request sends the message and returns the replies, until the end of a dump or the acknowledgement
+func (c *netlinkConn) request(messageType, flags uint16, payload []byte) ([]syscall.NetlinkMessage, error) {
+	c.sequence++
+	length := unix.NLMSG_HDRLEN + len(payload)
+	request := make([]byte, unix.NLMSG_HDRLEN, length)
+	binary.NativeEndian.PutUint32(request[0:], uint32(length))
+	binary.NativeEndian.PutUint16(request[4:], messageType)
+	binary.NativeEndian.PutUint16(request[6:], unix.NLM_F_REQUEST|flags)
+	binary.NativeEndian.PutUint32(request[8:], c.sequence)
+	request = append(request, payload...)
+	if err := unix.Sendto(c.fd, request, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var replies []syscall.NetlinkMessage
+	buffer := make([]byte, netlinkReceiveSize)
+	for {
+		n, _, err := unix.Recvfrom(c.fd, buffer, 0)
+		if err != nil {
+			return nil, err
+		}
+		messages, err := syscall.ParseNetlinkMessage(buffer[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, message := range messages {
+			if message.Header.Seq != c.sequence {
+				continue
+			}
+			switch message.Header.Type {
+			case unix.NLMSG_DONE:
+				return replies, nil
+			case unix.NLMSG_ERROR:
+				if len(message.Data) < 4 {
+					return nil, errors.New("short netlink error")
+				}
+				if errno := -int32(binary.NativeEndian.Uint32(message.Data)); errno != 0 {
+					return nil, unix.Errno(errno)
+				}
+				return replies, nil
+			}
+			message.Data = slices.Clone(message.Data)
+			replies = append(replies, message)
+			if message.Header.Flags&unix.NLM_F_MULTI == 0 {
+				return replies, nil
+			}
+		}
+	}
+}
+
+// netlinkAttributeBytes encodes the attribute, padded to the attribute alignment
+func netlinkAttributeBytes(attributeType uint16, value []byte) []byte {
+	length := unix.SizeofRtAttr + len(value)
+	data := make([]byte, (length+unix.NLA_ALIGNTO-1)&^(unix.NLA_ALIGNTO-1))
+	binary.NativeEndian.PutUint16(data, uint16(length))
+	binary.NativeEndian.PutUint16(data[2:], attributeType)
+	copy(data[unix.SizeofRtAttr:], value)
+	return data
+}
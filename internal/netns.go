@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"regexp"
+	"slices"
+)
+
+// namespaceRegex matches the names of the network namespaces of ip netns
+var namespaceRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+// namespaces returns the network namespaces of the connection settings
+func (c *Config) namespaces() []string {
+	var namespaces []string
+	for _, settings := range c.Connections {
+		if settings.Namespace != "" && !slices.Contains(namespaces, settings.Namespace) {
+			namespaces = append(namespaces, settings.Namespace)
+		}
+	}
+	slices.Sort(namespaces)
+	return namespaces
+}
+
+// namespaceOf returns the network namespace of the connection, empty for the namespace of the portal
+func (c *Config) namespaceOf(name string) string {
+	return c.Connections[name].Namespace
+}
+
+// namespacedCommand returns the command running the args in the network namespace through
+// ip netns exec, as root since entering a namespace requires it. The args are unchanged for
+// the namespace of the portal.
+func namespacedCommand(namespace string, args []string) []string {
+	if namespace == "" {
+		return args
+	}
+	if args[0] == "sudo" {
+		args = args[1:]
+	}
+	return append([]string{"sudo", "ip", "netns", "exec", namespace}, args...)
+}
+
+// combinedOutputIn runs the command in the network namespace of the connection,
+// the commands changing the interface drop the cached devices
+func (m *WireGuardManager) combinedOutputIn(name string, args ...string) ([]byte, error) {
+	command := namespacedCommand(m.config.namespaceOf(name), args)
+	defer m.invalidateDevices()
+	return m.runner.CombinedOutput(command[0], command[1:]...)
+}
+
+// outputIn runs the command in the network namespace of the connection, returning its standard output
+func (m *WireGuardManager) outputIn(name string, args ...string) ([]byte, error) {
+	command := namespacedCommand(m.config.namespaceOf(name), args)
+	return m.runner.Output(command[0], command[1:]...)
+}
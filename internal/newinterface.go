@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// defaultListenPort is the listen port of the new interfaces without one
+const defaultListenPort = 51820
+
+// ErrListenPortUsed is returned when creating an interface on the listen port of another connection
+var ErrListenPortUsed = errors.New("listen port already used")
+
+// InterfaceSpec are the settings of a new server interface
+type InterfaceSpec struct {
+	Name string `json:"name"`
+	// Subnet is the network of the interface and its peers, like 10.8.0.0/24
+	Subnet     string `json:"subnet"`
+	ListenPort int    `json:"listen_port"`
+}
+
+// NewInterface is a created server interface
+type NewInterface struct {
+	Name       string `json:"name"`
+	PublicKey  string `json:"public_key"`
+	Address    string `json:"address"`
+	ListenPort int    `json:"listen_port"`
+}
+
+// CreateInterface writes the config of a new server interface with a generated key pair,
+// the interface gets the first address of the subnet. The peers are added afterwards.
+func (m *WireGuardManager) CreateInterface(spec InterfaceSpec) (*NewInterface, error) {
+	if spec.ListenPort == 0 {
+		spec.ListenPort = defaultListenPort
+	}
+	address, err := interfaceAddress(spec.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	if spec.ListenPort < 1 || spec.ListenPort > 65535 {
+		return nil, fmt.Errorf("%w: listen_port must be between 1 and 65535", ErrInvalidConfig)
+	}
+	if err := m.checkListenPort(spec.ListenPort); err != nil {
+		return nil, err
+	}
+	keyPair, err := GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &WireGuardConfig{Interface: InterfaceConfig{
+		PrivateKey: keyPair.PrivateKey,
+		Address:    []string{address.String()},
+		ListenPort: spec.ListenPort,
+	}}
+	if _, err := m.ImportConfig(spec.Name, string(config.Render())); err != nil {
+		return nil, err
+	}
+	return &NewInterface{
+		Name:       spec.Name,
+		PublicKey:  keyPair.PublicKey,
+		Address:    address.String(),
+		ListenPort: spec.ListenPort,
+	}, nil
+}
+
+// interfaceAddress returns the first address of the subnet, with the subnet prefix length
+func interfaceAddress(subnet string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(subnet)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%w: invalid subnet %q", ErrInvalidConfig, subnet)
+	}
+	prefix = prefix.Masked()
+	if prefix.Addr().BitLen()-prefix.Bits() < 2 {
+		return netip.Prefix{}, fmt.Errorf("%w: subnet %s has no room for peers", ErrInvalidConfig, prefix)
+	}
+	return netip.PrefixFrom(prefix.Addr().Next(), prefix.Bits()), nil
+}
+
+// checkListenPort checks no other connection config listens on the port
+func (m *WireGuardManager) checkListenPort(port int) error {
+	allConnections, err := m.getAllConnections()
+	if err != nil {
+		return err
+	}
+	for _, name := range allConnections {
+		config, err := ParseConfig(m.configPath(name))
+		if err == nil && config.Interface.ListenPort == port {
+			return fmt.Errorf("%w: %d by %s", ErrListenPortUsed, port, name)
+		}
+	}
+	return nil
+}
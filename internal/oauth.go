@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// oauthTimeout bounds each request to the OAuth2 provider
+const oauthTimeout = 10 * time.Second
+
+var (
+	// ErrOAuthDenied is returned for the provider accounts missing from the allowlist
+	ErrOAuthDenied = errors.New("account is not allowed")
+	// ErrOAuthFailed is returned when the provider doesn't complete the login
+	ErrOAuthFailed = errors.New("OAuth2 login failed")
+)
+
+// OAuthConfig logs users in with their GitHub or Google account, for the portals
+// without a self-hosted identity provider
+type OAuthConfig struct {
+	// Provider is "github" or "google"
+	Provider     string `yaml:"provider"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// RedirectURL is the callback URL registered at the provider, ending with /oauth/callback
+	RedirectURL string `yaml:"redirect_url"`
+	// Allowed are the GitHub usernames and the verified emails permitted to log in,
+	// the matching entry is the portal username
+	Allowed []string `yaml:"allowed"`
+	// Role of the users logging in for the first time, defaults to viewer
+	Role Role `yaml:"role"`
+}
+
+// oauthProvider are the endpoints of an OAuth2 provider
+type oauthProvider struct {
+	name     string
+	authURL  string
+	tokenURL string
+	scope    string
+	// identities returns the usernames and verified emails of the account of the access token
+	identities func(ctx context.Context, client *http.Client, token string) ([]string, error)
+}
+
+var oauthProviders = map[string]*oauthProvider{
+	"github": {
+		name:       "GitHub",
+		authURL:    "https://github.com/login/oauth/authorize",
+		tokenURL:   "https://github.com/login/oauth/access_token",
+		scope:      "read:user user:email",
+		identities: githubIdentities,
+	},
+	"google": {
+		name:       "Google",
+		authURL:    "https://accounts.google.com/o/oauth2/v2/auth",
+		tokenURL:   "https://oauth2.googleapis.com/token",
+		scope:      "openid email",
+		identities: googleIdentities,
+	},
+}
+
+// Configured reports whether the OAuth2 login is enabled
+func (c OAuthConfig) Configured() bool {
+	return c.Provider != ""
+}
+
+// ProviderName returns the display name of the provider
+func (c OAuthConfig) ProviderName() string {
+	if provider, ok := oauthProviders[c.Provider]; ok {
+		return provider.name
+	}
+	return ""
+}
+
+func (c OAuthConfig) validate() error {
+	if !c.Configured() {
+		return nil
+	}
+	if _, ok := oauthProviders[c.Provider]; !ok {
+		return fmt.Errorf("provider must be github or google, got %q", c.Provider)
+	}
+	if c.ClientID == "" || c.ClientSecret == "" {
+		return errors.New("client_id and client_secret are required")
+	}
+	parsed, err := url.Parse(c.RedirectURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid redirect_url %q", c.RedirectURL)
+	}
+	if len(c.Allowed) == 0 {
+		return errors.New("allowed must list the permitted accounts")
+	}
+	for _, allowed := range c.Allowed {
+		if !usernameRegex.MatchString(allowed) {
+			return fmt.Errorf("invalid allowed account %q", allowed)
+		}
+	}
+	_, err = ParseRole(string(c.Role))
+	return err
+}
+
+// NewOAuthState returns a random state for a login at the provider
+func NewOAuthState() (string, error) {
+	return generateSecureToken()
+}
+
+// AuthURL returns the provider URL the users authorize the portal at, with the state
+// sent back to the callback
+func (c OAuthConfig) AuthURL(state string) string {
+	query := url.Values{
+		"client_id":     {c.ClientID},
+		"redirect_uri":  {c.RedirectURL},
+		"response_type": {"code"},
+		"scope":         {oauthProviders[c.Provider].scope},
+		"state":         {state},
+	}
+	return oauthProviders[c.Provider].authURL + "?" + query.Encode()
+}
+
+// Authenticate exchanges the authorization code of the callback, returning the allowed
+// entry matching the account of the user
+func (c OAuthConfig) Authenticate(ctx context.Context, code string) (string, error) {
+	if code == "" {
+		return "", fmt.Errorf("%w: no authorization code", ErrOAuthFailed)
+	}
+	provider := oauthProviders[c.Provider]
+	client := &http.Client{Timeout: oauthTimeout}
+	token, err := c.exchange(ctx, client, code)
+	if err != nil {
+		return "", err
+	}
+	identities, err := provider.identities(ctx, client, token)
+	if err != nil {
+		return "", err
+	}
+	for _, allowed := range c.Allowed {
+		if slices.ContainsFunc(identities, func(identity string) bool { return strings.EqualFold(identity, allowed) }) {
+			return allowed, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrOAuthDenied, strings.Join(identities, ", "))
+}
+
+// exchange returns the access token of the authorization code
+func (c OAuthConfig) exchange(ctx context.Context, client *http.Client, code string) (string, error) {
+	form := url.Values{
+		"client_id":     {c.ClientID},
+		"client_secret": {c.ClientSecret},
+		"code":          {code},
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {c.RedirectURL},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, oauthProviders[c.Provider].tokenURL,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var response struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := doOAuthRequest(client, request, &response); err != nil {
+		return "", err
+	}
+	if response.AccessToken == "" {
+		return "", fmt.Errorf("%w: no access token (%s)", ErrOAuthFailed, response.Error)
+	}
+	return response.AccessToken, nil
+}
+
+// getOAuthJSON decodes the JSON response of an API request with the access token
+func getOAuthJSON(ctx context.Context, client *http.Client, endpoint, token string, response any) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	return doOAuthRequest(client, request, response)
+}
+
+func doOAuthRequest(client *http.Client, request *http.Request, response any) error {
+	request.Header.Set("Accept", "application/json")
+	httpResponse, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrOAuthFailed, err)
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s returned %s", ErrOAuthFailed, request.URL.Host, httpResponse.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(httpResponse.Body, 1<<20)).Decode(response); err != nil {
+		return fmt.Errorf("%w: invalid response of %s: %w", ErrOAuthFailed, request.URL.Host, err)
+	}
+	return nil
+}
+
+// githubIdentities returns the username and the verified emails of the GitHub account
+func githubIdentities(ctx context.Context, client *http.Client, token string) ([]string, error) {
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := getOAuthJSON(ctx, client, "https://api.github.com/user", token, &user); err != nil {
+		return nil, err
+	}
+	var emails []struct {
+		Email    string `json:"email"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getOAuthJSON(ctx, client, "https://api.github.com/user/emails", token, &emails); err != nil {
+		return nil, err
+	}
+
+	identities := []string{user.Login}
+	for _, email := range emails {
+		if email.Verified {
+			identities = append(identities, email.Email)
+		}
+	}
+	return identities, nil
+}
+
+// googleIdentities returns the verified email of the Google account
+func googleIdentities(ctx context.Context, client *http.Client, token string) ([]string, error) {
+	var user struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	endpoint := "https://openidconnect.googleapis.com/v1/userinfo"
+	if err := getOAuthJSON(ctx, client, endpoint, token, &user); err != nil {
+		return nil, err
+	}
+	if !user.EmailVerified {
+		return nil, fmt.Errorf("%w: email %s isn't verified", ErrOAuthDenied, user.Email)
+	}
+	return []string{user.Email}, nil
+}
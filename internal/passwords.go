@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters of the new password hashes (OWASP recommendation),
+// the hashes keep their parameters so they can be changed later
+const (
+	argon2Version = argon2.Version
+	argon2Memory  = 19 * 1024
+	argon2Time    = 2
+	argon2Threads = 1
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// argon2Params are the parameters encoded in an Argon2id hash
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+var (
+	currentArgon2Params = argon2Params{memory: argon2Memory, time: argon2Time, threads: argon2Threads}
+	argon2Encoding      = base64.RawStdEncoding
+)
+
+// GeneratePasswordHash hashes the password with Argon2id, in the PHC string format:
+// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>
+func GeneratePasswordHash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate password salt: %w", err)
+	}
+	params := currentArgon2Params
+	key := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2Version, params.memory, params.time,
+		params.threads, argon2Encoding.EncodeToString(salt), argon2Encoding.EncodeToString(key)), nil
+}
+
+// ValidatePassword checks the password against an Argon2id hash,
+// or a legacy double SHA256 hash of the previous portal versions
+func ValidatePassword(password, hash string) bool {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return subtle.ConstantTimeCompare([]byte(legacyPasswordHash(password)), []byte(hash)) == 1
+	}
+	parsed, err := parseArgon2Hash(hash)
+	if err != nil {
+		return false
+	}
+	params := parsed.params
+	derived := argon2.IDKey([]byte(password), parsed.salt, params.time, params.memory, params.threads,
+		uint32(len(parsed.key)))
+	return subtle.ConstantTimeCompare(derived, parsed.key) == 1
+}
+
+// PasswordNeedsRehash reports whether the hash is a legacy hash, or an Argon2id hash
+// of other parameters than the current ones
+func PasswordNeedsRehash(hash string) bool {
+	parsed, err := parseArgon2Hash(hash)
+	return err != nil || parsed.params != currentArgon2Params
+}
+
+// validPasswordHash reports whether the hash is an Argon2id hash or a legacy hash
+func validPasswordHash(hash string) bool {
+	if _, err := parseArgon2Hash(hash); err == nil {
+		return true
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil && len(hash) == sha256.Size*2
+}
+
+// argon2Hash is a parsed Argon2id hash
+type argon2Hash struct {
+	params argon2Params
+	salt   []byte
+	key    []byte
+}
+
+func parseArgon2Hash(hash string) (*argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errors.New("not an argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2Version {
+		return nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+
+	parsed := &argon2Hash{}
+	params := &parsed.params
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil || params.time == 0 || params.threads == 0 {
+		return nil, fmt.Errorf("invalid argon2 parameters %q", parts[3])
+	}
+	if parsed.salt, err = argon2Encoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	if parsed.key, err = argon2Encoding.DecodeString(parts[5]); err != nil || len(parsed.key) == 0 {
+		return nil, errors.New("invalid argon2 key")
+	}
+	return parsed, nil
+}
+
+// legacyPasswordHash is the double SHA256 hash of the previous portal versions,
+// using the same logic that powers the pi-hole authentication
+func legacyPasswordHash(password string) string {
+	first := sha256.Sum256([]byte(password))
+	firstHex := hex.EncodeToString(first[:])
+	second := sha256.Sum256([]byte(firstHex))
+	return hex.EncodeToString(second[:])
+}
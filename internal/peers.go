@@ -0,0 +1,355 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrPeerNotFound is returned for public keys missing from the connection config
+	ErrPeerNotFound = errors.New("peer not found")
+	// ErrPeerExists is returned when adding a public key already in the connection config
+	ErrPeerExists = errors.New("peer already exists")
+	// ErrInvalidPeer is returned for invalid peer settings
+	ErrInvalidPeer = errors.New("invalid peer")
+)
+
+// PeerSpec are the peer settings managed from the API, the other options of an edited peer
+// are kept, and so is its preshared key unless the spec sets one
+type PeerSpec struct {
+	PublicKey           string   `json:"public_key"`
+	AllowedIPs          []string `json:"allowed_ips"`
+	Endpoint            string   `json:"endpoint"`
+	PersistentKeepalive int      `json:"persistent_keepalive"`
+	PresharedKey        string   `json:"preshared_key"`
+}
+
+// PeerInfo is a peer of a connection config listed without its preshared key
+type PeerInfo struct {
+	*PeerConfig
+	// ID identifies the peer in the URLs, unlike its public key it needs no escaping
+	ID              string `json:"id"`
+	HasPresharedKey bool   `json:"has_preshared_key"`
+	// Expires is the expiry time of the peer, Expired reports whether it was removed from the interface
+	Expires *time.Time `json:"expires,omitempty"`
+	Expired bool       `json:"expired"`
+}
+
+// PeerID returns the ID of the peer with the public key, its URL-safe base64 encoding
+func PeerID(publicKey string) string {
+	return strings.TrimRight(strings.NewReplacer("+", "-", "/", "_").Replace(publicKey), "=")
+}
+
+// PeerResult is the outcome of a peer change
+type PeerResult struct {
+	// PublicKey is the public key of the changed peer
+	PublicKey string
+	Output    []byte
+	// Applied reports whether the connection was active and its peers updated live
+	Applied bool
+}
+
+func (p PeerSpec) validate() error {
+	if !validKey(p.PublicKey) {
+		return fmt.Errorf("%w: public_key must be a base64 WireGuard key", ErrInvalidPeer)
+	}
+	if p.PresharedKey != "" && !validKey(p.PresharedKey) {
+		return fmt.Errorf("%w: preshared_key must be a base64 WireGuard key", ErrInvalidPeer)
+	}
+	for _, allowedIP := range p.AllowedIPs {
+		if _, err := netip.ParsePrefix(allowedIP); err != nil {
+			return fmt.Errorf("%w: invalid allowed_ips %q", ErrInvalidPeer, allowedIP)
+		}
+	}
+	if p.Endpoint != "" && !validEndpoint(p.Endpoint) {
+		return fmt.Errorf("%w: endpoint must be host:port, got %q", ErrInvalidPeer, p.Endpoint)
+	}
+	if p.PersistentKeepalive < 0 || p.PersistentKeepalive > 65535 {
+		return fmt.Errorf("%w: persistent_keepalive must be between 0 and 65535", ErrInvalidPeer)
+	}
+	return nil
+}
+
+// validEndpoint reports whether the endpoint is a host and a port
+func validEndpoint(endpoint string) bool {
+	host, port, err := net.SplitHostPort(endpoint)
+	number, portErr := strconv.Atoi(port)
+	return err == nil && host != "" && portErr == nil && number >= 1 && number <= 65535
+}
+
+// apply sets the settings of the spec on the peer
+func (p PeerSpec) apply(peer *PeerConfig) {
+	peer.PublicKey = p.PublicKey
+	peer.AllowedIPs = slices.Clone(p.AllowedIPs)
+	peer.Endpoint = p.Endpoint
+	peer.PersistentKeepalive = p.PersistentKeepalive
+	if p.PresharedKey != "" {
+		peer.PresharedKey = p.PresharedKey
+	}
+}
+
+// ListPeers returns the peers of the connection config, without their preshared keys
+func (m *WireGuardManager) ListPeers(name string) ([]*PeerInfo, error) {
+	config, err := m.connectionConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]*PeerInfo, 0, len(config.Peers))
+	now := time.Now()
+	for _, peer := range config.Peers {
+		info := &PeerInfo{PeerConfig: peer, ID: PeerID(peer.PublicKey), HasPresharedKey: peer.PresharedKey != ""}
+		info.Expires = m.expiries.Get(name, peer.PublicKey)
+		info.Expired = info.Expires != nil && !now.Before(*info.Expires)
+		peer.PresharedKey = ""
+		peers = append(peers, info)
+	}
+	return peers, nil
+}
+
+// AddPeer adds a peer to the connection config. Without a public key, the portal generates
+// the key pair of the peer and keeps its private key for the client config.
+func (m *WireGuardManager) AddPeer(name string, spec PeerSpec) (*PeerResult, error) {
+	var privateKey string
+	if spec.PublicKey == "" {
+		keyPair, err := GenerateKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		spec.PublicKey, privateKey = keyPair.PublicKey, keyPair.PrivateKey
+	}
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+	result, err := m.changePeers(name, func(config *WireGuardConfig) error {
+		if slices.ContainsFunc(config.Peers, func(peer *PeerConfig) bool { return peer.PublicKey == spec.PublicKey }) {
+			return fmt.Errorf("%w: %s", ErrPeerExists, spec.PublicKey)
+		}
+		peer := &PeerConfig{}
+		spec.apply(peer)
+		config.Peers = append(config.Peers, peer)
+		if privateKey != "" {
+			return m.setPeerKey(spec.PublicKey, privateKey)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.PublicKey = spec.PublicKey
+	return result, nil
+}
+
+// UpdatePeer replaces the settings of the peer with the public key, which the spec may change
+func (m *WireGuardManager) UpdatePeer(name, publicKey string, spec PeerSpec) (*PeerResult, error) {
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+	return m.changePeers(name, func(config *WireGuardConfig) error {
+		index, err := findPeer(config, publicKey)
+		if err != nil {
+			return err
+		}
+		if spec.PublicKey != publicKey &&
+			slices.ContainsFunc(config.Peers, func(peer *PeerConfig) bool { return peer.PublicKey == spec.PublicKey }) {
+			return fmt.Errorf("%w: %s", ErrPeerExists, spec.PublicKey)
+		}
+		spec.apply(config.Peers[index])
+		if spec.PublicKey != publicKey {
+			if err := m.moveExpiry(name, publicKey, spec.PublicKey); err != nil {
+				return err
+			}
+			// The kept private key doesn't match the new public key anymore
+			return m.setPeerKey(publicKey, "")
+		}
+		return nil
+	})
+}
+
+// RemovePeer removes the peer with the public key from the connection config
+func (m *WireGuardManager) RemovePeer(name, publicKey string) (*PeerResult, error) {
+	return m.changePeers(name, func(config *WireGuardConfig) error {
+		index, err := findPeer(config, publicKey)
+		if err != nil {
+			return err
+		}
+		config.Peers = slices.Delete(config.Peers, index, index+1)
+		if err := m.expiries.Set(name, publicKey, nil); err != nil {
+			return err
+		}
+		return m.setPeerKey(publicKey, "")
+	})
+}
+
+// SetPresharedKey sets the preshared key of the peer with the public key, an empty key removes it
+func (m *WireGuardManager) SetPresharedKey(name, publicKey, presharedKey string) (*PeerResult, error) {
+	if presharedKey != "" && !validKey(presharedKey) {
+		return nil, fmt.Errorf("%w: preshared_key must be a base64 WireGuard key", ErrInvalidPeer)
+	}
+	return m.changePeers(name, func(config *WireGuardConfig) error {
+		index, err := findPeer(config, publicKey)
+		if err != nil {
+			return err
+		}
+		config.Peers[index].PresharedKey = presharedKey
+		return nil
+	})
+}
+
+// PeerKeepalive is the persistent keepalive of a peer, in seconds and 0 when it's off
+type PeerKeepalive struct {
+	PersistentKeepalive int `json:"persistent_keepalive"`
+	// Current is the keepalive of the peer of the active connection
+	Current *int `json:"current,omitempty"`
+}
+
+// GetPersistentKeepalive returns the keepalive of the peer in the connection config,
+// and on the interface when the connection is active
+func (m *WireGuardManager) GetPersistentKeepalive(name, publicKey string) (*PeerKeepalive, error) {
+	config, err := m.connectionConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	index, err := findPeer(config, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	keepalive := &PeerKeepalive{PersistentKeepalive: config.Peers[index].PersistentKeepalive}
+	devices, err := m.readDevices()
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		for _, peer := range device.Peers {
+			if device.Name == name && peer.PublicKey == publicKey {
+				keepalive.Current = &peer.PersistentKeepalive
+			}
+		}
+	}
+	return keepalive, nil
+}
+
+// SetPersistentKeepalive sets the keepalive of the peer in the connection config, 0 turning it off.
+// It's set live with wg set on an active connection, without syncing the other peers.
+func (m *WireGuardManager) SetPersistentKeepalive(name, publicKey string, seconds int) (*PeerResult, error) {
+	if seconds < 0 || seconds > 65535 {
+		return nil, fmt.Errorf("%w: persistent_keepalive must be between 0 and 65535", ErrInvalidPeer)
+	}
+	m.peersMutex.Lock()
+	defer m.peersMutex.Unlock()
+	connection, err := m.getConnection(name)
+	if err != nil {
+		return nil, err
+	}
+	config, err := m.connectionConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	index, err := findPeer(config, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	config.Peers[index].PersistentKeepalive = seconds
+	if err := m.writeConfig(name, config); err != nil {
+		return nil, err
+	}
+	log.Printf("Changed the persistent keepalive of a peer of %s to %d", name, seconds)
+	if !connection.Active {
+		return &PeerResult{PublicKey: publicKey}, nil
+	}
+	interval := "off"
+	if seconds > 0 {
+		interval = strconv.Itoa(seconds)
+	}
+	output, err := m.combinedOutputIn(name, "sudo", "wg", "set", name, "peer", publicKey, "persistent-keepalive", interval)
+	if err != nil {
+		err = fmt.Errorf("failed to set the persistent keepalive: %w", commandError(err, output))
+		m.setLastError(name, "sync", err)
+		return nil, err
+	}
+	return &PeerResult{PublicKey: publicKey, Output: output, Applied: true}, nil
+}
+
+// FindPeer returns the granted connection and the public key of the peer with the ID
+func (m *WireGuardManager) FindPeer(id string, grants ConnectionGrants) (string, string, error) {
+	allConnections, err := m.getAllConnections()
+	if err != nil {
+		return "", "", err
+	}
+	for _, name := range grants.Filter(allConnections) {
+		config, err := ParseConfig(m.configPath(name))
+		if err != nil {
+			continue
+		}
+		for _, peer := range config.Peers {
+			if PeerID(peer.PublicKey) == id {
+				return name, peer.PublicKey, nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("%w: %s", ErrPeerNotFound, id)
+}
+
+// findPeer returns the index of the peer with the public key in the config
+func findPeer(config *WireGuardConfig, publicKey string) (int, error) {
+	index := slices.IndexFunc(config.Peers, func(peer *PeerConfig) bool { return peer.PublicKey == publicKey })
+	if index < 0 {
+		return 0, fmt.Errorf("%w: %s", ErrPeerNotFound, publicKey)
+	}
+	return index, nil
+}
+
+// changePeers rewrites the connection config changed by change, the peers of an active
+// connection are then synced with wg syncconf, which keeps the unchanged peers connected
+func (m *WireGuardManager) changePeers(name string, change func(config *WireGuardConfig) error) (*PeerResult, error) {
+	m.peersMutex.Lock()
+	defer m.peersMutex.Unlock()
+
+	connection, err := m.getConnection(name)
+	if err != nil {
+		return nil, err
+	}
+	config, err := m.connectionConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := change(config); err != nil {
+		return nil, err
+	}
+	if err := m.writeConfig(name, config); err != nil {
+		return nil, err
+	}
+	log.Printf("Changed the peers of %s", name)
+	if !connection.Active {
+		return &PeerResult{}, nil
+	}
+	output, err := m.syncPeers(name, config)
+	if err != nil {
+		m.setLastError(name, "sync", err)
+		return nil, err
+	}
+	m.clearLastErrors(name)
+	return &PeerResult{Output: output, Applied: true}, nil
+}
+
+// syncPeers applies the peers of the config which haven't expired to the up interface. The routes
+// of allowed IPs added to a peer are only installed by restarting the connection.
+func (m *WireGuardManager) syncPeers(name string, config *WireGuardConfig) ([]byte, error) {
+	wgConfig, err := writeWGConfig(m.activePeers(name, config), m.config.keys)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(wgConfig)
+	output, err := m.combinedOutputIn(name, "sudo", "wg", "syncconf", name, wgConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync peers: %w", commandError(err, output))
+	}
+	return output, nil
+}
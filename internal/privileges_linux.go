@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// directCapabilities are passed on to the commands run without sudo by a portal which isn't root:
+// configuring the interfaces, listing the firewall rules and entering the network namespaces
+var directCapabilities = []uintptr{unix.CAP_NET_ADMIN, unix.CAP_NET_RAW, unix.CAP_SYS_ADMIN}
+
+// capabilities returns the permitted and effective capabilities of the portal
+func capabilities() (permitted, effective uint64, err error) {
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return 0, 0, err
+	}
+	permitted = uint64(data[1].Permitted)<<32 | uint64(data[0].Permitted)
+	effective = uint64(data[1].Effective)<<32 | uint64(data[0].Effective)
+	return permitted, effective, nil
+}
+
+// hasNetAdmin reports whether the portal configures the interfaces without sudo, as root or
+// with CAP_NET_ADMIN, like from setcap or the AmbientCapabilities of its systemd unit
+func hasNetAdmin() bool {
+	if os.Geteuid() == 0 {
+		return true
+	}
+	_, effective, err := capabilities()
+	return err == nil && effective&(1<<unix.CAP_NET_ADMIN) != 0
+}
+
+// directProcAttr raises the capabilities the portal has among directCapabilities in the ambient set
+// of the commands, which don't inherit them otherwise. Root passes on all of its capabilities.
+func directProcAttr() *syscall.SysProcAttr {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	permitted, _, err := capabilities()
+	if err != nil {
+		return nil
+	}
+	var ambient []uintptr
+	for _, capability := range directCapabilities {
+		if permitted&(1<<capability) != 0 {
+			ambient = append(ambient, capability)
+		}
+	}
+	return &syscall.SysProcAttr{AmbientCaps: ambient}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package internal
+
+import (
+	"os"
+	"syscall"
+)
+
+// hasNetAdmin reports whether the portal configures the interfaces without sudo, as root since
+// the capabilities are only detected on Linux
+func hasNetAdmin() bool {
+	return os.Geteuid() == 0
+}
+
+// directProcAttr returns the attributes of the commands run without sudo, which need none
+func directProcAttr() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ProxyAuthConfig takes the user identity from a header set by a trusted authenticating
+// reverse proxy (Authelia, Authentik, ...), only for requests coming from the proxy addresses.
+// The trusted proxies also forward the client addresses of the login limit.
+type ProxyAuthConfig struct {
+	Header         string   `yaml:"header"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// Role of the users logging in for the first time, defaults to viewer
+	Role Role `yaml:"role"`
+}
+
+// Configured reports whether the proxy authentication is enabled
+func (c ProxyAuthConfig) Configured() bool {
+	return c.Header != "" && len(c.TrustedProxies) > 0
+}
+
+func (c ProxyAuthConfig) validate() error {
+	for _, proxy := range c.TrustedProxies {
+		if _, err := netip.ParsePrefix(proxy); err != nil {
+			return fmt.Errorf("invalid trusted_proxies %q", proxy)
+		}
+	}
+	_, err := ParseRole(string(c.Role))
+	return err
+}
+
+// Username returns the username of the header, when the request comes from a trusted proxy
+func (c ProxyAuthConfig) Username(r *http.Request) (string, bool) {
+	if !c.Configured() {
+		return "", false
+	}
+	username := r.Header.Get(c.Header)
+	if !usernameRegex.MatchString(username) || !c.trusted(r) {
+		return "", false
+	}
+	return username, true
+}
+
+// ClientAddr returns the address of the request client, taken from the last
+// X-Forwarded-For entry when the request comes from a trusted proxy
+func (c ProxyAuthConfig) ClientAddr(r *http.Request) string {
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) > 0 && c.trusted(r) {
+		entries := strings.Split(forwarded[len(forwarded)-1], ",")
+		if addr, err := netip.ParseAddr(strings.TrimSpace(entries[len(entries)-1])); err == nil {
+			return addr.Unmap().String()
+		}
+	}
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return remote.Addr().Unmap().String()
+}
+
+// trusted reports whether the request comes from a trusted proxy
+func (c ProxyAuthConfig) trusted(r *http.Request) bool {
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	return containsAddr(c.TrustedProxies, remote.Addr().Unmap())
+}
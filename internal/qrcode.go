@@ -0,0 +1,483 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// The QR codes are encoded in byte mode with the low error correction level, like
+// qrencode does for the client configs shown by wg-quick users, which keeps the
+// codes of the configs small enough to scan from a screen
+
+// qrQuietZone is the light border around the codes, in modules
+const qrQuietZone = 4
+
+// ErrQRTooLong is returned for data exceeding the capacity of the largest QR code
+var ErrQRTooLong = errors.New("data too long for a QR code")
+
+var (
+	// qrECCPerBlock are the error correction codewords per block of the low level, by version
+	qrECCPerBlock = [41]int{0,
+		7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28,
+		28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30}
+	// qrBlocks are the error correction blocks of the low level, by version
+	qrBlocks = [41]int{0,
+		1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8,
+		8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25}
+)
+
+// QRCode is a square grid of dark and light modules
+type QRCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// EncodeQR encodes the data in the smallest QR code holding it
+func EncodeQR(data []byte) (*QRCode, error) {
+	version := 1
+	for ; qrDataBits(data, version) > qrDataCodewords(version)*8; version++ {
+		if version == 40 {
+			return nil, fmt.Errorf("%w: %d bytes", ErrQRTooLong, len(data))
+		}
+	}
+	size := version*4 + 17
+	q := &QRCode{size: size, modules: newQRGrid(size), function: newQRGrid(size)}
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(qrInterleave(qrEncodeData(data, version), version))
+	mask := q.bestMask()
+	q.applyMask(mask)
+	q.drawFormatBits(mask)
+	return q, nil
+}
+
+func newQRGrid(size int) [][]bool {
+	grid := make([][]bool, size)
+	for y := range grid {
+		grid[y] = make([]bool, size)
+	}
+	return grid
+}
+
+// qrCountBits is the length of the byte count of the version
+func qrCountBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// qrDataBits is the length of the encoded data, with its mode and count
+func qrDataBits(data []byte, version int) int {
+	if len(data) >= 1<<qrCountBits(version) {
+		return 1 << 30
+	}
+	return 4 + qrCountBits(version) + len(data)*8
+}
+
+// qrRawModules is the number of modules of the version available for the codewords
+func qrRawModules(version int) int {
+	modules := (16*version+128)*version + 64
+	if version >= 2 {
+		alignments := version/7 + 2
+		modules -= (25*alignments-10)*alignments - 55
+		if version >= 7 {
+			modules -= 36
+		}
+	}
+	return modules
+}
+
+func qrDataCodewords(version int) int {
+	return qrRawModules(version)/8 - qrECCPerBlock[version]*qrBlocks[version]
+}
+
+// qrEncodeData returns the data codewords: the byte mode segment, its terminator and the padding
+func qrEncodeData(data []byte, version int) []byte {
+	var bits qrBits
+	bits.append(0b0100, 4)
+	bits.append(len(data), qrCountBits(version))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := qrDataCodewords(version) * 8
+	bits.append(0, min(4, capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	return codewords
+}
+
+// qrBits is a bit buffer, most significant bits first
+type qrBits []bool
+
+func (b *qrBits) append(value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		*b = append(*b, value>>i&1 == 1)
+	}
+}
+
+// qrInterleave splits the data codewords into blocks, adds their error correction
+// codewords and interleaves the blocks
+func qrInterleave(data []byte, version int) []byte {
+	blocks := qrBlocks[version]
+	eccLength := qrECCPerBlock[version]
+	rawCodewords := qrRawModules(version) / 8
+	shortBlocks := blocks - rawCodewords%blocks
+	shortLength := rawCodewords/blocks - eccLength
+	divisor := qrDivisor(eccLength)
+
+	var dataBlocks, eccBlocks [][]byte
+	for i := range blocks {
+		length := shortLength
+		if i >= shortBlocks {
+			length++
+		}
+		dataBlocks = append(dataBlocks, data[:length])
+		eccBlocks = append(eccBlocks, qrRemainder(data[:length], divisor))
+		data = data[length:]
+	}
+
+	var result []byte
+	for i := range shortLength + 1 {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := range eccLength {
+		for _, block := range eccBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// qrDivisor returns the Reed-Solomon generator polynomial of the degree, highest
+// coefficients first without the leading 1
+func qrDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for range degree {
+		for j := range result {
+			result[j] = qrMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = qrMultiply(root, 0x02)
+	}
+	return result
+}
+
+// qrRemainder returns the Reed-Solomon error correction codewords of the data
+func qrRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range divisor {
+			result[i] ^= qrMultiply(coefficient, factor)
+		}
+	}
+	return result
+}
+
+// qrMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func qrMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+func (q *QRCode) setFunction(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *QRCode) drawFunctionPatterns(version int) {
+	for i := range q.size {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+	q.drawFinder(3, 3)
+	q.drawFinder(q.size-4, 3)
+	q.drawFinder(3, q.size-4)
+
+	positions := qrAlignmentPositions(version)
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			corner := (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0)
+			if !corner {
+				q.drawSquare(x, y, 2, func(distance int) bool { return distance != 1 })
+			}
+		}
+	}
+	// Reserve the format modules, drawn once the mask is chosen
+	q.drawFormatBits(0)
+	q.drawVersion(version)
+}
+
+func (q *QRCode) drawFinder(x, y int) {
+	q.drawSquare(x, y, 4, func(distance int) bool { return distance != 2 && distance != 4 })
+}
+
+// drawSquare draws the modules around the center, dark by their distance to the center
+func (q *QRCode) drawSquare(x, y, radius int, dark func(distance int) bool) {
+	for dy := -radius; dy <= radius; dy++ {
+		for dx := -radius; dx <= radius; dx++ {
+			if x+dx >= 0 && x+dx < q.size && y+dy >= 0 && y+dy < q.size {
+				q.setFunction(x+dx, y+dy, dark(max(abs(dx), abs(dy))))
+			}
+		}
+	}
+}
+
+func abs(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
+
+// qrAlignmentPositions returns the coordinates of the alignment pattern centers
+func qrAlignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	count := version/7 + 2
+	step := (version*4 + count*2 + 1) / (count*2 - 2) * 2
+	if version == 32 {
+		step = 26
+	}
+	positions := make([]int, count)
+	positions[0] = 6
+	for i, position := count-1, version*4+10; i >= 1; i, position = i-1, position-step {
+		positions[i] = position
+	}
+	return positions
+}
+
+// drawFormatBits draws the error correction level and the mask, twice
+func (q *QRCode) drawFormatBits(mask int) {
+	data := 1<<3 | mask // Low error correction level
+	remainder := data
+	for range 10 {
+		remainder = remainder<<1 ^ (remainder>>9)*0x537
+	}
+	bits := (data<<10 | remainder) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	for i := range 6 {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+	for i := range 8 {
+		q.setFunction(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.size-15+i, bit(i))
+	}
+	q.setFunction(8, q.size-8, true)
+}
+
+// drawVersion draws the version of the codes from version 7, twice
+func (q *QRCode) drawVersion(version int) {
+	if version < 7 {
+		return
+	}
+	remainder := version
+	for range 12 {
+		remainder = remainder<<1 ^ (remainder>>11)*0x1F25
+	}
+	bits := version<<12 | remainder
+	for i := range 18 {
+		dark := bits>>i&1 == 1
+		a, b := q.size-11+i%3, i/3
+		q.setFunction(a, b, dark)
+		q.setFunction(b, a, dark)
+	}
+}
+
+// drawCodewords fills the modules left of the function patterns in the zigzag order,
+// two columns at a time from the bottom right corner
+func (q *QRCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vertical := range q.size {
+			y := vertical
+			if upward {
+				y = q.size - 1 - vertical
+			}
+			for _, x := range []int{right, right - 1} {
+				if !q.function[y][x] && i < len(codewords)*8 {
+					q.modules[y][x] = codewords[i/8]>>(7-i%8)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// qrMasks tell the modules flipped by each mask
+var qrMasks = [8]func(x, y int) bool{
+	func(x, y int) bool { return (x+y)%2 == 0 },
+	func(_, y int) bool { return y%2 == 0 },
+	func(x, _ int) bool { return x%3 == 0 },
+	func(x, y int) bool { return (x+y)%3 == 0 },
+	func(x, y int) bool { return (x/3+y/2)%2 == 0 },
+	func(x, y int) bool { return x*y%2+x*y%3 == 0 },
+	func(x, y int) bool { return (x*y%2+x*y%3)%2 == 0 },
+	func(x, y int) bool { return ((x+y)%2+x*y%3)%2 == 0 },
+}
+
+// applyMask flips the data modules of the mask, applying it twice restores them
+func (q *QRCode) applyMask(mask int) {
+	for y := range q.size {
+		for x := range q.size {
+			if !q.function[y][x] && qrMasks[mask](x, y) {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// bestMask returns the mask with the lowest penalty, the codes easiest to scan
+func (q *QRCode) bestMask() int {
+	best, bestPenalty := 0, -1
+	for mask := range qrMasks {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if penalty := q.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		q.applyMask(mask)
+	}
+	return best
+}
+
+// penalty scores the runs, the blocks and the finder-like patterns of same colored
+// modules, and the imbalance of dark and light modules
+func (q *QRCode) penalty() int {
+	penalty, dark := 0, 0
+	for i := range q.size {
+		penalty += qrLinePenalty(func(j int) bool { return q.modules[i][j] }, q.size)
+		penalty += qrLinePenalty(func(j int) bool { return q.modules[j][i] }, q.size)
+	}
+	for y := range q.size {
+		for x := range q.size {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 && q.modules[y][x] == q.modules[y-1][x] &&
+				q.modules[y][x] == q.modules[y][x-1] && q.modules[y][x] == q.modules[y-1][x-1] {
+				penalty += 3
+			}
+		}
+	}
+	total := q.size * q.size
+	return penalty + (abs(dark*20-total*10)+total-1)/total*10 - 10
+}
+
+// qrFinderLike are the module patterns looking like a finder pattern
+var qrFinderLike = [][]bool{
+	{true, false, true, true, true, false, true, false, false, false, false},
+	{false, false, false, false, true, false, true, true, true, false, true},
+}
+
+// qrLinePenalty scores the runs and the finder-like patterns of a row or a column
+func qrLinePenalty(module func(i int) bool, size int) int {
+	penalty, run := 0, 1
+	for i := 1; i <= size; i++ {
+		if i < size && module(i) == module(i-1) {
+			run++
+			continue
+		}
+		if run >= 5 {
+			penalty += run - 2
+		}
+		run = 1
+	}
+	for start := 0; start+11 <= size; start++ {
+		for _, pattern := range qrFinderLike {
+			matches := true
+			for i, dark := range pattern {
+				matches = matches && module(start+i) == dark
+			}
+			if matches {
+				penalty += 40
+			}
+		}
+	}
+	return penalty
+}
+
+// dark reports whether the module is dark, the quiet zone around the code is light
+func (q *QRCode) dark(x, y int) bool {
+	x, y = x-qrQuietZone, y-qrQuietZone
+	return x >= 0 && x < q.size && y >= 0 && y < q.size && q.modules[y][x]
+}
+
+// PNG renders the code with its quiet zone, each module scale pixels wide
+func (q *QRCode) PNG(scale int) ([]byte, error) {
+	width := (q.size + 2*qrQuietZone) * scale
+	img := image.NewPaletted(image.Rect(0, 0, width, width), color.Palette{color.White, color.Black})
+	for y := range width {
+		for x := range width {
+			if q.dark(x/scale, y/scale) {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SVG renders the code with its quiet zone, scaling to the size of its container
+func (q *QRCode) SVG() []byte {
+	width := q.size + 2*qrQuietZone
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		width, width)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, width, width)
+	for y := range width {
+		for x := range width {
+			if q.dark(x, y) {
+				fmt.Fprintf(&buf, "M%d,%dh1v1h-1z", x, y)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrReadOnly is returned when changing a connection of a read-only portal
+var ErrReadOnly = errors.New("the portal is in read-only mode")
+
+// ReadOnlyMode parks the portal in view-only mode during network maintenance,
+// the connections are listed but can't be toggled or reconfigured from the portal
+type ReadOnlyMode struct {
+	enabled bool
+	mutex   sync.Mutex
+}
+
+// ReadOnlyState is the read-only mode as reported by the API
+type ReadOnlyState struct {
+	Enabled bool `json:"enabled"`
+}
+
+// NewReadOnlyMode creates the mode, enabled from the start when configured
+func NewReadOnlyMode(enabled bool) *ReadOnlyMode {
+	return &ReadOnlyMode{enabled: enabled}
+}
+
+// Set enables or disables the read-only mode
+func (m *ReadOnlyMode) Set(enabled bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.enabled = enabled
+}
+
+func (m *ReadOnlyMode) Enabled() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.enabled
+}
+
+func (m *ReadOnlyMode) State() ReadOnlyState {
+	return ReadOnlyState{Enabled: m.Enabled()}
+}
@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisTimeout bounds each request against the Redis server
+const redisTimeout = 5 * time.Second
+
+// RedisConfig connects to the Redis server of the redis session store,
+// portal instances sharing the server share their sessions
+type RedisConfig struct {
+	// Address is the host:port of the server
+	Address  string `yaml:"address"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	TLS      bool   `yaml:"tls"`
+	// KeyPrefix starts the keys of the portal, so the server can be shared with other applications
+	KeyPrefix string `yaml:"key_prefix"`
+}
+
+func (c RedisConfig) validate() error {
+	if c.Address == "" {
+		return errors.New("address is required by the redis session store")
+	}
+	if c.DB < 0 {
+		return fmt.Errorf("db must not be negative, got %d", c.DB)
+	}
+	return nil
+}
+
+// redisSessionStore keeps the sessions in Redis, expiring with the sessions.
+// The session keys of each user are kept in a set, to delete the sessions of the user.
+type redisSessionStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// newRedisSessionStore connects to the Redis server, the keys of the profile are prefixed with its name
+func newRedisSessionStore(profile string, config RedisConfig) (*redisSessionStore, error) {
+	options := &redis.Options{
+		Addr:         config.Address,
+		Username:     config.Username,
+		Password:     config.Password,
+		DB:           config.DB,
+		DialTimeout:  redisTimeout,
+		ReadTimeout:  redisTimeout,
+		WriteTimeout: redisTimeout,
+	}
+	if config.TLS {
+		options.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	store := &redisSessionStore{
+		client: redis.NewClient(options),
+		prefix: config.KeyPrefix + profile + ":",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := store.client.Ping(ctx).Err(); err != nil {
+		store.client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	return store, nil
+}
+
+func (s *redisSessionStore) Get(key string) (*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	data, err := s.client.Get(ctx, s.sessionKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrInvalidSession
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("failed to parse session: %w", err)
+	}
+	return &session, nil
+}
+
+func (s *redisSessionStore) Save(key string, session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to save session: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SetArgs(ctx, s.sessionKey(key), data, redis.SetArgs{ExpireAt: session.Expires})
+		pipe.SAdd(ctx, s.userKey(session.Username), key)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save session: %w", err)
+	}
+	return nil
+}
+
+func (s *redisSessionStore) Delete(key string) error {
+	session, err := s.Get(key)
+	if errors.Is(err, ErrInvalidSession) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, s.sessionKey(key))
+		pipe.SRem(ctx, s.userKey(session.Username), key)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	return nil
+}
+
+func (s *redisSessionStore) ListUser(username string) (map[string]*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	keys, err := s.client.SMembers(ctx, s.userKey(username)).Result()
+	if err != nil || len(keys) == 0 {
+		return map[string]*Session{}, err
+	}
+	redisKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		redisKeys = append(redisKeys, s.sessionKey(key))
+	}
+	values, err := s.client.MGet(ctx, redisKeys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	sessions := make(map[string]*Session, len(keys))
+	for i, value := range values {
+		// Expired sessions are nil
+		data, ok := value.(string)
+		var session Session
+		if ok && json.Unmarshal([]byte(data), &session) == nil {
+			sessions[keys[i]] = &session
+		}
+	}
+	return sessions, nil
+}
+
+func (s *redisSessionStore) DeleteUser(username string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	keys, err := s.client.SMembers(ctx, s.userKey(username)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to delete sessions: %w", err)
+	}
+	redisKeys := []string{s.userKey(username)}
+	for _, key := range keys {
+		redisKeys = append(redisKeys, s.sessionKey(key))
+	}
+	if err := s.client.Del(ctx, redisKeys...).Err(); err != nil {
+		return fmt.Errorf("failed to delete sessions: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpired removes the keys of the expired sessions from the user sets,
+// Redis expires the sessions themselves
+func (s *redisSessionStore) DeleteExpired(_ time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	iter := s.client.Scan(ctx, 0, s.userKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		if err := s.pruneUserSet(ctx, iter.Val()); err != nil {
+			return err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("failed to scan sessions: %w", err)
+	}
+	return nil
+}
+
+// pruneUserSet removes the keys of the expired sessions from the user set
+func (s *redisSessionStore) pruneUserSet(ctx context.Context, userKey string) error {
+	keys, err := s.client.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read sessions: %w", err)
+	}
+	for _, key := range keys {
+		exists, err := s.client.Exists(ctx, s.sessionKey(key)).Result()
+		if err == nil && exists == 0 {
+			err = s.client.SRem(ctx, userKey, key).Err()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete expired sessions: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *redisSessionStore) sessionKey(key string) string {
+	return s.prefix + "session:" + key
+}
+
+func (s *redisSessionStore) userKey(username string) string {
+	return s.prefix + "user:" + username
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// Role grants access to the portal routes, each role includes the access of the lower ones
+type Role string
+
+const (
+	// RoleViewer can read the connections and their status
+	RoleViewer Role = "viewer"
+	// RoleOperator can toggle the connections and run the operational actions
+	RoleOperator Role = "operator"
+	// RoleAdmin can manage the users and the connection configs
+	RoleAdmin Role = "admin"
+)
+
+// roles are ordered from the lowest to the highest access
+var roles = []Role{RoleViewer, RoleOperator, RoleAdmin}
+
+// ParseRole returns the role of the name, an empty name is the viewer role
+func ParseRole(name string) (Role, error) {
+	if name == "" {
+		return RoleViewer, nil
+	}
+	if !slices.Contains(roles, Role(name)) {
+		return "", fmt.Errorf("invalid role %q, expected one of %v", name, roles)
+	}
+	return Role(name), nil
+}
+
+// Allows reports whether the role has the access of the required role
+func (r Role) Allows(required Role) bool {
+	return slices.Index(roles, r) >= slices.Index(roles, required)
+}
+
+type (
+	userContextKey  struct{}
+	tokenContextKey struct{}
+	csrfContextKey  struct{}
+)
+
+// WithUser returns a copy of the context carrying the authenticated user
+func WithUser(ctx context.Context, user *User) context.Context {
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+// UserFromContext returns the authenticated user of the request context
+func UserFromContext(ctx context.Context) (*User, bool) {
+	user, ok := ctx.Value(userContextKey{}).(*User)
+	return user, ok
+}
+
+// WithToken returns a copy of the context carrying the API token the request authenticated with
+func WithToken(ctx context.Context, token *APIToken) context.Context {
+	return context.WithValue(ctx, tokenContextKey{}, token)
+}
+
+// TokenFromContext returns the API token of the request context, for requests authenticated with one
+func TokenFromContext(ctx context.Context) (*APIToken, bool) {
+	token, ok := ctx.Value(tokenContextKey{}).(*APIToken)
+	return token, ok
+}
+
+// WithCSRFToken returns a copy of the context carrying the CSRF token of the request session
+func WithCSRFToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, csrfContextKey{}, token)
+}
+
+// CSRFTokenFromContext returns the CSRF token of the request session, empty without a session
+func CSRFTokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(csrfContextKey{}).(string)
+	return token
+}
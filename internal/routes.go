@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Routing tables named by iproute2
+var routeTableNames = map[int]string{253: "default", 254: "main", 255: "local"}
+
+// Route is a route of the kernel through the interface of a tunnel
+type Route struct {
+	// Destination is the destination network, default for the default routes
+	Destination string `json:"destination"`
+	Gateway     string `json:"gateway,omitempty"`
+	// Source is the preferred source address of the route
+	Source string `json:"source,omitempty"`
+	Table  string `json:"table"`
+	Metric int    `json:"metric,omitempty"`
+	// Type is the route type, like unicast or local
+	Type string `json:"type"`
+}
+
+// RoutingRule is a policy routing rule looking up a table of the routes of a tunnel,
+// like the rules wg-quick adds for the full tunnels
+type RoutingRule struct {
+	Family   string `json:"family"`
+	Priority int    `json:"priority"`
+	Table    string `json:"table"`
+	FwMark   string `json:"fwmark,omitempty"`
+	// Invert reports whether the rule matches the packets not matching its selectors
+	Invert bool `json:"invert,omitempty"`
+}
+
+// TunnelRoutes are the routes and the routing rules of the interface of an active connection
+type TunnelRoutes struct {
+	Connection string         `json:"connection"`
+	Routes     []*Route       `json:"routes"`
+	Rules      []*RoutingRule `json:"rules"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// TunnelRoutesResult are the routes of the active connections
+type TunnelRoutesResult struct {
+	Tunnels []*TunnelRoutes `json:"tunnels"`
+	Time    time.Time       `json:"time"`
+}
+
+// kernelRoute is a route of the kernel with the index of its output interface
+type kernelRoute struct {
+	Route
+	ifindex int
+	table   int
+}
+
+// kernelRule is a routing rule of the kernel with the number of its table
+type kernelRule struct {
+	RoutingRule
+	table int
+}
+
+// TunnelRoutes returns the routes installed through the interfaces of the granted active
+// connections, read from the kernel over netlink, with the routing rules looking up their tables
+func (m *WireGuardManager) TunnelRoutes(grants ConnectionGrants) (*TunnelRoutesResult, error) {
+	status, err := m.GetStatus(grants)
+	if err != nil {
+		return nil, err
+	}
+	if len(status) == 0 {
+		return nil, ErrNoActiveConnection
+	}
+	routes, err := readKernelRoutes()
+	if err != nil {
+		return nil, err
+	}
+	rules, err := readRoutingRules()
+	if err != nil {
+		return nil, err
+	}
+	result := &TunnelRoutesResult{Tunnels: []*TunnelRoutes{}, Time: time.Now()}
+	for _, connection := range status {
+		if connection.Namespace != "" {
+			result.Tunnels = append(result.Tunnels, &TunnelRoutes{
+				Connection: connection.Name, Routes: []*Route{}, Rules: []*RoutingRule{},
+				Error: fmt.Sprintf("the routes of network namespace %s aren't read", connection.Namespace),
+			})
+			continue
+		}
+		result.Tunnels = append(result.Tunnels, tunnelRoutes(connection.Name, routes, rules))
+	}
+	return result, nil
+}
+
+// tunnelRoutes returns the routes through the interface and the rules looking up their tables,
+// besides the main and local tables looked up by every packet
+func tunnelRoutes(name string, routes []*kernelRoute, rules []*kernelRule) *TunnelRoutes {
+	tunnel := &TunnelRoutes{Connection: name, Routes: []*Route{}, Rules: []*RoutingRule{}}
+	device, err := net.InterfaceByName(name)
+	if err != nil {
+		tunnel.Error = err.Error()
+		return tunnel
+	}
+	tables := make(map[int]bool)
+	for _, route := range routes {
+		if route.ifindex == device.Index {
+			tunnel.Routes = append(tunnel.Routes, &route.Route)
+			tables[route.table] = route.table != 254 && route.table != 255
+		}
+	}
+	for _, rule := range rules {
+		if tables[rule.table] {
+			tunnel.Rules = append(tunnel.Rules, &rule.RoutingRule)
+		}
+	}
+	return tunnel
+}
+
+// routeTableName returns the iproute2 name of the routing table, its number otherwise
+func routeTableName(table int) string {
+	if name, ok := routeTableNames[table]; ok {
+		return name
+	}
+	return strconv.Itoa(table)
+}
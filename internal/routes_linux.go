@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// routeHeaderSize is the size of the headers of the route and rule messages, rtmsg and fib_rule_hdr
+const routeHeaderSize = 12
+
+// Route types named by iproute2
+var routeTypeNames = map[uint8]string{
+	unix.RTN_UNICAST: "unicast", unix.RTN_LOCAL: "local", unix.RTN_BROADCAST: "broadcast",
+	unix.RTN_ANYCAST: "anycast", unix.RTN_MULTICAST: "multicast", unix.RTN_BLACKHOLE: "blackhole",
+	unix.RTN_UNREACHABLE: "unreachable", unix.RTN_PROHIBIT: "prohibit", unix.RTN_THROW: "throw",
+}
+
+// readKernelRoutes dumps the IPv4 and IPv6 routes of every table
+func readKernelRoutes() ([]*kernelRoute, error) {
+	messages, err := dumpNetlink(unix.RTM_GETROUTE, unix.RTM_NEWROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the routes: %w", err)
+	}
+	routes := make([]*kernelRoute, 0, len(messages))
+	for _, message := range messages {
+		routes = append(routes, parseKernelRoute(message))
+	}
+	return routes, nil
+}
+
+// parseKernelRoute parses the route message
+func parseKernelRoute(message syscall.NetlinkMessage) *kernelRoute {
+	header := message.Data[:routeHeaderSize]
+	attributes := parseNetlinkAttributes(message.Data[routeHeaderSize:])
+	route := &kernelRoute{table: int(header[4])}
+	route.Type = routeTypeNames[header[7]]
+	route.Destination = "default"
+	if destination, ok := netlinkAddr(attributes[unix.RTA_DST]); ok {
+		route.Destination = netip.PrefixFrom(destination, int(header[1])).String()
+	}
+	if gateway, ok := netlinkAddr(attributes[unix.RTA_GATEWAY]); ok {
+		route.Gateway = gateway.String()
+	}
+	if source, ok := netlinkAddr(attributes[unix.RTA_PREFSRC]); ok {
+		route.Source = source.String()
+	}
+	if table, ok := netlinkUint32(attributes[unix.RTA_TABLE]); ok {
+		route.table = int(table)
+	}
+	if metric, ok := netlinkUint32(attributes[unix.RTA_PRIORITY]); ok {
+		route.Metric = int(metric)
+	}
+	if ifindex, ok := netlinkUint32(attributes[unix.RTA_OIF]); ok {
+		route.ifindex = int(ifindex)
+	}
+	route.Table = routeTableName(route.table)
+	return route
+}
+
+// readRoutingRules dumps the IPv4 and IPv6 routing rules looking up a table
+func readRoutingRules() ([]*kernelRule, error) {
+	messages, err := dumpNetlink(unix.RTM_GETRULE, unix.RTM_NEWRULE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the routing rules: %w", err)
+	}
+	var rules []*kernelRule
+	for _, message := range messages {
+		if message.Data[7] == unix.FR_ACT_TO_TBL {
+			rules = append(rules, parseRoutingRule(message))
+		}
+	}
+	return rules, nil
+}
+
+// parseRoutingRule parses the message of a rule looking up a table
+func parseRoutingRule(message syscall.NetlinkMessage) *kernelRule {
+	header := message.Data[:routeHeaderSize]
+	attributes := parseNetlinkAttributes(message.Data[routeHeaderSize:])
+	rule := &kernelRule{table: int(header[4])}
+	rule.Family = "ipv4"
+	if header[0] == unix.AF_INET6 {
+		rule.Family = "ipv6"
+	}
+	rule.Invert = binary.NativeEndian.Uint32(header[8:])&unix.FIB_RULE_INVERT != 0
+	if table, ok := netlinkUint32(attributes[unix.FRA_TABLE]); ok {
+		rule.table = int(table)
+	}
+	if priority, ok := netlinkUint32(attributes[unix.FRA_PRIORITY]); ok {
+		rule.Priority = int(priority)
+	}
+	if mark, ok := netlinkUint32(attributes[unix.FRA_FWMARK]); ok {
+		rule.FwMark = fmt.Sprintf("%#x", mark)
+		if mask, ok := netlinkUint32(attributes[unix.FRA_FWMASK]); ok && mask != 0xffffffff {
+			rule.FwMark += fmt.Sprintf("/%#x", mask)
+		}
+	}
+	rule.Table = routeTableName(rule.table)
+	return rule
+}
+
+// dumpNetlink sends the dump request over netlink and returns the messages of the type
+func dumpNetlink(request, reply int) ([]syscall.NetlinkMessage, error) {
+	data, err := syscall.NetlinkRIB(request, unix.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := syscall.ParseNetlinkMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	var replies []syscall.NetlinkMessage
+	for _, message := range messages {
+		if int(message.Header.Type) == reply && len(message.Data) >= routeHeaderSize {
+			replies = append(replies, message)
+		}
+	}
+	return replies, nil
+}
+
+// netlinkAttribute is an attribute of a netlink message
+type netlinkAttribute struct {
+	attributeType uint16
+	value         []byte
+}
+
+// splitNetlinkAttributes returns the attributes in order, the entries of a nested list share their type
+func splitNetlinkAttributes(data []byte) []netlinkAttribute {
+	var attributes []netlinkAttribute
+	for len(data) >= unix.SizeofRtAttr {
+		length := int(binary.NativeEndian.Uint16(data))
+		if length < unix.SizeofRtAttr || length > len(data) {
+			break
+		}
+		attributeType := binary.NativeEndian.Uint16(data[2:]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+		attributes = append(attributes, netlinkAttribute{attributeType, data[unix.SizeofRtAttr:length]})
+		data = data[min((length+unix.NLA_ALIGNTO-1)&^(unix.NLA_ALIGNTO-1), len(data)):]
+	}
+	return attributes
+}
+
+// parseNetlinkAttributes returns the values of the attributes by type
+func parseNetlinkAttributes(data []byte) map[uint16][]byte {
+	attributes := make(map[uint16][]byte)
+	for _, attribute := range splitNetlinkAttributes(data) {
+		attributes[attribute.attributeType] = attribute.value
+	}
+	return attributes
+}
+
+// netlinkAddr returns the IPv4 or IPv6 address of the attribute value
+func netlinkAddr(value []byte) (netip.Addr, bool) {
+	if len(value) != 4 && len(value) != 16 {
+		return netip.Addr{}, false
+	}
+	return netip.AddrFromSlice(value)
+}
+
+// netlinkUint32 returns the 32-bit value of the attribute
+func netlinkUint32(value []byte) (uint32, bool) {
+	if len(value) != 4 {
+		return 0, false
+	}
+	return binary.NativeEndian.Uint32(value), true
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package internal
+
+import "errors"
+
+// readKernelRoutes reads the routes over netlink, which is only supported on Linux
+func readKernelRoutes() ([]*kernelRoute, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// readRoutingRules reads the routing rules over netlink, which is only supported on Linux
+func readRoutingRules() ([]*kernelRule, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,457 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedule actions
+const (
+	// ScheduleStart switches to the connection, stopping the others unless multiple may be active
+	ScheduleStart = "start"
+	ScheduleStop  = "stop"
+	// ScheduleDisconnect stops all the active connections
+	ScheduleDisconnect = "disconnect"
+)
+
+// scheduleTimeLayout is the layout of the times of day of the schedules
+const scheduleTimeLayout = "15:04"
+
+// scheduleCheckInterval is the interval between the checks of the due schedules,
+// short enough to run each schedule within its minute
+const scheduleCheckInterval = 15 * time.Second
+
+var (
+	// ErrScheduleNotFound is returned for unknown schedules
+	ErrScheduleNotFound = errors.New("schedule not found")
+	// ErrInvalidSchedule is returned for schedules with an invalid action, connection, time or days
+	ErrInvalidSchedule = errors.New("invalid schedule")
+)
+
+// scheduleDays are the day names of the schedules, in the order of time.Weekday
+var scheduleDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// scheduleDayGroups are the shorthands of the days of the schedules
+var scheduleDayGroups = map[string][]string{
+	"weekdays": {"mon", "tue", "wed", "thu", "fri"},
+	"weekends": {"sat", "sun"},
+}
+
+// ScheduleSpec is a schedule as created or updated through the API
+type ScheduleSpec struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	// Connection is the started or stopped connection, unset to disconnect
+	Connection string `json:"connection"`
+	// Time is the time of day in the local time of the server, as HH:MM
+	Time string `json:"time"`
+	// Days are mon to sun, weekdays or weekends, every day when unset
+	Days []string `json:"days"`
+	// Enabled defaults to true
+	Enabled *bool `json:"enabled"`
+}
+
+// Schedule runs an action on the connections at a time of day, on some days of the week
+type Schedule struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Action     string    `json:"action"`
+	Connection string    `json:"connection,omitempty"`
+	Time       string    `json:"time"`
+	Days       []string  `json:"days"`
+	Enabled    bool      `json:"enabled"`
+	Created    time.Time `json:"created"`
+	// LastRun is the latest run of the schedule, unset until its first run
+	LastRun *ScheduleRun `json:"last_run,omitempty"`
+}
+
+// ScheduleRun is a run of a schedule
+type ScheduleRun struct {
+	Schedule   string    `json:"schedule"`
+	Name       string    `json:"name"`
+	Action     string    `json:"action"`
+	Connection string    `json:"connection,omitempty"`
+	Time       time.Time `json:"time"`
+	Error      string    `json:"error,omitempty"`
+	// Result is the connection changes of the run, unset when it failed
+	Result *ToggleResult `json:"-"`
+}
+
+// schedule validates the spec, returning the schedule with the days in week order
+func (s ScheduleSpec) schedule() (*Schedule, error) {
+	switch {
+	case s.Action == ScheduleDisconnect && s.Connection != "":
+		return nil, fmt.Errorf("%w: the disconnect action stops all the connections", ErrInvalidSchedule)
+	case s.Action == ScheduleStart || s.Action == ScheduleStop:
+		if !connectionNameRegex.MatchString(s.Connection) {
+			return nil, fmt.Errorf("%w: invalid connection name %q", ErrInvalidSchedule, s.Connection)
+		}
+	case s.Action != ScheduleDisconnect:
+		return nil, fmt.Errorf("%w: action must be %s, %s or %s, got %q",
+			ErrInvalidSchedule, ScheduleStart, ScheduleStop, ScheduleDisconnect, s.Action)
+	}
+	if _, err := time.Parse(scheduleTimeLayout, s.Time); err != nil {
+		return nil, fmt.Errorf("%w: time must be HH:MM, got %q", ErrInvalidSchedule, s.Time)
+	}
+	days, err := parseScheduleDays(s.Days)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(s.Name)
+	if name == "" {
+		name = strings.TrimSpace(fmt.Sprintf("%s %s", s.Action, s.Connection))
+	}
+	return &Schedule{
+		Name:       name,
+		Action:     s.Action,
+		Connection: s.Connection,
+		Time:       s.Time,
+		Days:       days,
+		Enabled:    s.Enabled == nil || *s.Enabled,
+	}, nil
+}
+
+// parseScheduleDays expands the day groups, returning the days in week order from monday
+func parseScheduleDays(names []string) ([]string, error) {
+	if len(names) == 0 {
+		names = scheduleDays
+	}
+	selected := make(map[string]bool)
+	for _, name := range names {
+		name = strings.ToLower(name)
+		switch {
+		case scheduleDayGroups[name] != nil:
+			for _, day := range scheduleDayGroups[name] {
+				selected[day] = true
+			}
+		case slices.Contains(scheduleDays, name):
+			selected[name] = true
+		default:
+			return nil, fmt.Errorf("%w: invalid day %q", ErrInvalidSchedule, name)
+		}
+	}
+	weekFromMonday := append(slices.Clone(scheduleDays[1:]), scheduleDays[0])
+	return slices.DeleteFunc(weekFromMonday, func(day string) bool { return !selected[day] }), nil
+}
+
+// due reports whether the schedule runs at the minute, and didn't run yet within it
+func (s *Schedule) due(now time.Time) bool {
+	if !s.Enabled || now.Format(scheduleTimeLayout) != s.Time {
+		return false
+	}
+	if !slices.Contains(s.Days, scheduleDays[now.Weekday()]) {
+		return false
+	}
+	return s.LastRun == nil || now.Sub(s.LastRun.Time) >= time.Minute
+}
+
+// ScheduleStore holds the schedules of the profile, persisted in the state directory with their last run
+type ScheduleStore struct {
+	path      string
+	schedules map[string]*Schedule
+	mutex     sync.Mutex
+}
+
+func NewScheduleStore(profile string, config *Config) (*ScheduleStore, error) {
+	store := &ScheduleStore{
+		path:      filepath.Join(config.StateDir, profileStateFile("schedules", ".json", profile)),
+		schedules: make(map[string]*Schedule),
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Create adds a schedule
+func (s *ScheduleStore) Create(spec ScheduleSpec) (*Schedule, error) {
+	schedule, err := spec.schedule()
+	if err != nil {
+		return nil, err
+	}
+	if schedule.ID, err = randomHex(6); err != nil {
+		return nil, fmt.Errorf("failed to generate schedule ID: %w", err)
+	}
+	schedule.Created = time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.schedules[schedule.ID] = schedule
+	if err := s.save(func() { delete(s.schedules, schedule.ID) }); err != nil {
+		return nil, err
+	}
+	scheduleCopy := *schedule
+	return &scheduleCopy, nil
+}
+
+// List returns the schedules sorted by time of day
+func (s *ScheduleStore) List() []*Schedule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	schedules := []*Schedule{}
+	for _, schedule := range s.schedules {
+		scheduleCopy := *schedule
+		schedules = append(schedules, &scheduleCopy)
+	}
+	slices.SortFunc(schedules, func(a, b *Schedule) int {
+		return strings.Compare(a.Time+a.ID, b.Time+b.ID)
+	})
+	return schedules
+}
+
+// Get returns the schedule
+func (s *ScheduleStore) Get(id string) (*Schedule, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	schedule, exists := s.schedules[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrScheduleNotFound, id)
+	}
+	scheduleCopy := *schedule
+	return &scheduleCopy, nil
+}
+
+// Update replaces the schedule, keeping its creation time and last run
+func (s *ScheduleStore) Update(id string, spec ScheduleSpec) (*Schedule, error) {
+	schedule, err := spec.schedule()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous, exists := s.schedules[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrScheduleNotFound, id)
+	}
+	schedule.ID, schedule.Created, schedule.LastRun = id, previous.Created, previous.LastRun
+	s.schedules[id] = schedule
+	if err := s.save(func() { s.schedules[id] = previous }); err != nil {
+		return nil, err
+	}
+	scheduleCopy := *schedule
+	return &scheduleCopy, nil
+}
+
+// Delete removes the schedule
+func (s *ScheduleStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	schedule, exists := s.schedules[id]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrScheduleNotFound, id)
+	}
+	delete(s.schedules, id)
+	return s.save(func() { s.schedules[id] = schedule })
+}
+
+// RenameConnection makes the schedules of the renamed connection run on its new name
+func (s *ScheduleStore) RenameConnection(name, newName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var renamed []*Schedule
+	for _, schedule := range s.schedules {
+		if schedule.Connection == name {
+			schedule.Connection = newName
+			renamed = append(renamed, schedule)
+		}
+	}
+	if len(renamed) == 0 {
+		return nil
+	}
+	return s.save(func() {
+		for _, schedule := range renamed {
+			schedule.Connection = name
+		}
+	})
+}
+
+// DeleteConnection removes the schedules of the deleted connection
+func (s *ScheduleStore) DeleteConnection(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	deleted := make(map[string]*Schedule)
+	for id, schedule := range s.schedules {
+		if schedule.Connection == name {
+			deleted[id] = schedule
+			delete(s.schedules, id)
+		}
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+	return s.save(func() { maps.Copy(s.schedules, deleted) })
+}
+
+// due returns the schedules due at the minute, in the order of their creation
+func (s *ScheduleStore) due(now time.Time) []*Schedule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var due []*Schedule
+	for _, schedule := range s.schedules {
+		if schedule.due(now) {
+			scheduleCopy := *schedule
+			due = append(due, &scheduleCopy)
+		}
+	}
+	slices.SortFunc(due, func(a, b *Schedule) int {
+		return a.Created.Compare(b.Created)
+	})
+	return due
+}
+
+// recordRun keeps the run as the last one of its schedule, unless the schedule was deleted
+func (s *ScheduleStore) recordRun(run *ScheduleRun) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	schedule, exists := s.schedules[run.Schedule]
+	if !exists {
+		return
+	}
+	previous := schedule.LastRun
+	schedule.LastRun = run
+	if err := s.save(func() { schedule.LastRun = previous }); err != nil {
+		log.Printf("Failed to record the run of schedule %s: %v", run.Schedule, err)
+	}
+}
+
+func (s *ScheduleStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read schedules: %w", err)
+	}
+	var schedules []*Schedule
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", s.path, err)
+	}
+	for _, schedule := range schedules {
+		s.schedules[schedule.ID] = schedule
+	}
+	return nil
+}
+
+// save persists the schedules, it must be called holding the mutex.
+// The change is reverted with undo when it can't be persisted.
+func (s *ScheduleStore) save(undo func()) error {
+	schedules := []*Schedule{}
+	for _, id := range slices.Sorted(maps.Keys(s.schedules)) {
+		schedules = append(schedules, s.schedules[id])
+	}
+	data, err := json.MarshalIndent(schedules, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		undo()
+		return fmt.Errorf("failed to save schedules: %w", err)
+	}
+	return nil
+}
+
+// Scheduler runs the due schedules. The runs missed while the portal was down aren't
+// caught up, and like all the automated connection management, the schedules don't run
+// during the maintenance windows and in read-only mode.
+type Scheduler struct {
+	store       *ScheduleStore
+	manager     *WireGuardManager
+	maintenance *MaintenanceWindow
+	readOnly    *ReadOnlyMode
+}
+
+func NewScheduler(
+	store *ScheduleStore, manager *WireGuardManager, maintenance *MaintenanceWindow, readOnly *ReadOnlyMode,
+) *Scheduler {
+	return &Scheduler{store: store, manager: manager, maintenance: maintenance, readOnly: readOnly}
+}
+
+// Start runs the due schedules, onRun is called after each run
+func (s *Scheduler) Start(onRun func(run *ScheduleRun)) {
+	go func() {
+		ticker := time.NewTicker(scheduleCheckInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			for _, run := range s.runDue(now) {
+				onRun(run)
+			}
+		}
+	}()
+}
+
+// runDue runs the schedules due at the minute in turn
+func (s *Scheduler) runDue(now time.Time) []*ScheduleRun {
+	due := s.store.due(now)
+	if len(due) == 0 {
+		return nil
+	}
+	if s.maintenance.Active() || s.readOnly.Enabled() {
+		log.Printf("Skipped %d due schedules during maintenance or in read-only mode", len(due))
+		return nil
+	}
+	runs := make([]*ScheduleRun, 0, len(due))
+	for _, schedule := range due {
+		run := &ScheduleRun{
+			Schedule:   schedule.ID,
+			Name:       schedule.Name,
+			Action:     schedule.Action,
+			Connection: schedule.Connection,
+			Time:       now,
+		}
+		var err error
+		if run.Result, err = s.run(schedule); err != nil {
+			log.Printf("Schedule %s failed to %s: %v", schedule.Name, schedule.Action, err)
+			run.Error = err.Error()
+		} else {
+			log.Printf("Ran schedule %s", schedule.Name)
+		}
+		s.store.recordRun(run)
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+func (s *Scheduler) run(schedule *Schedule) (*ToggleResult, error) {
+	switch schedule.Action {
+	case ScheduleStart:
+		return s.manager.StartConnection(schedule.Connection, nil)
+	case ScheduleStop:
+		return s.manager.StopConnection(schedule.Connection, nil)
+	default:
+		return s.manager.stopAllConnections()
+	}
+}
+
+// stopAllConnections stops the active connections in turn, until one fails to stop.
+// The connections are stopped under a single operationMutex hold, so a toggle can't start one in between.
+func (m *WireGuardManager) stopAllConnections() (*ToggleResult, error) {
+	m.operationMutex.Lock()
+	defer m.operationMutex.Unlock()
+	connections, err := m.GetConnections()
+	if err != nil {
+		return nil, err
+	}
+	result := &ToggleResult{}
+	for _, connection := range connections {
+		if !connection.Active {
+			continue
+		}
+		stopped, err := m.changeConnection(connection.Name, changeStop, nil)
+		if err != nil {
+			return nil, err
+		}
+		result.Output = append(result.Output, stopped.Output...)
+		result.Stopped = append(result.Stopped, stopped.Stopped...)
+	}
+	return result, nil
+}
@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Session store backends of the session_store option
+const (
+	SessionStoreMemory = "memory"
+	SessionStoreFile   = "file"
+	SessionStoreRedis  = "redis"
+)
+
+// SessionStore keeps the sessions by key, the hash of the session ID,
+// so the stored sessions can't be used as session cookies
+type SessionStore interface {
+	// Get returns the session of the key, or ErrInvalidSession when there is none
+	Get(key string) (*Session, error)
+	Save(key string, session *Session) error
+	Delete(key string) error
+	// ListUser returns the sessions of the user by key
+	ListUser(username string) (map[string]*Session, error)
+	// DeleteUser removes all sessions of the user
+	DeleteUser(username string) error
+	// DeleteExpired removes the sessions expired before now
+	DeleteExpired(now time.Time) error
+}
+
+// NewSessionStore creates the session store of the configured backend for the named profile,
+// the sessions of each profile are separate like their session cookies
+func NewSessionStore(profile string, config *Config) (SessionStore, error) {
+	switch config.SessionStore {
+	case "", SessionStoreMemory:
+		return &localSessionStore{sessions: make(map[string]Session)}, nil
+	case SessionStoreFile:
+		return newFileSessionStore(filepath.Join(config.StateDir, profileStateFile("sessions", ".json", profile)))
+	case SessionStoreRedis:
+		return newRedisSessionStore(profile, config.Redis)
+	default:
+		return nil, fmt.Errorf("unknown session store %q", config.SessionStore)
+	}
+}
+
+// validateSessionStore checks the session_store option names a backend, and the backend settings
+func (c *Config) validateSessionStore() error {
+	switch c.SessionStore {
+	case "", SessionStoreMemory, SessionStoreFile:
+		return nil
+	case SessionStoreRedis:
+		if err := c.Redis.validate(); err != nil {
+			return fmt.Errorf("invalid redis: %w", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("session_store must be %s, %s or %s, got %q",
+			SessionStoreMemory, SessionStoreFile, SessionStoreRedis, c.SessionStore)
+	}
+}
+
+// localSessionStore keeps the sessions in memory, writing them to the file of path
+// on every change when set so they survive restarts
+type localSessionStore struct {
+	path     string
+	sessions map[string]Session
+	mutex    sync.RWMutex
+}
+
+// newFileSessionStore loads the sessions of the file. A corrupted file is moved aside
+// for inspection and the store starts without sessions, instead of failing the startup.
+func newFileSessionStore(path string) (*localSessionStore, error) {
+	store := &localSessionStore{path: path, sessions: make(map[string]Session)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sessions: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &store.sessions); err != nil {
+		backup := fmt.Sprintf("%s.corrupt-%d", path, time.Now().Unix())
+		log.Printf("Warning: corrupted session store %s (%v), starting without sessions", path, err)
+		if err := os.Rename(path, backup); err != nil {
+			log.Printf("Failed to back up the corrupted session store: %v", err)
+		} else {
+			log.Printf("Corrupted session store backed up to %s", backup)
+		}
+		store.sessions = make(map[string]Session)
+	}
+	return store, nil
+}
+
+func (s *localSessionStore) Get(key string) (*Session, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	session, exists := s.sessions[key]
+	if !exists {
+		return nil, ErrInvalidSession
+	}
+	return &session, nil
+}
+
+func (s *localSessionStore) Save(key string, session *Session) error {
+	return s.update(func() bool {
+		s.sessions[key] = *session
+		return true
+	})
+}
+
+func (s *localSessionStore) Delete(key string) error {
+	return s.update(func() bool {
+		_, exists := s.sessions[key]
+		delete(s.sessions, key)
+		return exists
+	})
+}
+
+func (s *localSessionStore) ListUser(username string) (map[string]*Session, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	sessions := make(map[string]*Session)
+	for key, session := range s.sessions {
+		if session.Username == username {
+			sessions[key] = &session
+		}
+	}
+	return sessions, nil
+}
+
+func (s *localSessionStore) DeleteUser(username string) error {
+	return s.update(func() bool {
+		return s.deleteFunc(func(session Session) bool { return session.Username == username })
+	})
+}
+
+func (s *localSessionStore) DeleteExpired(now time.Time) error {
+	return s.update(func() bool {
+		return s.deleteFunc(func(session Session) bool { return now.After(session.Expires) })
+	})
+}
+
+// deleteFunc removes the sessions matching del, it must be called holding the mutex
+func (s *localSessionStore) deleteFunc(del func(Session) bool) bool {
+	deleted := false
+	for key, session := range s.sessions {
+		if del(session) {
+			delete(s.sessions, key)
+			deleted = true
+		}
+	}
+	return deleted
+}
+
+// update applies the change to the sessions, writing the file when the change reports any
+func (s *localSessionStore) update(change func() bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !change() || s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.sessions)
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save sessions: %w", err)
+	}
+	return nil
+}
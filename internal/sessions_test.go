@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSessionStoreRecoversFromCorruptFile(t *testing.T) {
+	config := DefaultConfig()
+	config.StateDir = t.TempDir()
+	config.SessionStore = SessionStoreFile
+	path := filepath.Join(config.StateDir, profileStateFile("sessions", ".json", DefaultProfile))
+	if err := os.WriteFile(path, []byte(`{"truncated": {"username": "al`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewSessionStore(DefaultProfile, config)
+	if err != nil {
+		t.Fatalf("corrupt session store prevented the startup: %v", err)
+	}
+	if _, err := store.Get("truncated"); !errors.Is(err, ErrInvalidSession) {
+		t.Fatalf("Get = %v, want ErrInvalidSession", err)
+	}
+	backups, err := filepath.Glob(path + ".corrupt-*")
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("corrupt store backups = %v (%v), want one", backups, err)
+	}
+
+	// The store keeps working and writes a valid file again
+	session := &Session{Username: "alice", Expires: time.Now().Add(time.Hour)}
+	if err := store.Save("key", session); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewSessionStore(DefaultProfile, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved, err := reloaded.Get("key"); err != nil || saved.Username != "alice" {
+		t.Fatalf("Get after reload = %+v, %v, want the session of alice", saved, err)
+	}
+}
@@ -0,0 +1,313 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSpeedTestRunning is returned while another speed test is running
+	ErrSpeedTestRunning = errors.New("a speed test is already running")
+	// ErrConnectionNotActive is returned for the speed tests of inactive connections
+	ErrConnectionNotActive = errors.New("connection is not active")
+	// ErrAmbiguousConnection is returned for the speed tests without a connection while several are active
+	ErrAmbiguousConnection = errors.New("several connections are active, the connection must be chosen")
+)
+
+// SpeedTestConfig measures the throughput through the active connection with HTTP transfers
+type SpeedTestConfig struct {
+	// DownloadURL answers the requested number of bytes, {bytes} is replaced by the size of
+	// the transfer, like https://speed.cloudflare.com/__down?bytes={bytes} (empty disables the tests)
+	DownloadURL string `yaml:"download_url"`
+	// UploadURL accepts the uploaded bytes, like https://speed.cloudflare.com/__up (optional)
+	UploadURL string `yaml:"upload_url"`
+	// Megabytes is the size of each transfer
+	Megabytes      int `yaml:"megabytes"`
+	TimeoutSeconds int `yaml:"timeout_seconds"`
+	// History is the number of results kept per connection
+	History int `yaml:"history"`
+}
+
+func (c SpeedTestConfig) validate() error {
+	if c.DownloadURL == "" {
+		return nil
+	}
+	for _, serviceURL := range []string{c.DownloadURL, c.UploadURL} {
+		if serviceURL == "" {
+			continue
+		}
+		parsed, err := url.Parse(strings.ReplaceAll(serviceURL, "{bytes}", "0"))
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("invalid service URL %q", serviceURL)
+		}
+	}
+	switch {
+	case c.Megabytes <= 0 || c.Megabytes > 1000:
+		return errors.New("megabytes must be between 1 and 1000")
+	case c.TimeoutSeconds <= 0:
+		return errors.New("timeout_seconds must be positive")
+	case c.History <= 0:
+		return errors.New("history must be positive")
+	}
+	return nil
+}
+
+// SpeedTestResult is the throughput measured through a connection
+type SpeedTestResult struct {
+	Connection    string    `json:"connection"`
+	Time          time.Time `json:"time"`
+	DownloadBytes int64     `json:"download_bytes"`
+	DownloadMbps  float64   `json:"download_mbps"`
+	// The upload is measured only when an upload URL is set
+	UploadBytes int64   `json:"upload_bytes,omitempty"`
+	UploadMbps  float64 `json:"upload_mbps,omitempty"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// SpeedTestHistory is the results of a connection, newest first,
+// with the averages of the successful ones to compare the connections
+type SpeedTestHistory struct {
+	Connection          string             `json:"connection"`
+	AverageDownloadMbps float64            `json:"average_download_mbps"`
+	AverageUploadMbps   float64            `json:"average_upload_mbps"`
+	Results             []*SpeedTestResult `json:"results"`
+}
+
+// SpeedTests runs the speed tests and keeps their results per connection, persisted in the state directory
+type SpeedTests struct {
+	config  SpeedTestConfig
+	path    string
+	results map[string][]*SpeedTestResult
+	mutex   sync.RWMutex
+	// running is held during a speed test, the tests would compete for the bandwidth
+	running sync.Mutex
+}
+
+func NewSpeedTests(profile string, config *Config) (*SpeedTests, error) {
+	tests := &SpeedTests{
+		config:  config.SpeedTest,
+		path:    filepath.Join(config.StateDir, profileStateFile("speedtests", ".json", profile)),
+		results: make(map[string][]*SpeedTestResult),
+	}
+	if err := tests.load(); err != nil {
+		return nil, err
+	}
+	return tests, nil
+}
+
+// Enabled reports whether a download URL is set
+func (t *SpeedTests) Enabled() bool {
+	return t.config.DownloadURL != ""
+}
+
+// Run measures the throughput through the active connection, the only active granted connection
+// when the name is empty. The transfers use the routes of the host, so they go through the tunnel
+// routing all the traffic. The failed measurements are recorded with their error.
+func (t *SpeedTests) Run(m *WireGuardManager, name string, grants ConnectionGrants) (*SpeedTestResult, error) {
+	if !t.running.TryLock() {
+		return nil, ErrSpeedTestRunning
+	}
+	defer t.running.Unlock()
+	name, err := activeConnection(m, name, grants)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SpeedTestResult{Connection: name, Time: time.Now()}
+	// New connections, the kept alive ones may have been routed outside of the tunnel
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	size := int64(t.config.Megabytes) * 1000 * 1000
+	downloadURL := strings.ReplaceAll(t.config.DownloadURL, "{bytes}", strconv.FormatInt(size, 10))
+	result.DownloadBytes, result.DownloadMbps, err = t.transfer(client, http.MethodGet, downloadURL, size)
+	if err == nil && t.config.UploadURL != "" {
+		result.UploadBytes, result.UploadMbps, err = t.transfer(client, http.MethodPost, t.config.UploadURL, size)
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result, t.record(result)
+}
+
+// activeConnection returns the named connection when it's active,
+// or the only active granted connection without a name
+func activeConnection(m *WireGuardManager, name string, grants ConnectionGrants) (string, error) {
+	status, err := m.GetStatus(grants)
+	if err != nil {
+		return "", err
+	}
+	active := make([]string, 0, len(status))
+	for _, connection := range status {
+		active = append(active, connection.Name)
+	}
+	switch {
+	case name != "" && !slices.Contains(active, name):
+		return "", fmt.Errorf("%w: %s", ErrConnectionNotActive, name)
+	case name != "":
+		return name, nil
+	case len(active) == 0:
+		return "", ErrNoActiveConnection
+	case len(active) > 1:
+		return "", ErrAmbiguousConnection
+	}
+	return active[0], nil
+}
+
+// transfer downloads, or uploads with POST, the bytes and returns the size transferred and its Mbit/s
+func (t *SpeedTests) transfer(client *http.Client, method, serviceURL string, size int64) (int64, float64, error) {
+	operation := map[string]string{http.MethodGet: "download", http.MethodPost: "upload"}[method]
+	timeout := time.Duration(t.config.TimeoutSeconds) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, method, serviceURL, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	if method == http.MethodPost {
+		request.Body, request.ContentLength = io.NopCloser(io.LimitReader(zeroReader{}, size)), size
+	}
+
+	start := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s failed: %w", operation, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return 0, 0, fmt.Errorf("%s: %s returned %s", operation, request.URL.Host, response.Status)
+	}
+	transferred, err := io.Copy(io.Discard, io.LimitReader(response.Body, size))
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s failed: %w", operation, err)
+	}
+	if method == http.MethodPost {
+		transferred = request.ContentLength
+	}
+	return transferred, float64(transferred) * 8 / time.Since(start).Seconds() / 1e6, nil
+}
+
+// zeroReader reads zeros, the uploaded bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// record keeps the result, dropping the oldest results of the connection past the history size
+func (t *SpeedTests) record(result *SpeedTestResult) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	previous := t.results[result.Connection]
+	results := append(slices.Clone(previous), result)
+	t.results[result.Connection] = results[max(0, len(results)-t.config.History):]
+	return t.save(func() { t.results[result.Connection] = previous })
+}
+
+// Histories returns the results of the granted connections, or of the named connection, sorted by name
+func (t *SpeedTests) Histories(name string, grants ConnectionGrants) []*SpeedTestHistory {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	histories := []*SpeedTestHistory{}
+	for _, connection := range slices.Sorted(maps.Keys(t.results)) {
+		if !grants.Allows(connection) || (name != "" && connection != name) {
+			continue
+		}
+		history := &SpeedTestHistory{Connection: connection}
+		var succeeded float64
+		for _, result := range slices.Backward(t.results[connection]) {
+			history.Results = append(history.Results, result)
+			if result.Error == "" {
+				succeeded++
+				history.AverageDownloadMbps += result.DownloadMbps
+				history.AverageUploadMbps += result.UploadMbps
+			}
+		}
+		if succeeded > 0 {
+			history.AverageDownloadMbps /= succeeded
+			history.AverageUploadMbps /= succeeded
+		}
+		histories = append(histories, history)
+	}
+	return histories
+}
+
+// RenameConnection moves the results of the renamed connection to its new name
+func (t *SpeedTests) RenameConnection(name, newName string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	results, ok := t.results[name]
+	if !ok {
+		return nil
+	}
+	previous, existed := t.results[newName]
+	for _, result := range results {
+		result.Connection = newName
+	}
+	t.results[newName] = results
+	delete(t.results, name)
+	return t.save(func() {
+		for _, result := range results {
+			result.Connection = name
+		}
+		t.results[name] = results
+		delete(t.results, newName)
+		if existed {
+			t.results[newName] = previous
+		}
+	})
+}
+
+// DeleteConnection removes the results of the deleted connection
+func (t *SpeedTests) DeleteConnection(name string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	results, ok := t.results[name]
+	if !ok {
+		return nil
+	}
+	delete(t.results, name)
+	return t.save(func() { t.results[name] = results })
+}
+
+func (t *SpeedTests) load() error {
+	data, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read speed tests: %w", err)
+	}
+	var results map[string][]*SpeedTestResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", t.path, err)
+	}
+	maps.Copy(t.results, results)
+	return nil
+}
+
+// save persists the results, it must be called holding the mutex.
+// The change is reverted with undo when it can't be persisted.
+func (t *SpeedTests) save(undo func()) error {
+	data, err := json.MarshalIndent(t.results, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(t.path, data)
+	}
+	if err != nil {
+		undo()
+		return fmt.Errorf("failed to save speed tests: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// precompressedEncodings are the content encodings served from precompressed files, in order of preference
+var precompressedEncodings = []struct {
+	name      string
+	extension string
+}{
+	{name: "br", extension: ".br"},
+	{name: "gzip", extension: ".gz"},
+}
+
+// staticHandler serves static assets, preferring precompressed variants
+type staticHandler struct {
+	fsys fs.FS
+}
+
+// NewStaticHandler serves the files of fsys. The precompressed .br or .gz variant of a file
+// is served when the client accepts it, other text assets are gzipped on the fly.
+func NewStaticHandler(fsys fs.FS) http.Handler {
+	return &staticHandler{fsys: fsys}
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	info, err := fs.Stat(h.fsys, name)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	// The content type is always the one of the original file
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Vary", "Accept-Encoding")
+
+	for _, encoding := range precompressedEncodings {
+		if acceptsEncoding(r, encoding.name) && h.serveFile(w, r, name+encoding.extension, encoding.name) {
+			return
+		}
+	}
+	if acceptsEncoding(r, "gzip") && isCompressible(contentType) {
+		h.serveGzipped(w, name)
+		return
+	}
+	if !h.serveFile(w, r, name, "") {
+		http.NotFound(w, r)
+	}
+}
+
+// serveFile serves the file with the given content encoding, it reports false if the file doesn't exist
+func (h *staticHandler) serveFile(w http.ResponseWriter, r *http.Request, name, encoding string) bool {
+	file, err := h.fsys.Open(name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	content, seekable := file.(io.ReadSeeker)
+	if err != nil || !seekable {
+		return false
+	}
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	http.ServeContent(w, r, name, info.ModTime(), content)
+	return true
+}
+
+// serveGzipped compresses the file on the fly
+func (h *staticHandler) serveGzipped(w http.ResponseWriter, name string) {
+	file, err := h.fsys.Open(name)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Encoding", "gzip")
+	writer := gzip.NewWriter(w)
+	if _, err := io.Copy(writer, file); err != nil {
+		log.Printf("Failed to serve %s: %v", name, err)
+	}
+	_ = writer.Close()
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header allows the encoding
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for accepted := range strings.SplitSeq(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(accepted), ";")
+		if strings.EqualFold(strings.TrimSpace(name), encoding) {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+func isCompressible(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") ||
+		strings.HasPrefix(contentType, "application/javascript") ||
+		strings.HasPrefix(contentType, "application/json") ||
+		strings.HasPrefix(contentType, "image/svg+xml")
+}
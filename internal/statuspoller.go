@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"log"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Status event types, changes of the interfaces observed by the status poller
+const (
+	StatusEventInterfaceUp   = "interface_up"
+	StatusEventInterfaceDown = "interface_down"
+	StatusEventHandshake     = "handshake"
+	StatusEventPeerAdded     = "peer_added"
+	StatusEventPeerRemoved   = "peer_removed"
+)
+
+// StatusEvent is a change of the state of the interfaces, whether made by the portal or outside of it
+type StatusEvent struct {
+	Type       string `json:"type"`
+	Connection string `json:"connection"`
+	// Peer is the ID of the peer of the peer events
+	Peer string    `json:"peer,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// EventBus delivers the status events to its subscribers, in the order they subscribed
+type EventBus struct {
+	subscribers []func(event *StatusEvent)
+	mutex       sync.RWMutex
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe calls handler with each published event, from the publishing goroutine
+func (b *EventBus) Subscribe(handler func(event *StatusEvent)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscribers = append(b.subscribers, handler)
+}
+
+// Publish delivers the events to all subscribers
+func (b *EventBus) Publish(events ...*StatusEvent) {
+	b.mutex.RLock()
+	subscribers := slices.Clone(b.subscribers)
+	b.mutex.RUnlock()
+	for _, event := range events {
+		for _, subscriber := range subscribers {
+			subscriber(event)
+		}
+	}
+}
+
+// StatusPoller reads the state of the interfaces every interval and publishes its changes on the bus
+type StatusPoller struct {
+	interval time.Duration
+	manager  *WireGuardManager
+	bus      *EventBus
+	// previous is the state of the last poll by interface name, nil until the first poll
+	previous map[string]*Device
+}
+
+func NewStatusPoller(interval time.Duration, manager *WireGuardManager, bus *EventBus) *StatusPoller {
+	return &StatusPoller{interval: interval, manager: manager, bus: bus}
+}
+
+// Start polls the interfaces every interval, the first poll only records their state
+func (p *StatusPoller) Start() {
+	if p.interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for now := time.Now(); ; now = <-ticker.C {
+			p.poll(now)
+		}
+	}()
+}
+
+func (p *StatusPoller) poll(now time.Time) {
+	devices, err := p.manager.readDevices()
+	if err != nil {
+		log.Printf("Failed to poll the status: %v", err)
+		return
+	}
+	current := make(map[string]*Device, len(devices))
+	for _, device := range devices {
+		current[device.Name] = device
+	}
+	if p.previous != nil {
+		p.bus.Publish(statusEvents(p.previous, current, now)...)
+	}
+	p.previous = current
+}
+
+// statusEvents returns the changes between the states of the interfaces, sorted by interface
+func statusEvents(previous, current map[string]*Device, now time.Time) []*StatusEvent {
+	names := slices.Collect(maps.Keys(current))
+	for name := range previous {
+		if current[name] == nil {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	var events []*StatusEvent
+	for _, name := range names {
+		before, after := previous[name], current[name]
+		switch {
+		case before == nil:
+			events = append(events, &StatusEvent{Type: StatusEventInterfaceUp, Connection: name, Time: now})
+		case after == nil:
+			events = append(events, &StatusEvent{Type: StatusEventInterfaceDown, Connection: name, Time: now})
+		default:
+			events = append(events, peerEvents(before, after, now)...)
+		}
+	}
+	return events
+}
+
+// peerEvents returns the peers added to and removed from the interface, and their new handshakes
+func peerEvents(before, after *Device, now time.Time) []*StatusEvent {
+	var events []*StatusEvent
+	event := func(eventType, publicKey string) {
+		events = append(events, &StatusEvent{
+			Type: eventType, Connection: after.Name, Peer: PeerID(publicKey), Time: now,
+		})
+	}
+	previous := make(map[string]*Peer, len(before.Peers))
+	for _, peer := range before.Peers {
+		previous[peer.PublicKey] = peer
+	}
+	for _, peer := range after.Peers {
+		previousPeer, existed := previous[peer.PublicKey]
+		delete(previous, peer.PublicKey)
+		if !existed {
+			event(StatusEventPeerAdded, peer.PublicKey)
+		}
+		if newHandshake(previousPeer, peer) {
+			event(StatusEventHandshake, peer.PublicKey)
+		}
+	}
+	for _, peer := range before.Peers {
+		if _, removed := previous[peer.PublicKey]; removed {
+			event(StatusEventPeerRemoved, peer.PublicKey)
+		}
+	}
+	return events
+}
+
+// newHandshake reports whether the peer completed a handshake since its previous state, nil for a new peer
+func newHandshake(previous, peer *Peer) bool {
+	if peer.LatestHandshake.IsZero() {
+		return false
+	}
+	return previous == nil || peer.LatestHandshake.After(previous.LatestHandshake)
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// IsTerminal reports whether the file descriptor is a terminal
+func IsTerminal(fd int) bool {
+	_, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	return err == nil
+}
+
+// ReadPassword reads a line from the terminal of the file descriptor without echoing it
+func ReadPassword(fd int) (string, error) {
+	state, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return "", err
+	}
+	hidden := *state
+	hidden.Lflag &^= unix.ECHO
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &hidden); err != nil {
+		return "", err
+	}
+	defer func() { _ = unix.IoctlSetTermios(fd, unix.TCSETS, state) }()
+
+	// The terminal is line buffered, a reader per line doesn't lose any input
+	line, err := bufio.NewReader(os.NewFile(uintptr(fd), "terminal")).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package internal
+
+import "errors"
+
+// IsTerminal reports whether the file descriptor is a terminal, which is only detected on Linux
+func IsTerminal(int) bool {
+	return false
+}
+
+// ReadPassword reads a line from the terminal without echoing it, which is only supported on Linux
+func ReadPassword(int) (string, error) {
+	return "", errors.ErrUnsupported
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// TLSConfig serves the portal over HTTPS. With a client CA, the clients must present
+// a certificate signed by the CA, and the certificate common name is the portal user.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientCAFile is the PEM file of the CA signing the client certificates
+	ClientCAFile string `yaml:"client_ca_file"`
+	// ClientRole is the role of the certificate users logging in for the first time, defaults to viewer
+	ClientRole Role `yaml:"client_role"`
+}
+
+// Enabled reports whether the portal is served over HTTPS
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// ClientAuth reports whether the clients authenticate with certificates
+func (c TLSConfig) ClientAuth() bool {
+	return c.ClientCAFile != ""
+}
+
+func (c TLSConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("cert_file and key_file must be set together")
+	}
+	if c.ClientAuth() && !c.Enabled() {
+		return errors.New("client_ca_file requires cert_file and key_file")
+	}
+	_, err := ParseRole(string(c.ClientRole))
+	return err
+}
+
+// ServerConfig returns the TLS config of the server, verifying the client certificates
+// against the client CA when set
+func (c TLSConfig) ServerConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if !c.ClientAuth() {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in client CA %s", c.ClientCAFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// Username returns the common name of the verified client certificate of the request
+func (c TLSConfig) Username(r *http.Request) (string, bool) {
+	if !c.ClientAuth() || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	username := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if !usernameRegex.MatchString(username) {
+		return "", false
+	}
+	return username, true
+}
@@ -0,0 +1,324 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokensFile is the file of the state directory keeping the API tokens
+const tokensFile = "tokens.json"
+
+// tokenPrefix starts every API token, so leaked tokens are easy to search for
+const tokenPrefix = "wgp_"
+
+// ErrTokenNotFound is returned for unknown API tokens
+var ErrTokenNotFound = errors.New("token not found")
+
+// TokenScope limits the requests of an API token, within the role of its user
+type TokenScope string
+
+const (
+	// ScopeRead permits reading the connections and their status
+	ScopeRead TokenScope = "read"
+	// ScopeControl also permits toggling the connections and the other operator actions
+	ScopeControl TokenScope = "control"
+)
+
+// ParseScope returns the scope of the name, an empty name is the read scope
+func ParseScope(name string) (TokenScope, error) {
+	switch TokenScope(name) {
+	case "", ScopeRead:
+		return ScopeRead, nil
+	case ScopeControl:
+		return ScopeControl, nil
+	default:
+		return "", fmt.Errorf("invalid scope %q, expected %s or %s", name, ScopeRead, ScopeControl)
+	}
+}
+
+// Allows reports whether the scope permits a request of the method to a route requiring the role
+func (s TokenScope) Allows(role Role, method string) bool {
+	switch s {
+	case ScopeRead:
+		return role == RoleViewer && (method == http.MethodGet || method == http.MethodHead)
+	case ScopeControl:
+		return RoleOperator.Allows(role)
+	default:
+		return false
+	}
+}
+
+// APIToken is a long-lived bearer token acting as its user, for scripts
+type APIToken struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Username string     `json:"username"`
+	Scope    TokenScope `json:"scope"`
+	// Connections further restricts the connections granted to the user, all of them when unset
+	Connections ConnectionGrants `json:"connections"`
+	Created     time.Time        `json:"created"`
+	// LastUsed is kept in memory only, so using a token doesn't write to disk
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	hash     string
+}
+
+// storedToken is a token as persisted in the tokens file
+type storedToken struct {
+	ID          string           `json:"id"`
+	Name        string           `json:"name"`
+	Username    string           `json:"username"`
+	Scope       TokenScope       `json:"scope"`
+	Connections ConnectionGrants `json:"connections"`
+	Created     time.Time        `json:"created"`
+	Hash        string           `json:"hash"`
+}
+
+// TokenStore holds the API tokens, only the hash of the token secrets is kept
+type TokenStore struct {
+	path   string
+	tokens map[string]*APIToken
+	mutex  sync.RWMutex
+}
+
+func NewTokenStore(config *Config) (*TokenStore, error) {
+	store := &TokenStore{
+		path:   filepath.Join(config.StateDir, tokensFile),
+		tokens: make(map[string]*APIToken),
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Create adds a token of the user granted the connections, returning the token which can't be retrieved later
+func (s *TokenStore) Create(
+	username, name string, scope TokenScope, connections ConnectionGrants,
+) (string, *APIToken, error) {
+	if err := connections.validate(); err != nil {
+		return "", nil, err
+	}
+	id, err := randomHex(6)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	secret, err := generateSecureToken()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	token := &APIToken{
+		ID:          id,
+		Name:        name,
+		Username:    username,
+		Scope:       scope,
+		Connections: slices.Clone(connections),
+		Created:     time.Now(),
+		hash:        hashToken(secret),
+	}
+	s.tokens[id] = token
+	if err := s.save(func() { delete(s.tokens, id) }); err != nil {
+		return "", nil, err
+	}
+	tokenCopy := *token
+	return tokenPrefix + id + "_" + secret, &tokenCopy, nil
+}
+
+// List returns the tokens of the user, oldest first
+func (s *TokenStore) List(username string) []*APIToken {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	tokens := []*APIToken{}
+	for _, token := range s.tokens {
+		if token.Username == username {
+			tokenCopy := *token
+			tokens = append(tokens, &tokenCopy)
+		}
+	}
+	slices.SortFunc(tokens, func(a, b *APIToken) int {
+		return a.Created.Compare(b.Created)
+	})
+	return tokens
+}
+
+// Revoke deletes a token of the user
+func (s *TokenStore) Revoke(username, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	token, exists := s.tokens[id]
+	if !exists || token.Username != username {
+		return fmt.Errorf("%w: %s", ErrTokenNotFound, id)
+	}
+	delete(s.tokens, id)
+	return s.save(func() { s.tokens[id] = token })
+}
+
+// RevokeUser deletes all tokens of the user
+func (s *TokenStore) RevokeUser(username string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	revoked := make(map[string]*APIToken)
+	for id, token := range s.tokens {
+		if token.Username == username {
+			revoked[id] = token
+			delete(s.tokens, id)
+		}
+	}
+	if len(revoked) == 0 {
+		return nil
+	}
+	return s.save(func() { maps.Copy(s.tokens, revoked) })
+}
+
+// RenameConnection grants the renamed connection to the tokens it was granted to
+func (s *TokenStore) RenameConnection(name, newName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := make(map[string]ConnectionGrants)
+	for id, token := range s.tokens {
+		if renamed, ok := token.Connections.rename(name, newName); ok {
+			previous[id] = token.Connections
+			token.Connections = renamed
+		}
+	}
+	if len(previous) == 0 {
+		return nil
+	}
+	return s.save(func() {
+		for id, connections := range previous {
+			s.tokens[id].Connections = connections
+		}
+	})
+}
+
+// DeleteConnection revokes the deleted connection from the tokens it was granted to,
+// so a connection created later under its name isn't granted to them
+func (s *TokenStore) DeleteConnection(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := make(map[string]ConnectionGrants)
+	for id, token := range s.tokens {
+		if remaining, ok := token.Connections.remove(name); ok {
+			previous[id] = token.Connections
+			token.Connections = remaining
+		}
+	}
+	if len(previous) == 0 {
+		return nil
+	}
+	return s.save(func() {
+		for id, connections := range previous {
+			s.tokens[id].Connections = connections
+		}
+	})
+}
+
+// Authenticate returns the token matching the bearer token
+func (s *TokenStore) Authenticate(bearer string) (*APIToken, bool) {
+	id, secret, found := strings.Cut(strings.TrimPrefix(bearer, tokenPrefix), "_")
+	if !found || !strings.HasPrefix(bearer, tokenPrefix) {
+		return nil, false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	token, exists := s.tokens[id]
+	if !exists || subtle.ConstantTimeCompare([]byte(token.hash), []byte(hashToken(secret))) != 1 {
+		return nil, false
+	}
+	now := time.Now()
+	token.LastUsed = &now
+	tokenCopy := *token
+	return &tokenCopy, true
+}
+
+func (s *TokenStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read tokens: %w", err)
+	}
+
+	var stored []storedToken
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", s.path, err)
+	}
+	for _, token := range stored {
+		// Tokens created before the scopes are read tokens
+		scope, _ := ParseScope(string(token.Scope))
+		s.tokens[token.ID] = &APIToken{
+			ID:          token.ID,
+			Name:        token.Name,
+			Username:    token.Username,
+			Scope:       scope,
+			Connections: token.Connections,
+			Created:     token.Created,
+			hash:        token.Hash,
+		}
+	}
+	return nil
+}
+
+// save persists the tokens, it must be called holding the mutex.
+// The change is reverted with undo when it can't be persisted.
+func (s *TokenStore) save(undo func()) error {
+	stored := []storedToken{}
+	for _, id := range slices.Sorted(maps.Keys(s.tokens)) {
+		token := s.tokens[id]
+		stored = append(stored, storedToken{
+			ID:          token.ID,
+			Name:        token.Name,
+			Username:    token.Username,
+			Scope:       token.Scope,
+			Connections: token.Connections,
+			Created:     token.Created,
+			Hash:        token.hash,
+		})
+	}
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		undo()
+		return fmt.Errorf("failed to save tokens: %w", err)
+	}
+	return nil
+}
+
+// hashToken hashes a token secret, a single SHA256 is enough for the random secrets
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(size int) (string, error) {
+	random := make([]byte, size)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" // TOTP authenticator apps use HMAC-SHA1
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	totpDigits = 6
+	totpPeriod = 30 * time.Second
+	// totpSkew is the number of periods accepted before and after the current one,
+	// to allow for clock drift between the server and the authenticator
+	totpSkew = 1
+	// recoveryCodeCount is the number of recovery codes generated at a time
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret returns a random base32 encoded TOTP secret
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate TOTP secret: %w", err)
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPURI returns the otpauth URI enrolling the secret in authenticator apps
+func TOTPURI(issuer, username, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	return fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(issuer), url.PathEscape(username), query.Encode())
+}
+
+// validateTOTP checks the code against the periods around now,
+// returning the period of the matched code so it can't be used twice
+func validateTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / int64(totpPeriod.Seconds())
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode computes the code of the period (RFC 4226 dynamic truncation)
+func totpCode(key []byte, step int64) string {
+	mac := hmac.New(sha1.New, key)
+	_ = binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000)
+}
+
+// generateRecoveryCodes returns single-use recovery codes, and their hashes to store
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		random := make([]byte, 5)
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate recovery codes: %w", err)
+		}
+		code := hex.EncodeToString(random)
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code, a single SHA256 is enough for the random codes
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+var (
+	// ErrTOTPEnabled is returned when enrolling a user with two-factor authentication enabled
+	ErrTOTPEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrTOTPNotEnabled is returned for TOTP changes of users without two-factor authentication
+	ErrTOTPNotEnabled = errors.New("two-factor authentication is not enabled")
+	// ErrTOTPNotEnrolled is returned when confirming without a pending enrollment
+	ErrTOTPNotEnrolled = errors.New("no pending two-factor enrollment")
+	// ErrInvalidCode is returned for wrong authentication or recovery codes
+	ErrInvalidCode = errors.New("invalid authentication code")
+)
+
+// EnrollTOTP starts the two-factor enrollment of the user, returning the new secret.
+// It's only enabled once confirmed with a code of the secret.
+func (s *UserStore) EnrollTOTP(username string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, exists := s.users[username]
+	if !exists {
+		return "", fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	if user.TOTPEnabled() {
+		return "", ErrTOTPEnabled
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	s.pendingTOTP[username] = secret
+	return secret, nil
+}
+
+// ConfirmTOTP enables the enrolled secret when the code matches it, returning the recovery codes
+func (s *UserStore) ConfirmTOTP(username, code string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, exists := s.users[username]
+	secret, pending := s.pendingTOTP[username]
+	if !exists || !pending {
+		return nil, ErrTOTPNotEnrolled
+	}
+	step, ok := validateTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	user.TOTPSecret, user.RecoveryCodes = secret, hashes
+	if err := s.save(func() { user.TOTPSecret, user.RecoveryCodes = "", nil }); err != nil {
+		return nil, err
+	}
+	delete(s.pendingTOTP, username)
+	s.totpSteps[username] = step
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user, after verifying the second factor
+func (s *UserStore) RegenerateRecoveryCodes(username, code string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, err := s.secondFactorUser(username, code)
+	if err != nil {
+		return nil, err
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	previous := user.RecoveryCodes
+	user.RecoveryCodes = hashes
+	if err := s.save(func() { user.RecoveryCodes = previous }); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns off the two-factor authentication of the user, after verifying the second factor
+func (s *UserStore) DisableTOTP(username, code string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, err := s.secondFactorUser(username, code)
+	if err != nil {
+		return err
+	}
+	secret, recoveryCodes := user.TOTPSecret, user.RecoveryCodes
+	user.TOTPSecret, user.RecoveryCodes = "", nil
+	return s.save(func() { user.TOTPSecret, user.RecoveryCodes = secret, recoveryCodes })
+}
+
+// VerifySecondFactor checks the TOTP or recovery code of the user, a recovery code is used up
+func (s *UserStore) VerifySecondFactor(username, code string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.secondFactorUser(username, code)
+	return err == nil
+}
+
+// secondFactorUser returns the user when the code is a valid TOTP or recovery code,
+// it must be called holding the mutex
+func (s *UserStore) secondFactorUser(username, code string) (*User, error) {
+	user, exists := s.users[username]
+	if !exists || !user.TOTPEnabled() {
+		return nil, ErrTOTPNotEnabled
+	}
+	code = strings.TrimSpace(code)
+	if step, ok := validateTOTP(user.TOTPSecret, code, time.Now()); ok && step > s.totpSteps[username] {
+		s.totpSteps[username] = step
+		return user, nil
+	}
+
+	index := slices.Index(user.RecoveryCodes, hashRecoveryCode(code))
+	if index < 0 {
+		return nil, ErrInvalidCode
+	}
+	previous := user.RecoveryCodes
+	user.RecoveryCodes = slices.Delete(slices.Clone(previous), index, index+1)
+	if err := s.save(func() { user.RecoveryCodes = previous }); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
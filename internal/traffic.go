@@ -0,0 +1,431 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trafficPruneInterval is the interval between the removals of the samples past the retention
+const trafficPruneInterval = 24 * time.Hour
+
+// ErrInvalidPeriod is returned for traffic periods other than day, week and month
+var ErrInvalidPeriod = errors.New("period must be day, week or month")
+
+// trafficPeriods are the length and the bucket size of the traffic usage periods
+var trafficPeriods = map[string]struct{ length, bucket time.Duration }{
+	"day":   {24 * time.Hour, time.Hour},
+	"week":  {7 * 24 * time.Hour, 24 * time.Hour},
+	"month": {30 * 24 * time.Hour, 24 * time.Hour},
+}
+
+// TrafficConfig records the transfer of the peers of the active connections in the state directory
+type TrafficConfig struct {
+	// SampleSeconds is the interval between the recorded samples (0 disables the history)
+	SampleSeconds int `yaml:"sample_seconds"`
+	// RetentionDays is the number of days the samples are kept
+	RetentionDays int `yaml:"retention_days"`
+}
+
+func (c TrafficConfig) validate() error {
+	if c.SampleSeconds < 0 {
+		return errors.New("sample_seconds must not be negative")
+	}
+	if c.SampleSeconds > 0 && c.RetentionDays <= 0 {
+		return errors.New("retention_days must be positive")
+	}
+	return nil
+}
+
+// trafficRecord is the transfer of a peer since the previous sample
+type trafficRecord struct {
+	Time       time.Time `json:"time"`
+	Connection string    `json:"connection"`
+	Peer       string    `json:"peer"`
+	Received   uint64    `json:"received"`
+	Sent       uint64    `json:"sent"`
+}
+
+// TrafficUsage is the transfer of the connections over a period, in buckets of BucketSeconds
+type TrafficUsage struct {
+	Period        string             `json:"period"`
+	Since         time.Time          `json:"since"`
+	BucketSeconds int                `json:"bucket_seconds"`
+	Connections   []*ConnectionUsage `json:"connections"`
+}
+
+// ConnectionUsage is the transfer of a connection and of its peers
+type ConnectionUsage struct {
+	Name     string        `json:"name"`
+	Received uint64        `json:"received"`
+	Sent     uint64        `json:"sent"`
+	Series   []*UsagePoint `json:"series"`
+	Peers    []*PeerUsage  `json:"peers"`
+}
+
+// PeerUsage is the transfer of a peer of a connection
+type PeerUsage struct {
+	PublicKey string `json:"public_key"`
+	ID        string `json:"id"`
+	Received  uint64 `json:"received"`
+	Sent      uint64 `json:"sent"`
+}
+
+// UsagePoint is the transfer of a bucket starting at Time
+type UsagePoint struct {
+	Time     time.Time `json:"time"`
+	Received uint64    `json:"received"`
+	Sent     uint64    `json:"sent"`
+}
+
+// trafficDayLayout names the file of the records of a day
+const trafficDayLayout = "2006-01-02"
+
+// TrafficHistory appends the transfer of the peers between samples to a file per day (UTC) of the
+// traffic directory of the state directory, one JSON record per line. The queries only read the
+// files of their period without blocking the samples, the days past the retention are removed daily.
+type TrafficHistory struct {
+	dir    string
+	config TrafficConfig
+	// file is the open file of day, the samples of the next day open its file
+	file *os.File
+	day  string
+	// previous are the transfer counters of the last sample, by connection and peer
+	previous map[[2]string]transferSample
+	mutex    sync.Mutex
+}
+
+// NewTrafficHistory opens the traffic history of the profile, nothing is recorded unless enabled.
+// The records of the single traffic.log of the previous versions are moved to the day files.
+func NewTrafficHistory(profile string, config *Config) (*TrafficHistory, error) {
+	if config.Traffic.SampleSeconds <= 0 {
+		return &TrafficHistory{}, nil
+	}
+	history := &TrafficHistory{
+		dir:      filepath.Join(config.StateDir, profileStateFile("traffic", "", profile)),
+		config:   config.Traffic,
+		previous: make(map[[2]string]transferSample),
+	}
+	if err := os.MkdirAll(history.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create traffic history: %w", err)
+	}
+	if err := history.migrate(filepath.Join(config.StateDir, profileStateFile("traffic", ".log", profile))); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// migrate splits the records of the previous single history file into the day files, and removes it
+func (h *TrafficHistory) migrate(path string) error {
+	days := make(map[string][]byte)
+	err := scanTrafficFile(path, func(record *trafficRecord) {
+		line, _ := json.Marshal(record)
+		day := record.Time.UTC().Format(trafficDayLayout)
+		days[day] = append(append(days[day], line...), '\n')
+	})
+	if err != nil {
+		return err
+	}
+	// Rewritten whole, migrating again after a crash doesn't count the records twice
+	for day, data := range days {
+		if err := writeFileAtomic(h.dayPath(day), data); err != nil {
+			return fmt.Errorf("failed to migrate traffic history: %w", err)
+		}
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to migrate traffic history: %w", err)
+	}
+	return nil
+}
+
+func (h *TrafficHistory) dayPath(day string) string {
+	return filepath.Join(h.dir, day+".log")
+}
+
+// openDay opens the file of the day for appending, closing the file of the previous day.
+// It must be called holding the mutex.
+func (h *TrafficHistory) openDay(day string) error {
+	if h.file != nil && h.day == day {
+		return nil
+	}
+	file, err := os.OpenFile(h.dayPath(day), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open traffic history: %w", err)
+	}
+	if h.file != nil {
+		h.file.Close()
+	}
+	h.file, h.day = file, day
+	return nil
+}
+
+// Start samples the transfer counters of the connections every sample interval
+func (h *TrafficHistory) Start(m *WireGuardManager) {
+	if h.dir == "" {
+		return
+	}
+	go func() {
+		h.prune(time.Now())
+		lastPrune := time.Now()
+		ticker := time.NewTicker(time.Duration(h.config.SampleSeconds) * time.Second)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			h.sample(m, now)
+			if now.Sub(lastPrune) >= trafficPruneInterval {
+				h.prune(now)
+				lastPrune = now
+			}
+		}
+	}()
+}
+
+// sample records the transfer of each peer since the previous sample. The counters of a
+// restarted interface start over, and the peers seen for the first time have no record
+// since their transfer before the portal started is unknown.
+func (h *TrafficHistory) sample(m *WireGuardManager, now time.Time) {
+	devices, err := m.readDevices()
+	if err != nil {
+		log.Printf("Failed to sample traffic: %v", err)
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	samples := make(map[[2]string]transferSample)
+	var data []byte
+	for _, device := range devices {
+		for _, peer := range device.Peers {
+			key := [2]string{device.Name, peer.PublicKey}
+			samples[key] = transferSample{received: peer.ReceiveBytes, sent: peer.TransmitBytes}
+			if record, ok := h.delta(key, samples[key], now); ok {
+				line, _ := json.Marshal(record)
+				data = append(append(data, line...), '\n')
+			}
+		}
+	}
+	h.previous = samples
+	if len(data) == 0 {
+		return
+	}
+	if err := h.openDay(now.UTC().Format(trafficDayLayout)); err != nil {
+		log.Printf("Failed to record traffic: %v", err)
+		return
+	}
+	if _, err := h.file.Write(data); err != nil {
+		log.Printf("Failed to record traffic: %v", err)
+	}
+}
+
+// delta returns the record of the transfer since the previous sample, if any.
+// It's called with the mutex held.
+func (h *TrafficHistory) delta(key [2]string, sample transferSample, now time.Time) (*trafficRecord, bool) {
+	previous, seen := h.previous[key]
+	if !seen {
+		return nil, false
+	}
+	if sample.received < previous.received || sample.sent < previous.sent {
+		previous = transferSample{}
+	}
+	record := &trafficRecord{
+		Time:       now.UTC(),
+		Connection: key[0],
+		Peer:       key[1],
+		Received:   sample.received - previous.received,
+		Sent:       sample.sent - previous.sent,
+	}
+	return record, record.Received > 0 || record.Sent > 0
+}
+
+// prune removes the files of the days past the retention, the file of the current day is never
+// one of them so the samples aren't blocked
+func (h *TrafficHistory) prune(now time.Time) {
+	cutoff := now.UTC().AddDate(0, 0, -h.config.RetentionDays)
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		log.Printf("Failed to prune traffic history: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		day, err := time.Parse(trafficDayLayout, strings.TrimSuffix(entry.Name(), ".log"))
+		if err != nil || !day.AddDate(0, 0, 1).Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(h.dir, entry.Name())); err != nil {
+			log.Printf("Failed to prune traffic history: %v", err)
+		}
+	}
+}
+
+// scan calls fn with each record of the days since the time, reading only their files.
+// The files are only appended to, a line being written is skipped like a line cut short.
+func (h *TrafficHistory) scan(since time.Time, fn func(record *trafficRecord)) error {
+	now := time.Now().UTC()
+	for day := since.UTC().Truncate(24 * time.Hour); !day.After(now); day = day.AddDate(0, 0, 1) {
+		if err := scanTrafficFile(h.dayPath(day.Format(trafficDayLayout)), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanTrafficFile calls fn with each record of the file, a missing file has none
+func scanTrafficFile(path string, fn func(record *trafficRecord)) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read traffic history: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record trafficRecord
+		// Skip the lines cut short by a crash, the other records stay readable
+		if json.Unmarshal(scanner.Bytes(), &record) == nil {
+			fn(&record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read traffic history: %w", err)
+	}
+	return nil
+}
+
+// Usage returns the transfer of the granted connections over the last day, week or month
+func (h *TrafficHistory) Usage(period string, grants ConnectionGrants) (*TrafficUsage, error) {
+	settings, ok := trafficPeriods[period]
+	if !ok {
+		return nil, fmt.Errorf("%w, got %q", ErrInvalidPeriod, period)
+	}
+	usage := &TrafficUsage{
+		Period:        period,
+		Since:         time.Now().UTC().Add(-settings.length).Truncate(settings.bucket),
+		BucketSeconds: int(settings.bucket.Seconds()),
+		Connections:   []*ConnectionUsage{},
+	}
+	if h.dir == "" {
+		return usage, nil
+	}
+
+	connections := make(map[string]*ConnectionUsage)
+	err := h.scan(usage.Since, func(record *trafficRecord) {
+		if !record.Time.Before(usage.Since) && grants.Allows(record.Connection) {
+			usage.add(connections, record, settings.length, settings.bucket)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range slices.Sorted(maps.Keys(connections)) {
+		usage.Connections = append(usage.Connections, connections[name])
+	}
+	return usage, nil
+}
+
+// add counts the record in the usage of its connection, peer and bucket
+func (u *TrafficUsage) add(
+	connections map[string]*ConnectionUsage, record *trafficRecord, length, bucket time.Duration,
+) {
+	connection, ok := connections[record.Connection]
+	if !ok {
+		connection = &ConnectionUsage{Name: record.Connection, Peers: []*PeerUsage{}}
+		for start := u.Since; start.Before(u.Since.Add(length + bucket)); start = start.Add(bucket) {
+			connection.Series = append(connection.Series, &UsagePoint{Time: start})
+		}
+		connections[record.Connection] = connection
+	}
+	connection.Received += record.Received
+	connection.Sent += record.Sent
+	if index := int(record.Time.Sub(u.Since) / bucket); index < len(connection.Series) {
+		connection.Series[index].Received += record.Received
+		connection.Series[index].Sent += record.Sent
+	}
+
+	index := slices.IndexFunc(connection.Peers, func(peer *PeerUsage) bool { return peer.PublicKey == record.Peer })
+	if index < 0 {
+		connection.Peers = append(connection.Peers, &PeerUsage{PublicKey: record.Peer, ID: PeerID(record.Peer)})
+		index = len(connection.Peers) - 1
+	}
+	connection.Peers[index].Received += record.Received
+	connection.Peers[index].Sent += record.Sent
+}
+
+// maxTimeseriesPoints bounds the points of a timeseries, the range divided by the step
+const maxTimeseriesPoints = 2000
+
+// ErrInvalidTimeseries is returned for invalid timeseries ranges and steps
+var ErrInvalidTimeseries = errors.New("invalid timeseries")
+
+// Timeseries is the transfer rate of a connection at each step of a range
+type Timeseries struct {
+	Interface   string             `json:"interface"`
+	Since       time.Time          `json:"since"`
+	StepSeconds int                `json:"step_seconds"`
+	Points      []*TimeseriesPoint `json:"points"`
+}
+
+// TimeseriesPoint is the average rate in bytes per second of the step starting at Time
+type TimeseriesPoint struct {
+	Time        time.Time `json:"time"`
+	ReceiveRate float64   `json:"rx_rate"`
+	SendRate    float64   `json:"tx_rate"`
+}
+
+// ParseSpan parses a duration of the timeseries parameters, like 5m or 24h, and days like 7d
+func ParseSpan(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		count, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("%w: invalid duration %q", ErrInvalidTimeseries, value)
+		}
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid duration %q", ErrInvalidTimeseries, value)
+	}
+	return duration, nil
+}
+
+// Timeseries returns the receive and send rates of the connection over the range,
+// averaged over each step. The steps shorter than the sample interval have gaps.
+func (h *TrafficHistory) Timeseries(name string, span, step time.Duration) (*Timeseries, error) {
+	if step < time.Second || span < step {
+		return nil, fmt.Errorf("%w: step must be at least 1s and range at least the step", ErrInvalidTimeseries)
+	}
+	if span/step > maxTimeseriesPoints {
+		return nil, fmt.Errorf("%w: at most %d points, increase the step", ErrInvalidTimeseries, maxTimeseriesPoints)
+	}
+	since := time.Now().UTC().Add(-span).Truncate(step)
+	series := &Timeseries{Interface: name, Since: since, StepSeconds: int(step.Seconds())}
+	for start := since; !start.After(time.Now()); start = start.Add(step) {
+		series.Points = append(series.Points, &TimeseriesPoint{Time: start})
+	}
+	if h.dir == "" {
+		return series, nil
+	}
+
+	err := h.scan(since, func(record *trafficRecord) {
+		index := int(record.Time.Sub(since) / step)
+		if record.Connection == name && !record.Time.Before(since) && index < len(series.Points) {
+			series.Points[index].ReceiveRate += float64(record.Received) / step.Seconds()
+			series.Points[index].SendRate += float64(record.Sent) / step.Seconds()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return series, nil
+}
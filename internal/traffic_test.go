@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrafficHistoryDayFiles(t *testing.T) {
+	config := DefaultConfig()
+	config.StateDir = t.TempDir()
+	config.Traffic = TrafficConfig{SampleSeconds: 60, RetentionDays: 7}
+	now := time.Now().UTC()
+	var legacy []byte
+	for _, record := range []trafficRecord{
+		{Time: now.AddDate(0, 0, -30), Connection: "wg0", Peer: "peer", Received: 1, Sent: 1},
+		{Time: now.Add(-time.Hour), Connection: "wg0", Peer: "peer", Received: 100, Sent: 10},
+	} {
+		line, _ := json.Marshal(record)
+		legacy = append(append(legacy, line...), '\n')
+	}
+	if err := os.WriteFile(filepath.Join(config.StateDir, "traffic.log"), legacy, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := NewTrafficHistory(DefaultProfile, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(config.StateDir, "traffic.log")); !os.IsNotExist(err) {
+		t.Fatal("the single history file wasn't migrated to the day files")
+	}
+	usage, err := history.Usage("day", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage.Connections) != 1 || usage.Connections[0].Received != 100 {
+		t.Fatalf("usage = %+v, want the 100 bytes received by wg0", usage.Connections)
+	}
+
+	history.prune(now)
+	old := history.dayPath(now.AddDate(0, 0, -30).Format(trafficDayLayout))
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Fatal("day past the retention not removed")
+	}
+	if _, err := os.Stat(history.dayPath(now.Add(-time.Hour).Format(trafficDayLayout))); err != nil {
+		t.Fatalf("day within the retention removed: %v", err)
+	}
+}
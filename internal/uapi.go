@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uapiTimeout bounds the reads of the interfaces from their UAPI sockets
+const uapiTimeout = 5 * time.Second
+
+// uapiReader reads the interfaces from the UAPI sockets of a userspace WireGuard implementation,
+// like wireguard-go, without running wg. The sockets usually only accept root.
+type uapiReader struct {
+	socketDir string
+}
+
+func (r uapiReader) Devices() ([]*Device, error) {
+	sockets, err := filepath.Glob(filepath.Join(r.socketDir, "*.sock"))
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]*Device, 0, len(sockets))
+	for _, socket := range sockets {
+		device, err := readUAPIDevice(socket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", socket, err)
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// readUAPIDevice sends the get operation to the UAPI socket of the interface and parses its reply
+func readUAPIDevice(socket string) (*Device, error) {
+	conn, err := net.DialTimeout("unix", socket, uapiTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(uapiTimeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte("get=1\n\n")); err != nil {
+		return nil, err
+	}
+	device := &Device{Name: strings.TrimSuffix(filepath.Base(socket), ".sock")}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() && scanner.Text() != "" {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		if err := setUAPIValue(device, key, value); err != nil {
+			return nil, err
+		}
+	}
+	return device, scanner.Err()
+}
+
+// setUAPIValue sets the value of a line of the get reply, the keys following a public_key
+// are the values of that peer
+func setUAPIValue(device *Device, key, value string) error {
+	var peer *Peer
+	if len(device.Peers) > 0 {
+		peer = device.Peers[len(device.Peers)-1]
+	}
+	var err error
+	switch {
+	case key == "errno" && value != "0":
+		return fmt.Errorf("get failed with errno %s", value)
+	case key == "private_key":
+		device.PublicKey, err = uapiPublicKey(value)
+	case key == "listen_port":
+		device.ListenPort, err = strconv.Atoi(value)
+	case key == "fwmark":
+		var fwMark uint64
+		fwMark, err = strconv.ParseUint(value, 10, 32)
+		device.FwMark = uint32(fwMark)
+	case key == "public_key":
+		var publicKey []byte
+		if publicKey, err = hex.DecodeString(value); err == nil {
+			device.Peers = append(device.Peers, &Peer{PublicKey: base64.StdEncoding.EncodeToString(publicKey)})
+		}
+	case peer != nil:
+		err = setUAPIPeerValue(peer, key, value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return nil
+}
+
+func setUAPIPeerValue(peer *Peer, key, value string) error {
+	var err error
+	switch key {
+	case "endpoint":
+		peer.Endpoint = value
+	case "allowed_ip":
+		peer.AllowedIPs = append(peer.AllowedIPs, value)
+	case "last_handshake_time_sec":
+		var handshake int64
+		if handshake, err = strconv.ParseInt(value, 10, 64); err == nil && handshake > 0 {
+			peer.LatestHandshake = time.Unix(handshake, 0)
+		}
+	case "rx_bytes":
+		peer.ReceiveBytes, err = strconv.ParseUint(value, 10, 64)
+	case "tx_bytes":
+		peer.TransmitBytes, err = strconv.ParseUint(value, 10, 64)
+	case "persistent_keepalive_interval":
+		peer.PersistentKeepalive, err = strconv.Atoi(value)
+	}
+	return err
+}
+
+// uapiPublicKey returns the base64 public key of the hex private key of the interface
+func uapiPublicKey(privateKey string) (string, error) {
+	private, err := hex.DecodeString(privateKey)
+	if err != nil {
+		return "", err
+	}
+	key, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
@@ -0,0 +1,479 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+)
+
+// DefaultUsername is the account of the shared password_hash when no users are configured
+const DefaultUsername = "admin"
+
+// usersFile is the file of the state directory keeping the users managed from the API
+const usersFile = "users.json"
+
+// usernameRegex matches the accepted usernames
+var usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.@-]{1,64}$`)
+
+var (
+	// ErrUserNotFound is returned for unknown usernames
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUserExists is returned when creating a user with a taken username
+	ErrUserExists = errors.New("user already exists")
+	// ErrUserConfigured is returned when deleting a user defined in config.yml
+	ErrUserConfigured = errors.New("user is defined in config.yml")
+	// ErrLastAdmin is returned when the change would leave no admin
+	ErrLastAdmin = errors.New("at least one admin is required")
+	// ErrInvalidUser is returned when creating a user with an invalid username or password
+	ErrInvalidUser = errors.New("invalid user")
+	// ErrWrongPassword is returned when changing the password with a wrong current password
+	ErrWrongPassword = errors.New("wrong current password")
+)
+
+// User is a portal account
+type User struct {
+	Username     string `yaml:"username" json:"username"`
+	PasswordHash string `yaml:"password_hash" json:"-"`
+	// Role defaults to viewer
+	Role Role `yaml:"role" json:"role"`
+	// Connections are the connections the user can see and toggle, all of them when unset
+	Connections ConnectionGrants `yaml:"connections" json:"connections"`
+	// TOTPSecret enables the two-factor authentication, it's enrolled from the API
+	TOTPSecret string `yaml:"-" json:"-"`
+	// RecoveryCodes are the hashes of the unused recovery codes
+	RecoveryCodes []string `yaml:"-" json:"-"`
+}
+
+// storedUser is a user as persisted in the users file
+type storedUser struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+	// ConfigPasswordHash is the config.yml password hash of the user when it was stored,
+	// the stored password only applies as long as config.yml has the same one
+	ConfigPasswordHash string           `json:"config_password_hash,omitempty"`
+	Role               Role             `json:"role"`
+	Connections        ConnectionGrants `json:"connections"`
+	TOTPSecret         string           `json:"totp_secret,omitempty"`
+	RecoveryCodes      []string         `json:"recovery_codes,omitempty"`
+}
+
+// UserStore holds the portal accounts. Users are defined in config.yml and managed
+// from the API, the API changes are persisted in the users file of the state directory
+// where they override the users of config.yml.
+type UserStore struct {
+	path       string
+	configured map[string]User
+	// legacy is set when the shared password hash is the only configured account
+	legacy bool
+	users  map[string]*User
+	mutex  sync.RWMutex
+
+	// pendingTOTP are the TOTP secrets enrolled but not confirmed yet
+	pendingTOTP map[string]string
+	// totpSteps are the last TOTP periods used by each user, so a code can't be used twice
+	totpSteps map[string]int64
+}
+
+// NewUserStore creates a store of the configured users, falling back to a single
+// DefaultUsername admin account of the shared password hash when no users are configured
+func NewUserStore(config *Config) (*UserStore, error) {
+	store := &UserStore{
+		path:       filepath.Join(config.StateDir, usersFile),
+		configured: make(map[string]User),
+		legacy:     len(config.Users) == 0,
+		users:      make(map[string]*User),
+
+		pendingTOTP: make(map[string]string),
+		totpSteps:   make(map[string]int64),
+	}
+	for _, user := range config.Users {
+		user.Role, _ = ParseRole(string(user.Role))
+		store.configured[user.Username] = user
+	}
+	if store.legacy && config.PasswordHash != "" {
+		store.configured[DefaultUsername] = User{
+			Username:     DefaultUsername,
+			PasswordHash: config.PasswordHash,
+			Role:         RoleAdmin,
+		}
+	}
+	for username, user := range store.configured {
+		store.users[username] = &user
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Authenticate returns the user matching the credentials,
+// upgrading a legacy password hash to the current hashing
+func (s *UserStore) Authenticate(username, password string) (*User, bool) {
+	user, ok := s.authenticate(username, password)
+	if ok && PasswordNeedsRehash(user.PasswordHash) {
+		s.rehashPassword(username, user.PasswordHash, password)
+	}
+	return user, ok
+}
+
+func (s *UserStore) authenticate(username, password string) (*User, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	user, exists := s.users[username]
+	if !exists || user.PasswordHash == "" {
+		// Hash anyway, so unknown usernames don't answer faster
+		_, _ = GeneratePasswordHash(password)
+		return nil, false
+	}
+	if !ValidatePassword(password, user.PasswordHash) {
+		return nil, false
+	}
+	return user.clone(), true
+}
+
+// rehashPassword replaces the password hash of the user with a hash of the current hashing,
+// unless the password changed meanwhile
+func (s *UserStore) rehashPassword(username, previous, password string) {
+	hash, err := GeneratePasswordHash(password)
+	if err != nil {
+		log.Printf("Failed to rehash the password of %s: %v", username, err)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, exists := s.users[username]
+	if !exists || user.PasswordHash != previous {
+		return
+	}
+	user.PasswordHash = hash
+	if err := s.save(func() { user.PasswordHash = previous }); err != nil {
+		log.Printf("Failed to rehash the password of %s: %v", username, err)
+	}
+}
+
+// Get returns the named user
+func (s *UserStore) Get(username string) (*User, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	user, exists := s.users[username]
+	if !exists {
+		return nil, false
+	}
+	return user.clone(), true
+}
+
+// MultiUser reports whether users log in with a username, rather than the shared password only
+func (s *UserStore) MultiUser() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return !s.legacy || len(s.users) > 1
+}
+
+// List returns the users sorted by username
+func (s *UserStore) List() []*User {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	users := make([]*User, 0, len(s.users))
+	for _, username := range slices.Sorted(maps.Keys(s.users)) {
+		users = append(users, s.users[username].clone())
+	}
+	return users
+}
+
+// Create adds a user with the password and role
+func (s *UserStore) Create(username, password string, role Role) error {
+	if !usernameRegex.MatchString(username) {
+		return fmt.Errorf("%w: invalid username %q", ErrInvalidUser, username)
+	}
+	if password == "" {
+		return fmt.Errorf("%w: password is required", ErrInvalidUser)
+	}
+	hash, err := GeneratePasswordHash(password)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.users[username]; exists {
+		return fmt.Errorf("%w: %s", ErrUserExists, username)
+	}
+	s.users[username] = &User{Username: username, PasswordHash: hash, Role: role}
+	return s.save(func() { delete(s.users, username) })
+}
+
+// ChangePassword replaces the password of the user after verifying the current one,
+// users of an external login (LDAP, proxy) have no portal password to change
+func (s *UserStore) ChangePassword(username, current, password string) error {
+	if password == "" {
+		return fmt.Errorf("%w: password is required", ErrInvalidUser)
+	}
+	if user, exists := s.Get(username); exists && user.PasswordHash == "" {
+		return fmt.Errorf("%w: %s logs in with an external login", ErrInvalidUser, username)
+	}
+	user, ok := s.authenticate(username, current)
+	if !ok {
+		return ErrWrongPassword
+	}
+	hash, err := GeneratePasswordHash(password)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored, exists := s.users[username]
+	if !exists || stored.PasswordHash != user.PasswordHash {
+		// The password changed since it was verified
+		return ErrWrongPassword
+	}
+	stored.PasswordHash = hash
+	return s.save(func() { stored.PasswordHash = user.PasswordHash })
+}
+
+// AddExternalUser returns the user authenticated by an external backend, like LDAP,
+// adding it without a password and with the role on its first login
+func (s *UserStore) AddExternalUser(username string, role Role) (*User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if user, exists := s.users[username]; exists {
+		return user.clone(), nil
+	}
+	user := &User{Username: username, Role: role}
+	s.users[username] = user
+	if err := s.save(func() { delete(s.users, username) }); err != nil {
+		return nil, err
+	}
+	return user.clone(), nil
+}
+
+// SetRole changes the role of the user
+func (s *UserStore) SetRole(username string, role Role) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, exists := s.users[username]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	if user.Role == RoleAdmin && role != RoleAdmin && s.admins() == 1 {
+		return ErrLastAdmin
+	}
+	previous := user.Role
+	user.Role = role
+	return s.save(func() { user.Role = previous })
+}
+
+// SetConnections changes the connections granted to the user, nil grants all of them
+func (s *UserStore) SetConnections(username string, connections ConnectionGrants) error {
+	if err := connections.validate(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, exists := s.users[username]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	previous := user.Connections
+	user.Connections = slices.Clone(connections)
+	return s.save(func() { user.Connections = previous })
+}
+
+// RenameConnection grants the renamed connection to the users it was granted to
+func (s *UserStore) RenameConnection(name, newName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := make(map[string]ConnectionGrants)
+	for username, user := range s.users {
+		if renamed, ok := user.Connections.rename(name, newName); ok {
+			previous[username] = user.Connections
+			user.Connections = renamed
+		}
+	}
+	if len(previous) == 0 {
+		return nil
+	}
+	return s.save(func() {
+		for username, connections := range previous {
+			s.users[username].Connections = connections
+		}
+	})
+}
+
+// DeleteConnection revokes the deleted connection from the users it was granted to,
+// so a connection created later under its name isn't granted to them
+func (s *UserStore) DeleteConnection(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := make(map[string]ConnectionGrants)
+	for username, user := range s.users {
+		if remaining, ok := user.Connections.remove(name); ok {
+			previous[username] = user.Connections
+			user.Connections = remaining
+		}
+	}
+	if len(previous) == 0 {
+		return nil
+	}
+	return s.save(func() {
+		for username, connections := range previous {
+			s.users[username].Connections = connections
+		}
+	})
+}
+
+// Delete removes a user managed from the API, users of config.yml can't be deleted
+func (s *UserStore) Delete(username string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, exists := s.users[username]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	if _, configured := s.configured[username]; configured {
+		return fmt.Errorf("%w: %s", ErrUserConfigured, username)
+	}
+	if user.Role == RoleAdmin && s.admins() == 1 {
+		return ErrLastAdmin
+	}
+	delete(s.users, username)
+	return s.save(func() { s.users[username] = user })
+}
+
+// admins counts the admin users, it must be called holding the mutex
+func (s *UserStore) admins() int {
+	count := 0
+	for _, user := range s.users {
+		if user.Role == RoleAdmin {
+			count++
+		}
+	}
+	return count
+}
+
+// load applies the users file on top of the configured users, a missing file has no changes
+func (s *UserStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read users: %w", err)
+	}
+
+	var stored []storedUser
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", s.path, err)
+	}
+	for _, user := range stored {
+		passwordHash := user.PasswordHash
+		// A password changed in config.yml since it was stored takes precedence
+		if configured, ok := s.configured[user.Username]; ok && user.ConfigPasswordHash != configured.PasswordHash {
+			passwordHash = configured.PasswordHash
+		}
+		s.users[user.Username] = &User{
+			Username:      user.Username,
+			PasswordHash:  passwordHash,
+			Role:          user.Role,
+			Connections:   user.Connections,
+			TOTPSecret:    user.TOTPSecret,
+			RecoveryCodes: user.RecoveryCodes,
+		}
+	}
+	return nil
+}
+
+// save persists the users differing from config.yml, it must be called holding the mutex.
+// The change is reverted with undo when it can't be persisted.
+func (s *UserStore) save(undo func()) error {
+	stored := []storedUser{}
+	for _, username := range slices.Sorted(maps.Keys(s.users)) {
+		user := s.users[username]
+		configured, isConfigured := s.configured[username]
+		if isConfigured && user.equal(&configured) {
+			continue
+		}
+		stored = append(stored, storedUser{
+			Username:           user.Username,
+			PasswordHash:       user.PasswordHash,
+			ConfigPasswordHash: configured.PasswordHash,
+			Role:               user.Role,
+			Connections:        user.Connections,
+			TOTPSecret:         user.TOTPSecret,
+			RecoveryCodes:      user.RecoveryCodes,
+		})
+	}
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		undo()
+		return fmt.Errorf("failed to save users: %w", err)
+	}
+	return nil
+}
+
+// clone returns a copy of the user, so callers can't modify the stored users
+func (u *User) clone() *User {
+	clone := *u
+	clone.RecoveryCodes = slices.Clone(u.RecoveryCodes)
+	clone.Connections = slices.Clone(u.Connections)
+	return &clone
+}
+
+// TOTPEnabled reports whether the user logs in with a second factor
+func (u *User) TOTPEnabled() bool {
+	return u.TOTPSecret != ""
+}
+
+func (u *User) equal(other *User) bool {
+	return u.Username == other.Username &&
+		u.PasswordHash == other.PasswordHash &&
+		u.Role == other.Role &&
+		u.Connections.equal(other.Connections) &&
+		u.TOTPSecret == other.TOTPSecret &&
+		slices.Equal(u.RecoveryCodes, other.RecoveryCodes)
+}
+
+// validateUsers checks the configured users have valid and unique usernames, a password hash and a valid role
+func validateUsers(users []User) error {
+	seen := make(map[string]bool, len(users))
+	for _, user := range users {
+		if !usernameRegex.MatchString(user.Username) {
+			return fmt.Errorf("invalid username %q", user.Username)
+		}
+		if seen[user.Username] {
+			return fmt.Errorf("duplicate username %s", user.Username)
+		}
+		if !validPasswordHash(user.PasswordHash) {
+			return fmt.Errorf("user %s has no valid password_hash", user.Username)
+		}
+		if _, err := ParseRole(string(user.Role)); err != nil {
+			return fmt.Errorf("user %s: %w", user.Username, err)
+		}
+		if err := user.Connections.validate(); err != nil {
+			return fmt.Errorf("user %s: %w", user.Username, err)
+		}
+		seen[user.Username] = true
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WatchdogConfig restarts the connections whose handshakes went stale or whose interface disappeared
+type WatchdogConfig struct {
+	// IntervalSeconds is the interval between the checks (0 disables the watchdog)
+	IntervalSeconds int `yaml:"interval_seconds"`
+	// HandshakeTimeoutSeconds is the age of the latest handshake making a connection stale
+	HandshakeTimeoutSeconds int `yaml:"handshake_timeout_seconds"`
+	// MaxBackoffSeconds caps the delay between the restarts of a connection, which doubles
+	// from the interval after each restart until the connection is healthy again
+	MaxBackoffSeconds int `yaml:"max_backoff_seconds"`
+}
+
+func (c WatchdogConfig) validate() error {
+	if c.IntervalSeconds < 0 {
+		return errors.New("interval_seconds must not be negative")
+	}
+	if c.IntervalSeconds == 0 {
+		return nil
+	}
+	if c.HandshakeTimeoutSeconds <= 0 {
+		return errors.New("handshake_timeout_seconds must be positive")
+	}
+	if c.MaxBackoffSeconds < c.IntervalSeconds {
+		return errors.New("max_backoff_seconds must be at least interval_seconds")
+	}
+	return nil
+}
+
+// WatchdogState is a connection expected to be up, as reported by the API
+type WatchdogState struct {
+	Connection string `json:"connection"`
+	// Enabled is false for the connections with the watchdog disabled in their settings
+	Enabled bool `json:"enabled"`
+	// Reason is why the connection is unhealthy, empty when it isn't
+	Reason string `json:"reason,omitempty"`
+	// Restarts is the number of restarts since the connection was last healthy
+	Restarts    int        `json:"restarts"`
+	LastRestart *time.Time `json:"last_restart,omitempty"`
+	// NextRestart is the earliest time of the next restart, after the backoff
+	NextRestart *time.Time `json:"next_restart,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+
+	// noHandshakeSince is when the up connection was first seen without a handshake
+	noHandshakeSince time.Time
+}
+
+// WatchdogRestart is a restart of an unhealthy connection by the watchdog
+type WatchdogRestart struct {
+	Connection string    `json:"connection"`
+	Reason     string    `json:"reason"`
+	Attempt    int       `json:"attempt"`
+	Error      string    `json:"error,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// expectedTracker keeps the connections expected to be up: those started by the portal
+// or seen active, until the portal stops them
+type expectedTracker struct {
+	names map[string]bool
+	mutex sync.Mutex
+}
+
+func newExpectedTracker() *expectedTracker {
+	return &expectedTracker{names: make(map[string]bool)}
+}
+
+func (t *expectedTracker) add(names ...string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, name := range names {
+		t.names[name] = true
+	}
+}
+
+func (t *expectedTracker) remove(names ...string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, name := range names {
+		delete(t.names, name)
+	}
+}
+
+func (t *expectedTracker) list() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return slices.Sorted(maps.Keys(t.names))
+}
+
+// Watchdog restarts the connections expected to be up whose interface disappeared, or whose
+// peer endpoints didn't complete a handshake for the handshake timeout, backing off between
+// the restarts of a connection. Like all the automated connection management, it pauses
+// during the maintenance windows and in read-only mode.
+type Watchdog struct {
+	config      WatchdogConfig
+	manager     *WireGuardManager
+	maintenance *MaintenanceWindow
+	readOnly    *ReadOnlyMode
+
+	states map[string]*WatchdogState
+	mutex  sync.Mutex
+}
+
+func NewWatchdog(
+	config WatchdogConfig, manager *WireGuardManager, maintenance *MaintenanceWindow, readOnly *ReadOnlyMode,
+) *Watchdog {
+	return &Watchdog{
+		config:      config,
+		manager:     manager,
+		maintenance: maintenance,
+		readOnly:    readOnly,
+		states:      make(map[string]*WatchdogState),
+	}
+}
+
+// Start checks the connections every interval, onRestart is called after each restart
+func (w *Watchdog) Start(onRestart func(restart *WatchdogRestart)) {
+	if w.config.IntervalSeconds <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(w.config.IntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			for _, restart := range w.check(now) {
+				onRestart(restart)
+			}
+		}
+	}()
+}
+
+// State returns the granted connections expected to be up, sorted by name
+func (w *Watchdog) State(grants ConnectionGrants) []*WatchdogState {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	states := []*WatchdogState{}
+	for name, state := range w.states {
+		if grants.Allows(name) {
+			stateCopy := *state
+			states = append(states, &stateCopy)
+		}
+	}
+	slices.SortFunc(states, func(a, b *WatchdogState) int {
+		return strings.Compare(a.Connection, b.Connection)
+	})
+	return states
+}
+
+// check restarts the unhealthy connections expected to be up, adopting the active ones
+func (w *Watchdog) check(now time.Time) []*WatchdogRestart {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.maintenance.Active() || w.readOnly.Enabled() {
+		return nil
+	}
+	status, err := w.manager.GetStatus(nil)
+	if err != nil {
+		log.Printf("Watchdog failed to get the status: %v", err)
+		return nil
+	}
+	active := make(map[string]*ConnectionStatus, len(status))
+	for _, connection := range status {
+		active[connection.Name] = connection
+	}
+	w.manager.expected.add(slices.Collect(maps.Keys(active))...)
+
+	states := make(map[string]*WatchdogState)
+	var restarts []*WatchdogRestart
+	for _, name := range w.manager.expected.list() {
+		state := w.connectionState(name, active[name], now)
+		if state == nil {
+			continue
+		}
+		states[name] = state
+		if restart := w.restart(state, active[name] != nil, now); restart != nil {
+			restarts = append(restarts, restart)
+		}
+	}
+	w.states = states
+	return restarts
+}
+
+// connectionState updates the state of the connection from its status, unset when it's down.
+// The connections deleted since they were last up aren't expected anymore.
+func (w *Watchdog) connectionState(name string, status *ConnectionStatus, now time.Time) *WatchdogState {
+	config, err := ParseConfig(w.manager.configPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		w.manager.expected.remove(name)
+		return nil
+	}
+	state, ok := w.states[name]
+	if !ok {
+		state = &WatchdogState{Connection: name}
+	}
+	state.Enabled = w.manager.config.Connections[name].watchdogEnabled()
+	// The handshakes of the connections without peer endpoints, like servers, depend on their clients
+	hasEndpoints := err == nil && slices.ContainsFunc(config.Peers, func(peer *PeerConfig) bool {
+		return peer.Endpoint != ""
+	})
+	var healthy bool
+	state.Reason, healthy = w.unhealthyReason(state, status, hasEndpoints, now)
+	if healthy {
+		state.Restarts, state.NextRestart, state.LastError = 0, nil, ""
+	}
+	return state
+}
+
+// unhealthyReason describes why the connection is unhealthy, and reports whether it's healthy.
+// A started connection is neither until its first handshake or the handshake timeout.
+func (w *Watchdog) unhealthyReason(
+	state *WatchdogState, status *ConnectionStatus, hasEndpoints bool, now time.Time,
+) (string, bool) {
+	timeout := time.Duration(w.config.HandshakeTimeoutSeconds) * time.Second
+	switch {
+	case status == nil:
+		return "interface down", false
+	case !hasEndpoints:
+		return "", true
+	case status.LatestHandshake != nil:
+		state.noHandshakeSince = time.Time{}
+		if age := now.Sub(*status.LatestHandshake); age > timeout {
+			return fmt.Sprintf("no handshake for %s", age.Round(time.Second)), false
+		}
+		return "", true
+	case state.noHandshakeSince.IsZero():
+		state.noHandshakeSince = now
+	}
+	if age := now.Sub(state.noHandshakeSince); age > timeout {
+		return fmt.Sprintf("no handshake for %s", age.Round(time.Second)), false
+	}
+	return "", false
+}
+
+// restart restarts the unhealthy connection unless its watchdog is disabled or it's backing off
+func (w *Watchdog) restart(state *WatchdogState, up bool, now time.Time) *WatchdogRestart {
+	if state.Reason == "" || !state.Enabled || (state.NextRestart != nil && now.Before(*state.NextRestart)) {
+		return nil
+	}
+	state.Restarts++
+	nextRestart := now.Add(w.backoff(state.Restarts))
+	state.LastRestart, state.NextRestart, state.LastError = &now, &nextRestart, ""
+	state.noHandshakeSince = now
+	restart := &WatchdogRestart{Connection: state.Connection, Reason: state.Reason, Attempt: state.Restarts, Time: now}
+	if err := w.manager.reconnect(state.Connection, up); err != nil {
+		log.Printf("Watchdog failed to restart %s (%s): %v", state.Connection, state.Reason, err)
+		state.LastError, restart.Error = err.Error(), err.Error()
+		return restart
+	}
+	log.Printf("Watchdog restarted %s: %s", state.Connection, state.Reason)
+	return restart
+}
+
+// backoff is the delay after the restart, doubling from the interval up to the max backoff
+func (w *Watchdog) backoff(restarts int) time.Duration {
+	backoff := time.Duration(w.config.IntervalSeconds) * time.Second << min(restarts-1, 20)
+	return min(backoff, time.Duration(w.config.MaxBackoffSeconds)*time.Second)
+}
+
+// reconnect restarts the connection when its interface is up and starts it otherwise,
+// recording the error of the failed step. The connection stays expected to be up.
+func (m *WireGuardManager) reconnect(name string, up bool) error {
+	m.peersMutex.Lock()
+	defer m.peersMutex.Unlock()
+	defer m.expected.add(name)
+	m.operationMutex.Lock()
+	defer m.operationMutex.Unlock()
+	if up {
+		_, err := m.restartConnection(name)
+		return err
+	}
+	if _, err := m.startConnection(&WireGuardConnection{Name: name}); err != nil {
+		m.setLastError(name, "up", err)
+		return err
+	}
+	m.clearLastErrors(name)
+	return nil
+}
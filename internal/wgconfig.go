@@ -0,0 +1,307 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WireGuardConfig is a parsed wg-quick connection config file
+type WireGuardConfig struct {
+	Interface InterfaceConfig `json:"interface"`
+	Peers     []*PeerConfig   `json:"peers"`
+}
+
+// InterfaceConfig is the [Interface] section of a connection config
+type InterfaceConfig struct {
+	PrivateKey string   `json:"private_key,omitempty"`
+	Address    []string `json:"address,omitempty"`
+	ListenPort int      `json:"listen_port,omitempty"`
+	DNS        []string `json:"dns,omitempty"`
+	MTU        int      `json:"mtu,omitempty"`
+	// Options are the remaining keys (Table, PostUp, ...) in file order
+	Options []ConfigOption `json:"options,omitempty"`
+}
+
+// PeerConfig is a [Peer] section of a connection config
+type PeerConfig struct {
+	PublicKey           string         `json:"public_key"`
+	PresharedKey        string         `json:"preshared_key,omitempty"`
+	Endpoint            string         `json:"endpoint,omitempty"`
+	AllowedIPs          []string       `json:"allowed_ips,omitempty"`
+	PersistentKeepalive int            `json:"persistent_keepalive,omitempty"`
+	Options             []ConfigOption `json:"options,omitempty"`
+}
+
+// ConfigOption is a config key without a dedicated field
+type ConfigOption struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// configCacheSize bounds the number of parsed configs kept in memory
+const configCacheSize = 256
+
+// configCacheEntry is a parsed config and the file version it was parsed from
+type configCacheEntry struct {
+	modTime time.Time
+	size    int64
+	config  *WireGuardConfig
+}
+
+var (
+	configCache      = make(map[string]*configCacheEntry)
+	configCacheMutex sync.Mutex
+)
+
+// ParseConfig reads and parses a wg-quick config file.
+// Parsed configs are cached until the file modification time or size changes.
+func ParseConfig(path string) (*WireGuardConfig, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	if config, ok := cachedConfig(path, info); ok {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	config, err := parseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	cacheConfig(path, info, config)
+	return config.clone(), nil
+}
+
+// cachedConfig returns a copy of the cached config if the file didn't change since it was parsed
+func cachedConfig(path string, info os.FileInfo) (*WireGuardConfig, bool) {
+	configCacheMutex.Lock()
+	defer configCacheMutex.Unlock()
+
+	entry, ok := configCache[path]
+	if !ok || !entry.modTime.Equal(info.ModTime()) || entry.size != info.Size() {
+		return nil, false
+	}
+	return entry.config.clone(), true
+}
+
+func cacheConfig(path string, info os.FileInfo, config *WireGuardConfig) {
+	configCacheMutex.Lock()
+	defer configCacheMutex.Unlock()
+
+	if _, ok := configCache[path]; !ok && len(configCache) >= configCacheSize {
+		// Evict an arbitrary entry, it's parsed again on the next access
+		for evict := range configCache {
+			delete(configCache, evict)
+			break
+		}
+	}
+	configCache[path] = &configCacheEntry{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		config:  config,
+	}
+}
+
+// clone returns a deep copy of the config, so cached configs can't be modified by callers
+func (c *WireGuardConfig) clone() *WireGuardConfig {
+	clone := &WireGuardConfig{Interface: c.Interface}
+	clone.Interface.Address = slices.Clone(c.Interface.Address)
+	clone.Interface.DNS = slices.Clone(c.Interface.DNS)
+	clone.Interface.Options = slices.Clone(c.Interface.Options)
+	for _, peer := range c.Peers {
+		peerClone := *peer
+		peerClone.AllowedIPs = slices.Clone(peer.AllowedIPs)
+		peerClone.Options = slices.Clone(peer.Options)
+		clone.Peers = append(clone.Peers, &peerClone)
+	}
+	return clone
+}
+
+// ConfigSyntaxError is an error of a config line
+type ConfigSyntaxError struct {
+	Line int
+	Err  error
+}
+
+func (e *ConfigSyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *ConfigSyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// parseConfig parses the wg-quick config format, following wg-quick
+// comments run to the end of the line and keys are case-insensitive
+func parseConfig(data []byte) (*WireGuardConfig, error) {
+	config := &WireGuardConfig{}
+	var section string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for number := 1; scanner.Scan(); number++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			if err := config.addSection(section); err != nil {
+				return nil, &ConfigSyntaxError{Line: number, Err: err}
+			}
+			continue
+		}
+		if err := config.setOption(section, line); err != nil {
+			return nil, &ConfigSyntaxError{Line: number, Err: err}
+		}
+	}
+	return config, scanner.Err()
+}
+
+func (c *WireGuardConfig) addSection(section string) error {
+	switch section {
+	case "interface":
+		return nil
+	case "peer":
+		c.Peers = append(c.Peers, &PeerConfig{})
+		return nil
+	default:
+		return fmt.Errorf("unknown section [%s]", section)
+	}
+}
+
+func (c *WireGuardConfig) setOption(section, line string) error {
+	key, value, found := strings.Cut(line, "=")
+	if !found {
+		return fmt.Errorf("expected key = value, got %q", line)
+	}
+	key = strings.TrimSpace(key)
+	value = strings.TrimSpace(value)
+
+	switch section {
+	case "interface":
+		return c.Interface.setOption(key, value)
+	case "peer":
+		return c.Peers[len(c.Peers)-1].setOption(key, value)
+	default:
+		return fmt.Errorf("%s is outside of a section", key)
+	}
+}
+
+func (i *InterfaceConfig) setOption(key, value string) error {
+	var err error
+	switch strings.ToLower(key) {
+	case "privatekey":
+		i.PrivateKey = value
+	case "address":
+		i.Address = append(i.Address, splitList(value)...)
+	case "listenport":
+		i.ListenPort, err = parseNumber(key, value)
+	case "dns":
+		i.DNS = append(i.DNS, splitList(value)...)
+	case "mtu":
+		i.MTU, err = parseNumber(key, value)
+	default:
+		i.Options = append(i.Options, ConfigOption{Key: key, Value: value})
+	}
+	return err
+}
+
+func (p *PeerConfig) setOption(key, value string) error {
+	var err error
+	switch strings.ToLower(key) {
+	case "publickey":
+		p.PublicKey = value
+	case "presharedkey":
+		p.PresharedKey = value
+	case "endpoint":
+		p.Endpoint = value
+	case "allowedips":
+		p.AllowedIPs = append(p.AllowedIPs, splitList(value)...)
+	case "persistentkeepalive":
+		if value != "off" {
+			p.PersistentKeepalive, err = parseNumber(key, value)
+		}
+	default:
+		p.Options = append(p.Options, ConfigOption{Key: key, Value: value})
+	}
+	return err
+}
+
+// splitList splits a comma separated config value
+func splitList(value string) []string {
+	var items []string
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseNumber(key, value string) (int, error) {
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", key, value)
+	}
+	return number, nil
+}
+
+// Render formats the config in the wg-quick format.
+// Comments and the original key order of the parsed file aren't preserved.
+func (c *WireGuardConfig) Render() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("[Interface]\n")
+	c.Interface.render(&buf)
+	for _, peer := range c.Peers {
+		buf.WriteString("\n[Peer]\n")
+		peer.render(&buf)
+	}
+	return buf.Bytes()
+}
+
+func (i *InterfaceConfig) render(buf *bytes.Buffer) {
+	writeOption(buf, "PrivateKey", i.PrivateKey)
+	writeOption(buf, "Address", strings.Join(i.Address, ", "))
+	writeNumber(buf, "ListenPort", i.ListenPort)
+	writeOption(buf, "DNS", strings.Join(i.DNS, ", "))
+	writeNumber(buf, "MTU", i.MTU)
+	for _, option := range i.Options {
+		writeOption(buf, option.Key, option.Value)
+	}
+}
+
+func (p *PeerConfig) render(buf *bytes.Buffer) {
+	writeOption(buf, "PublicKey", p.PublicKey)
+	writeOption(buf, "PresharedKey", p.PresharedKey)
+	writeOption(buf, "Endpoint", p.Endpoint)
+	writeOption(buf, "AllowedIPs", strings.Join(p.AllowedIPs, ", "))
+	writeNumber(buf, "PersistentKeepalive", p.PersistentKeepalive)
+	for _, option := range p.Options {
+		writeOption(buf, option.Key, option.Value)
+	}
+}
+
+// writeOption writes a key = value line, skipping empty values
+func writeOption(buf *bytes.Buffer, key, value string) {
+	if value != "" {
+		fmt.Fprintf(buf, "%s = %s\n", key, value)
+	}
+}
+
+// writeNumber writes a key = value line, skipping zero values
+func writeNumber(buf *bytes.Buffer, key string, value int) {
+	if value != 0 {
+		writeOption(buf, key, strconv.Itoa(value))
+	}
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testConfig = `[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.8.0.2/32
+ListenPort = %d
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+AllowedIPs = 0.0.0.0/0
+`
+
+func writeTestConfig(t *testing.T, path string, listenPort int, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(testConfig, listenPort)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseConfigCacheBustedByEdit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wg0.conf")
+	modTime := time.Now().Add(-time.Hour)
+	writeTestConfig(t, path, 51820, modTime)
+
+	config, err := ParseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Interface.ListenPort != 51820 {
+		t.Fatalf("ListenPort = %d, want 51820", config.Interface.ListenPort)
+	}
+
+	// Same size, only the modification time tells the edit apart
+	writeTestConfig(t, path, 51821, modTime.Add(time.Second))
+	config, err = ParseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Interface.ListenPort != 51821 {
+		t.Fatalf("ListenPort = %d after the edit, want 51821", config.Interface.ListenPort)
+	}
+}
+
+func TestParseConfigCacheReturnsCopies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wg0.conf")
+	writeTestConfig(t, path, 51820, time.Now().Add(-time.Hour))
+
+	config, err := ParseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Interface.ListenPort = 1
+	config.Peers[0].AllowedIPs[0] = "10.0.0.0/8"
+
+	config, err = ParseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Interface.ListenPort != 51820 || config.Peers[0].AllowedIPs[0] != "0.0.0.0/0" {
+		t.Fatalf("cached config was modified by a caller: %+v", config)
+	}
+}
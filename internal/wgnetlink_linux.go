@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readNetlinkDevices reads the kernel WireGuard interfaces of the namespace of the portal over
+// generic netlink, like wg does, without running it. The kernel requires CAP_NET_ADMIN.
+func readNetlinkDevices() ([]*Device, error) {
+	names, err := wireguardLinks()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	conn, err := dialNetlink(unix.NETLINK_GENERIC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open generic netlink: %w", err)
+	}
+	defer conn.close()
+	family, err := conn.family(unix.WG_GENL_NAME)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve the wireguard netlink family: %w", err)
+	}
+	devices := make([]*Device, 0, len(names))
+	for _, name := range names {
+		messages, err := conn.genericRequest(family, unix.WG_CMD_GET_DEVICE, unix.WG_GENL_VERSION, unix.NLM_F_DUMP,
+			netlinkAttributeBytes(unix.WGDEVICE_A_IFNAME, append([]byte(name), 0)))
+		if errors.Is(err, unix.ENODEV) {
+			// The interface went down since the links were listed
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		device, err := parseWireGuardDevice(messages)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// wireguardLinks returns the names of the WireGuard interfaces, the links of kind wireguard
+func wireguardLinks() ([]string, error) {
+	messages, err := dumpNetlink(unix.RTM_GETLINK, unix.RTM_NEWLINK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the interfaces: %w", err)
+	}
+	var names []string
+	for _, message := range messages {
+		if len(message.Data) < unix.SizeofIfInfomsg {
+			continue
+		}
+		attributes := parseNetlinkAttributes(message.Data[unix.SizeofIfInfomsg:])
+		info := parseNetlinkAttributes(attributes[unix.IFLA_LINKINFO])
+		if netlinkString(info[unix.IFLA_INFO_KIND]) == unix.WG_GENL_NAME {
+			names = append(names, netlinkString(attributes[unix.IFLA_IFNAME]))
+		}
+	}
+	return names, nil
+}
+
+// parseWireGuardDevice parses the messages of a device dump. A device with many peers is split
+// across messages, a peer whose allowed IPs don't fit continues at the start of the next message.
+func parseWireGuardDevice(messages []syscall.NetlinkMessage) (*Device, error) {
+	device := &Device{}
+	for _, message := range messages {
+		if len(message.Data) < unix.GENL_HDRLEN {
+			return nil, errors.New("short wireguard netlink message")
+		}
+		attributes := parseNetlinkAttributes(message.Data[unix.GENL_HDRLEN:])
+		device.Name = netlinkString(attributes[unix.WGDEVICE_A_IFNAME])
+		if key := attributes[unix.WGDEVICE_A_PUBLIC_KEY]; len(key) == 32 {
+			device.PublicKey = base64.StdEncoding.EncodeToString(key)
+		}
+		if port, ok := netlinkUint16(attributes[unix.WGDEVICE_A_LISTEN_PORT]); ok {
+			device.ListenPort = int(port)
+		}
+		if mark, ok := netlinkUint32(attributes[unix.WGDEVICE_A_FWMARK]); ok {
+			device.FwMark = mark
+		}
+		for _, attribute := range splitNetlinkAttributes(attributes[unix.WGDEVICE_A_PEERS]) {
+			peer, err := parseWireGuardPeer(attribute.value)
+			if err != nil {
+				return nil, err
+			}
+			if last := len(device.Peers) - 1; last >= 0 && device.Peers[last].PublicKey == peer.PublicKey {
+				device.Peers[last].AllowedIPs = append(device.Peers[last].AllowedIPs, peer.AllowedIPs...)
+				continue
+			}
+			device.Peers = append(device.Peers, peer)
+		}
+	}
+	if device.Name == "" {
+		return nil, errors.New("wireguard netlink reply without interface")
+	}
+	return device, nil
+}
+
+// parseWireGuardPeer parses the nested attributes of a peer
+func parseWireGuardPeer(data []byte) (*Peer, error) {
+	attributes := parseNetlinkAttributes(data)
+	key := attributes[unix.WGPEER_A_PUBLIC_KEY]
+	if len(key) != 32 {
+		return nil, errors.New("wireguard peer without public key")
+	}
+	peer := &Peer{PublicKey: base64.StdEncoding.EncodeToString(key)}
+	if endpoint, ok := parseSockaddr(attributes[unix.WGPEER_A_ENDPOINT]); ok {
+		peer.Endpoint = endpoint.String()
+	}
+	// struct __kernel_timespec, the seconds and the nanoseconds
+	if handshake := attributes[unix.WGPEER_A_LAST_HANDSHAKE_TIME]; len(handshake) == 16 {
+		if seconds := int64(binary.NativeEndian.Uint64(handshake)); seconds > 0 {
+			peer.LatestHandshake = time.Unix(seconds, 0)
+		}
+	}
+	peer.ReceiveBytes, _ = netlinkUint64(attributes[unix.WGPEER_A_RX_BYTES])
+	peer.TransmitBytes, _ = netlinkUint64(attributes[unix.WGPEER_A_TX_BYTES])
+	if keepalive, ok := netlinkUint16(attributes[unix.WGPEER_A_PERSISTENT_KEEPALIVE_INTERVAL]); ok {
+		peer.PersistentKeepalive = int(keepalive)
+	}
+	for _, attribute := range splitNetlinkAttributes(attributes[unix.WGPEER_A_ALLOWEDIPS]) {
+		allowedIP := parseNetlinkAttributes(attribute.value)
+		address, ok := netlinkAddr(allowedIP[unix.WGALLOWEDIP_A_IPADDR])
+		mask := allowedIP[unix.WGALLOWEDIP_A_CIDR_MASK]
+		if !ok || len(mask) != 1 {
+			return nil, fmt.Errorf("invalid allowed IP of peer %s", peer.PublicKey)
+		}
+		peer.AllowedIPs = append(peer.AllowedIPs, netip.PrefixFrom(address, int(mask[0])).String())
+	}
+	return peer, nil
+}
+
+// parseSockaddr parses the sockaddr_in or sockaddr_in6 of an endpoint, its port in network byte order
+func parseSockaddr(data []byte) (netip.AddrPort, bool) {
+	if len(data) < 4 {
+		return netip.AddrPort{}, false
+	}
+	port := binary.BigEndian.Uint16(data[2:])
+	switch binary.NativeEndian.Uint16(data) {
+	case unix.AF_INET:
+		if len(data) >= unix.SizeofSockaddrInet4 {
+			return netip.AddrPortFrom(netip.AddrFrom4([4]byte(data[4:8])), port), true
+		}
+	case unix.AF_INET6:
+		if len(data) >= unix.SizeofSockaddrInet6 {
+			return netip.AddrPortFrom(netip.AddrFrom16([16]byte(data[8:24])), port), true
+		}
+	}
+	return netip.AddrPort{}, false
+}
+
+// netlinkString returns the NUL-terminated string of the attribute value
+func netlinkString(value []byte) string {
+	return strings.TrimRight(string(value), "\x00")
+}
+
+// netlinkUint16 returns the 16-bit value of the attribute
+func netlinkUint16(value []byte) (uint16, bool) {
+	if len(value) != 2 {
+		return 0, false
+	}
+	return binary.NativeEndian.Uint16(value), true
+}
+
+// netlinkUint64 returns the 64-bit value of the attribute
+func netlinkUint64(value []byte) (uint64, bool) {
+	if len(value) != 8 {
+		return 0, false
+	}
+	return binary.NativeEndian.Uint64(value), true
+}
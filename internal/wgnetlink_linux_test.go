@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseWireGuardDevice(t *testing.T) {
+	deviceKey, peerKey, otherKey := make([]byte, 32), make([]byte, 32), make([]byte, 32)
+	deviceKey[0], peerKey[0], otherKey[0] = 1, 2, 3
+	endpoint := make([]byte, unix.SizeofSockaddrInet4)
+	binary.NativeEndian.PutUint16(endpoint, unix.AF_INET)
+	binary.BigEndian.PutUint16(endpoint[2:], 51820)
+	copy(endpoint[4:], []byte{203, 0, 113, 7})
+	handshake := make([]byte, 16)
+	binary.NativeEndian.PutUint64(handshake, 1700000000)
+
+	// The peer continues in the second message with the allowed IPs which didn't fit
+	messages := []syscall.NetlinkMessage{
+		wireGuardMessage(deviceKey, nestedList(unix.WGDEVICE_A_PEERS,
+			netlinkAttributeBytes(0, slices.Concat(
+				netlinkAttributeBytes(unix.WGPEER_A_PUBLIC_KEY, peerKey),
+				netlinkAttributeBytes(unix.WGPEER_A_ENDPOINT, endpoint),
+				netlinkAttributeBytes(unix.WGPEER_A_LAST_HANDSHAKE_TIME, handshake),
+				netlinkAttributeBytes(unix.WGPEER_A_RX_BYTES, binary.NativeEndian.AppendUint64(nil, 1024)),
+				netlinkAttributeBytes(unix.WGPEER_A_TX_BYTES, binary.NativeEndian.AppendUint64(nil, 2048)),
+				netlinkAttributeBytes(unix.WGPEER_A_PERSISTENT_KEEPALIVE_INTERVAL, binary.NativeEndian.AppendUint16(nil, 25)),
+				nestedList(unix.WGPEER_A_ALLOWEDIPS, allowedIP(unix.AF_INET, []byte{10, 8, 0, 0}, 24)),
+			)))),
+		wireGuardMessage(deviceKey, nestedList(unix.WGDEVICE_A_PEERS,
+			netlinkAttributeBytes(0, slices.Concat(
+				netlinkAttributeBytes(unix.WGPEER_A_PUBLIC_KEY, peerKey),
+				nestedList(unix.WGPEER_A_ALLOWEDIPS, allowedIP(unix.AF_INET6, make([]byte, 16), 0)),
+			)),
+			netlinkAttributeBytes(0, netlinkAttributeBytes(unix.WGPEER_A_PUBLIC_KEY, otherKey)),
+		)),
+	}
+
+	device, err := parseWireGuardDevice(messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Name != "wg0" || device.PublicKey != base64.StdEncoding.EncodeToString(deviceKey) ||
+		device.ListenPort != 51820 || device.FwMark != 0xca6c {
+		t.Fatalf("device = %+v", device)
+	}
+	if len(device.Peers) != 2 {
+		t.Fatalf("peers = %d, want 2", len(device.Peers))
+	}
+	peer := device.Peers[0]
+	if peer.PublicKey != base64.StdEncoding.EncodeToString(peerKey) || peer.Endpoint != "203.0.113.7:51820" ||
+		!peer.LatestHandshake.Equal(time.Unix(1700000000, 0)) || peer.ReceiveBytes != 1024 ||
+		peer.TransmitBytes != 2048 || peer.PersistentKeepalive != 25 {
+		t.Fatalf("peer = %+v", peer)
+	}
+	if !slices.Equal(peer.AllowedIPs, []string{"10.8.0.0/24", "::/0"}) {
+		t.Fatalf("allowed IPs = %v, want 10.8.0.0/24 and ::/0", peer.AllowedIPs)
+	}
+	if other := device.Peers[1]; other.Endpoint != "" || !other.LatestHandshake.IsZero() || other.AllowedIPs != nil {
+		t.Fatalf("peer without endpoint and handshake = %+v", other)
+	}
+}
+
+// wireGuardMessage returns a WG_CMD_GET_DEVICE reply of wg0 with the peers attribute
+func wireGuardMessage(key, peers []byte) syscall.NetlinkMessage {
+	data := slices.Concat(
+		[]byte{unix.WG_CMD_GET_DEVICE, unix.WG_GENL_VERSION, 0, 0},
+		netlinkAttributeBytes(unix.WGDEVICE_A_IFNAME, []byte("wg0\x00")),
+		netlinkAttributeBytes(unix.WGDEVICE_A_PUBLIC_KEY, key),
+		netlinkAttributeBytes(unix.WGDEVICE_A_LISTEN_PORT, binary.NativeEndian.AppendUint16(nil, 51820)),
+		netlinkAttributeBytes(unix.WGDEVICE_A_FWMARK, binary.NativeEndian.AppendUint32(nil, 0xca6c)),
+		peers,
+	)
+	return syscall.NetlinkMessage{Data: data}
+}
+
+func allowedIP(family uint16, address []byte, mask uint8) []byte {
+	return netlinkAttributeBytes(0, slices.Concat(
+		netlinkAttributeBytes(unix.WGALLOWEDIP_A_FAMILY, binary.NativeEndian.AppendUint16(nil, family)),
+		netlinkAttributeBytes(unix.WGALLOWEDIP_A_IPADDR, address),
+		netlinkAttributeBytes(unix.WGALLOWEDIP_A_CIDR_MASK, []byte{mask}),
+	))
+}
+
+func nestedList(attributeType uint16, entries ...[]byte) []byte {
+	return netlinkAttributeBytes(attributeType|unix.NLA_F_NESTED, slices.Concat(entries...))
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package internal
+
+import "errors"
+
+// readNetlinkDevices reads the WireGuard interfaces over netlink, which is only supported on Linux
+func readNetlinkDevices() ([]*Device, error) {
+	return nil, errors.ErrUnsupported
+}
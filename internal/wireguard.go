@@ -1,155 +1,563 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"os/exec"
+	"os"
 	"path/filepath"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/samber/lo"
+	"golang.org/x/sync/singleflight"
 )
 
-var interfaceRegex = regexp.MustCompile(`^interface:\s+(.+)$`)
+// connectionNameRegex matches the interface names accepted by wg-quick
+var connectionNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_=+.-]{1,15}$`)
+
+// ErrConnectionNotFound is returned for connections without a config file
+var ErrConnectionNotFound = errors.New("connection not found")
+
+// ErrOperationInProgress is returned for a toggle while connections are being brought up or down
+var ErrOperationInProgress = errors.New("another connection operation is in progress")
 
 type WireGuardConnection struct {
-	Name   string `json:"name"`
-	Active bool   `json:"active"`
+	Name      string           `json:"name"`
+	Active    bool             `json:"active"`
+	LastError *ConnectionError `json:"last_error,omitempty"`
+	// ConfigDir is the config directory of the config file, empty for the connections listed
+	// by the list connections command without one
+	ConfigDir string `json:"config_dir,omitempty"`
+	// Namespace is the network namespace of the connection, empty for the namespace of the portal
+	Namespace string `json:"namespace,omitempty"`
+	// Health is the latest check of the peer endpoints, unset until checked
+	Health *ConnectionHealth `json:"health,omitempty"`
+	ConnectionMetadata
+	// Flag is the flag emoji of the country of the connection
+	Flag string `json:"flag,omitempty"`
+}
+
+// ConnectionError is the most recent failed operation of a connection
+type ConnectionError struct {
+	Action  string    `json:"action"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// operationError is an error of an operation on a specific connection
+type operationError struct {
+	connection string
+	action     string
+	err        error
+}
+
+func (e *operationError) Error() string {
+	return e.err.Error()
+}
+
+func (e *operationError) Unwrap() error {
+	return e.err
+}
+
+// ToggleResult is the outcome of a connection toggle, start or stop
+type ToggleResult struct {
+	Output   []byte
+	Warnings []string
+	// Stopped are the connections stopped by the toggle
+	Stopped []string
+	// Started is the connection started by the toggle, empty when it was stopped
+	Started string
+}
+
+// WireGuardManager manages the WireGuard connections configured in a config directory
+type WireGuardManager struct {
+	config *Config
+	// configDirs are the config directories in search order
+	configDirs []string
+	runner     CommandRunner
+	backend    ConnectionBackend
+
+	// lastErrors keeps the most recent error of each connection until its next successful operation
+	lastErrors      map[string]*ConnectionError
+	lastErrorsMutex sync.Mutex
+
+	activity *activityTracker
+	latency  *latencyTracker
+	health   *healthTracker
+	// expected are the connections the watchdog keeps up
+	expected  *expectedTracker
+	metadata  *MetadataStore
+	expiries  *PeerExpiryStore
+	rotations *KeyRotationStore
+	exitIP    *exitIPTracker
+
+	// devices reads the state of the up interfaces, devicesGroup collapses concurrent reads into one
+	devices      DeviceReader
+	devicesGroup singleflight.Group
+	// devicesCache keeps the last read for status_cache_seconds
+	devicesCache devicesCache
+
+	// peersMutex serializes the peer changes and the config edits, each rewriting a whole connection config
+	peersMutex sync.Mutex
+	// operationMutex serializes the toggles, starts, stops and restarts of the connections,
+	// it's taken after peersMutex
+	operationMutex sync.Mutex
+}
+
+func NewWireGuardManager(
+	config *Config, runner CommandRunner, metadata *MetadataStore, expiries *PeerExpiryStore,
+	rotations *KeyRotationStore,
+) *WireGuardManager {
+	return &WireGuardManager{
+		config:     config,
+		configDirs: config.SearchDirs(),
+		runner:     runner,
+		backend:    NewConnectionBackend(config, runner),
+		devices:    newDeviceReader(config, runner),
+		lastErrors: make(map[string]*ConnectionError),
+		activity:   newActivityTracker(),
+		latency:    newLatencyTracker(),
+		health:     newHealthTracker(),
+		expected:   newExpectedTracker(),
+		metadata:   metadata,
+		expiries:   expiries,
+		rotations:  rotations,
+		exitIP:     newExitIPTracker(),
+	}
+}
+
+// Connection states of the status
+const (
+	// StateStarting is the state of a connection until a peer completed a handshake
+	StateStarting  = "starting"
+	StateConnected = "connected"
+)
+
+// ConnectionStatus is the state of an active connection, its transfer sums up its peers
+type ConnectionStatus struct {
+	Name       string `json:"name"`
+	ListenPort int    `json:"listen_port"`
+	State      string `json:"state"`
+	// Namespace is the network namespace of the interface, empty for the namespace of the portal
+	Namespace string `json:"namespace,omitempty"`
+	// LatestHandshake is the most recent handshake of the peers, unset until the first one
+	LatestHandshake *time.Time `json:"latest_handshake"`
+	// HandshakeAge is the number of seconds since the latest handshake
+	HandshakeAge  *int64       `json:"handshake_age"`
+	ReceiveBytes  uint64       `json:"receive_bytes"`
+	TransmitBytes uint64       `json:"transmit_bytes"`
+	Peers         []*PeerStats `json:"peers"`
+	// ExitIP is the public address of the host checked after the connection was started
+	ExitIP *ExitIP `json:"exit_ip,omitempty"`
+}
+
+// PeerStats is the state of a peer of an active connection
+type PeerStats struct {
+	Connection string   `json:"connection"`
+	PublicKey  string   `json:"public_key"`
+	ID         string   `json:"id"`
+	Endpoint   string   `json:"endpoint"`
+	AllowedIPs []string `json:"allowed_ips"`
+	// LatestHandshake is unset until the first handshake
+	LatestHandshake *time.Time `json:"latest_handshake"`
+	// HandshakeAge is the number of seconds since the latest handshake
+	HandshakeAge  *int64 `json:"handshake_age"`
+	ReceiveBytes  uint64 `json:"receive_bytes"`
+	TransmitBytes uint64 `json:"transmit_bytes"`
+	// PersistentKeepalive is the keepalive interval in seconds, 0 when it's off
+	PersistentKeepalive int `json:"persistent_keepalive"`
 }
 
-func GetStatus() (string, error) {
-	output, err := showStatus()
+// GetStatus returns the status of the granted active connections
+func (m *WireGuardManager) GetStatus(grants ConnectionGrants) ([]*ConnectionStatus, error) {
+	devices, err := m.readDevices()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	status := lo.FilterMap(strings.Split(string(output), "\n"), func(line string, _ int) (string, bool) {
-		line = strings.TrimSpace(line)
-		if strings.Contains(line, "interface") {
-			return fmt.Sprintf("Connection: %s", strings.TrimPrefix(line, "interface:")), true
+	allConnections, err := m.getAllConnections()
+	if err != nil {
+		return nil, err
+	}
+	status := []*ConnectionStatus{}
+	for _, device := range devices {
+		if slices.Contains(grants.Filter(allConnections), device.Name) {
+			connectionStatus := deviceStatus(device, time.Now())
+			connectionStatus.ExitIP = m.exitIP.get(device.Name)
+			status = append(status, connectionStatus)
 		}
-		if strings.Contains(line, "latest handshake") {
-			return fmt.Sprintf("Latest Handshake: %s", strings.TrimPrefix(line, "latest handshake:")), true
+	}
+	return status, nil
+}
+
+// GetPeerStats returns the peers of the granted active connections
+func (m *WireGuardManager) GetPeerStats(grants ConnectionGrants) ([]*PeerStats, error) {
+	status, err := m.GetStatus(grants)
+	if err != nil {
+		return nil, err
+	}
+	stats := []*PeerStats{}
+	for _, connection := range status {
+		stats = append(stats, connection.Peers...)
+	}
+	return stats, nil
+}
+
+// deviceStatus returns the status of the connection of the device
+func deviceStatus(device *Device, now time.Time) *ConnectionStatus {
+	status := &ConnectionStatus{
+		Name:       device.Name,
+		ListenPort: device.ListenPort,
+		State:      StateStarting,
+		Namespace:  device.Namespace,
+		Peers:      make([]*PeerStats, 0, len(device.Peers)),
+	}
+	for _, peer := range device.Peers {
+		stats := peerStats(device.Name, peer, now)
+		status.Peers = append(status.Peers, stats)
+		status.ReceiveBytes += peer.ReceiveBytes
+		status.TransmitBytes += peer.TransmitBytes
+		if stats.LatestHandshake == nil {
+			continue
 		}
-		if strings.Contains(line, "transfer") {
-			return fmt.Sprintf("Transfer: %s", strings.TrimPrefix(line, "transfer:")), true
+		status.State = StateConnected
+		if status.LatestHandshake == nil || stats.LatestHandshake.After(*status.LatestHandshake) {
+			status.LatestHandshake, status.HandshakeAge = stats.LatestHandshake, stats.HandshakeAge
 		}
-		return "", false
-	})
-	// This is a simple check on whether a connection started or not.
-	// Instead of complex logic on looping on connections and figuring which connection might be missing info.
-	// NOTE: This doesn't handle if 3x connections were started and none of them is still active.
-	// NOTE: ToggleConnection stops all active connections and activate one.
-	// to avoid issues with multiple VPNs configuring the same iptable that could happen with default wireguard configs
-	if len(status)%3 != 0 {
-		status = append(status, "Connection starting...")
 	}
-	return strings.Join(status, "\n"), nil
+	return status
+}
+
+func peerStats(connection string, peer *Peer, now time.Time) *PeerStats {
+	stats := &PeerStats{
+		Connection:          connection,
+		PublicKey:           peer.PublicKey,
+		ID:                  PeerID(peer.PublicKey),
+		Endpoint:            peer.Endpoint,
+		AllowedIPs:          slices.Clone(peer.AllowedIPs),
+		ReceiveBytes:        peer.ReceiveBytes,
+		TransmitBytes:       peer.TransmitBytes,
+		PersistentKeepalive: peer.PersistentKeepalive,
+	}
+	if !peer.LatestHandshake.IsZero() {
+		latestHandshake := peer.LatestHandshake
+		age := int64(now.Sub(latestHandshake).Round(time.Second).Seconds())
+		stats.LatestHandshake, stats.HandshakeAge = &latestHandshake, &age
+	}
+	return stats
 }
 
-func GetConnections() ([]*WireGuardConnection, error) {
-	activeConnection, err := getActiveConnections()
+func (m *WireGuardManager) GetConnections() ([]*WireGuardConnection, error) {
+	activeConnection, err := m.getActiveConnections()
 	if err != nil {
 		return nil, err
 	}
-	allConnections, err := getAllConnections()
+	allConnections, err := m.getAllConnections()
 	if err != nil {
 		return nil, err
 	}
 
+	m.lastErrorsMutex.Lock()
+	defer m.lastErrorsMutex.Unlock()
 	connections := make([]*WireGuardConnection, 0, len(allConnections))
 	for _, i := range allConnections {
+		metadata := m.metadata.Get(i)
 		connections = append(connections, &WireGuardConnection{
-			Name:   i,
-			Active: slices.Contains(activeConnection, i),
+			Name:               i,
+			Active:             slices.Contains(activeConnection, i),
+			LastError:          m.lastErrors[i],
+			ConfigDir:          m.configDirOf(i),
+			Namespace:          m.config.namespaceOf(i),
+			Health:             m.health.get(i),
+			ConnectionMetadata: metadata,
+			Flag:               countryFlag(metadata.Country),
 		})
 	}
 	return connections, nil
 }
 
-func ToggleConnection(name string) ([]byte, error) {
-	allConnections, err := GetConnections()
-	if err != nil {
+// Connection changes
+const (
+	changeToggle = "toggle"
+	changeStart  = "start"
+	changeStop   = "stop"
+)
+
+// ToggleConnection stops the named connection when it's active and starts it otherwise.
+// Unless multiple connections may be active, the toggle stops all the active connections.
+// The error of the connection that failed is recorded, and the connection and the
+// stopped active connections must be granted.
+func (m *WireGuardManager) ToggleConnection(name string, grants ConnectionGrants) (*ToggleResult, error) {
+	// A toggle waiting for another operation could revert it, like a double click, it's rejected instead
+	if !m.operationMutex.TryLock() {
+		return nil, fmt.Errorf("%w: %s", ErrOperationInProgress, name)
+	}
+	defer m.operationMutex.Unlock()
+	return m.changeConnection(name, changeToggle, grants)
+}
+
+// StartConnection starts the named connection unless it's active. Unless multiple
+// connections may be active, the other active connections are stopped first.
+func (m *WireGuardManager) StartConnection(name string, grants ConnectionGrants) (*ToggleResult, error) {
+	m.operationMutex.Lock()
+	defer m.operationMutex.Unlock()
+	return m.changeConnection(name, changeStart, grants)
+}
+
+// StopConnection stops the named connection when it's active
+func (m *WireGuardManager) StopConnection(name string, grants ConnectionGrants) (*ToggleResult, error) {
+	m.operationMutex.Lock()
+	defer m.operationMutex.Unlock()
+	return m.changeConnection(name, changeStop, grants)
+}
+
+func (m *WireGuardManager) changeConnection(name, change string, grants ConnectionGrants) (*ToggleResult, error) {
+	result, err := m.applyChange(name, change, grants)
+	var opErr *operationError
+	switch {
+	case errors.Is(err, ErrConnectionNotGranted):
+		// Nothing was attempted on the connections
+	case errors.As(err, &opErr):
+		m.setLastError(opErr.connection, opErr.action, opErr.err)
+	case err != nil:
+		m.setLastError(name, change, err)
+	default:
+		m.clearLastErrors(append(result.Stopped, name)...)
+		if change == changeStop {
+			// Stopping a connection whose interface disappeared keeps it down
+			m.expected.remove(name)
+		}
+	}
+	return result, err
+}
+
+func (m *WireGuardManager) setLastError(name, action string, err error) {
+	m.lastErrorsMutex.Lock()
+	defer m.lastErrorsMutex.Unlock()
+	m.lastErrors[name] = &ConnectionError{
+		Action:  action,
+		Message: err.Error(),
+		Time:    time.Now(),
+	}
+}
+
+func (m *WireGuardManager) clearLastErrors(names ...string) {
+	m.lastErrorsMutex.Lock()
+	defer m.lastErrorsMutex.Unlock()
+	for _, name := range names {
+		delete(m.lastErrors, name)
+	}
+}
+
+func (m *WireGuardManager) applyChange(name, change string, grants ConnectionGrants) (*ToggleResult, error) {
+	if err := grants.allowToggle(name, nil); err != nil {
 		return nil, err
 	}
-	activeConnections := lo.Filter(allConnections, func(i *WireGuardConnection, _ int) bool {
-		return i.Active
-	})
-	connection, err := getConnection(name)
+	allConnections, err := m.GetConnections()
 	if err != nil {
 		return nil, err
 	}
-	output, err := stopActiveConnections(activeConnections)
+	connection, ok := lo.Find(allConnections, func(c *WireGuardConnection) bool { return c.Name == name })
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrConnectionNotFound, name)
+	}
+	stop, start := m.planChange(change, connection, allConnections)
+	if err := grants.allowToggle(name, stop); err != nil {
+		return nil, err
+	}
+	var warnings []string
+	if start {
+		if warnings, err = m.startChecks(connection, allConnections); err != nil {
+			return nil, err
+		}
+	}
+	output, err := m.stopActiveConnections(stop)
 	if err != nil {
 		return nil, err
 	}
-	startOutput, err := startConnection(connection)
+	result := &ToggleResult{Warnings: warnings, Stopped: lo.Map(stop, func(c *WireGuardConnection, _ int) string {
+		return c.Name
+	})}
+	if start {
+		startOutput, err := m.startConnection(connection)
+		if err != nil {
+			return nil, err
+		}
+		output = append(output, startOutput...)
+		result.Started = name
+	}
+	result.Output = output
+	return result, nil
+}
+
+// planChange returns the active connections to stop for the change of the connection,
+// and whether the connection is then started
+func (m *WireGuardManager) planChange(
+	change string, connection *WireGuardConnection, allConnections []*WireGuardConnection,
+) ([]*WireGuardConnection, bool) {
+	activeConnections := lo.Filter(allConnections, func(c *WireGuardConnection, _ int) bool {
+		return c.Active && (change == changeToggle || c.Name != connection.Name)
+	})
+	switch {
+	case change == changeStop || (change == changeToggle && m.config.MultiActive && connection.Active):
+		if connection.Active {
+			return []*WireGuardConnection{connection}, false
+		}
+		return nil, false
+	case m.config.MultiActive:
+		return nil, !connection.Active
+	default:
+		return activeConnections, !connection.Active
+	}
+}
+
+// startChecks runs the opt-in checks before starting a connection, returning their warnings
+func (m *WireGuardManager) startChecks(
+	connection *WireGuardConnection, allConnections []*WireGuardConnection,
+) ([]string, error) {
+	if connection.Active {
+		return nil, nil
+	}
+	var warnings []string
+	names := lo.Map(allConnections, func(c *WireGuardConnection, _ int) string {
+		return c.Name
+	})
+	warning, err := m.checkIPv6(connection.Name, names)
 	if err != nil {
 		return nil, err
 	}
-	output = append(output, startOutput...)
-	return output, nil
+	if warning != "" {
+		warnings = append(warnings, warning)
+	}
+	return warnings, nil
 }
 
-func stopActiveConnections(activeConnections []*WireGuardConnection) ([]byte, error) {
+func (m *WireGuardManager) stopActiveConnections(activeConnections []*WireGuardConnection) ([]byte, error) {
 	var output []byte
 	for _, activeConnection := range activeConnections {
+		output = append(output, m.runHooks(HookPreStop, m.config.Hooks.PreStop, activeConnection.Name)...)
 		log.Printf("Stopping connection %s", activeConnection.Name)
-		cmd := exec.Command("sudo", "wg-quick", "down", activeConnection.Name)
-		out, err := cmd.CombinedOutput()
+		out, err := m.backend.Down(activeConnection.Name)
+		m.invalidateDevices()
 		if err != nil {
-			return nil, err
+			return nil, &operationError{connection: activeConnection.Name, action: "down", err: err}
 		}
 		output = append(output, out...)
+		m.expected.remove(activeConnection.Name)
 		log.Printf("Successfully stopped connection %s", activeConnection.Name)
 	}
 	return output, nil
 }
 
-func startConnection(connection *WireGuardConnection) ([]byte, error) {
+func (m *WireGuardManager) startConnection(connection *WireGuardConnection) ([]byte, error) {
 	if connection.Active {
 		return nil, nil
 	}
 	log.Printf("Starting connection %s", connection.Name)
-	cmd := exec.Command("sudo", "wg-quick", "up", connection.Name)
-	output, err := cmd.CombinedOutput()
+	output, err := m.backend.Up(connection.Name)
+	m.invalidateDevices()
 	if err != nil {
-		return nil, err
+		return nil, &operationError{connection: connection.Name, action: "up", err: err}
 	}
+	m.expected.add(connection.Name)
+	// wg-quick adds the expired peers of the config back
+	m.reapExpiredPeers(time.Now())
 	log.Printf("Successfully started connection %s", connection.Name)
-	return output, nil
+	return append(output, m.runHooks(HookPostStart, m.config.Hooks.PostStart, connection.Name)...), nil
 }
 
-// Get the list of all wireguard connections using config files
-func getAllConnections() ([]string, error) {
-	files, err := filepath.Glob("/etc/wireguard/*.conf")
-	if err != nil {
-		return nil, err
+// configPath returns the config file of the connection in the first config directory having it,
+// in config_dir for a new connection
+func (m *WireGuardManager) configPath(name string) string {
+	return findConfigFile(m.configDirs, name)
+}
+
+// Get the list of all wireguard connections using the list connections command when set,
+// falling back to the config files
+func (m *WireGuardManager) getAllConnections() ([]string, error) {
+	if m.config.ListConnectionsCommand != "" {
+		return m.listConnections()
 	}
-	files = lo.Map(files, func(f string, _ int) string {
-		return strings.TrimSuffix(filepath.Base(f), filepath.Ext(f))
-	})
-	return files, nil
+	return m.globConnections()
 }
 
-// Get the list of active wireguard connections using wg show command
-func getActiveConnections() ([]string, error) {
-	var activeConnections []string
-	status, err := showStatus()
+// listConnections runs the list connections command, which prints a connection name per line
+func (m *WireGuardManager) listConnections() ([]string, error) {
+	fields := strings.Fields(m.config.ListConnectionsCommand)
+	output, err := m.runner.Output(fields[0], fields[1:]...)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to list connections: %w", err)
+	}
+
+	var connections []string
+	for line := range strings.SplitSeq(string(output), "\n") {
+		name := strings.TrimSpace(line)
+		if name == "" {
+			continue
+		}
+		if !connectionNameRegex.MatchString(name) {
+			log.Printf("Skipping invalid connection name %q", name)
+			continue
+		}
+		connections = append(connections, name)
 	}
-	for line := range strings.SplitSeq(string(status), "\n") {
-		if matches := interfaceRegex.FindStringSubmatch(strings.TrimSpace(line)); len(matches) > 1 {
-			activeConnections = append(activeConnections, matches[1])
+	return connections, nil
+}
+
+// Get the list of all wireguard connections using config files
+func (m *WireGuardManager) globConnections() ([]string, error) {
+	var names []string
+	for _, configDir := range m.configDirs {
+		files, err := filepath.Glob(filepath.Join(configDir, m.config.ConfigGlob))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			// The configs of the earlier directories shadow the configs of the same name
+			if name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)); !slices.Contains(names, name) {
+				names = append(names, name)
+			}
 		}
 	}
-	return activeConnections, nil
+	return names, nil
 }
 
-func getConnection(name string) (*WireGuardConnection, error) {
-	allConnections, err := GetConnections()
+// configDirOf returns the config directory of the config file of the connection, empty without one
+func (m *WireGuardManager) configDirOf(name string) string {
+	path := m.configPath(name)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return filepath.Dir(path)
+}
+
+// checkNewName checks the name of a new connection is a valid interface name
+// whose config file is matched by the config glob
+func (m *WireGuardManager) checkNewName(name string) error {
+	if !connectionNameRegex.MatchString(name) {
+		return fmt.Errorf("%w: invalid connection name %q", ErrInvalidConfig, name)
+	}
+	if matched, _ := filepath.Match(m.config.ConfigGlob, name+".conf"); !matched {
+		return fmt.Errorf("%w: %s.conf isn't matched by the config glob %s", ErrInvalidConfig, name, m.config.ConfigGlob)
+	}
+	return nil
+}
+
+// Get the list of active wireguard connections, the up interfaces
+func (m *WireGuardManager) getActiveConnections() ([]string, error) {
+	devices, err := m.readDevices()
+	if err != nil {
+		return nil, err
+	}
+	return lo.Map(devices, func(device *Device, _ int) string { return device.Name }), nil
+}
+
+func (m *WireGuardManager) getConnection(name string) (*WireGuardConnection, error) {
+	allConnections, err := m.GetConnections()
 	if err != nil {
 		return nil, err
 	}
@@ -157,16 +565,87 @@ func getConnection(name string) (*WireGuardConnection, error) {
 		return dev.Name == name
 	})
 	if !ok {
-		return nil, fmt.Errorf("failed to find connection: %s", name)
+		return nil, fmt.Errorf("%w: %s", ErrConnectionNotFound, name)
 	}
 	return connection, nil
 }
 
-func showStatus() ([]byte, error) {
-	cmd := exec.Command("sudo", "wg", "show")
-	output, err := cmd.Output()
+// connectionConfig parses the config of a known connection
+func (m *WireGuardManager) connectionConfig(name string) (*WireGuardConfig, error) {
+	allConnections, err := m.getAllConnections()
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute wg show: %w", err)
+		return nil, err
 	}
-	return output, nil
+	if !slices.Contains(allConnections, name) {
+		return nil, fmt.Errorf("%w: %s", ErrConnectionNotFound, name)
+	}
+	return ParseConfig(m.configPath(name))
+}
+
+// readDevices reads the up interfaces, concurrent callers share the devices of a single read
+// which must not be modified
+func (m *WireGuardManager) readDevices() ([]*Device, error) {
+	if devices, ok := m.devicesCache.get(m.config.GetStatusCacheTTL()); ok {
+		return devices, nil
+	}
+	generation := m.devicesCache.generation()
+	// Reads started before an invalidation aren't shared with the callers coming after it
+	devices, err, _ := m.devicesGroup.Do(strconv.FormatUint(generation, 10), func() (any, error) {
+		devices, err := m.devices.Devices()
+		if err == nil {
+			m.devicesCache.set(generation, devices)
+		}
+		return devices, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return devices.([]*Device), nil
+}
+
+// invalidateDevices drops the cached devices after a change of the interfaces
+func (m *WireGuardManager) invalidateDevices() {
+	m.devicesCache.invalidate()
+}
+
+// devicesCache keeps the devices of the last read, a read started before an invalidation isn't kept
+type devicesCache struct {
+	devices []*Device
+	read    time.Time
+	// readGeneration is the generation the devices were read in, current the generation
+	// bumped by each invalidation
+	readGeneration uint64
+	current        uint64
+	mutex          sync.Mutex
+}
+
+func (c *devicesCache) get(ttl time.Duration) ([]*Device, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.devices == nil || c.readGeneration != c.current || time.Since(c.read) >= ttl {
+		return nil, false
+	}
+	return c.devices, true
+}
+
+func (c *devicesCache) generation() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.current
+}
+
+func (c *devicesCache) set(generation uint64, devices []*Device) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation != c.current {
+		return
+	}
+	c.devices, c.read, c.readGeneration = devices, time.Now(), generation
+}
+
+func (c *devicesCache) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.current++
+	c.devices = nil
 }
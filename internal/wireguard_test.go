@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingRunner counts the wg show commands, holding them until release is closed
+type countingRunner struct {
+	dump    string
+	calls   atomic.Int32
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func newCountingRunner(dump string) *countingRunner {
+	return &countingRunner{dump: dump, started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (r *countingRunner) CombinedOutput(name string, args ...string) ([]byte, error) {
+	return r.Output(name, args...)
+}
+
+func (r *countingRunner) Output(name string, args ...string) ([]byte, error) {
+	if !strings.Contains(strings.Join(append([]string{name}, args...), " "), "wg show all dump") {
+		return nil, nil
+	}
+	r.calls.Add(1)
+	r.once.Do(func() { close(r.started) })
+	<-r.release
+	return []byte(r.dump), nil
+}
+
+// newTestManager returns a manager of the connection configs of a temporary directory
+func newTestManager(t *testing.T, runner CommandRunner, names ...string) *WireGuardManager {
+	t.Helper()
+	config := DefaultConfig()
+	config.ConfigDir = t.TempDir()
+	config.StateDir = t.TempDir()
+	config.StatusCacheSeconds = 0
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(config.ConfigDir, name+".conf"), []byte("[Interface]\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	metadata, err := NewMetadataStore(DefaultProfile, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewWireGuardManager(config, runner, metadata, nil, nil)
+}
+
+func TestGetStatusConcurrentReadsShareOneCommand(t *testing.T) {
+	runner := newCountingRunner("wg0\tprivate\tpublic\t51820\toff\n")
+	manager := newTestManager(t, runner, "wg0")
+
+	const callers = 10
+	var joined, done sync.WaitGroup
+	joined.Add(callers)
+	done.Add(callers)
+	errs := make(chan error, callers)
+	for range callers {
+		go func() {
+			defer done.Done()
+			joined.Done()
+			status, err := manager.GetStatus(nil)
+			if err == nil && (len(status) != 1 || status[0].Name != "wg0") {
+				t.Errorf("status = %+v, want wg0", status)
+			}
+			errs <- err
+		}()
+	}
+	joined.Wait()
+	<-runner.started
+	// Let the remaining callers join the read in flight
+	time.Sleep(50 * time.Millisecond)
+	close(runner.release)
+	done.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := runner.calls.Load(); calls != 1 {
+		t.Fatalf("wg show ran %d times for %d concurrent callers, want 1", calls, callers)
+	}
+}
@@ -1,14 +1,28 @@
 package main
 
 import (
+	"bufio"
+	"cmp"
+	"crypto/subtle"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"io/fs"
 	"log"
+	"maps"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/samber/lo"
 
 	"wg-portal/internal"
 )
@@ -23,29 +37,195 @@ type APIResponse struct {
 	Error   string `json:"error,omitempty"`
 }
 
+// Failures of the audited authentications
+var (
+	errWrongCredentials = errors.New("wrong credentials")
+	errLockedOut        = errors.New("locked out after too many failed logins")
+)
+
+// maxAuditUsernameLength truncates the usernames of the audit log
+const maxAuditUsernameLength = 128
+
+// The CSRF token of the session is sent in the header by the dashboard scripts,
+// and in the form field by the HTML forms
+const (
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrf_token"
+)
+
+// The OAuth2 state cookie ties the provider callback to the browser starting the login,
+// which has the state lifetime to log in at the provider
+const (
+	oauthStateCookie   = "oauth_state"
+	oauthStateLifetime = 10 * time.Minute
+)
+
+// maxImportSize bounds the uploaded config files, larger files fail the validation
+const maxImportSize = 1 << 20
+
+// qrScale is the width in pixels of a module of the PNG QR codes
+const qrScale = 8
+
 // Server encapsulates our HTTP server
 type Server struct {
+	name           string
 	mux            *http.ServeMux
 	templates      *template.Template
 	config         *internal.Config
 	sessionManager *internal.SessionManager
+	users          *internal.UserStore
+	tokens         *internal.TokenStore
+	loginLimiter   *internal.LoginLimiter
+	loginAlerter   *internal.LoginAlerter
+	feed           *internal.Feed
+	wireguard      *internal.WireGuardManager
+	killSwitch     *internal.KillSwitch
+	maintenance    *internal.MaintenanceWindow
+	readOnly       *internal.ReadOnlyMode
+	events         *internal.EventLog
+	bus            *internal.EventBus
+	auditLog       *internal.AuditLog
+	traffic        *internal.TrafficHistory
+	failover       *internal.FailoverController
+	watchdog       *internal.Watchdog
+	schedules      *internal.ScheduleStore
+	metadata       *internal.MetadataStore
+	speedTests     *internal.SpeedTests
+	configRepo     *internal.ConfigRepository
+	configHistory  *internal.ConfigHistory
+	crossOrigin    *http.CrossOriginProtection
 }
 
-// NewServer creates a new server instance
-func NewServer(config *internal.Config) (*Server, error) {
+// NewServer creates a new server instance for the named config profile
+func NewServer(name string, config *internal.Config) (*Server, error) {
 	// Parse embedded templates
-	templates, err := template.ParseFS(embeddedAssets, "templates/index.html", "templates/login.html")
+	templates, err := template.ParseFS(embeddedAssets,
+		"templates/index.html", "templates/login.html", "templates/settings.html")
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse templates: %w", err)
 	}
 
+	if err := config.LoadKeyCipher(); err != nil {
+		return nil, err
+	}
+	users, err := internal.NewUserStore(config)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := internal.NewTokenStore(config)
+	if err != nil {
+		return nil, err
+	}
+	auditLog, err := internal.NewAuditLog(name, config)
+	if err != nil {
+		return nil, err
+	}
+	traffic, err := internal.NewTrafficHistory(name, config)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := internal.NewMetadataStore(name, config)
+	if err != nil {
+		return nil, err
+	}
+	expiries, err := internal.NewPeerExpiryStore(name, config)
+	if err != nil {
+		return nil, err
+	}
+	rotations, err := internal.NewKeyRotationStore(name, config)
+	if err != nil {
+		return nil, err
+	}
+	schedules, err := internal.NewScheduleStore(name, config)
+	if err != nil {
+		return nil, err
+	}
+	speedTests, err := internal.NewSpeedTests(name, config)
+	if err != nil {
+		return nil, err
+	}
+	configHistory, err := internal.NewConfigHistory(name, config)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionStore, err := internal.NewSessionStore(name, config)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionManager := internal.NewSessionManager(sessionStore, config.GetSessionLifetime(),
+		config.MaxSessionsPerUser, config.SessionBinding)
+	direct := config.DirectPrivileges()
+	if direct && config.Backend == internal.BackendWGQuick && os.Geteuid() != 0 {
+		log.Printf("wg-quick runs sudo itself unless the portal is root, the native backend runs without sudo")
+	}
+	runner := internal.NewCommandRunner(config.GetCommandTimeout(), direct)
+	if config.PrivilegedHelper.Socket != "" {
+		runner = internal.NewHelperRunner(config, runner)
+	}
+	killSwitch, err := internal.NewKillSwitch(name, config, runner)
+	if err != nil {
+		return nil, err
+	}
 	s := &Server{
+		name:           name,
 		mux:            http.NewServeMux(),
 		templates:      templates,
 		config:         config,
-		sessionManager: internal.NewSessionManager(),
+		sessionManager: sessionManager,
+		users:          users,
+		tokens:         tokens,
+		loginLimiter:   internal.NewLoginLimiter(config.LoginLimit),
+		loginAlerter:   internal.NewLoginAlerter(config.LoginAlert),
+		feed:           internal.NewFeed(sessionManager, config.GetSessionWarning(), config.GetBroadcastInterval()),
+		wireguard:      internal.NewWireGuardManager(config, runner, metadata, expiries, rotations),
+		killSwitch:     killSwitch,
+		maintenance:    internal.NewMaintenanceWindow(),
+		readOnly:       internal.NewReadOnlyMode(config.ReadOnly),
+		events:         internal.NewEventLog(config.EventLogSize),
+		bus:            internal.NewEventBus(),
+		auditLog:       auditLog,
+		traffic:        traffic,
+		schedules:      schedules,
+		metadata:       metadata,
+		speedTests:     speedTests,
+		configRepo:     internal.NewConfigRepository(config, runner),
+		configHistory:  configHistory,
+		crossOrigin:    http.NewCrossOriginProtection(),
+	}
+	if err := s.wireguard.EncryptPrivateKeys(); err != nil {
+		return nil, err
 	}
+	if err := s.configRepo.Init(); err != nil {
+		return nil, err
+	}
+	s.configHistory.Sync(s.wireguard)
+	s.failover = internal.NewFailoverController(config.Failover, s.wireguard, s.maintenance, s.readOnly)
+	s.watchdog = internal.NewWatchdog(config.Watchdog, s.wireguard, s.maintenance, s.readOnly)
 	s.setupRoutes()
+	s.wireguard.StartActivitySampler(config.GetActivitySampleInterval())
+	s.traffic.Start(s.wireguard)
+	s.wireguard.StartLatencyMonitor(config.Latency)
+	s.wireguard.StartHealthChecks(config.HealthChecks)
+	s.failover.Start(s.recordFailover)
+	s.watchdog.Start(s.recordWatchdogRestart)
+	s.wireguard.StartExpiryReaper(s.recordPeerExpiration)
+	s.wireguard.StartKeyRotation(s.recordKeyRotation)
+	internal.NewScheduler(s.schedules, s.wireguard, s.maintenance, s.readOnly).Start(s.recordScheduleRun)
+	s.bus.Subscribe(s.recordStatusEvent)
+	internal.NewStatusPoller(config.GetStatusPollInterval(), s.wireguard, s.bus).Start()
+
+	// The rules are installed again when the kill switch was enabled before the restart
+	if config.KillSwitch.EnableOnStartup || s.killSwitch.Enabled() {
+		output, err := s.killSwitch.Restore()
+		entry := internal.AuditEntry{Action: internal.AuditKillSwitch, Target: "enable", Result: internal.AuditSuccess, Reason: "startup"}
+		if err != nil {
+			log.Printf("Failed to enable kill switch on startup: %v (output: %s)", err, string(output))
+			entry.Result, entry.Reason = internal.AuditFailure, fmt.Sprintf("startup: %v", err)
+		}
+		s.auditLog.Record(entry)
+	}
 	return s, nil
 }
 
@@ -53,17 +233,106 @@ func NewServer(config *internal.Config) (*Server, error) {
 func (s *Server) setupRoutes() {
 	// Serve embedded static files (no auth required)
 	staticFS, _ := fs.Sub(embeddedAssets, "static")
-	s.mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(staticFS))))
+	s.mux.Handle("/static/", http.StripPrefix("/static/", internal.NewStaticHandler(staticFS)))
 
 	// Auth routes (no auth required)
 	s.mux.HandleFunc("/login", s.handleLogin)
 	s.mux.HandleFunc("/logout", s.handleLogout)
+	s.mux.HandleFunc("/oauth/login", s.handleOAuthLogin)
+	s.mux.HandleFunc("/oauth/callback", s.handleOAuthCallback)
+	// Replies 401 instead of redirecting to the login page
+	s.mux.HandleFunc(s.apiPath("/session/refresh"), s.handleSessionRefreshAPI)
+
+	// Protected routes, viewers can read the connections and status
+	s.mux.HandleFunc("/", s.requireRole(internal.RoleViewer, s.handleHome))
+	s.mux.HandleFunc("/settings", s.requireRole(internal.RoleViewer, s.handleSettings))
+	s.mux.HandleFunc(s.apiPath("/connections"), s.requireRole(internal.RoleViewer, s.handleConnectionsAPI))
+	s.mux.HandleFunc(s.apiPath("/tags"), s.requireRole(internal.RoleViewer, s.handleTagsAPI))
+	s.mux.HandleFunc(s.apiPath("/status"), s.requireRole(internal.RoleViewer, s.handleStatusAPI))
+	s.mux.HandleFunc(s.apiPath("/peers"), s.requireRole(internal.RoleViewer, s.handlePeerStatsAPI))
+	s.mux.HandleFunc(s.apiPath("/traffic"), s.requireRole(internal.RoleViewer, s.handleTrafficAPI))
+	s.mux.HandleFunc(s.apiPath("/stats/timeseries"), s.requireRole(internal.RoleViewer, s.handleTimeseriesAPI))
+	s.mux.HandleFunc(s.apiPath("/latency"), s.requireRole(internal.RoleViewer, s.handleLatencyAPI))
+	s.mux.HandleFunc(s.apiPath("/failover"), s.requireRole(internal.RoleViewer, s.handleFailoverAPI))
+	s.mux.HandleFunc(s.apiPath("/watchdog"), s.requireRole(internal.RoleViewer, s.handleWatchdogAPI))
+	s.mux.HandleFunc(s.apiPath("/speed-tests"), s.requireRole(internal.RoleViewer, s.handleSpeedTestsAPI))
+	s.mux.HandleFunc(s.apiPath("/ws"), s.requireRole(internal.RoleViewer, s.handleFeed))
+	s.mux.HandleFunc(s.apiPath("/events.json"), s.requireRole(internal.RoleViewer, s.handleEventsAPI))
+	s.mux.HandleFunc(s.apiPath("/capabilities"), s.requireRole(internal.RoleViewer, s.handleCapabilitiesAPI))
+
+	// Every user manages their own account, from a login session
+	s.mux.HandleFunc(s.apiPath("/password"), s.requireAccount(s.handlePasswordAPI))
+	s.mux.HandleFunc(s.apiPath("/totp/enroll"), s.requireAccount(s.handleTOTPEnrollAPI))
+	s.mux.HandleFunc(s.apiPath("/totp/confirm"), s.requireAccount(s.handleTOTPConfirmAPI))
+	s.mux.HandleFunc(s.apiPath("/totp/recovery-codes"), s.requireAccount(s.handleRecoveryCodesAPI))
+	s.mux.HandleFunc(s.apiPath("/totp/disable"), s.requireAccount(s.handleTOTPDisableAPI))
+	s.mux.HandleFunc(s.apiPath("/sessions"), s.requireAccount(s.handleSessionsAPI))
+	s.mux.HandleFunc(s.apiPath("/sessions/{id}"), s.requireAccount(s.handleSessionAPI))
+	s.mux.HandleFunc(s.apiPath("/tokens"), s.requireAccount(s.handleTokensAPI))
+	s.mux.HandleFunc(s.apiPath("/tokens/{id}"), s.requireAccount(s.handleTokenAPI))
+
+	// Operators can toggle the connections and run the operational actions
+	operator := func(next http.HandlerFunc) http.HandlerFunc {
+		return s.requireRole(internal.RoleOperator, next)
+	}
+	s.mux.HandleFunc(s.apiPath("/connections/toggle"), operator(s.handleToggleAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/start"), operator(s.handleStartAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/stop"), operator(s.handleStopAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/compare"), operator(s.handleCompareAPI))
+	s.mux.HandleFunc(s.apiPath("/kill-switch"), operator(s.handleKillSwitchAPI))
+	s.mux.HandleFunc(s.apiPath("/maintenance/start"), operator(s.handleMaintenanceStartAPI))
+	s.mux.HandleFunc(s.apiPath("/maintenance/stop"), operator(s.handleMaintenanceStopAPI))
+	s.mux.HandleFunc(s.apiPath("/diagnostics/route-conflicts"), operator(s.handleRouteConflictsAPI))
+	s.mux.HandleFunc(s.apiPath("/diagnostics/dns-leak"), operator(s.handleDNSLeakAPI))
+	s.mux.HandleFunc(s.apiPath("/diagnostics/speed-test"), operator(s.handleSpeedTestAPI))
+	s.mux.HandleFunc(s.apiPath("/diagnostics/routes"), operator(s.handleTunnelRoutesAPI))
+	s.mux.HandleFunc(s.apiPath("/diagnostics/firewall"), operator(s.handleTunnelFirewallAPI))
+
+	// Admins can manage the users and the connection configs
+	admin := func(next http.HandlerFunc) http.HandlerFunc {
+		return s.requireRole(internal.RoleAdmin, next)
+	}
+	s.mux.HandleFunc(s.apiPath("/connections/{name}/apply-profile"), admin(s.handleApplyProfileAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/{name}/allowed-ips"), admin(s.handleAllowedIPsAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/{name}/mtu"), admin(s.handleMTUAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/{name}/config"), admin(s.handleConfigFileAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/{name}/versions"), admin(s.handleConfigVersionsAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/{name}/versions/{version}"), admin(s.handleConfigVersionAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/{name}/versions/{version}/rollback"), admin(s.handleConfigRollbackAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/{name}/diff"), admin(s.handleConfigDiffAPI))
+	s.mux.HandleFunc(s.apiPath("/config/validate"), admin(s.handleValidateConfigAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/import"), admin(s.handleImportAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/create"), admin(s.handleCreateInterfaceAPI))
+	s.mux.HandleFunc(s.apiPath("/backup"), admin(s.handleBackupAPI))
+	s.mux.HandleFunc(s.apiPath("/backup/restore"), admin(s.handleRestoreAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/{name}"), admin(s.handleDeleteConnectionAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/{name}/rename"), admin(s.handleRenameConnectionAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/{name}/tags"), admin(s.handleConnectionTagsAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/{name}/metadata"), admin(s.handleConnectionMetadataAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/{name}/peers"), admin(s.handlePeersAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/{name}/peers/{key}"), admin(s.handlePeerAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/{name}/peers/{key}/preshared-key"), admin(s.handlePresharedKeyAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/{name}/peers/{key}/qr"), admin(s.handlePeerQRAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/{name}/peers/{key}/keepalive"), admin(s.handleKeepaliveAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/{name}/peers/{key}/expiry"), admin(s.handlePeerExpiryAPI))
+	s.mux.HandleFunc(s.apiPath("/connections/{name}/peers/{key}/rotate"), admin(s.handleRotatePeerKeyAPI))
+	s.mux.HandleFunc(s.apiPath("/key-rotations"), admin(s.handleKeyRotationsAPI))
+	s.mux.HandleFunc(s.apiPath("/peers/{id}/config"), admin(s.handlePeerConfigAPI))
+	s.mux.HandleFunc(s.apiPath("/keys"), admin(s.handleKeysAPI))
+	s.mux.HandleFunc(s.apiPath("/users"), admin(s.handleUsersAPI))
+	s.mux.HandleFunc(s.apiPath("/audit"), admin(s.handleAuditAPI))
+	s.mux.HandleFunc(s.apiPath("/read-only"), admin(s.handleReadOnlyAPI))
+	s.mux.HandleFunc(s.apiPath("/schedules"), admin(s.handleSchedulesAPI))
+	s.mux.HandleFunc(s.apiPath("/schedules/{id}"), admin(s.handleScheduleAPI))
+	s.mux.HandleFunc(s.apiPath("/lockouts"), admin(s.handleLockoutsAPI))
+	s.mux.HandleFunc(s.apiPath("/lockouts/{kind}/{value}"), admin(s.handleLockoutAPI))
+	s.mux.HandleFunc(s.apiPath("/users/{username}"), admin(s.handleUserAPI))
+	s.mux.HandleFunc(s.apiPath("/users/{username}/connections"), admin(s.handleUserConnectionsAPI))
+}
 
-	// Protected routes
-	s.mux.HandleFunc("/", s.requireAuth(s.handleHome))
-	s.mux.HandleFunc("/api/connections", s.requireAuth(s.handleConnectionsAPI))
-	s.mux.HandleFunc("/api/connections/toggle", s.requireAuth(s.handleToggleAPI))
-	s.mux.HandleFunc("/api/status", s.requireAuth(s.handleStatusAPI))
+// apiPath returns the route of an API endpoint under the configured API prefix
+func (s *Server) apiPath(path string) string {
+	return s.config.APIPrefix + path
 }
 
 // handleHome serves the main HTML page
@@ -74,7 +343,11 @@ func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	if err := s.templates.ExecuteTemplate(w, "index.html", nil); err != nil {
+	templateData := map[string]any{
+		"APIPrefix": s.config.APIPrefix,
+		"CSRFToken": internal.CSRFTokenFromContext(r.Context()),
+	}
+	if err := s.templates.ExecuteTemplate(w, "index.html", templateData); err != nil {
 		log.Printf("Failed to render template: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
@@ -87,25 +360,44 @@ func (s *Server) handleConnectionsAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	connections, err := internal.GetConnections()
+	connections, err := s.wireguard.GetConnections()
 	if err != nil {
 		log.Printf("Failed to get connections: %v", err)
 		s.sendErrorResponse(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
 		return
 	}
 
+	grants := s.callerGrants(r)
+	tags := r.URL.Query()["tag"]
+	connections = slices.DeleteFunc(connections, func(connection *internal.WireGuardConnection) bool {
+		return !grants.Allows(connection.Name) || !lo.Every(connection.Tags, tags)
+	})
+	slices.SortStableFunc(connections, func(a, b *internal.WireGuardConnection) int {
+		return cmp.Compare(b.Priority, a.Priority)
+	})
 	s.sendSuccessResponse(w, connections)
 }
 
-// handleToggleAPI handles connection toggle requests
-func (s *Server) handleToggleAPI(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+// handleTagsAPI returns the tags of the granted connections with their number of connections
+func (s *Server) handleTagsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.sendSuccessResponse(w, s.metadata.CountTags(s.callerGrants(r)))
+}
+
+// handleConnectionTagsAPI replaces the tags of a connection
+func (s *Server) handleConnectionTagsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
 		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	name := r.PathValue("name")
 
 	var req struct {
-		Name string `json:"name"`
+		Tags []string `json:"tags"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -113,197 +405,3292 @@ func (s *Server) handleToggleAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if strings.TrimSpace(req.Name) == "" {
-		s.sendErrorResponse(w, "Connection name is required", http.StatusBadRequest)
+	if !s.requireGranted(w, r, name) || !s.requireConnection(w, name) {
+		return
+	}
+	tags, err := s.metadata.SetTags(name, req.Tags)
+	if errors.Is(err, internal.ErrInvalidTag) {
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to tag connection %s: %v", name, err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Tagged connection %s with %v", name, tags)
+	s.sendSuccessResponse(w, map[string]any{"name": name, "tags": tags})
+}
+
+// handleConnectionMetadataAPI replaces the notes, the provider, the country and the priority of a connection
+func (s *Server) handleConnectionMetadataAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.PathValue("name")
+
+	var req internal.ConnectionDetails
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	output, err := internal.ToggleConnection(req.Name)
+	if !s.requireGranted(w, r, name) || !s.requireConnection(w, name) {
+		return
+	}
+	details, err := s.metadata.SetDetails(name, req)
+	if errors.Is(err, internal.ErrInvalidMetadata) {
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to toggle connection %s: %v (output: %s)", req.Name, err, string(output))
+		log.Printf("Failed to save the metadata of connection %s: %v", name, err)
 		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	response := map[string]any{
-		"message": fmt.Sprintf("Connection %s toggled successfully", req.Name),
-		"output":  string(output),
+	log.Printf("Updated the metadata of connection %s", name)
+	s.sendSuccessResponse(w, details)
+}
+
+// requireConnection sends 404 unless the connection exists
+func (s *Server) requireConnection(w http.ResponseWriter, name string) bool {
+	connections, err := s.wireguard.GetConnections()
+	if err != nil {
+		log.Printf("Failed to get connections: %v", err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return false
 	}
+	if !slices.ContainsFunc(connections, func(c *internal.WireGuardConnection) bool { return c.Name == name }) {
+		s.sendErrorResponse(w, fmt.Sprintf("%v: %s", internal.ErrConnectionNotFound, name), http.StatusNotFound)
+		return false
+	}
+	return true
+}
 
-	s.sendSuccessResponse(w, response)
+// callerGrants returns the connections granted to the user of the request,
+// further restricted by the API token of the request
+func (*Server) callerGrants(r *http.Request) internal.ConnectionGrants {
+	user, _ := internal.UserFromContext(r.Context())
+	grants := user.Connections
+	if token, ok := internal.TokenFromContext(r.Context()); ok {
+		grants = grants.Intersect(token.Connections)
+	}
+	return grants
 }
 
-// handleStatusAPI returns WireGuard status information
-func (s *Server) handleStatusAPI(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+// recordConfigChange commits the config changes of the request to the config repository and records
+// the new versions of the configs of the connections in their history, by the caller
+func (s *Server) recordConfigChange(r *http.Request, message string, names ...string) {
+	user, _ := internal.UserFromContext(r.Context())
+	s.configRepo.Commit(user.Username, message)
+	s.configHistory.Record(s.wireguard, user.Username, message, names...)
+}
+
+// requireGranted sends 403 unless the connections are granted to the caller
+func (s *Server) requireGranted(w http.ResponseWriter, r *http.Request, names ...string) bool {
+	grants := s.callerGrants(r)
+	for _, name := range names {
+		if !grants.Allows(name) {
+			s.sendErrorResponse(w, fmt.Sprintf("%v: %s", internal.ErrConnectionNotGranted, name), http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// handleToggleAPI handles connection toggle requests
+func (s *Server) handleToggleAPI(w http.ResponseWriter, r *http.Request) {
+	s.changeConnection(w, r, internal.AuditToggle, "toggled", s.wireguard.ToggleConnection)
+}
+
+// handleStartAPI starts a connection, unlike a toggle it leaves an active connection up
+func (s *Server) handleStartAPI(w http.ResponseWriter, r *http.Request) {
+	s.changeConnection(w, r, internal.AuditStart, "started", s.wireguard.StartConnection)
+}
+
+// handleStopAPI stops a connection, unlike a toggle it never starts one
+func (s *Server) handleStopAPI(w http.ResponseWriter, r *http.Request) {
+	s.changeConnection(w, r, internal.AuditStop, "stopped", s.wireguard.StopConnection)
+}
+
+// changeConnection runs a change of the connection named in the request body
+func (s *Server) changeConnection(w http.ResponseWriter, r *http.Request, action, done string,
+	change func(name string, grants internal.ConnectionGrants) (*internal.ToggleResult, error)) {
+	if r.Method != http.MethodPost {
 		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	status, err := internal.GetStatus()
+	var req struct {
+		Name string `json:"name"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(req.Name) == "" {
+		s.sendErrorResponse(w, "Connection name is required", http.StatusBadRequest)
+		return
+	}
+
+	if s.rejectReadOnly(w) {
+		return
+	}
+	user, _ := internal.UserFromContext(r.Context())
+	result, err := change(req.Name, s.callerGrants(r))
+	s.audit(r, internal.AuditEntry{Action: action, Username: user.Username, Target: req.Name}, err)
 	if err != nil {
-		log.Printf("Failed to get status: %v", err)
-		s.sendErrorResponse(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		s.sendChangeError(w, req.Name, action, err)
 		return
 	}
 
 	response := map[string]any{
-		"status": status,
+		"message":  fmt.Sprintf("Connection %s %s successfully", req.Name, done),
+		"output":   string(result.Output),
+		"warnings": result.Warnings,
+		"stopped":  result.Stopped,
+		"started":  result.Started,
+	}
+	if exitIP := s.checkExitIP(result); exitIP != nil {
+		response["exit_ip"] = exitIP
 	}
 
+	s.recordToggleEvents(result)
 	s.sendSuccessResponse(w, response)
+	s.broadcastStatus()
 }
 
-// sendSuccessResponse sends a JSON success response
-func (*Server) sendSuccessResponse(w http.ResponseWriter, data any) {
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    data,
-	})
+// checkExitIP checks the public address through the connection started by the change, the address
+// after the connections were stopped is checked in the background to compare the next check with
+func (s *Server) checkExitIP(result *internal.ToggleResult) *internal.ExitIP {
+	switch {
+	case result.Started != "":
+		return s.wireguard.CheckExitIP(result.Started)
+	case len(result.Stopped) > 0:
+		go s.wireguard.CheckExitIP("")
+	}
+	return nil
 }
 
-// sendErrorResponse sends a JSON error response
-func (*Server) sendErrorResponse(w http.ResponseWriter, message string, statusCode int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	_ = json.NewEncoder(w).Encode(APIResponse{
-		Success: false,
-		Error:   message,
-	})
+// sendChangeError maps the error of a connection change to its status code
+func (s *Server) sendChangeError(w http.ResponseWriter, name, action string, err error) {
+	switch {
+	case errors.Is(err, internal.ErrConnectionNotGranted):
+		s.sendErrorResponse(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, internal.ErrConnectionNotFound):
+		s.sendErrorResponse(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, internal.ErrIPv6Unavailable), errors.Is(err, internal.ErrOperationInProgress):
+		s.sendErrorResponse(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Failed to %s connection %s: %v", action, name, err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
-// requireAuth middleware checks for valid authentication
-func (s *Server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("session_id")
-		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
-
-		_, valid := s.sessionManager.ValidateSession(cookie.Value)
-		if !valid {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
+// recordFailover records the connection events and the audit entry of a failover,
+// and notifies the dashboards
+func (s *Server) recordFailover(event *internal.FailoverEvent, result *internal.ToggleResult) {
+	s.recordToggleEvents(result)
+	s.auditLog.Record(internal.AuditEntry{
+		Action: internal.AuditFailover,
+		Target: event.To,
+		Result: internal.AuditSuccess,
+		Reason: fmt.Sprintf("%s: %s", event.From, event.Reason),
+	})
+	s.feed.Broadcast(internal.FeedMessage{Type: "failover", Data: event})
+	s.broadcastStatus()
+}
 
-		next(w, r)
+// recordWatchdogRestart records the audit entry of a restart by the watchdog, and the
+// connection event of a successful one, and notifies the dashboards
+func (s *Server) recordWatchdogRestart(restart *internal.WatchdogRestart) {
+	entry := internal.AuditEntry{
+		Action: internal.AuditReconnect,
+		Target: restart.Connection,
+		Result: internal.AuditSuccess,
+		Reason: restart.Reason,
 	}
+	if restart.Error != "" {
+		entry.Result, entry.Reason = internal.AuditFailure, fmt.Sprintf("%s: %s", restart.Reason, restart.Error)
+	} else {
+		s.events.Record(internal.EventConnectionUp, restart.Connection)
+	}
+	s.auditLog.Record(entry)
+	s.feed.Broadcast(internal.FeedMessage{Type: "watchdog", Data: restart})
+	s.broadcastStatus()
 }
 
-// handleLogin handles login form display and processing
-func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		s.showLoginForm(w, r)
+// recordPeerExpiration records the audit entry of the removal of an expired peer from its interface,
+// and notifies the dashboards
+func (s *Server) recordPeerExpiration(expiration *internal.PeerExpiration) {
+	entry := internal.AuditEntry{
+		Action: internal.AuditExpire,
+		Target: expiration.Connection,
+		Result: internal.AuditSuccess,
+		Reason: fmt.Sprintf("peer %s expired at %s", expiration.ID, expiration.Expires.Format(time.RFC3339)),
+	}
+	if expiration.Error != "" {
+		entry.Result, entry.Reason = internal.AuditFailure, fmt.Sprintf("%s: %s", entry.Reason, expiration.Error)
+	}
+	s.auditLog.Record(entry)
+	s.feed.Broadcast(internal.FeedMessage{Type: "peer_expired", Data: expiration})
+	s.broadcastStatus()
+}
 
-	case http.MethodPost:
-		password := r.FormValue("password")
+// recordKeyRotation records the audit entry of the start or the completion of a key rotation,
+// and notifies the dashboards
+func (s *Server) recordKeyRotation(event *internal.KeyRotationEvent) {
+	entry := internal.AuditEntry{
+		Action: internal.AuditRotate,
+		Target: event.Connection,
+		Result: internal.AuditSuccess,
+		Reason: fmt.Sprintf("rotation of the peer %s %s: %s",
+			internal.PeerID(event.OldPublicKey), event.Action, event.Reason),
+	}
+	if event.Error != "" {
+		entry.Result, entry.Reason = internal.AuditFailure, fmt.Sprintf("%s: %s", entry.Reason, event.Error)
+	}
+	s.auditLog.Record(entry)
+	message := fmt.Sprintf("Key rotation of the peer %s of %s %s",
+		internal.PeerID(event.OldPublicKey), event.Connection, event.Action)
+	s.configRepo.Commit("", message)
+	s.configHistory.Record(s.wireguard, "", message, event.Connection)
+	s.feed.Broadcast(internal.FeedMessage{Type: "key_rotation", Data: event})
+}
 
-		// Validate credentials
-		if internal.ValidatePassword(password, s.config.PasswordHash) {
-			s.loginUser(w, r)
-		} else {
-			// Invalid credentials
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			templateData := map[string]any{
-				"Error": "Wrong password",
-			}
-			if err := s.templates.ExecuteTemplate(w, "login.html", templateData); err != nil {
-				log.Printf("Failed to render login template: %v", err)
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			}
-		}
+// recordScheduleRun records the connection events and the audit entry of a schedule run,
+// and notifies the dashboards
+func (s *Server) recordScheduleRun(run *internal.ScheduleRun) {
+	entry := internal.AuditEntry{
+		Action: internal.AuditSchedule,
+		Target: run.Name,
+		Result: internal.AuditSuccess,
+	}
+	if run.Error != "" {
+		entry.Result, entry.Reason = internal.AuditFailure, run.Error
+	} else {
+		s.recordToggleEvents(run.Result)
+	}
+	s.auditLog.Record(entry)
+	s.feed.Broadcast(internal.FeedMessage{Type: "schedule", Data: run})
+	s.broadcastStatus()
+}
 
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// recordToggleEvents records the connection state changes of a toggle, start or stop in the event log
+func (s *Server) recordToggleEvents(result *internal.ToggleResult) {
+	// The status poller may have observed the changes first
+	for _, name := range result.Stopped {
+		s.events.RecordChange(internal.EventConnectionDown, name)
+	}
+	if result.Started != "" {
+		s.events.RecordChange(internal.EventConnectionUp, result.Started)
 	}
 }
 
-func (s *Server) showLoginForm(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	isHTTPS := r.TLS != nil ||
-		r.Header.Get("X-Forwarded-Proto") == "https" ||
-		r.Header.Get("X-Forwarded-Ssl") == "on" ||
-		r.Header.Get("X-Url-Scheme") == "https"
-	templateData := map[string]any{
-		"Error":   "",
-		"IsHTTPS": isHTTPS,
+// recordStatusEvent records the interfaces brought up or down in the event log, including those
+// changed outside of the portal, and notifies the dashboards
+func (s *Server) recordStatusEvent(event *internal.StatusEvent) {
+	switch event.Type {
+	case internal.StatusEventInterfaceUp:
+		s.events.RecordChange(internal.EventConnectionUp, event.Connection)
+	case internal.StatusEventInterfaceDown:
+		s.events.RecordChange(internal.EventConnectionDown, event.Connection)
 	}
-	if err := s.templates.ExecuteTemplate(w, "login.html", templateData); err != nil {
-		log.Printf("Failed to render login template: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	s.feed.BroadcastStatusEvent(internal.FeedMessage{Type: "status_event", Data: event})
+	if event.Type != internal.StatusEventHandshake {
+		s.broadcastStatus()
 	}
 }
 
-func (s *Server) loginUser(w http.ResponseWriter, r *http.Request) {
-	// Create session
-	sessionID, expires, err := s.sessionManager.CreateSession()
-	if err != nil {
-		log.Printf("Failed to create session: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+// handleApplyProfileAPI applies a connection profile to the connection config,
+// restarting the connection when it's active
+func (s *Server) handleApplyProfileAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Set session cookie
-	cookie := &http.Cookie{
-		Name:     "session_id",
-		Value:    sessionID,
-		Expires:  expires,
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
+	var req struct {
+		Profile string `json:"profile"`
 	}
-	http.SetCookie(w, cookie)
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-}
-
-// handleLogout handles user logout
-func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	// Get session cookie and delete session
-	if cookie, err := r.Cookie("session_id"); err == nil {
-		s.sessionManager.DeleteSession(cookie.Value)
+	name := r.PathValue("name")
+	if !s.requireGranted(w, r, name) || s.rejectReadOnly(w) {
+		return
+	}
+	result, err := s.wireguard.ApplyProfile(name, req.Profile)
+	s.recordConfigChange(r, fmt.Sprintf("Apply the profile %s to %s", req.Profile, name), name)
+	if errors.Is(err, internal.ErrConnectionNotFound) || errors.Is(err, internal.ErrProfileNotFound) {
+		s.sendErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to apply connection profile %s to %s: %v", req.Profile, name, err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	// Clear session cookie
-	cookie := &http.Cookie{
-		Name:     "session_id",
-		Value:    "",
-		MaxAge:   -1,
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
+	response := map[string]any{
+		"message":   fmt.Sprintf("Connection profile %s applied to %s", req.Profile, name),
+		"output":    string(result.Output),
+		"restarted": result.Restarted,
 	}
-	http.SetCookie(w, cookie)
 
-	http.Redirect(w, r, "/login", http.StatusSeeOther)
+	s.sendSuccessResponse(w, response)
+	if result.Restarted {
+		s.events.Record(internal.EventConnectionDown, name)
+		s.events.Record(internal.EventConnectionUp, name)
+		s.broadcastStatus()
+	}
 }
 
-// Start starts the HTTP server
-func (s *Server) Start() error {
-	addr := s.config.GetAddress()
-	log.Printf("Starting on http://%s", addr)
-	return http.ListenAndServe(addr, s.mux)
+// handleAllowedIPsAPI returns the allowed IPs of the peers of a connection with the presets on GET,
+// and sets them from a preset or custom CIDRs on PUT, restarting the connection when it's active
+func (s *Server) handleAllowedIPsAPI(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !s.requireGranted(w, r, name) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		peers, err := s.wireguard.ListPeers(name)
+		if err != nil {
+			s.sendPeerError(w, name, err)
+			return
+		}
+		allowedIPs := make([]map[string]any, 0, len(peers))
+		for _, peer := range peers {
+			allowedIPs = append(allowedIPs, map[string]any{
+				"public_key": peer.PublicKey, "id": peer.ID, "allowed_ips": peer.AllowedIPs,
+			})
+		}
+		s.sendSuccessResponse(w, map[string]any{"peers": allowedIPs, "presets": internal.AllowedIPsPresets()})
+	case http.MethodPut:
+		s.setAllowedIPs(w, r, name)
+	default:
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
 }
 
-func main() {
-	// Load configuration
-	config, err := internal.LoadConfig("config.yml")
-	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+func (s *Server) setAllowedIPs(w http.ResponseWriter, r *http.Request, name string) {
+	var spec internal.AllowedIPsSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if s.rejectReadOnly(w) {
+		return
 	}
 
-	server, err := NewServer(config)
+	allowedIPs, result, err := s.wireguard.SetAllowedIPs(name, spec)
+	s.recordConfigChange(r, fmt.Sprintf("Set the allowed IPs of %s", name), name)
+	if errors.Is(err, internal.ErrInvalidAllowedIPs) {
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		log.Fatalf("Failed to create server: %v", err)
+		s.sendPeerError(w, name, err)
+		return
+	}
+
+	s.sendSuccessResponse(w, map[string]any{
+		"message":     fmt.Sprintf("Allowed IPs of %s changed", name),
+		"allowed_ips": allowedIPs,
+		"output":      string(result.Output),
+		"restarted":   result.Restarted,
+	})
+	if result.Restarted {
+		s.events.Record(internal.EventConnectionDown, name)
+		s.events.Record(internal.EventConnectionUp, name)
+		s.broadcastStatus()
+	}
+}
+
+// handleMTUAPI returns the MTU of a connection config and of its interface on GET, and sets it
+// on PUT, live on the interface of an active connection
+func (s *Server) handleMTUAPI(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !s.requireGranted(w, r, name) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		info, err := s.wireguard.GetMTU(name)
+		if err != nil {
+			s.sendPeerError(w, name, err)
+			return
+		}
+		s.sendSuccessResponse(w, info)
+	case http.MethodPut:
+		s.setMTU(w, r, name)
+	default:
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) setMTU(w http.ResponseWriter, r *http.Request, name string) {
+	var req struct {
+		MTU int `json:"mtu"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if s.rejectReadOnly(w) {
+		return
+	}
+
+	result, err := s.wireguard.SetMTU(name, req.MTU)
+	s.recordConfigChange(r, fmt.Sprintf("Set the MTU of %s", name), name)
+	if errors.Is(err, internal.ErrInvalidMTU) {
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.sendPeerError(w, name, err)
+		return
+	}
+
+	s.sendSuccessResponse(w, map[string]any{
+		"message":   fmt.Sprintf("MTU of %s changed", name),
+		"mtu":       req.MTU,
+		"output":    string(result.Output),
+		"restarted": result.Restarted,
+	})
+	if result.Restarted {
+		s.events.Record(internal.EventConnectionDown, name)
+		s.events.Record(internal.EventConnectionUp, name)
+		s.broadcastStatus()
+	}
+}
+
+// handleConfigFileAPI returns the config file of a connection on GET, and saves it
+// on PUT after validating it
+func (s *Server) handleConfigFileAPI(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !s.requireGranted(w, r, name) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		content, err := s.wireguard.ReadConfigFile(name)
+		if err != nil {
+			s.sendConfigFileError(w, name, err)
+			return
+		}
+		s.sendSuccessResponse(w, map[string]any{"name": name, "config": content})
+	case http.MethodPut:
+		s.saveConfigFile(w, r, name)
+	default:
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleValidateConfigAPI reports the errors and warnings of a submitted config, without saving it
+func (s *Server) handleValidateConfigAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Config string `json:"config"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	s.sendSuccessResponse(w, internal.ValidateConfig([]byte(req.Config), s.config.AllowConfigHooks))
+}
+
+// handleImportAPI installs the .conf file uploaded in the "file" field of a multipart form
+// as a new connection, named by the "name" field or else by the file name
+func (s *Server) handleImportAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		s.sendErrorResponse(w, "A .conf file is required in the file field", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	content, err := io.ReadAll(io.LimitReader(file, maxImportSize))
+	if err != nil {
+		s.sendErrorResponse(w, "Failed to read the uploaded file", http.StatusBadRequest)
+		return
+	}
+
+	name := r.FormValue("name")
+	if name == "" {
+		name = header.Filename
+	}
+	name = internal.SanitizeConnectionName(name)
+	if !s.requireGranted(w, r, name) || s.rejectReadOnly(w) {
+		return
+	}
+	report, err := s.wireguard.ImportConfig(name, string(content))
+	s.recordConfigChange(r, fmt.Sprintf("Import %s", name), name)
+	switch {
+	case errors.Is(err, internal.ErrInvalidConfig):
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, internal.ErrConnectionExists):
+		s.sendErrorResponse(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		log.Printf("Failed to import connection %s: %v", name, err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+	default:
+		s.sendSuccessResponse(w, map[string]any{
+			"message":  fmt.Sprintf("Connection %s imported", name),
+			"name":     name,
+			"warnings": report.Warnings,
+		})
+	}
+}
+
+// handleBackupAPI downloads an archive of the configs and the metadata of the granted connections,
+// encrypted when a passphrase is given, which is required when the private keys are encrypted
+func (s *Server) handleBackupAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Passphrase string `json:"passphrase"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	user, _ := internal.UserFromContext(r.Context())
+	archive, err := s.wireguard.ExportBackup(s.callerGrants(r), req.Passphrase)
+	s.audit(r, internal.AuditEntry{Action: internal.AuditBackup, Username: user.Username}, err)
+	switch {
+	case errors.Is(err, internal.ErrBackupPassphrase):
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("Failed to back up the connections: %v", err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	filename := fmt.Sprintf("wg-portal-backup-%s.tar.gz", time.Now().Format("20060102-150405"))
+	if req.Passphrase != "" {
+		filename += ".enc"
+	}
+	// The archive holds the private keys of the connections
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	_, _ = w.Write(archive)
+}
+
+// handleRestoreAPI restores the configs and the metadata of the backup uploaded in the file field,
+// decrypted with the passphrase field. The restored active connections aren't restarted.
+func (s *Server) handleRestoreAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.rejectReadOnly(w) {
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		s.sendErrorResponse(w, "A backup archive is required in the file field", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, internal.MaxBackupSize+1))
+	if err != nil {
+		s.sendErrorResponse(w, "Failed to read the uploaded file", http.StatusBadRequest)
+		return
+	}
+	if len(data) > internal.MaxBackupSize {
+		s.sendErrorResponse(w, fmt.Sprintf("The backup is larger than %d bytes", internal.MaxBackupSize),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	user, _ := internal.UserFromContext(r.Context())
+	result, err := s.wireguard.RestoreBackup(data, r.FormValue("passphrase"), s.callerGrants(r))
+	var restored []string
+	if result != nil {
+		restored = result.Restored
+	}
+	s.recordConfigChange(r, "Restore a backup", restored...)
+	s.audit(r, internal.AuditEntry{Action: internal.AuditRestore, Username: user.Username}, err)
+	switch {
+	case errors.Is(err, internal.ErrInvalidBackup), errors.Is(err, internal.ErrBackupPassphrase):
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, internal.ErrConnectionNotGranted):
+		s.sendErrorResponse(w, err.Error(), http.StatusForbidden)
+	case err != nil:
+		log.Printf("Failed to restore the backup: %v", err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+	default:
+		s.sendSuccessResponse(w, map[string]any{
+			"message": fmt.Sprintf("%d connections restored, %d unchanged", len(result.Restored), len(result.Unchanged)),
+			"result":  result,
+		})
+		s.broadcastStatus()
+	}
+}
+
+// handleCreateInterfaceAPI creates a server interface with a generated key pair, and starts
+// it when requested like the start endpoint does
+func (s *Server) handleCreateInterfaceAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		internal.InterfaceSpec
+		Start bool `json:"start"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if !s.requireGranted(w, r, req.Name) || s.rejectReadOnly(w) {
+		return
+	}
+	created, err := s.wireguard.CreateInterface(req.InterfaceSpec)
+	s.recordConfigChange(r, fmt.Sprintf("Create %s", req.Name), req.Name)
+	switch {
+	case errors.Is(err, internal.ErrInvalidConfig):
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, internal.ErrConnectionExists), errors.Is(err, internal.ErrListenPortUsed):
+		s.sendErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("Failed to create interface %s: %v", req.Name, err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]any{
+		"message":   fmt.Sprintf("Interface %s created", created.Name),
+		"interface": created,
+	}
+	if req.Start {
+		s.startCreatedInterface(r, created.Name, response)
+	}
+	s.sendSuccessResponse(w, response)
+}
+
+// startCreatedInterface starts a created interface, its outcome is added to the response
+func (s *Server) startCreatedInterface(r *http.Request, name string, response map[string]any) {
+	user, _ := internal.UserFromContext(r.Context())
+	result, err := s.wireguard.StartConnection(name, s.callerGrants(r))
+	s.audit(r, internal.AuditEntry{Action: internal.AuditStart, Username: user.Username, Target: name}, err)
+	if err != nil {
+		log.Printf("Failed to start interface %s: %v", name, err)
+		response["start_error"] = err.Error()
+		return
+	}
+	response["output"] = string(result.Output)
+	response["warnings"] = result.Warnings
+	s.recordToggleEvents(result)
+	s.broadcastStatus()
+}
+
+// handleDeleteConnectionAPI deletes a connection once confirmed: without the confirm
+// parameter the request fails with the token to repeat it with
+func (s *Server) handleDeleteConnectionAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.PathValue("name")
+	if !s.requireGranted(w, r, name) || s.rejectReadOnly(w) {
+		return
+	}
+
+	user, _ := internal.UserFromContext(r.Context())
+	result, err := s.wireguard.DeleteConnection(name, r.URL.Query().Get("confirm"), s.callerGrants(r))
+	s.recordConfigChange(r, fmt.Sprintf("Delete %s", name))
+	switch {
+	case errors.Is(err, internal.ErrConfirmationRequired):
+		s.sendErrorResponse(w, err.Error(), http.StatusPreconditionRequired)
+		return
+	case errors.Is(err, internal.ErrConfirmationMismatch):
+		s.sendErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	s.audit(r, internal.AuditEntry{Action: internal.AuditDelete, Username: user.Username, Target: name}, err)
+	if err != nil {
+		s.sendChangeError(w, name, internal.AuditDelete, err)
+		return
+	}
+	s.deleteGrants(name)
+
+	s.sendSuccessResponse(w, map[string]any{
+		"message": fmt.Sprintf("Connection %s deleted", name),
+		"archive": result.Archive,
+		"output":  string(result.Output),
+		"stopped": result.Stopped,
+	})
+	if result.Stopped {
+		s.broadcastStatus()
+	}
+}
+
+// handleRenameConnectionAPI renames a connection, the users and the API tokens granted
+// the connection are granted it under its new name
+func (s *Server) handleRenameConnectionAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.PathValue("name")
+
+	var req struct {
+		Name string `json:"name"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if !s.requireGranted(w, r, name) || s.rejectReadOnly(w) {
+		return
+	}
+	user, _ := internal.UserFromContext(r.Context())
+	result, err := s.wireguard.RenameConnection(name, req.Name)
+	s.recordConfigChange(r, fmt.Sprintf("Rename %s to %s", name, req.Name))
+	s.audit(r, internal.AuditEntry{Action: internal.AuditRename, Username: user.Username, Target: name}, err)
+	if result != nil {
+		s.renameGrants(name, req.Name)
+	}
+	switch {
+	case errors.Is(err, internal.ErrInvalidConfig):
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, internal.ErrConnectionExists):
+		s.sendErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		s.sendChangeError(w, name, internal.AuditRename, err)
+		return
+	}
+
+	response := map[string]any{
+		"message":   fmt.Sprintf("Connection %s renamed to %s", name, req.Name),
+		"output":    string(result.Output),
+		"restarted": result.Restarted,
+	}
+	if _, ok := s.config.Connections[name]; ok {
+		response["warnings"] = []string{fmt.Sprintf("The settings of %s in config.yml must be renamed to %s", name, req.Name)}
+	}
+	s.sendSuccessResponse(w, response)
+	s.broadcastStatus()
+}
+
+// renameGrants grants the renamed connection to the users and the tokens granted it,
+// makes its schedules run on its new name and moves its speed test results and its config history
+func (s *Server) renameGrants(name, newName string) {
+	if err := s.users.RenameConnection(name, newName); err != nil {
+		log.Printf("Failed to rename the connection %s granted to users: %v", name, err)
+	}
+	if err := s.tokens.RenameConnection(name, newName); err != nil {
+		log.Printf("Failed to rename the connection %s granted to tokens: %v", name, err)
+	}
+	if err := s.schedules.RenameConnection(name, newName); err != nil {
+		log.Printf("Failed to rename the connection %s of the schedules: %v", name, err)
+	}
+	if err := s.speedTests.RenameConnection(name, newName); err != nil {
+		log.Printf("Failed to rename the connection %s of the speed tests: %v", name, err)
+	}
+	if err := s.configHistory.RenameConnection(name, newName); err != nil {
+		log.Printf("Failed to rename the connection %s of the config history: %v", name, err)
+	}
+}
+
+// deleteGrants revokes the deleted connection from the users and the tokens granted it,
+// removes its schedules and deletes its speed test results and its config history
+func (s *Server) deleteGrants(name string) {
+	if err := s.users.DeleteConnection(name); err != nil {
+		log.Printf("Failed to revoke the deleted connection %s from users: %v", name, err)
+	}
+	if err := s.tokens.DeleteConnection(name); err != nil {
+		log.Printf("Failed to revoke the deleted connection %s from tokens: %v", name, err)
+	}
+	if err := s.schedules.DeleteConnection(name); err != nil {
+		log.Printf("Failed to delete the schedules of %s: %v", name, err)
+	}
+	if err := s.speedTests.DeleteConnection(name); err != nil {
+		log.Printf("Failed to delete the speed tests of %s: %v", name, err)
+	}
+	if err := s.configHistory.DeleteConnection(name); err != nil {
+		log.Printf("Failed to delete the config history of %s: %v", name, err)
+	}
+}
+
+func (s *Server) saveConfigFile(w http.ResponseWriter, r *http.Request, name string) {
+	var req struct {
+		Config string `json:"config"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if s.rejectReadOnly(w) {
+		return
+	}
+	result, err := s.wireguard.WriteConfigFile(name, req.Config)
+	s.recordConfigChange(r, fmt.Sprintf("Edit the config of %s", name), name)
+	if err != nil {
+		s.sendConfigFileError(w, name, err)
+		return
+	}
+
+	s.sendSuccessResponse(w, map[string]any{
+		"message":   fmt.Sprintf("Config of %s saved", name),
+		"output":    string(result.Output),
+		"restarted": result.Restarted,
+	})
+	if result.Restarted {
+		s.events.Record(internal.EventConnectionDown, name)
+		s.events.Record(internal.EventConnectionUp, name)
+		s.broadcastStatus()
+	}
+}
+
+// handleConfigVersionsAPI lists the versions of the config of a connection, newest first
+func (s *Server) handleConfigVersionsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.PathValue("name")
+	if !s.requireGranted(w, r, name) || !s.requireConfigHistory(w) {
+		return
+	}
+	s.sendSuccessResponse(w, map[string]any{"name": name, "versions": s.configHistory.Versions(name)})
+}
+
+// handleConfigVersionAPI returns a version of the config of a connection with its content
+func (s *Server) handleConfigVersionAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.PathValue("name")
+	if !s.requireGranted(w, r, name) || !s.requireConfigHistory(w) {
+		return
+	}
+	version, ok := s.parseConfigVersion(w, r.PathValue("version"))
+	if !ok {
+		return
+	}
+	found, err := s.configHistory.Version(name, version)
+	if err != nil {
+		s.sendErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.sendSuccessResponse(w, found)
+}
+
+// handleConfigDiffAPI returns the unified diff between two versions of the config of a connection,
+// ?from=1&to=3, to the last version when to is omitted
+func (s *Server) handleConfigDiffAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.PathValue("name")
+	if !s.requireGranted(w, r, name) || !s.requireConfigHistory(w) {
+		return
+	}
+	from, ok := s.parseConfigVersion(w, r.URL.Query().Get("from"))
+	if !ok {
+		return
+	}
+	to := 0
+	if param := r.URL.Query().Get("to"); param != "" {
+		if to, ok = s.parseConfigVersion(w, param); !ok {
+			return
+		}
+	}
+	diff, err := s.configHistory.Diff(name, from, to)
+	if err != nil {
+		s.sendErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.sendSuccessResponse(w, map[string]any{"name": name, "diff": diff})
+}
+
+// handleConfigRollbackAPI saves a version of the config of a connection as its config, restarting
+// the connection when it's active like an edit of the config does
+func (s *Server) handleConfigRollbackAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.PathValue("name")
+	if !s.requireGranted(w, r, name) || !s.requireConfigHistory(w) || s.rejectReadOnly(w) {
+		return
+	}
+	version, ok := s.parseConfigVersion(w, r.PathValue("version"))
+	if !ok {
+		return
+	}
+	found, err := s.configHistory.Version(name, version)
+	if err != nil {
+		s.sendErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	result, err := s.wireguard.WriteConfigFile(name, found.Content)
+	s.recordConfigChange(r, fmt.Sprintf("Roll back %s to version %d", name, version), name)
+	if err != nil {
+		s.sendConfigFileError(w, name, err)
+		return
+	}
+
+	s.sendSuccessResponse(w, map[string]any{
+		"message":   fmt.Sprintf("Config of %s rolled back to version %d", name, version),
+		"output":    string(result.Output),
+		"restarted": result.Restarted,
+	})
+	if result.Restarted {
+		s.events.Record(internal.EventConnectionDown, name)
+		s.events.Record(internal.EventConnectionUp, name)
+		s.broadcastStatus()
+	}
+}
+
+// requireConfigHistory sends 404 when the config history is disabled
+func (s *Server) requireConfigHistory(w http.ResponseWriter) bool {
+	if !s.configHistory.Enabled() {
+		s.sendErrorResponse(w, "The config history is disabled", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// parseConfigVersion parses a version number, sending 400 when it isn't a positive number
+func (s *Server) parseConfigVersion(w http.ResponseWriter, param string) (int, bool) {
+	version, err := strconv.Atoi(param)
+	if err != nil || version <= 0 {
+		s.sendErrorResponse(w, fmt.Sprintf("Invalid version %q", param), http.StatusBadRequest)
+		return 0, false
+	}
+	return version, true
+}
+
+func (s *Server) sendConfigFileError(w http.ResponseWriter, name string, err error) {
+	switch {
+	case errors.Is(err, internal.ErrConnectionNotFound):
+		s.sendErrorResponse(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, internal.ErrInvalidConfig):
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("Failed to save the config of %s: %v", name, err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handlePeersAPI lists the peers of a connection on GET and adds a peer on POST
+func (s *Server) handlePeersAPI(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !s.requireGranted(w, r, name) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		peers, err := s.wireguard.ListPeers(name)
+		if err != nil {
+			s.sendPeerError(w, name, err)
+			return
+		}
+		s.sendSuccessResponse(w, peers)
+	case http.MethodPost:
+		s.changePeer(w, r, "Add a peer to "+name, func(spec internal.PeerSpec) (*internal.PeerResult, error) {
+			return s.wireguard.AddPeer(name, spec)
+		})
+	default:
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handlePeerAPI edits a peer of a connection on PUT and removes it on DELETE,
+// the public key is URL-encoded in the path
+func (s *Server) handlePeerAPI(w http.ResponseWriter, r *http.Request) {
+	name, key := r.PathValue("name"), r.PathValue("key")
+	if !s.requireGranted(w, r, name) {
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		message := fmt.Sprintf("Update the peer %s of %s", internal.PeerID(key), name)
+		s.changePeer(w, r, message, func(spec internal.PeerSpec) (*internal.PeerResult, error) {
+			if spec.PublicKey == "" {
+				spec.PublicKey = key
+			}
+			return s.wireguard.UpdatePeer(name, key, spec)
+		})
+	case http.MethodDelete:
+		if s.rejectReadOnly(w) {
+			return
+		}
+		result, err := s.wireguard.RemovePeer(name, key)
+		s.recordConfigChange(r, fmt.Sprintf("Remove the peer %s from %s", internal.PeerID(key), name), name)
+		s.sendPeerResult(w, name, result, err)
+	default:
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handlePresharedKeyAPI assigns a generated preshared key to a peer on POST, returning it
+// for the other side of the tunnel, and removes the preshared key on DELETE
+func (s *Server) handlePresharedKeyAPI(w http.ResponseWriter, r *http.Request) {
+	name, key := r.PathValue("name"), r.PathValue("key")
+	if !s.requireGranted(w, r, name) {
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.rejectReadOnly(w) {
+		return
+	}
+
+	var presharedKey string
+	if r.Method == http.MethodPost {
+		var err error
+		if presharedKey, err = internal.GeneratePresharedKey(); err != nil {
+			s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	result, err := s.wireguard.SetPresharedKey(name, key, presharedKey)
+	s.recordConfigChange(r, fmt.Sprintf("Set the preshared key of the peer %s of %s", internal.PeerID(key), name), name)
+	if err != nil {
+		s.sendPeerError(w, name, err)
+		return
+	}
+	s.sendSuccessResponse(w, map[string]any{
+		"message":       fmt.Sprintf("Preshared key of the peer of %s changed", name),
+		"preshared_key": presharedKey,
+		"output":        string(result.Output),
+		"applied":       result.Applied,
+	})
+}
+
+// handleKeepaliveAPI returns the persistent keepalive of a peer, configured and live, on GET
+// and sets it on PUT, live on an active connection
+func (s *Server) handleKeepaliveAPI(w http.ResponseWriter, r *http.Request) {
+	name, key := r.PathValue("name"), r.PathValue("key")
+	if !s.requireGranted(w, r, name) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		keepalive, err := s.wireguard.GetPersistentKeepalive(name, key)
+		if err != nil {
+			s.sendPeerError(w, name, err)
+			return
+		}
+		s.sendSuccessResponse(w, keepalive)
+	case http.MethodPut:
+		var req struct {
+			PersistentKeepalive int `json:"persistent_keepalive"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if s.rejectReadOnly(w) {
+			return
+		}
+		result, err := s.wireguard.SetPersistentKeepalive(name, key, req.PersistentKeepalive)
+		s.recordConfigChange(r, fmt.Sprintf("Set the keepalive of the peer %s of %s", internal.PeerID(key), name), name)
+		s.sendPeerResult(w, name, result, err)
+	default:
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handlePeerExpiryAPI sets the expiry time of a peer on PUT, a null expiry removes it.
+// The expired peers are removed from the interface and flagged in the peers.
+func (s *Server) handlePeerExpiryAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, key := r.PathValue("name"), r.PathValue("key")
+	if !s.requireGranted(w, r, name) {
+		return
+	}
+	var req struct {
+		Expires *time.Time `json:"expires"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON, expires must be an RFC 3339 time or null", http.StatusBadRequest)
+		return
+	}
+	if s.rejectReadOnly(w) {
+		return
+	}
+
+	result, err := s.wireguard.SetPeerExpiry(name, key, req.Expires)
+	s.sendPeerResult(w, name, result, err)
+}
+
+// handleRotatePeerKeyAPI starts the rotation of the key of a peer, returning the download link
+// of the client config with the new key. The old key stays valid until the new key completes
+// a handshake or the grace window ends.
+func (s *Server) handleRotatePeerKeyAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, key := r.PathValue("name"), r.PathValue("key")
+	if !s.requireGranted(w, r, name) || s.rejectReadOnly(w) {
+		return
+	}
+
+	user, _ := internal.UserFromContext(r.Context())
+	rotation, err := s.wireguard.RotatePeerKey(name, key)
+	s.recordConfigChange(r, fmt.Sprintf("Rotate the key of the peer %s of %s", internal.PeerID(key), name), name)
+	s.audit(r, internal.AuditEntry{
+		Action: internal.AuditRotate, Username: user.Username, Target: name, Reason: internal.PeerID(key),
+	}, err)
+	if errors.Is(err, internal.ErrRotationPending) {
+		s.sendErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		s.sendPeerError(w, name, err)
+		return
+	}
+
+	s.feed.Broadcast(internal.FeedMessage{Type: "key_rotation", Data: &internal.KeyRotationEvent{
+		KeyRotation: rotation, Action: internal.RotationStarted, Reason: "requested by " + user.Username,
+	}})
+	s.sendSuccessResponse(w, s.keyRotationResponse(rotation))
+}
+
+// handleKeyRotationsAPI lists the pending key rotations of the granted connections
+func (s *Server) handleKeyRotationsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rotations := []map[string]any{}
+	for _, rotation := range s.wireguard.KeyRotations(s.callerGrants(r)) {
+		rotations = append(rotations, s.keyRotationResponse(rotation))
+	}
+	s.sendSuccessResponse(w, rotations)
+}
+
+// keyRotationResponse is the rotation with the download link of the client config with the new key
+func (s *Server) keyRotationResponse(rotation *internal.KeyRotation) map[string]any {
+	return map[string]any{
+		"rotation":   rotation,
+		"config_url": s.apiPath("/peers/" + rotation.NewID + "/config"),
+	}
+}
+
+// handlePeerQRAPI renders the client config of a peer as a QR code, PNG by default or SVG
+// with ?format=svg, to scan with the WireGuard mobile apps
+func (s *Server) handlePeerQRAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.PathValue("name")
+	format := r.URL.Query().Get("format")
+	if !s.requireGranted(w, r, name) {
+		return
+	}
+	if format != "" && format != "png" && format != "svg" {
+		s.sendErrorResponse(w, "format must be png or svg", http.StatusBadRequest)
+		return
+	}
+
+	config, err := s.wireguard.ClientConfig(name, r.PathValue("key"), requestHost(r))
+	if err != nil {
+		s.sendPeerError(w, name, err)
+		return
+	}
+	code, err := internal.EncodeQR(config.Render())
+	if err != nil {
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The code holds the private key of the peer
+	w.Header().Set("Cache-Control", "no-store")
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		_, _ = w.Write(code.SVG())
+		return
+	}
+	pngData, err := code.PNG(qrScale)
+	if err != nil {
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	_, _ = w.Write(pngData)
+}
+
+// handlePeerConfigAPI downloads the client config of a peer, found by its ID
+// in the granted connections
+func (s *Server) handlePeerConfigAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, publicKey, err := s.wireguard.FindPeer(r.PathValue("id"), s.callerGrants(r))
+	if err != nil {
+		s.sendPeerError(w, name, err)
+		return
+	}
+	config, err := s.wireguard.ClientConfig(name, publicKey, requestHost(r))
+	if err != nil {
+		s.sendPeerError(w, name, err)
+		return
+	}
+	// The config holds the private key of the peer
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".conf"))
+	_, _ = w.Write(config.Render())
+}
+
+// requestHost returns the host the portal is reached at, without the port
+func requestHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		return host
+	}
+	return r.Host
+}
+
+// changePeer runs a change of the peer settings of the request body
+func (s *Server) changePeer(w http.ResponseWriter, r *http.Request, message string,
+	change func(spec internal.PeerSpec) (*internal.PeerResult, error)) {
+	var spec internal.PeerSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if s.rejectReadOnly(w) {
+		return
+	}
+	result, err := change(spec)
+	s.recordConfigChange(r, message, r.PathValue("name"))
+	s.sendPeerResult(w, r.PathValue("name"), result, err)
+}
+
+func (s *Server) sendPeerResult(w http.ResponseWriter, name string, result *internal.PeerResult, err error) {
+	if err != nil {
+		s.sendPeerError(w, name, err)
+		return
+	}
+	s.sendSuccessResponse(w, map[string]any{
+		"message":    fmt.Sprintf("Peers of %s changed", name),
+		"public_key": result.PublicKey,
+		"output":     string(result.Output),
+		"applied":    result.Applied,
+	})
+}
+
+func (s *Server) sendPeerError(w http.ResponseWriter, name string, err error) {
+	switch {
+	case errors.Is(err, internal.ErrConnectionNotFound), errors.Is(err, internal.ErrPeerNotFound):
+		s.sendErrorResponse(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, internal.ErrInvalidPeer):
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, internal.ErrPeerExists), errors.Is(err, internal.ErrPeerKeyUnknown):
+		s.sendErrorResponse(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Failed to change the peers of %s: %v", name, err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleKeysAPI generates a key pair for a new peer or interface
+func (s *Server) handleKeysAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	keyPair, err := internal.GenerateKeyPair()
+	if err != nil {
+		log.Printf("Failed to generate a key pair: %v", err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.sendSuccessResponse(w, keyPair)
+}
+
+// handleUsersAPI lists the users on GET and creates a user on POST
+func (s *Server) handleUsersAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.sendSuccessResponse(w, s.users.List())
+	case http.MethodPost:
+		s.createUser(w, r)
+	default:
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	role, err := internal.ParseRole(req.Role)
+	if err != nil {
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.users.Create(req.Username, req.Password, role); err != nil {
+		s.sendUserError(w, err)
+		return
+	}
+
+	log.Printf("User %s created with role %s", req.Username, role)
+	user, _ := s.users.Get(req.Username)
+	s.sendSuccessResponse(w, user)
+}
+
+// handleUserAPI changes the role of a user on PUT and deletes a user on DELETE,
+// the sessions of a deleted user are logged out
+func (s *Server) handleUserAPI(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	switch r.Method {
+	case http.MethodPut:
+		s.setUserRole(w, r, username)
+	case http.MethodDelete:
+		if err := s.users.Delete(username); err != nil {
+			s.sendUserError(w, err)
+			return
+		}
+		s.sessionManager.DeleteUserSessions(username)
+		if err := s.tokens.RevokeUser(username); err != nil {
+			log.Printf("Failed to revoke the tokens of %s: %v", username, err)
+		}
+		log.Printf("User %s deleted", username)
+		s.sendSuccessResponse(w, map[string]any{"message": fmt.Sprintf("User %s deleted", username)})
+	default:
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) setUserRole(w http.ResponseWriter, r *http.Request, username string) {
+	var req struct {
+		Role string `json:"role"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	role, err := internal.ParseRole(req.Role)
+	if err != nil {
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.users.SetRole(username, role); err != nil {
+		s.sendUserError(w, err)
+		return
+	}
+
+	log.Printf("User %s role changed to %s", username, role)
+	user, _ := s.users.Get(username)
+	s.sendSuccessResponse(w, user)
+}
+
+// handleUserConnectionsAPI changes the connections granted to a user,
+// a null list grants all the connections
+func (s *Server) handleUserConnectionsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Connections internal.ConnectionGrants `json:"connections"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	username := r.PathValue("username")
+	if err := s.users.SetConnections(username, req.Connections); err != nil {
+		s.sendUserError(w, err)
+		return
+	}
+
+	log.Printf("User %s granted connections %v", username, req.Connections)
+	user, _ := s.users.Get(username)
+	s.sendSuccessResponse(w, user)
+}
+
+// sendUserError sends the error of a user store change with its status code
+func (s *Server) sendUserError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, internal.ErrUserNotFound):
+		s.sendErrorResponse(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, internal.ErrInvalidUser), errors.Is(err, internal.ErrInvalidGrants):
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, internal.ErrUserExists),
+		errors.Is(err, internal.ErrUserConfigured),
+		errors.Is(err, internal.ErrLastAdmin):
+		s.sendErrorResponse(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Failed to change users: %v", err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleSettings serves the account settings page
+func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
+	user, _ := internal.UserFromContext(r.Context())
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	templateData := map[string]any{
+		"APIPrefix": s.config.APIPrefix,
+		"CSRFToken": internal.CSRFTokenFromContext(r.Context()),
+		"Username":  user.Username,
+	}
+	if err := s.templates.ExecuteTemplate(w, "settings.html", templateData); err != nil {
+		log.Printf("Failed to render settings template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// handlePasswordAPI changes the password of the current user
+func (s *Server) handlePasswordAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	s.changePassword(w, r, req.CurrentPassword, req.NewPassword)
+}
+
+// changePassword replaces the password of the current user, wrong current passwords count
+// as failed logins. The other sessions of the user are signed out.
+func (s *Server) changePassword(w http.ResponseWriter, r *http.Request, current, password string) {
+	user, _ := internal.UserFromContext(r.Context())
+	addr := s.config.ProxyAuth.ClientAddr(r)
+	if wait := s.loginLimiter.Locked(addr, user.Username); wait > 0 {
+		setRetryAfter(w, wait)
+		s.sendErrorResponse(w, "Too many failed attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	err := s.users.ChangePassword(user.Username, current, password)
+	switch {
+	case errors.Is(err, internal.ErrWrongPassword):
+		s.failAuth(addr, user.Username)
+		s.audit(r, internal.AuditEntry{Action: internal.AuditAuth, Username: user.Username, Target: "password_change"},
+			err)
+		s.sendErrorResponse(w, err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, internal.ErrInvalidUser), errors.Is(err, internal.ErrInvalidGrants):
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("Failed to change the password of %s: %v", user.Username, err)
+		s.sendErrorResponse(w, "Failed to change password", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s changed their password", user.Username)
+	s.sessionManager.DeleteUserSessions(user.Username)
+	sessionID, err := s.startSession(w, r, user.Username)
+	if err != nil {
+		log.Printf("Failed to create session: %v", err)
+	}
+	// The page continues with the new session, and so its CSRF token
+	s.sendSuccessResponse(w, map[string]any{
+		"message":    "Password changed",
+		"csrf_token": s.sessionManager.CSRFToken(sessionID),
+	})
+}
+
+// handleTOTPEnrollAPI starts the two-factor enrollment of the current user,
+// returning the secret to add to an authenticator app
+func (s *Server) handleTOTPEnrollAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, _ := internal.UserFromContext(r.Context())
+	secret, err := s.users.EnrollTOTP(user.Username)
+	if err != nil {
+		s.sendTOTPError(w, err)
+		return
+	}
+
+	s.sendSuccessResponse(w, map[string]any{
+		"secret": secret,
+		"uri":    internal.TOTPURI("wg-portal", user.Username, secret),
+	})
+}
+
+// handleTOTPConfirmAPI enables the enrolled two-factor authentication with a code of the
+// authenticator app, returning the recovery codes
+func (s *Server) handleTOTPConfirmAPI(w http.ResponseWriter, r *http.Request) {
+	user, code, ok := s.decodeTOTPRequest(w, r)
+	if !ok {
+		return
+	}
+
+	recoveryCodes, err := s.users.ConfirmTOTP(user.Username, code)
+	if err != nil {
+		s.sendTOTPError(w, err)
+		return
+	}
+
+	log.Printf("User %s enabled two-factor authentication", user.Username)
+	s.sendSuccessResponse(w, map[string]any{"recovery_codes": recoveryCodes})
+}
+
+// handleRecoveryCodesAPI replaces the recovery codes of the current user
+func (s *Server) handleRecoveryCodesAPI(w http.ResponseWriter, r *http.Request) {
+	user, code, ok := s.decodeTOTPRequest(w, r)
+	if !ok {
+		return
+	}
+
+	recoveryCodes, err := s.users.RegenerateRecoveryCodes(user.Username, code)
+	if err != nil {
+		s.sendTOTPError(w, err)
+		return
+	}
+
+	s.sendSuccessResponse(w, map[string]any{"recovery_codes": recoveryCodes})
+}
+
+// handleTOTPDisableAPI turns off the two-factor authentication of the current user
+func (s *Server) handleTOTPDisableAPI(w http.ResponseWriter, r *http.Request) {
+	user, code, ok := s.decodeTOTPRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.users.DisableTOTP(user.Username, code); err != nil {
+		s.sendTOTPError(w, err)
+		return
+	}
+
+	log.Printf("User %s disabled two-factor authentication", user.Username)
+	s.sendSuccessResponse(w, map[string]any{"message": "Two-factor authentication disabled"})
+}
+
+// decodeTOTPRequest reads the code of a POST request of the current user,
+// replying with the error when the request is invalid
+func (s *Server) decodeTOTPRequest(w http.ResponseWriter, r *http.Request) (*internal.User, string, bool) {
+	if r.Method != http.MethodPost {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, "", false
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	user, _ := internal.UserFromContext(r.Context())
+	return user, req.Code, true
+}
+
+// sendTOTPError sends the error of a two-factor change with its status code
+func (s *Server) sendTOTPError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, internal.ErrInvalidCode):
+		s.sendErrorResponse(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, internal.ErrTOTPEnabled),
+		errors.Is(err, internal.ErrTOTPNotEnabled),
+		errors.Is(err, internal.ErrTOTPNotEnrolled):
+		s.sendErrorResponse(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Failed to change two-factor authentication: %v", err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleAuditAPI queries the audit log, newest entries first. The username and action
+// parameters filter the entries, since (RFC 3339) skips the older ones and limit caps their number.
+func (s *Server) handleAuditAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := parseAuditQuery(r)
+	if err != nil {
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := s.auditLog.Query(query)
+	if err != nil {
+		log.Printf("Failed to query the audit log: %v", err)
+		s.sendErrorResponse(w, "Failed to query the audit log", http.StatusInternalServerError)
+		return
+	}
+	s.sendSuccessResponse(w, entries)
+}
+
+func parseAuditQuery(r *http.Request) (internal.AuditQuery, error) {
+	params := r.URL.Query()
+	query := internal.AuditQuery{Username: params.Get("username"), Action: params.Get("action")}
+	if since := params.Get("since"); since != "" {
+		parsed, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return query, errors.New("since must be an RFC 3339 time")
+		}
+		query.Since = parsed
+	}
+	if limit := params.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed <= 0 {
+			return query, errors.New("limit must be a positive number")
+		}
+		query.Limit = parsed
+	}
+	return query, nil
+}
+
+// audit records an action of the request in the audit log, err is the failure of the action
+func (s *Server) audit(r *http.Request, entry internal.AuditEntry, err error) {
+	// The failed logins record the submitted username, whatever its length
+	entry.Username = entry.Username[:min(len(entry.Username), maxAuditUsernameLength)]
+	entry.IP = s.config.ProxyAuth.ClientAddr(r)
+	entry.Result = internal.AuditSuccess
+	if err != nil {
+		entry.Result = internal.AuditFailure
+		entry.Reason = err.Error()
+	}
+	s.auditLog.Record(entry)
+}
+
+// handleLockoutsAPI lists the client addresses and accounts locked out by their failed logins
+func (s *Server) handleLockoutsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.sendSuccessResponse(w, s.loginLimiter.Lockouts())
+}
+
+// handleLockoutAPI unlocks a client address (kind addr) or an account (kind user) before its lockout ends
+func (s *Server) handleLockoutAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	kind, value := r.PathValue("kind"), r.PathValue("value")
+	err := s.loginLimiter.Unlock(kind, value)
+	if errors.Is(err, internal.ErrLockoutNotFound) {
+		s.sendErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to unlock %s %s: %v", kind, value, err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user, _ := internal.UserFromContext(r.Context())
+	log.Printf("User %s unlocked %s %s", user.Username, kind, value)
+	s.sendSuccessResponse(w, map[string]any{"message": fmt.Sprintf("Unlocked %s %s", kind, value)})
+}
+
+// handleSessionsAPI lists the active sessions of the current user on GET,
+// and logs the user out everywhere on DELETE
+func (s *Server) handleSessionsAPI(w http.ResponseWriter, r *http.Request) {
+	user, _ := internal.UserFromContext(r.Context())
+	switch r.Method {
+	case http.MethodGet:
+		s.listSessions(w, r, user)
+	case http.MethodDelete:
+		s.sessionManager.DeleteUserSessions(user.Username)
+		s.audit(r, internal.AuditEntry{Action: internal.AuditLogout, Username: user.Username, Target: "everywhere"}, nil)
+		s.setCookie(w, s.sessionCookieName(), "", time.Time{})
+		s.setCookie(w, s.rememberCookieName(), "", time.Time{})
+		log.Printf("User %s logged out everywhere", user.Username)
+		s.sendSuccessResponse(w, map[string]any{"message": "Logged out everywhere"})
+	default:
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request, user *internal.User) {
+	var current string
+	if cookie, err := r.Cookie(s.sessionCookieName()); err == nil {
+		current = cookie.Value
+	}
+	sessions, err := s.sessionManager.ListUserSessions(user.Username, current)
+	if err != nil {
+		log.Printf("Failed to list the sessions of %s: %v", user.Username, err)
+		s.sendErrorResponse(w, "Failed to list sessions", http.StatusInternalServerError)
+		return
+	}
+	s.sendSuccessResponse(w, sessions)
+}
+
+// handleSessionAPI revokes a session of the current user
+func (s *Server) handleSessionAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, _ := internal.UserFromContext(r.Context())
+	id := r.PathValue("id")
+	err := s.sessionManager.RevokeSession(user.Username, id)
+	if errors.Is(err, internal.ErrSessionNotFound) {
+		s.sendErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to revoke session: %v", err)
+		s.sendErrorResponse(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s revoked a session", user.Username)
+	s.sendSuccessResponse(w, map[string]any{"message": "Session revoked"})
+}
+
+// handleTokensAPI lists the API tokens of the current user on GET and creates one on POST,
+// the created token is only returned once
+func (s *Server) handleTokensAPI(w http.ResponseWriter, r *http.Request) {
+	user, _ := internal.UserFromContext(r.Context())
+	switch r.Method {
+	case http.MethodGet:
+		s.sendSuccessResponse(w, s.tokens.List(user.Username))
+	case http.MethodPost:
+		s.createToken(w, r, user)
+	default:
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) createToken(w http.ResponseWriter, r *http.Request, user *internal.User) {
+	var req struct {
+		Name  string `json:"name"`
+		Scope string `json:"scope"`
+		// Connections restricts the connections of the token, all those of the user when unset
+		Connections internal.ConnectionGrants `json:"connections"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(req.Name) == "" {
+		s.sendErrorResponse(w, "Token name is required", http.StatusBadRequest)
+		return
+	}
+
+	scope, err := internal.ParseScope(req.Scope)
+	if err != nil {
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	secret, token, err := s.tokens.Create(user.Username, req.Name, scope, req.Connections)
+	if errors.Is(err, internal.ErrInvalidGrants) {
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create token: %v", err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s created API token %s", user.Username, token.ID)
+	s.sendSuccessResponse(w, map[string]any{"token": secret, "details": token})
+}
+
+// handleTokenAPI revokes an API token of the current user
+func (s *Server) handleTokenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, _ := internal.UserFromContext(r.Context())
+	id := r.PathValue("id")
+	err := s.tokens.Revoke(user.Username, id)
+	if errors.Is(err, internal.ErrTokenNotFound) {
+		s.sendErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to revoke token: %v", err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s revoked API token %s", user.Username, id)
+	s.sendSuccessResponse(w, map[string]any{"message": fmt.Sprintf("Token %s revoked", id)})
+}
+
+// handleSchedulesAPI lists the schedules on GET and creates one on POST
+func (s *Server) handleSchedulesAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.sendSuccessResponse(w, s.schedules.List())
+	case http.MethodPost:
+		s.saveSchedule(w, r, "")
+	default:
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleScheduleAPI returns a schedule on GET, replaces it on PUT and deletes it on DELETE
+func (s *Server) handleScheduleAPI(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	switch r.Method {
+	case http.MethodGet:
+		schedule, err := s.schedules.Get(id)
+		if err != nil {
+			s.sendScheduleError(w, err)
+			return
+		}
+		s.sendSuccessResponse(w, schedule)
+	case http.MethodPut:
+		s.saveSchedule(w, r, id)
+	case http.MethodDelete:
+		if err := s.schedules.Delete(id); err != nil {
+			s.sendScheduleError(w, err)
+			return
+		}
+		log.Printf("Schedule %s deleted", id)
+		s.sendSuccessResponse(w, map[string]any{"message": fmt.Sprintf("Schedule %s deleted", id)})
+	default:
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// saveSchedule creates a schedule, or replaces the schedule of the ID
+func (s *Server) saveSchedule(w http.ResponseWriter, r *http.Request, id string) {
+	var spec internal.ScheduleSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var schedule *internal.Schedule
+	var err error
+	if id == "" {
+		schedule, err = s.schedules.Create(spec)
+	} else {
+		schedule, err = s.schedules.Update(id, spec)
+	}
+	if err != nil {
+		s.sendScheduleError(w, err)
+		return
+	}
+	log.Printf("Schedule %s saved", schedule.ID)
+	s.sendSuccessResponse(w, schedule)
+}
+
+func (s *Server) sendScheduleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, internal.ErrScheduleNotFound):
+		s.sendErrorResponse(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, internal.ErrInvalidSchedule):
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("Failed to change schedules: %v", err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleCapabilitiesAPI returns the optional features enabled on this portal
+func (s *Server) handleCapabilitiesAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.sendSuccessResponse(w, s.config.Capabilities())
+}
+
+// handleEventsAPI returns the recent connection events as a JSON Feed,
+// clients polling with If-None-Match get 304 until a new event is recorded
+func (s *Server) handleEventsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	feed, etag := s.events.JSONFeed()
+	grants := s.callerGrants(r)
+	feed.Items = slices.DeleteFunc(feed.Items, func(item *internal.JSONFeedItem) bool {
+		return !grants.Allows(item.Event.Connection)
+	})
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/feed+json")
+	_ = json.NewEncoder(w).Encode(feed)
+}
+
+// handlePeerStatsAPI returns the endpoint, the allowed IPs, the transfer and the latest
+// handshake of the peers of the active connections
+func (s *Server) handlePeerStatsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	peers, err := s.wireguard.GetPeerStats(s.callerGrants(r))
+	if err != nil {
+		log.Printf("Failed to get peer stats: %v", err)
+		s.sendErrorResponse(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.sendSuccessResponse(w, peers)
+}
+
+// handleTrafficAPI returns the transfer history of the connections and their peers
+// over the period of the period parameter: day (default), week or month
+func (s *Server) handleTrafficAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "day"
+	}
+	usage, err := s.traffic.Usage(period, s.callerGrants(r))
+	if errors.Is(err, internal.ErrInvalidPeriod) {
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read traffic history: %v", err)
+		s.sendErrorResponse(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.sendSuccessResponse(w, usage)
+}
+
+// handleTimeseriesAPI returns the transfer rates of the interface parameter over the range
+// parameter (24h by default) at each step parameter (5m by default), for the dashboard charts
+func (s *Server) handleTimeseriesAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	name := query.Get("interface")
+	if name == "" {
+		s.sendErrorResponse(w, "Interface is required", http.StatusBadRequest)
+		return
+	}
+	if !s.requireGranted(w, r, name) {
+		return
+	}
+	span, err := internal.ParseSpan(cmp.Or(query.Get("range"), "24h"))
+	var step time.Duration
+	if err == nil {
+		step, err = internal.ParseSpan(cmp.Or(query.Get("step"), "5m"))
+	}
+	var series *internal.Timeseries
+	if err == nil {
+		series, err = s.traffic.Timeseries(name, span, step)
+	}
+	if errors.Is(err, internal.ErrInvalidTimeseries) {
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read traffic history: %v", err)
+		s.sendErrorResponse(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.sendSuccessResponse(w, series)
+}
+
+// handleLatencyAPI returns the latest latency and packet loss of the connections
+func (s *Server) handleLatencyAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.sendSuccessResponse(w, s.wireguard.GetLatency(s.callerGrants(r)))
+}
+
+// handleFailoverAPI returns the failover list, the unhealthy active connection and the last switch
+func (s *Server) handleFailoverAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.sendSuccessResponse(w, s.failover.State())
+}
+
+// handleWatchdogAPI returns the granted connections kept up by the watchdog and their restarts
+func (s *Server) handleWatchdogAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.sendSuccessResponse(w, s.watchdog.State(s.callerGrants(r)))
+}
+
+// broadcastStatus pushes the status to the dashboard right away, skipping the coalescing
+func (s *Server) broadcastStatus() {
+	status, err := s.wireguard.GetStatus(nil)
+	if err != nil {
+		log.Printf("Failed to get status: %v", err)
+		return
+	}
+	s.feed.FlushStatus(map[string]any{"status": status})
+}
+
+// handleCompareAPI returns the differences between the configs of two connections
+func (s *Server) handleCompareAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	a, b := r.URL.Query().Get("a"), r.URL.Query().Get("b")
+	if a == "" || b == "" {
+		s.sendErrorResponse(w, "Connection names a and b are required", http.StatusBadRequest)
+		return
+	}
+	if !s.requireGranted(w, r, a, b) {
+		return
+	}
+
+	differences, err := s.wireguard.CompareConnections(a, b)
+	if errors.Is(err, internal.ErrConnectionNotFound) {
+		s.sendErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to compare connections %s and %s: %v", a, b, err)
+		s.sendErrorResponse(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.sendSuccessResponse(w, differences)
+}
+
+// handleStatusAPI returns WireGuard status information
+func (s *Server) handleStatusAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	grants := s.callerGrants(r)
+	status, err := s.wireguard.GetStatus(grants)
+	if err != nil {
+		log.Printf("Failed to get status: %v", err)
+		s.sendErrorResponse(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+
+	activity, err := s.wireguard.GetLastActivity()
+	if err != nil {
+		log.Printf("Failed to get last activity: %v", err)
+		s.sendErrorResponse(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	maps.DeleteFunc(activity, func(name string, _ *time.Time) bool { return !grants.Allows(name) })
+
+	response := map[string]any{
+		"status":        status,
+		"last_activity": activity,
+		"maintenance":   s.maintenance.State(),
+		"read_only":     s.readOnly.State(),
+	}
+
+	s.sendSuccessResponse(w, response)
+	// The status of a restricted caller doesn't cover all the connections of the dashboards
+	if !grants.Restricted() {
+		s.feed.PublishStatus(response)
+	}
+}
+
+// handleRouteConflictsAPI reports connections routing overlapping AllowedIPs
+func (s *Server) handleRouteConflictsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	activeOnly := r.URL.Query().Get("active") == "true"
+	conflicts, err := s.wireguard.FindRouteConflicts(activeOnly)
+	if err != nil {
+		log.Printf("Failed to find route conflicts: %v", err)
+		s.sendErrorResponse(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+
+	grants := s.callerGrants(r)
+	conflicts = slices.DeleteFunc(conflicts, func(conflict *internal.RouteConflict) bool {
+		return !grants.Allows(conflict.Connection) || !grants.Allows(conflict.OtherConnection)
+	})
+
+	s.sendSuccessResponse(w, conflicts)
+}
+
+// handleDNSLeakAPI resolves a test name through the resolvers of the host and the DNS servers
+// of the active connections, reporting which answered and whether they're routed through a tunnel
+func (s *Server) handleDNSLeakAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := s.wireguard.TestDNSLeak(s.callerGrants(r))
+	if errors.Is(err, internal.ErrNoActiveConnection) {
+		s.sendErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to test DNS leaks: %v", err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.sendSuccessResponse(w, result)
+}
+
+// handleTunnelRoutesAPI returns the routes installed through the interfaces of the active
+// connections and the routing rules looking up their tables
+func (s *Server) handleTunnelRoutesAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := s.wireguard.TunnelRoutes(s.callerGrants(r))
+	switch {
+	case errors.Is(err, internal.ErrNoActiveConnection):
+		s.sendErrorResponse(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errors.ErrUnsupported):
+		s.sendErrorResponse(w, "Reading the routes is only supported on Linux", http.StatusNotImplemented)
+	case err != nil:
+		log.Printf("Failed to read the routes of the tunnels: %v", err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+	default:
+		s.sendSuccessResponse(w, result)
+	}
+}
+
+// handleTunnelFirewallAPI returns the iptables and nftables rules affecting the traffic of the
+// active connections, like the fwmark and masquerade rules of wg-quick and of the config hooks
+func (s *Server) handleTunnelFirewallAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := s.wireguard.TunnelFirewall(s.callerGrants(r))
+	if errors.Is(err, internal.ErrNoActiveConnection) {
+		s.sendErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read the firewall rules of the tunnels: %v", err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.sendSuccessResponse(w, result)
+}
+
+// handleSpeedTestAPI measures the throughput through the requested active connection,
+// or the only active one without a connection
+func (s *Server) handleSpeedTestAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.speedTests.Enabled() {
+		s.sendErrorResponse(w, "Speed tests are not configured", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Connection string `json:"connection"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		s.sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Connection != "" && !s.requireGranted(w, r, req.Connection) {
+		return
+	}
+
+	result, err := s.speedTests.Run(s.wireguard, req.Connection, s.callerGrants(r))
+	switch {
+	case errors.Is(err, internal.ErrAmbiguousConnection):
+		s.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, internal.ErrSpeedTestRunning), errors.Is(err, internal.ErrNoActiveConnection),
+		errors.Is(err, internal.ErrConnectionNotActive):
+		s.sendErrorResponse(w, err.Error(), http.StatusConflict)
+	case err != nil && result == nil:
+		log.Printf("Failed to run a speed test: %v", err)
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+	default:
+		if err != nil {
+			log.Printf("Failed to record a speed test: %v", err)
+		}
+		s.sendSuccessResponse(w, result)
+	}
+}
+
+// handleSpeedTestsAPI returns the speed test results of the granted connections,
+// or of the connection parameter
+func (s *Server) handleSpeedTestsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("connection")
+	if name != "" && !s.requireGranted(w, r, name) {
+		return
+	}
+
+	s.sendSuccessResponse(w, s.speedTests.Histories(name, s.callerGrants(r)))
+}
+
+// handleKillSwitchAPI returns the kill switch state on GET and enables or disables it on POST
+func (s *Server) handleKillSwitchAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.sendSuccessResponse(w, s.killSwitchState())
+	case http.MethodPost:
+		s.setKillSwitch(w, r)
+	default:
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) setKillSwitch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	change, target := s.killSwitch.Disable, "disable"
+	if req.Enabled {
+		change, target = s.killSwitch.Enable, "enable"
+	}
+	output, err := change()
+	user, _ := internal.UserFromContext(r.Context())
+	s.audit(r, internal.AuditEntry{Action: internal.AuditKillSwitch, Username: user.Username, Target: target}, err)
+	if errors.Is(err, internal.ErrKillSwitchNotConfigured) {
+		s.sendErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to change kill switch: %v (output: %s)", err, string(output))
+		s.sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	state := s.killSwitchState()
+	s.feed.Broadcast(internal.FeedMessage{Type: "kill_switch", Data: state})
+	state["output"] = string(output)
+	s.sendSuccessResponse(w, state)
+}
+
+func (s *Server) killSwitchState() map[string]any {
+	return map[string]any{
+		"configured": s.killSwitch.Configured(),
+		"enabled":    s.killSwitch.Enabled(),
+	}
+}
+
+// handleMaintenanceStartAPI pauses the automated connection management,
+// for the requested duration or the configured default
+func (s *Server) handleMaintenanceStartAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := struct {
+		DurationSeconds int `json:"duration_seconds"`
+	}{DurationSeconds: s.config.MaintenanceSeconds}
+
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.DurationSeconds <= 0 {
+		s.sendErrorResponse(w, "Duration must be positive", http.StatusBadRequest)
+		return
+	}
+
+	duration := time.Duration(req.DurationSeconds) * time.Second
+	s.maintenance.Start(duration, s.recordMaintenanceEnd)
+	state := s.maintenance.State()
+	log.Printf("Maintenance window started until %s", state.Until.Format(time.RFC3339))
+	user, _ := internal.UserFromContext(r.Context())
+	s.audit(r, internal.AuditEntry{
+		Action:   internal.AuditMaintenance,
+		Username: user.Username,
+		Target:   "start",
+		Reason:   fmt.Sprintf("for %s, until %s", duration, state.Until.Format(time.RFC3339)),
+	}, nil)
+	s.feed.Broadcast(internal.FeedMessage{Type: "maintenance", Data: state})
+	s.sendSuccessResponse(w, state)
+}
+
+// handleMaintenanceStopAPI resumes the automated connection management
+func (s *Server) handleMaintenanceStopAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.maintenance.Stop()
+	state := s.maintenance.State()
+	log.Printf("Maintenance window stopped")
+	user, _ := internal.UserFromContext(r.Context())
+	s.audit(r, internal.AuditEntry{Action: internal.AuditMaintenance, Username: user.Username, Target: "stop"}, nil)
+	s.feed.Broadcast(internal.FeedMessage{Type: "maintenance", Data: state})
+	s.sendSuccessResponse(w, state)
+}
+
+// recordMaintenanceEnd records the audit entry of the end of a maintenance window by itself,
+// and notifies the dashboards
+func (s *Server) recordMaintenanceEnd() {
+	log.Printf("Maintenance window ended")
+	s.auditLog.Record(internal.AuditEntry{
+		Action: internal.AuditMaintenance,
+		Target: "end",
+		Result: internal.AuditSuccess,
+	})
+	s.feed.Broadcast(internal.FeedMessage{Type: "maintenance", Data: s.maintenance.State()})
+}
+
+// handleReadOnlyAPI returns the read-only mode on GET and enables or disables it on POST
+func (s *Server) handleReadOnlyAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.sendSuccessResponse(w, s.readOnly.State())
+	case http.MethodPost:
+		s.setReadOnly(w, r)
+	default:
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) setReadOnly(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	s.readOnly.Set(req.Enabled)
+	state := s.readOnly.State()
+	user, _ := internal.UserFromContext(r.Context())
+	log.Printf("User %s set read-only mode to %t", user.Username, state.Enabled)
+	s.feed.Broadcast(internal.FeedMessage{Type: "read_only", Data: state})
+	s.sendSuccessResponse(w, state)
+}
+
+// rejectReadOnly sends 423 when the portal is in read-only mode
+func (s *Server) rejectReadOnly(w http.ResponseWriter) bool {
+	if !s.readOnly.Enabled() {
+		return false
+	}
+	s.sendErrorResponse(w, internal.ErrReadOnly.Error(), http.StatusLocked)
+	return true
+}
+
+// handleFeed upgrades to a websocket connection pushing live updates to the dashboard
+func (s *Server) handleFeed(w http.ResponseWriter, r *http.Request) {
+	// Users authenticated by a client certificate or a trusted proxy have no session to watch
+	var sessionID string
+	if _, _, external := s.externalIdentity(r); !external {
+		cookie, err := r.Cookie(s.sessionCookieName())
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		sessionID = cookie.Value
+	}
+
+	// The status broadcasts cover all the connections, restricted users poll their own status
+	statusUpdates := !s.callerGrants(r).Restricted()
+	if err := s.feed.Serve(w, r, sessionID, statusUpdates); err != nil {
+		log.Printf("Failed to serve websocket feed: %v", err)
+	}
+}
+
+// sendSuccessResponse sends a JSON success response
+func (*Server) sendSuccessResponse(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(APIResponse{
+		Success: true,
+		Data:    data,
+	})
+}
+
+// sendErrorResponse sends a JSON error response
+func (*Server) sendErrorResponse(w http.ResponseWriter, message string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(APIResponse{
+		Success: false,
+		Error:   message,
+	})
+}
+
+// withResponseHeaders middleware adds the configured response headers,
+// handlers setting the same headers take precedence
+func (s *Server) withResponseHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range s.config.ResponseHeaders {
+			w.Header().Set(name, value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withIPFilter middleware rejects the clients the IP filter doesn't allow, before any route
+func (s *Server) withIPFilter(next http.Handler) http.Handler {
+	if !s.config.IPFilter.Configured() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.config.IPFilter.Allows(s.config.ProxyAuth.ClientAddr(r)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireRole middleware checks for valid authentication of a user with (at least) the role,
+// the authenticated user is added to the request context
+func (s *Server) requireRole(role internal.Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			s.serveToken(w, r, bearer, role, next)
+			return
+		}
+		if _, _, ok := r.BasicAuth(); ok && s.config.APIBasicAuth && s.isAPIRequest(r) {
+			s.serveBasicAuth(w, r, role, next)
+			return
+		}
+
+		user, sessionID, ok := s.requestUser(w, r)
+		if !ok {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		if !s.validCSRF(r, sessionID) {
+			s.sendErrorResponse(w, "Invalid CSRF token, reload the page", http.StatusForbidden)
+			return
+		}
+
+		if !user.Role.Allows(role) {
+			s.sendErrorResponse(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		ctx := internal.WithCSRFToken(internal.WithUser(r.Context(), user), s.sessionManager.CSRFToken(sessionID))
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// serveBasicAuth serves an API request authenticated with HTTP Basic credentials,
+// which count for the login limit like the login form. Browsers may send cached
+// credentials on their own, so the requests must come from the portal origin.
+func (s *Server) serveBasicAuth(w http.ResponseWriter, r *http.Request, role internal.Role, next http.HandlerFunc) {
+	username, password, _ := r.BasicAuth()
+	if !s.multiUser() {
+		username = internal.DefaultUsername
+	}
+	addr := s.config.ProxyAuth.ClientAddr(r)
+	entry := internal.AuditEntry{Action: internal.AuditAuth, Username: username, Target: "basic"}
+	if wait := s.loginLimiter.Locked(addr, username); wait > 0 {
+		s.audit(r, entry, errLockedOut)
+		seconds := setRetryAfter(w, wait)
+		s.sendErrorResponse(w, fmt.Sprintf("Too many failed logins, try again in %d seconds", seconds),
+			http.StatusTooManyRequests)
+		return
+	}
+	if !s.validCSRF(r, "") {
+		s.sendErrorResponse(w, "Cross-origin request rejected", http.StatusForbidden)
+		return
+	}
+
+	user, ok := s.authenticatePassword(username, password)
+	if !ok {
+		s.failAuth(addr, username)
+		s.audit(r, entry, errWrongCredentials)
+		s.sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if user.TOTPEnabled() {
+		s.sendErrorResponse(w, "Accounts with two-factor authentication must use an API token",
+			http.StatusForbidden)
+		return
+	}
+	if !user.Role.Allows(role) {
+		s.sendErrorResponse(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	s.loginLimiter.Reset(user.Username)
+	next(w, r.WithContext(internal.WithUser(r.Context(), user)))
+}
+
+// isAPIRequest reports whether the request is for an API route
+func (s *Server) isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, s.config.APIPrefix+"/")
+}
+
+// validCSRF checks a state-changing request of the session carries the CSRF token of the session,
+// in the header or the form field. Requests without a session (the login form, the users of
+// a trusted proxy) are checked to come from the portal origin instead.
+// API tokens aren't sent by browsers on their own, so their requests aren't checked.
+func (s *Server) validCSRF(r *http.Request, sessionID string) bool {
+	if sessionID == "" {
+		return s.crossOrigin.Check(r) == nil
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.PostFormValue(csrfField)
+	}
+	return s.sessionManager.ValidCSRFToken(sessionID, token)
+}
+
+// serveToken serves a request authenticated with an API token, the route must be
+// allowed by both the role of the token user and the token scope
+func (s *Server) serveToken(
+	w http.ResponseWriter, r *http.Request, bearer string, role internal.Role, next http.HandlerFunc,
+) {
+	token, valid := s.tokens.Authenticate(bearer)
+	var user *internal.User
+	if valid {
+		user, valid = s.users.Get(token.Username)
+	}
+	if !valid {
+		s.audit(r, internal.AuditEntry{Action: internal.AuditAuth, Target: "token"}, errWrongCredentials)
+		s.sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !user.Role.Allows(role) || !token.Scope.Allows(role, r.Method) {
+		s.sendErrorResponse(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	ctx := internal.WithToken(internal.WithUser(r.Context(), user), token)
+	next(w, r.WithContext(ctx))
+}
+
+// requireAccount middleware checks for a logged in user managing their own account,
+// which API tokens can't do whatever their scope
+func (s *Server) requireAccount(next http.HandlerFunc) http.HandlerFunc {
+	return s.requireRole(internal.RoleViewer, func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := internal.TokenFromContext(r.Context()); ok {
+			s.sendErrorResponse(w, "API tokens can't manage the account", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// requestUser returns the user of a client certificate or asserted by a trusted proxy, or else
+// the user of the request session with the session ID (empty for the users without session)
+func (s *Server) requestUser(w http.ResponseWriter, r *http.Request) (*internal.User, string, bool) {
+	username, role, ok := s.externalIdentity(r)
+	if !ok {
+		return s.sessionUser(w, r)
+	}
+
+	user, err := s.users.AddExternalUser(username, role)
+	if err != nil {
+		log.Printf("Failed to add external user %s: %v", username, err)
+		return nil, "", false
+	}
+	return user, "", true
+}
+
+// externalIdentity returns the username of the verified client certificate, or else the username
+// asserted by a trusted proxy, with the role of their first login
+func (s *Server) externalIdentity(r *http.Request) (string, internal.Role, bool) {
+	if username, ok := s.config.TLS.Username(r); ok {
+		role, _ := internal.ParseRole(string(s.config.TLS.ClientRole))
+		return username, role, true
+	}
+	username, ok := s.config.ProxyAuth.Username(r)
+	role, _ := internal.ParseRole(string(s.config.ProxyAuth.Role))
+	return username, role, ok
+}
+
+// sessionUser returns the user of the request session, the role is read from the user store
+// so role changes and deleted users apply to the existing sessions.
+// The cookie of sliding sessions follows their extended expiry.
+func (s *Server) sessionUser(w http.ResponseWriter, r *http.Request) (*internal.User, string, bool) {
+	cookie, err := r.Cookie(s.sessionCookieName())
+	if err != nil {
+		return s.rememberedUser(w, r)
+	}
+
+	session, valid := s.sessionManager.UseSession(cookie.Value, s.config.ProxyAuth.ClientAddr(r), r.UserAgent())
+	if !valid {
+		return s.rememberedUser(w, r)
+	}
+	if s.config.SessionSliding {
+		s.setSessionCookie(w, cookie.Value, session.Expires)
+	}
+	user, ok := s.users.Get(session.Username)
+	return user, cookie.Value, ok
+}
+
+// rememberedUser logs the user of the remember-me cookie in again, replacing its token.
+// WebSocket upgrades can't set cookies, so they don't log in again.
+func (s *Server) rememberedUser(w http.ResponseWriter, r *http.Request) (*internal.User, string, bool) {
+	cookie, err := r.Cookie(s.rememberCookieName())
+	if err != nil || strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return nil, "", false
+	}
+
+	username, ok := s.sessionManager.ConsumeRememberToken(cookie.Value)
+	if !ok {
+		return nil, "", false
+	}
+	user, ok := s.users.Get(username)
+	if !ok {
+		return nil, "", false
+	}
+	sessionID, err := s.startSession(w, r, user.Username)
+	if err != nil {
+		log.Printf("Failed to create session: %v", err)
+		return nil, "", false
+	}
+
+	s.rememberUser(w, user.Username)
+	s.audit(r, internal.AuditEntry{Action: internal.AuditLogin, Username: user.Username, Target: "remember_me"}, nil)
+	log.Printf("User %s logged in again by remember-me", user.Username)
+	return user, sessionID, true
+}
+
+// handleLogin handles login form display and processing
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.showLoginForm(w, r)
+
+	case http.MethodPost:
+		if !s.validCSRF(r, "") {
+			http.Error(w, "Cross-origin login rejected", http.StatusForbidden)
+			return
+		}
+		if challenge := r.FormValue("challenge"); challenge != "" {
+			s.verifyLoginCode(w, r, challenge)
+		} else {
+			s.verifyLoginPassword(w, r)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// verifyLoginPassword logs in the user of valid credentials,
+// users with two-factor authentication are asked for their code first
+func (s *Server) verifyLoginPassword(w http.ResponseWriter, r *http.Request) {
+	username := r.FormValue("username")
+	if !s.multiUser() {
+		username = internal.DefaultUsername
+	}
+	if wait := s.loginLimiter.Locked(s.config.ProxyAuth.ClientAddr(r), username); wait > 0 {
+		s.rejectLockedLogin(w, r, username, wait)
+		return
+	}
+	password := r.FormValue("password")
+
+	user, ok := s.authenticatePassword(username, password)
+	if !ok {
+		s.failLogin(w, r, username, "Wrong username or password")
+		return
+	}
+	if !user.TOTPEnabled() {
+		s.loginUser(w, r, user)
+		return
+	}
+	s.challengeLogin(w, r, user)
+}
+
+// challengeLogin asks the user with two-factor authentication for their code
+func (s *Server) challengeLogin(w http.ResponseWriter, r *http.Request, user *internal.User) {
+	challenge, err := s.sessionManager.CreateChallenge(user.Username)
+	if err != nil {
+		log.Printf("Failed to create login challenge: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderLogin(w, r, http.StatusOK, "", challenge)
+}
+
+// verifyLoginCode logs in the user of the challenge with a valid TOTP or recovery code
+func (s *Server) verifyLoginCode(w http.ResponseWriter, r *http.Request, challenge string) {
+	username, ok := s.sessionManager.ConsumeChallenge(challenge)
+	if !ok {
+		s.renderLogin(w, r, http.StatusOK, "Login expired, please try again", "")
+		return
+	}
+	if wait := s.loginLimiter.Locked(s.config.ProxyAuth.ClientAddr(r), username); wait > 0 {
+		s.rejectLockedLogin(w, r, username, wait)
+		return
+	}
+	if !s.users.VerifySecondFactor(username, r.FormValue("code")) {
+		s.failLogin(w, r, username, "Wrong authentication code")
+		return
+	}
+
+	user, ok := s.users.Get(username)
+	if !ok {
+		s.renderLogin(w, r, http.StatusOK, "Wrong username or password", "")
+		return
+	}
+	s.loginUser(w, r, user)
+}
+
+// failLogin records the failed login of the client and the account, and renders the login error
+func (s *Server) failLogin(w http.ResponseWriter, r *http.Request, username, loginError string) {
+	addr := s.config.ProxyAuth.ClientAddr(r)
+	if lockout := s.failAuth(addr, username); lockout > 0 {
+		log.Printf("Failed login of %s from %s, locked out for %s", username, addr, lockout)
+	}
+	s.audit(r, internal.AuditEntry{Action: internal.AuditLogin, Username: username}, errors.New(loginError))
+	s.renderLogin(w, r, http.StatusOK, loginError, "")
+}
+
+// failAuth records a failed login for the login limit and the alerts, returning the lockout
+func (s *Server) failAuth(addr, username string) time.Duration {
+	s.loginAlerter.Fail(addr, username)
+	return s.loginLimiter.Fail(addr, username)
+}
+
+// rejectLockedLogin renders the login error of a locked out client or account
+func (s *Server) rejectLockedLogin(w http.ResponseWriter, r *http.Request, username string, wait time.Duration) {
+	seconds := setRetryAfter(w, wait)
+	loginError := fmt.Sprintf("Too many failed logins, try again in %d seconds", seconds)
+	s.audit(r, internal.AuditEntry{Action: internal.AuditLogin, Username: username}, errLockedOut)
+	s.renderLogin(w, r, http.StatusTooManyRequests, loginError, "")
+}
+
+// authenticatePassword validates the credentials against the portal accounts, and else the LDAP server
+func (s *Server) authenticatePassword(username, password string) (*internal.User, bool) {
+	if user, ok := s.users.Authenticate(username, password); ok {
+		return user, true
+	}
+	return s.authenticateLDAP(username, password)
+}
+
+// authenticateLDAP authenticates users without a portal password against the LDAP server
+func (s *Server) authenticateLDAP(username, password string) (*internal.User, bool) {
+	if !s.config.LDAP.Configured() {
+		return nil, false
+	}
+	if user, exists := s.users.Get(username); exists && user.PasswordHash != "" {
+		// Portal accounts take precedence over the directory users
+		return nil, false
+	}
+
+	err := internal.AuthenticateLDAP(s.config.LDAP, username, password)
+	if errors.Is(err, internal.ErrInvalidCredentials) {
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("LDAP authentication of %s failed: %v", username, err)
+		return nil, false
+	}
+
+	role, _ := internal.ParseRole(string(s.config.LDAP.Role))
+	user, err := s.users.AddExternalUser(username, role)
+	if err != nil {
+		log.Printf("Failed to add LDAP user %s: %v", username, err)
+		return nil, false
+	}
+	return user, true
+}
+
+// multiUser reports whether the login asks for a username
+func (s *Server) multiUser() bool {
+	return s.users.MultiUser() || s.config.LDAP.Configured()
+}
+
+func (s *Server) showLoginForm(w http.ResponseWriter, r *http.Request) {
+	s.renderLogin(w, r, http.StatusOK, "", "")
+}
+
+// setRetryAfter sets the Retry-After header of the wait, returning its seconds
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) int {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return seconds
+}
+
+// renderLogin renders the login page with the status and error, asking for the authentication code
+// of the challenge when set
+func (s *Server) renderLogin(w http.ResponseWriter, r *http.Request, status int, loginError, challenge string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	isHTTPS := r.TLS != nil ||
+		r.Header.Get("X-Forwarded-Proto") == "https" ||
+		r.Header.Get("X-Forwarded-Ssl") == "on" ||
+		r.Header.Get("X-Url-Scheme") == "https"
+	templateData := map[string]any{
+		"Error":     loginError,
+		"IsHTTPS":   isHTTPS,
+		"MultiUser": s.multiUser(),
+		"Challenge": challenge,
+		// RememberMe offers the remember-me checkbox, Remember keeps it through the challenge
+		"RememberMe": s.config.RememberMeSeconds > 0,
+		"Remember":   r.FormValue("remember") != "",
+		// OAuthProvider offers the login with the OAuth2 provider
+		"OAuthProvider": s.config.OAuth.ProviderName(),
+	}
+	w.WriteHeader(status)
+	if err := s.templates.ExecuteTemplate(w, "login.html", templateData); err != nil {
+		log.Printf("Failed to render login template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) loginUser(w http.ResponseWriter, r *http.Request, user *internal.User) {
+	if !s.openSession(w, r, user, "") {
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// openSession starts the session of the user logged in with the method (empty for the password),
+// replying an error when it can't be created
+func (s *Server) openSession(w http.ResponseWriter, r *http.Request, user *internal.User, method string) bool {
+	if _, err := s.startSession(w, r, user.Username); err != nil {
+		log.Printf("Failed to create session: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	if r.FormValue("remember") != "" && s.config.RememberMeSeconds > 0 {
+		s.rememberUser(w, user.Username)
+	}
+
+	s.loginLimiter.Reset(user.Username)
+	s.audit(r, internal.AuditEntry{Action: internal.AuditLogin, Username: user.Username, Target: method}, nil)
+	log.Printf("User %s logged in", user.Username)
+	return true
+}
+
+// handleOAuthLogin redirects to the OAuth2 provider, the state cookie ties the callback
+// to this browser so another site can't log it in to an account of its choice
+func (s *Server) handleOAuthLogin(w http.ResponseWriter, r *http.Request) {
+	if !s.config.OAuth.Configured() {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	state, err := internal.NewOAuthState()
+	if err != nil {
+		log.Printf("Failed to create OAuth2 state: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.setOAuthState(w, state, time.Now().Add(oauthStateLifetime))
+	http.Redirect(w, r, s.config.OAuth.AuthURL(state), http.StatusSeeOther)
+}
+
+// setOAuthState sets the state cookie of an OAuth2 login, an empty state clears it
+func (s *Server) setOAuthState(w http.ResponseWriter, state string, expires time.Time) {
+	cookie := s.config.Cookie.Cookie(s.profileCookieName(oauthStateCookie), state, expires)
+	// The provider redirects back from another site, which doesn't send the strict cookies
+	cookie.SameSite = http.SameSiteLaxMode
+	http.SetCookie(w, cookie)
+}
+
+// handleOAuthCallback logs in the allowed user coming back from the OAuth2 provider,
+// the users with two-factor authentication still enter their code
+func (s *Server) handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	if !s.config.OAuth.Configured() {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	cookie, err := r.Cookie(s.profileCookieName(oauthStateCookie))
+	s.setOAuthState(w, "", time.Time{})
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+		s.renderLogin(w, r, http.StatusBadRequest, "Login expired, please try again", "")
+		return
+	}
+
+	user, err := s.oauthUser(r, query.Get("code"))
+	if err != nil {
+		s.audit(r, internal.AuditEntry{Action: internal.AuditLogin, Target: "oauth"}, err)
+		log.Printf("OAuth2 login failed: %v", err)
+		s.renderLogin(w, r, http.StatusForbidden, fmt.Sprintf("%s login failed", s.config.OAuth.ProviderName()), "")
+		return
+	}
+	if user.TOTPEnabled() {
+		s.challengeLogin(w, r, user)
+		return
+	}
+	if s.openSession(w, r, user, "oauth") {
+		s.redirectHome(w)
+	}
+}
+
+// oauthUser returns the portal user of the authorization code, adding the allowed users
+// logging in for the first time
+func (s *Server) oauthUser(r *http.Request, code string) (*internal.User, error) {
+	username, err := s.config.OAuth.Authenticate(r.Context(), code)
+	if err != nil {
+		return nil, err
+	}
+	role, _ := internal.ParseRole(string(s.config.OAuth.Role))
+	return s.users.AddExternalUser(username, role)
+}
+
+// redirectHome sends the browser to the dashboard from a page of this site, since the strict
+// session cookie isn't sent on the redirects of a navigation started by another site
+func (*Server) redirectHome(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = io.WriteString(w, `<!DOCTYPE html><meta http-equiv="refresh" content="0;url=/"><a href="/">Continue</a>`)
+}
+
+// startSession creates a session of the user and sets its cookie,
+// the session records the client of the request for the session listing
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, username string) (string, error) {
+	sessionID, expires, err := s.sessionManager.CreateSession(username, s.config.ProxyAuth.ClientAddr(r),
+		r.UserAgent())
+	if err != nil {
+		return "", err
+	}
+	s.setSessionCookie(w, sessionID, expires)
+	return sessionID, nil
+}
+
+// rememberUser sets the remember-me cookie of the user, its failure only logs
+// since the user is logged in anyway
+func (s *Server) rememberUser(w http.ResponseWriter, username string) {
+	token, expires, err := s.sessionManager.CreateRememberToken(username, s.config.GetRememberMe())
+	if err != nil {
+		log.Printf("Failed to remember user %s: %v", username, err)
+		return
+	}
+	s.setCookie(w, s.rememberCookieName(), token, expires)
+}
+
+// setSessionCookie sets the session cookie expiring with the session
+func (s *Server) setSessionCookie(w http.ResponseWriter, sessionID string, expires time.Time) {
+	s.setCookie(w, s.sessionCookieName(), sessionID, expires)
+}
+
+// setCookie sets an authentication cookie of the configured attributes, an empty value clears the cookie
+func (s *Server) setCookie(w http.ResponseWriter, name, value string, expires time.Time) {
+	http.SetCookie(w, s.config.Cookie.Cookie(name, value, expires))
+}
+
+// handleSessionRefreshAPI extends the current session by the session TTL
+func (s *Server) handleSessionRefreshAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cookie, err := r.Cookie(s.sessionCookieName())
+	if err != nil {
+		s.sendErrorResponse(w, internal.ErrInvalidSession.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !s.validCSRF(r, cookie.Value) {
+		s.sendErrorResponse(w, "Invalid CSRF token, reload the page", http.StatusForbidden)
+		return
+	}
+
+	expires, err := s.sessionManager.RefreshSession(cookie.Value, s.config.ProxyAuth.ClientAddr(r), r.UserAgent(),
+		s.config.GetSessionRefreshInterval())
+	switch {
+	case errors.Is(err, internal.ErrInvalidSession):
+		s.sendErrorResponse(w, err.Error(), http.StatusUnauthorized)
+		return
+	case errors.Is(err, internal.ErrRefreshTooSoon):
+		s.sendErrorResponse(w, err.Error(), http.StatusTooManyRequests)
+		return
+	case err != nil:
+		log.Printf("Failed to refresh session: %v", err)
+		s.sendErrorResponse(w, "Failed to refresh session", http.StatusInternalServerError)
+		return
+	}
+
+	s.setSessionCookie(w, cookie.Value, expires)
+	s.sendSuccessResponse(w, map[string]any{"expires": expires})
+}
+
+// handleLogout handles user logout
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var sessionID string
+	if cookie, err := r.Cookie(s.sessionCookieName()); err == nil {
+		sessionID = cookie.Value
+	}
+	if !s.validCSRF(r, sessionID) {
+		http.Error(w, "Invalid CSRF token, reload the page", http.StatusForbidden)
+		return
+	}
+
+	// Delete the session
+	if session, valid := s.sessionManager.ValidateSession(sessionID); valid {
+		s.audit(r, internal.AuditEntry{Action: internal.AuditLogout, Username: session.Username}, nil)
+	}
+	if sessionID != "" {
+		s.sessionManager.DeleteSession(sessionID)
+	}
+	if cookie, err := r.Cookie(s.rememberCookieName()); err == nil {
+		s.sessionManager.DeleteRememberToken(cookie.Value)
+	}
+
+	// Clear the cookies
+	s.setCookie(w, s.sessionCookieName(), "", time.Time{})
+	s.setCookie(w, s.rememberCookieName(), "", time.Time{})
+
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// sessionCookieName returns the session cookie name, unique per profile
+// since browsers share cookies between ports of the same host
+func (s *Server) sessionCookieName() string {
+	return s.profileCookieName(s.config.Cookie.Name)
+}
+
+// rememberCookieName returns the remember-me cookie name, unique per profile like the session cookie
+func (s *Server) rememberCookieName() string {
+	return s.profileCookieName(s.config.Cookie.RememberName)
+}
+
+func (s *Server) profileCookieName(name string) string {
+	if s.name == internal.DefaultProfile {
+		return name
+	}
+	return name + "_" + s.name
+}
+
+// Start starts the HTTP server
+func (s *Server) Start() error {
+	server := &http.Server{
+		Addr:    s.config.GetAddress(),
+		Handler: s.withIPFilter(s.withResponseHeaders(s.mux)),
+	}
+	if !s.config.TLS.Enabled() {
+		log.Printf("Starting %s on http://%s", s.name, server.Addr)
+		return server.ListenAndServe()
+	}
+
+	tlsConfig, err := s.config.TLS.ServerConfig()
+	if err != nil {
+		return err
+	}
+	server.TLSConfig = tlsConfig
+	log.Printf("Starting %s on https://%s", s.name, server.Addr)
+	return server.ListenAndServeTLS(s.config.TLS.CertFile, s.config.TLS.KeyFile)
+}
+
+// hashPassword prints the hash of a password for the config password_hash, prompting for it
+// twice without echo on a terminal, or else reading it from stdin
+func hashPassword() {
+	readPassword := readPasswordLine
+	if fd := int(os.Stdin.Fd()); internal.IsTerminal(fd) {
+		readPassword = func() (string, error) { return promptPassword(fd) }
+	}
+	password, err := readPassword()
+	if err != nil {
+		log.Fatalf("Failed to read password: %v", err)
+	}
+	if password == "" {
+		log.Fatal("Password is required")
+	}
+
+	hash, err := internal.GeneratePasswordHash(password)
+	if err != nil {
+		log.Fatalf("Failed to hash password: %v", err)
+	}
+	fmt.Println(hash)
+}
+
+// readPasswordLine reads the password from the first line of stdin
+func readPasswordLine() (string, error) {
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return strings.TrimRight(password, "\r\n"), nil
+}
+
+// promptPassword asks for the password and its confirmation on the terminal,
+// the prompts go to stderr so stdout only has the hash
+func promptPassword(fd int) (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := internal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Confirm password: ")
+	confirmation, err := internal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if password != confirmation {
+		return "", errors.New("passwords don't match")
+	}
+	return password, nil
+}
+
+// runHelper runs the privileged helper as root, with the top-level settings of the config file
+func runHelper() {
+	config, err := internal.LoadConfig("config.yml")
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if err := internal.RunHelper(config); err != nil {
+		log.Fatalf("Privileged helper failed: %v", err)
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		hashPassword()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "helper" {
+		runHelper()
+		return
+	}
+
+	// Load configuration
+	profiles, err := internal.LoadProfiles("config.yml")
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	errs := make(chan error, len(profiles))
+	for name, config := range profiles {
+		server, err := NewServer(name, config)
+		if err != nil {
+			log.Fatalf("Failed to create server %s: %v", name, err)
+		}
+		go func() {
+			errs <- server.Start()
+		}()
 	}
 
-	if err := server.Start(); err != nil {
+	if err := <-errs; err != nil {
 		log.Fatalf("Server failed to start: %v", err)
 	}
 }
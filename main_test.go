@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"wg-portal/internal"
+)
+
+// fakeRunner reports the interfaces of dump as up, and fails the other commands
+type fakeRunner struct {
+	dump string
+}
+
+func (r fakeRunner) CombinedOutput(name string, args ...string) ([]byte, error) {
+	return r.Output(name, args...)
+}
+
+func (r fakeRunner) Output(name string, args ...string) ([]byte, error) {
+	if strings.Contains(strings.Join(append([]string{name}, args...), " "), "wg show all dump") {
+		return []byte(r.dump), nil
+	}
+	return nil, os.ErrPermission
+}
+
+// newTestServer returns a server of the connection configs of a temporary directory, with work up
+func newTestServer(t *testing.T, names ...string) *Server {
+	t.Helper()
+	config := internal.DefaultConfig()
+	config.ConfigDir = t.TempDir()
+	config.StateDir = t.TempDir()
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(config.ConfigDir, name+".conf"), []byte("[Interface]\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	metadata, err := internal.NewMetadataStore(internal.DefaultProfile, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := fakeRunner{dump: "work\tprivate\tpublic\t51820\toff\n"}
+	return &Server{
+		config:    config,
+		wireguard: internal.NewWireGuardManager(config, runner, metadata, nil, nil),
+		readOnly:  internal.NewReadOnlyMode(false),
+		auditLog:  &internal.AuditLog{},
+		metadata:  metadata,
+	}
+}
+
+// newUserRequest returns a request authenticated as a user granted the connections
+func newUserRequest(method, target, body string, grants internal.ConnectionGrants) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	user := &internal.User{Username: "bob", Role: internal.RoleOperator, Connections: grants}
+	return r.WithContext(internal.WithUser(r.Context(), user))
+}
+
+func TestConnectionsAPIFiltersGrantedConnections(t *testing.T) {
+	s := newTestServer(t, "home", "work", "travel")
+
+	w := httptest.NewRecorder()
+	s.handleConnectionsAPI(w, newUserRequest(http.MethodGet, "/api/connections", "", internal.ConnectionGrants{"home"}))
+
+	var response struct {
+		Data []*internal.WireGuardConnection `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Data) != 1 || response.Data[0].Name != "home" {
+		t.Fatalf("connections = %+v, want only home", response.Data)
+	}
+
+	w = httptest.NewRecorder()
+	s.handleConnectionsAPI(w, newUserRequest(http.MethodGet, "/api/connections", "", nil))
+	response.Data = nil
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Data) != 3 {
+		t.Fatalf("connections = %+v, want all 3 for an unrestricted user", response.Data)
+	}
+}
+
+func TestToggleAPIRejectsUngrantedConnections(t *testing.T) {
+	s := newTestServer(t, "home", "work")
+
+	tests := []struct {
+		name   string
+		body   string
+		grants internal.ConnectionGrants
+	}{
+		{"ungranted connection", `{"name": "work"}`, internal.ConnectionGrants{"home"}},
+		// Starting home would stop the active work connection
+		{"ungranted active connection", `{"name": "home"}`, internal.ConnectionGrants{"home"}},
+		{"no grants", `{"name": "home"}`, internal.ConnectionGrants{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.handleToggleAPI(w, newUserRequest(http.MethodPost, "/api/connections/toggle", test.body, test.grants))
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("status = %d, want 403: %s", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestRequireGranted(t *testing.T) {
+	s := newTestServer(t)
+	r := newUserRequest(http.MethodGet, "/", "", internal.ConnectionGrants{"home"})
+
+	if w := httptest.NewRecorder(); !s.requireGranted(w, r, "home") {
+		t.Fatalf("home rejected with %d, want granted", w.Code)
+	}
+	w := httptest.NewRecorder()
+	if s.requireGranted(w, r, "home", "work") || w.Code != http.StatusForbidden {
+		t.Fatalf("work granted (status %d), want 403", w.Code)
+	}
+}
@@ -1,6 +1,8 @@
 // Application state and configuration
 const App = {
-    apiBase: "/api",
+    apiBase: document.body.dataset.apiBase || "/api",
+    // Sent with the state-changing requests of the session
+    csrfToken: document.querySelector('meta[name="csrf-token"]').content,
     elements: {
         connectionList: document.getElementById('connections__container'),
         statusArea: document.getElementById('status__container'),
@@ -20,6 +22,32 @@ const Utils = {
     renderSuccess(element, message) {
         Utils.renderMessage(element, message, "success");
     },
+    // Format a byte count with binary units, like wg does
+    formatBytes(size) {
+        const units = ['B', 'KiB', 'MiB', 'GiB', 'TiB'];
+        let value = size;
+        let unit = 0;
+        while (value >= 1024 && unit < units.length - 1) {
+            value /= 1024;
+            unit++;
+        }
+        return unit === 0 ? `${size} B` : `${value.toFixed(2)} ${units[unit]}`;
+    },
+    // Format a number of seconds like 1h2m3s
+    formatDuration(seconds) {
+        const hours = Math.floor(seconds / 3600);
+        const minutes = Math.floor(seconds % 3600 / 60);
+        if (hours > 0) {
+            return `${hours}h${minutes}m${seconds % 60}s`;
+        }
+        return minutes > 0 ? `${minutes}m${seconds % 60}s` : `${seconds}s`;
+    },
+    // Escape the free text set by the users before rendering it as HTML
+    escapeHTML(text) {
+        const element = document.createElement('div');
+        element.textContent = text;
+        return element.innerHTML;
+    },
     renderMessage(element, message, type = '') {
         element.innerHTML = `
             <div class="message ${type}">${message}</div>
@@ -31,6 +59,7 @@ const Utils = {
             const response = await fetch(`${App.apiBase}${endpoint}`, {
                 headers: {
                     'Content-Type': 'application/json',
+                    'X-CSRF-Token': App.csrfToken,
                     ...options.headers
                 },
                 ...options
@@ -56,10 +85,12 @@ const Utils = {
 
 // Connection management
 const ConnectionManager = {
-    // Load and display all connections
+    // Load and display all connections, filtered by the tags of the page URL like /?tag=work
     async loadConnections() {
         try {
-            const connections = await Utils.apiCall('/connections');
+            const tags = new URLSearchParams(window.location.search).getAll('tag');
+            const query = tags.map(tag => `tag=${encodeURIComponent(tag)}`).join('&');
+            const connections = await Utils.apiCall(query ? `/connections?${query}` : '/connections');
             this.renderConnections(connections);
         } catch (error) {
             Utils.renderError(App.elements.connectionList,
@@ -71,20 +102,36 @@ const ConnectionManager = {
     renderConnections(connections) {
         if (!connections || connections.length === 0) {
             Utils.renderWarning(App.elements.connectionList,
-                "No WireGuard connections found in /etc/wireguard/");
+                "No WireGuard connections found in the config directory");
             return;
         }
 
-        const html = connections.map(conn => `
-            <div class="connection ${conn.active ? 'active' : ''}"
+        const html = connections.map(conn => {
+            const unreachable = conn.health && !conn.health.reachable;
+            return `
+            <div class="connection ${conn.active ? 'active' : ''} ${conn.last_error ? 'error' : ''}
+                        ${unreachable ? 'unreachable' : ''}"
                     data-connection="${conn.name}"
+                    ${conn.last_error ? `title="${this.describeError(conn.last_error)}"` : ''}
                     onclick="ConnectionManager.toggleConnection('${conn.name}')">
-                <div class="connection__name ${conn.active ? 'active' : ''}">${conn.name}</div>
+                <div class="connection__name ${conn.active ? 'active' : ''}">
+                    ${conn.flag ? `${conn.flag} ` : ''}${conn.name}
+                </div>
+                ${conn.provider ? `<div class="connection__provider">${Utils.escapeHTML(conn.provider)}</div>` : ''}
+                ${unreachable ? '<div class="connection__health">endpoint unreachable</div>' : ''}
+                ${conn.tags ? `<div class="connection__tags">${conn.tags.join(', ')}</div>` : ''}
             </div>
-        `).join('');
+        `;
+        }).join('');
         App.elements.connectionList.innerHTML = html;
     },
 
+    // Describe the last failed operation of a connection for its tooltip
+    describeError(lastError) {
+        const time = new Date(lastError.time).toLocaleString();
+        return `${lastError.action} failed at ${time}: ${lastError.message}`.replaceAll('"', '&quot;');
+    },
+
     // Toggle connection state
     async toggleConnection(name) {
         const connection = document.querySelector(`[data-connection="${name}"]`);
@@ -94,13 +141,21 @@ const ConnectionManager = {
             connection.textContent = 'Processing...';
             connection.className = "connection loading"
 
-            await Utils.apiCall('/connections/toggle', {
+            const result = await Utils.apiCall('/connections/toggle', {
                 method: 'POST',
                 body: JSON.stringify({ name })
             });
             await this.loadConnections(); // Refresh the list
             await StatusManager.loadStatus(); // Refresh the status
-            Utils.renderSuccess(App.elements.messageArea, `No Errors Found.`);
+            if (result.warnings && result.warnings.length > 0) {
+                Utils.renderWarning(App.elements.messageArea, result.warnings.join('\n'));
+            } else if (result.exit_ip && result.exit_ip.address) {
+                const country = result.exit_ip.country ? ` (${result.exit_ip.country})` : '';
+                Utils.renderSuccess(App.elements.messageArea,
+                    Utils.escapeHTML(`No Errors Found. Exit IP: ${result.exit_ip.address}${country}`));
+            } else {
+                Utils.renderSuccess(App.elements.messageArea, `No Errors Found.`);
+            }
         } catch (error) {
             Utils.renderError(App.elements.messageArea, `Failed to toggle ${name}: ${error.message}`);
             connection.disabled = false;
@@ -118,17 +173,38 @@ const StatusManager = {
     async loadStatus() {
         try {
             const statusData = await Utils.apiCall('/status');
-            const statusText = statusData.status;
-            if (statusText) {
-                Utils.renderSuccess(App.elements.statusArea, statusText);
-            } else {
-                Utils.renderWarning(App.elements.statusArea, "No active connections.");
-            }
+            this.renderStatus(statusData);
         } catch (error) {
             Utils.renderError(App.elements.statusArea, error.message);
         }
     },
 
+    renderStatus(statusData) {
+        const connections = statusData.status || [];
+        if (connections.length > 0) {
+            const activity = Object.entries(statusData.last_activity || {}).map(([name, time]) =>
+                `Last Activity (${name}): ${time ? new Date(time).toLocaleString() : 'none observed'}`);
+            const lines = connections.flatMap((connection) => this.connectionLines(connection));
+            Utils.renderSuccess(App.elements.statusArea, [...lines, ...activity].join('\n'));
+        } else {
+            Utils.renderWarning(App.elements.statusArea, "No active connections.");
+        }
+    },
+
+    // Describe the connection and the handshakes of its peers
+    connectionLines(connection) {
+        const namespace = connection.namespace ? ` (network namespace ${connection.namespace})` : '';
+        const lines = [`Connection: ${connection.name}${namespace}`];
+        if (connection.state === 'starting') {
+            return [...lines, 'Connection starting...'];
+        }
+        for (const peer of connection.peers.filter((peer) => peer.latest_handshake)) {
+            lines.push(`Latest Handshake: ${Utils.formatDuration(peer.handshake_age)} ago`,
+                `Transfer: ${Utils.formatBytes(peer.receive_bytes)} received, ${Utils.formatBytes(peer.transmit_bytes)} sent`);
+        }
+        return lines;
+    },
+
     startAutoRefresh() {
         // Clear any existing interval first
         this.stopAutoRefresh();
@@ -144,11 +220,101 @@ const StatusManager = {
     }
 };
 
+// Session management
+const SessionManager = {
+    renderExpiring(expires) {
+        const time = new Date(expires).toLocaleTimeString();
+        App.elements.messageArea.innerHTML = `
+            <div class="message warning">Your session expires at ${time}.
+                <button class="message__action" onclick="SessionManager.refreshSession()">Stay signed in</button>
+            </div>
+        `;
+    },
+
+    // Extend the session, the server stops warning about the previous expiry
+    async refreshSession() {
+        try {
+            await Utils.apiCall('/session/refresh', { method: 'POST' });
+            Utils.renderSuccess(App.elements.messageArea, 'Session extended.');
+        } catch (error) {
+            Utils.renderError(App.elements.messageArea, `Failed to extend session: ${error.message}`);
+        }
+    }
+};
+
+// Live updates pushed by the server
+const FeedManager = {
+    socket: null,
+
+    connect() {
+        const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+        this.socket = new WebSocket(`${protocol}//${window.location.host}${App.apiBase}/ws`);
+        this.socket.onmessage = (event) => this.handleMessage(JSON.parse(event.data));
+    },
+
+    handleMessage(message) {
+        switch (message.type) {
+        case 'session_expiring':
+            SessionManager.renderExpiring(message.data.expires);
+            break;
+        case 'session_expired':
+            // Remembered users are logged in again by the page, the others are sent to the login
+            window.location.href = '/';
+            break;
+        case 'status':
+            StatusManager.renderStatus(message.data);
+            break;
+        case 'maintenance':
+            Utils.renderWarning(App.elements.messageArea, message.data.active
+                ? `Maintenance until ${new Date(message.data.until).toLocaleString()}, automated changes are paused.`
+                : 'Maintenance ended, automated changes resumed.');
+            break;
+        case 'read_only':
+            Utils.renderWarning(App.elements.messageArea, message.data.enabled
+                ? 'Read-only mode enabled, the connections can\'t be toggled.'
+                : 'Read-only mode disabled.');
+            break;
+        case 'failover':
+            Utils.renderWarning(App.elements.messageArea,
+                `Failed over from ${message.data.from} to ${message.data.to}: ${message.data.reason}.`);
+            ConnectionManager.loadConnections();
+            break;
+        case 'watchdog':
+            Utils.renderWarning(App.elements.messageArea, message.data.error
+                ? `Failed to restart ${message.data.connection} (${message.data.reason}): ${message.data.error}`
+                : `Restarted ${message.data.connection}: ${message.data.reason}.`);
+            ConnectionManager.loadConnections();
+            break;
+        case 'schedule':
+            Utils.renderWarning(App.elements.messageArea, message.data.error
+                ? `Schedule ${message.data.name} failed: ${message.data.error}`
+                : `Ran schedule ${message.data.name}.`);
+            ConnectionManager.loadConnections();
+            break;
+        case 'peer_expired':
+            Utils.renderWarning(App.elements.messageArea, message.data.error
+                ? `Failed to remove the expired peer ${message.data.id} from ${message.data.connection}: ${message.data.error}`
+                : `Removed the expired peer ${message.data.id} from ${message.data.connection}.`);
+            break;
+        case 'key_rotation':
+            Utils.renderWarning(App.elements.messageArea, message.data.error
+                ? `Key rotation of a peer of ${message.data.connection} failed: ${message.data.error}`
+                : `Key rotation of a peer of ${message.data.connection} ${message.data.action}: ${message.data.reason}.`);
+            break;
+        case 'kill_switch':
+            Utils.renderWarning(App.elements.messageArea,
+                `Kill switch ${message.data.enabled ? 'enabled' : 'disabled'}.`);
+            break;
+        }
+    }
+};
+
 // Initialize the application
 document.addEventListener('DOMContentLoaded', () => {
     StatusManager.loadStatus();
     ConnectionManager.loadConnections();
     StatusManager.startAutoRefresh();
+    FeedManager.connect();
 });
 
 // Pause when tab is hidden, resume when visible
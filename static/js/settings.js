@@ -0,0 +1,114 @@
+// Account settings page
+const Settings = {
+    apiBase: document.body.dataset.apiBase || "/api",
+    csrfToken: document.querySelector('meta[name="csrf-token"]').content,
+    elements: {
+        passwordForm: document.getElementById('password__form'),
+        sessionsContainer: document.getElementById('sessions__container'),
+        sessionsForm: document.getElementById('sessions__form'),
+        messageArea: document.getElementById('notifications__container')
+    },
+
+    renderMessage(message, type) {
+        const element = document.createElement('div');
+        element.className = `message ${type}`;
+        element.textContent = message;
+        this.elements.messageArea.replaceChildren(element);
+    },
+
+    // Change the password, the other sessions of the user are signed out
+    async changePassword(event) {
+        event.preventDefault();
+        const form = this.elements.passwordForm;
+        if (form.new_password.value !== form.confirm_password.value) {
+            this.renderMessage('The new passwords do not match.', 'error');
+            return;
+        }
+
+        try {
+            const response = await fetch(`${this.apiBase}/password`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': this.csrfToken },
+                body: JSON.stringify({
+                    current_password: form.current_password.value,
+                    new_password: form.new_password.value
+                })
+            });
+            const data = await response.json();
+            if (!response.ok || !data.success) {
+                throw new Error(data.error || `HTTP ${response.status}`);
+            }
+            form.reset();
+            // The password change started a new session
+            this.csrfToken = data.data.csrf_token;
+            document.querySelectorAll('input[name="csrf_token"]').forEach((input) => {
+                input.value = this.csrfToken;
+            });
+            this.renderMessage('Password changed, your other sessions were signed out.', 'success');
+            this.loadSessions();
+        } catch (error) {
+            this.renderMessage(`Failed to change password: ${error.message}`, 'error');
+        }
+    },
+
+    async request(path, method) {
+        const response = await fetch(`${this.apiBase}${path}`, {
+            method,
+            headers: { 'X-CSRF-Token': this.csrfToken }
+        });
+        const data = await response.json();
+        if (!response.ok || !data.success) {
+            throw new Error(data.error || `HTTP ${response.status}`);
+        }
+        return data.data;
+    },
+
+    async loadSessions() {
+        try {
+            const sessions = await this.request('/sessions', 'GET');
+            this.elements.sessionsContainer.replaceChildren(...sessions.map((session) => this.renderSession(session)));
+        } catch (error) {
+            this.renderMessage(`Failed to load sessions: ${error.message}`, 'error');
+        }
+    },
+
+    renderSession(session) {
+        const element = document.createElement('div');
+        element.className = session.current ? 'connection active' : 'connection';
+        const created = new Date(session.created).toLocaleString();
+        element.textContent = `${session.ip || 'unknown address'} since ${created}\n` +
+            `${session.user_agent || 'unknown browser'}${session.current ? ' (this session)' : ''}`;
+        if (!session.current) {
+            const revoke = document.createElement('button');
+            revoke.className = 'message__action';
+            revoke.textContent = 'Revoke';
+            revoke.addEventListener('click', () => this.revokeSession(session.id));
+            element.append(revoke);
+        }
+        return element;
+    },
+
+    async revokeSession(id) {
+        try {
+            await this.request(`/sessions/${encodeURIComponent(id)}`, 'DELETE');
+            this.loadSessions();
+        } catch (error) {
+            this.renderMessage(`Failed to revoke session: ${error.message}`, 'error');
+        }
+    },
+
+    // Log out all sessions of the user, including this one
+    async logoutEverywhere(event) {
+        event.preventDefault();
+        try {
+            await this.request('/sessions', 'DELETE');
+            window.location.href = '/login';
+        } catch (error) {
+            this.renderMessage(`Failed to log out everywhere: ${error.message}`, 'error');
+        }
+    }
+};
+
+Settings.elements.passwordForm.addEventListener('submit', (event) => Settings.changePassword(event));
+Settings.elements.sessionsForm.addEventListener('submit', (event) => Settings.logoutEverywhere(event));
+Settings.loadSessions();